@@ -0,0 +1,124 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+var (
+	_ Strategy  = &auditStrategy{}
+	_ KeyNamer  = &auditStrategy{}
+	_ Refunder  = &auditStrategy{}
+	_ Committer = &auditStrategy{}
+)
+
+const (
+	// DefaultAuditMaxLen is how many entries an audit stream keeps when AuditConfig doesn't set `MaxLen`.
+	DefaultAuditMaxLen = 1000
+)
+
+// AuditConfig configures NewAuditStrategy.
+type AuditConfig struct {
+	// Stream is the stream all entries are added to, when empty every key gets its own stream at the request key
+	// with `:audit` appended.
+	Stream string
+	// MaxLen is how many entries are kept in a stream, older ones are trimmed as new ones are added. Defaults to
+	// DefaultAuditMaxLen.
+	MaxLen int64
+	// Approximate trims with `MAXLEN ~`, which lets Redis keep a few more entries than `MaxLen` but is a lot
+	// cheaper on large streams.
+	Approximate bool
+}
+
+// NewAuditStrategy creates a strategy that runs `inner` and adds an entry with the key, action, time, decision,
+// reason and total requests of every request to a Redis stream, so there is an append only log of the recent
+// decisions to go through when investigating abuse. Entries can't be changed once added and get increasing IDs
+// from Redis, but anyone with access to the stream can still delete or trim them. It costs an extra round trip per
+// request, so it's meant for a few high value endpoints. Requests `inner` fails for are not logged.
+func NewAuditStrategy(inner Strategy, client redis.Cmdable, now func() time.Time, config *AuditConfig) Strategy {
+	return &auditStrategy{
+		inner:  inner,
+		client: client,
+		now:    now,
+		config: config,
+	}
+}
+
+type auditStrategy struct {
+	inner  Strategy
+	client redis.Cmdable
+	now    func() time.Time
+	config *AuditConfig
+}
+
+// Run runs the inner strategy and logs its decision, the result is only returned if the entry was added.
+func (a *auditStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	result, err := a.inner.Run(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := "deny"
+	if result.State == Allow {
+		decision = "allow"
+	}
+
+	stream := a.stream(r)
+
+	err = a.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: a.maxLen(),
+		Approx: a.config.Approximate,
+		Values: []interface{}{
+			"key", r.Key,
+			"action", r.Action,
+			"timestamp", strconv.FormatInt(r.now(a.now).UnixMilli(), 10),
+			"decision", decision,
+			"reason", string(result.Reason),
+			"total", strconv.FormatUint(result.TotalRequests, 10),
+		},
+	}).Err()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add audit entry for key %v to stream %v", r.redisKey(), stream)
+	}
+
+	return result, nil
+}
+
+// KeyFor returns the keys of the inner strategy followed by the audit stream.
+func (a *auditStrategy) KeyFor(r *Request) []string {
+	return append(keysFor(a.inner, r), a.stream(r))
+}
+
+// Refund gives back the request on the inner strategy, refunds are not logged.
+func (a *auditStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, a.inner, r)
+}
+
+// Commit settles the request on the inner strategy, commits are not logged.
+func (a *auditStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, a.inner, r, actualCost)
+}
+
+func (a *auditStrategy) unwrap() Strategy {
+	return a.inner
+}
+
+func (a *auditStrategy) stream(r *Request) string {
+	if a.config.Stream != "" {
+		return a.config.Stream
+	}
+
+	return r.redisKey() + ":audit"
+}
+
+func (a *auditStrategy) maxLen() int64 {
+	if a.config.MaxLen <= 0 {
+		return DefaultAuditMaxLen
+	}
+
+	return a.config.MaxLen
+}
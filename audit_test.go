@@ -0,0 +1,105 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAuditStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name   string
+		config *AuditConfig
+		stream string
+	}{
+		{
+			name:   "adds entries to a stream per key",
+			config: &AuditConfig{MaxLen: 2},
+			stream: "some-user:a:login:audit",
+		},
+		{
+			name:   "adds entries to the configured stream",
+			config: &AuditConfig{Stream: "rl:audit", MaxLen: 2},
+			stream: "rl:audit",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			clock := func() time.Time {
+				return now
+			}
+
+			strategy := NewAuditStrategy(NewCounterStrategy(client, clock), client, clock, ts.config)
+
+			states := make([]State, 0, 3)
+
+			for x := 0; x < 3; x++ {
+				result, err := strategy.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    1,
+					Duration: time.Minute,
+					Action:   "login",
+				})
+				require.NoError(t, err)
+				states = append(states, result.State)
+			}
+
+			assert.Equal(t, []State{Allow, Deny, Deny}, states)
+
+			// the first entry was trimmed
+			entries, err := client.XRange(context.Background(), ts.stream, "-", "+").Result()
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+
+			for _, entry := range entries {
+				assert.Equal(t, map[string]interface{}{
+					"key":       "some-user",
+					"action":    "login",
+					"timestamp": "1585131330000",
+					"decision":  "deny",
+					"reason":    string(ReasonGuardRejected),
+					"total":     "1",
+				}, entry.Values)
+			}
+
+			assert.Equal(t, []string{"some-user:a:login", ts.stream}, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user", Action: "login"}))
+		})
+	}
+}
+
+func TestAuditStrategy_RunWithStreamError(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	require.NoError(t, server.Set("some-user:audit", "not-a-stream"))
+
+	strategy := NewAuditStrategy(NewCounterStrategy(client, time.Now), client, time.Now, &AuditConfig{})
+
+	_, err = strategy.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    1,
+		Duration: time.Minute,
+	})
+	assert.EqualError(t, err, "failed to add audit entry for key some-user to stream some-user:audit: WRONGTYPE Operation against a key holding the wrong kind of value")
+}
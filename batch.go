@@ -0,0 +1,57 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+)
+
+// pipeliner is implemented by the pipelined strategies in this package, it creates a pipeline on the client the
+// strategy runs its commands on (which might not be the one it was created with, like with WithDB). Decorators return
+// the pipeline of the strategy they wrap, nil means there is no pipeline to use.
+type pipeliner interface {
+	pipeline() redis.Pipeliner
+}
+
+// BatchResult is the outcome of one of the requests given to RunMany, either `Result` or `Err` is set.
+type BatchResult struct {
+	Result *Result
+	Err    error
+}
+
+// RunMany runs many requests, usually for different keys, and returns a result for each of them in the order they
+// were given. When the strategy is one of the Pipelined strategies of this package (or an in memory decorator around
+// one, like the sampled strategy) all requests are sent in a single pipeline on the client of the strategy,
+// otherwise they're run one after the other.
+//
+// A failure only fails the requests it affected: a command that errors for one key (like a key holding the wrong
+// type) sets `Err` on the result of that request and the others still get their results, so callers can act on the
+// ones that succeeded and decide what to do with the failed ones, like letting them through. If Redis can't be
+// reached every request fails with the same error. RunMany itself never fails.
+func RunMany(ctx context.Context, strategy Strategy, requests ...*Request) []BatchResult {
+	results := make([]BatchResult, len(requests))
+
+	pipelined, ok := strategy.(Pipelined)
+	p := pipelineFor(strategy)
+	if !ok || p == nil {
+		for x, r := range requests {
+			results[x].Result, results[x].Err = strategy.Run(ctx, r)
+		}
+
+		return results
+	}
+
+	interpreters := make([]func() (*Result, error), 0, len(requests))
+
+	for _, r := range requests {
+		interpreters = append(interpreters, pipelined.RunPipelined(ctx, p, r))
+	}
+
+	// the pipeline only returns the first error, every command has its own error that is checked by its request
+	_, _ = p.Exec(ctx)
+
+	for x, interpret := range interpreters {
+		results[x].Result, results[x].Err = interpret()
+	}
+
+	return results
+}
@@ -0,0 +1,140 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRunMany(t *testing.T) {
+	tt := []struct {
+		name     string
+		strategy func(client *redis.Client) Strategy
+		err      string
+	}{
+		{
+			name: "runs pipelined strategies in a single pipeline",
+			strategy: func(client *redis.Client) Strategy {
+				return NewSortedSetCounterStrategy(client, time.Now)
+			},
+			err: "redis command zremrangebyscore failed for key broken-user",
+		},
+		{
+			name: "runs decorated pipelined strategies in a single pipeline",
+			strategy: func(client *redis.Client) Strategy {
+				return NewSampledStrategy(NewSortedSetCounterStrategy(client, time.Now), 1)
+			},
+			err: "redis command zremrangebyscore failed for key broken-user",
+		},
+		{
+			name: "runs routed strategies one after the other",
+			strategy: func(client *redis.Client) Strategy {
+				return NewRoutedStrategy(func(key string) Strategy {
+					return NewCounterStrategy(client, time.Now)
+				})
+			},
+			err: "failed to increment key broken-user",
+		},
+		{
+			name: "runs other strategies one after the other",
+			strategy: func(client *redis.Client) Strategy {
+				return NewCounterStrategy(client, time.Now)
+			},
+			err: "failed to increment key broken-user",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			require.NoError(t, server.Set("broken-user", "not-a-counter"))
+
+			requests := make([]*Request, 0, 3)
+			for _, key := range []string{"some-user", "broken-user", "other-user"} {
+				requests = append(requests, &Request{
+					Key:      key,
+					Limit:    10,
+					Duration: time.Minute,
+				})
+			}
+
+			results := RunMany(context.Background(), ts.strategy(client), requests...)
+			require.Len(t, results, 3)
+
+			for _, x := range []int{0, 2} {
+				require.NoError(t, results[x].Err)
+				assert.Equal(t, State(Allow), results[x].Result.State)
+				assert.Equal(t, uint64(1), results[x].Result.TotalRequests)
+			}
+
+			assert.Nil(t, results[1].Result)
+			require.Error(t, results[1].Err)
+			assert.Contains(t, results[1].Err.Error(), ts.err)
+		})
+	}
+}
+
+func TestRunManyWithDB(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewSortedSetCounterStrategy(client, time.Now, WithDB(5))
+	defer strategy.(io.Closer).Close()
+
+	// the pipeline runs on the database of the strategy, not the one of the client it was created with
+	results := RunMany(context.Background(), strategy,
+		&Request{Key: "some-user", Limit: 10, Duration: time.Minute},
+		&Request{Key: "other-user", Limit: 10, Duration: time.Minute},
+	)
+	require.Len(t, results, 2)
+
+	for _, result := range results {
+		require.NoError(t, result.Err)
+	}
+
+	assert.Empty(t, server.DB(0).Keys())
+	assert.Equal(t, []string{"other-user", "some-user"}, server.DB(5).Keys())
+}
+
+func TestRunManyWithoutRedis(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+
+	client := redis.NewClient(&redis.Options{
+		Addr:       server.Addr(),
+		MaxRetries: -1,
+	})
+	defer client.Close()
+
+	server.Close()
+
+	results := RunMany(context.Background(), NewSortedSetCounterStrategy(client, time.Now),
+		&Request{Key: "some-user", Limit: 10, Duration: time.Minute},
+		&Request{Key: "other-user", Limit: 10, Duration: time.Minute},
+	)
+	require.Len(t, results, 2)
+
+	for _, result := range results {
+		assert.Nil(t, result.Result)
+		assert.Error(t, result.Err)
+	}
+}
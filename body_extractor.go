@@ -0,0 +1,121 @@
+package redis_rate_limiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	_ Extractor = &bodyFieldExtractor{}
+)
+
+const (
+	// DefaultMaxBodyBytes is the most the body field extractor will buffer when no limit is given.
+	DefaultMaxBodyBytes = 1 << 20
+)
+
+type bodyFieldExtractor struct {
+	path     []string
+	maxBytes int64
+}
+
+// NewBodyFieldExtractor creates an extractor that reads a field from a JSON request body, the path is a dot separated
+// list of object fields like `sender.id`. Unlike the other extractors this one has to read the body, so use it only
+// when there is nothing in the headers or URL that identifies the client (webhooks are the usual case). The tradeoffs:
+//
+// - the body is buffered in memory (up to DefaultMaxBodyBytes) and parsed before the wrapped handler gets it;
+// - requests with bodies larger than the limit, that are not a single JSON value or that don't have the field are
+// rejected;
+// - the field comes from the client, so like header values it must have at most MaxHeaderValueLength bytes and no
+// control characters, otherwise the request is rejected (invalid UTF-8 is replaced by the JSON parser);
+// - the body is restored, so the wrapped handler can still read it as if nothing had happened.
+func NewBodyFieldExtractor(jsonPath string) Extractor {
+	return NewBodyFieldExtractorWithLimit(jsonPath, DefaultMaxBodyBytes)
+}
+
+// NewBodyFieldExtractorWithLimit is the same as NewBodyFieldExtractor but sets the maximum amount of bytes that will
+// be buffered from the body. Keep this small, every request pays for it in memory before being rate limited.
+func NewBodyFieldExtractorWithLimit(jsonPath string, maxBytes int64) Extractor {
+	return &bodyFieldExtractor{
+		path:     strings.Split(jsonPath, "."),
+		maxBytes: maxBytes,
+	}
+}
+
+// Extract reads up to the limit from the body, puts what was read back on the request and then looks for the field.
+func (b *bodyFieldExtractor) Extract(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", extractError(CodeMissingBodyField, "the request body is empty, can't read field %v", strings.Join(b.path, "."))
+	}
+
+	// we read one byte more than the limit so we know if the body is larger than it without reading all of it
+	buffered, err := io.ReadAll(io.LimitReader(r.Body, b.maxBytes+1))
+
+	// whatever happens the wrapped handler must still be able to read the full body, so we put back
+	// what we have read in front of whatever is left to be read from the original body.
+	r.Body = &restoredBody{
+		Reader: io.MultiReader(bytes.NewReader(buffered), r.Body),
+		Closer: r.Body,
+	}
+
+	if err != nil {
+		return "", extractError(CodeInvalidBody, "failed to read request body: %v", err)
+	}
+
+	if int64(len(buffered)) > b.maxBytes {
+		return "", extractError(CodeBodyTooLarge, "the request body is larger than %v bytes", b.maxBytes)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buffered))
+	decoder.UseNumber()
+
+	var current interface{}
+	if err := decoder.Decode(&current); err != nil {
+		return "", extractError(CodeInvalidBody, "failed to parse request body as JSON: %v", err)
+	}
+
+	// a body with more than a JSON value isn't what the handler expects either, so it's not ignored
+	if _, err := decoder.Token(); err != io.EOF {
+		return "", extractError(CodeInvalidBody, "the request body must have a single JSON value")
+	}
+
+	for _, field := range b.path {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return "", extractError(CodeInvalidBody, "the field %v must be an object", field)
+		}
+
+		if current, ok = object[field]; !ok {
+			return "", extractError(CodeMissingBodyField, "the body field %v must have a value set", strings.Join(b.path, "."))
+		}
+	}
+
+	var value string
+
+	switch v := current.(type) {
+	case string:
+		value = strings.TrimSpace(v)
+	case json.Number:
+		value = v.String()
+	default:
+		return "", extractError(CodeInvalidBody, "the body field %v must be a string or a number", strings.Join(b.path, "."))
+	}
+
+	if value == "" {
+		return "", extractError(CodeMissingBodyField, "the body field %v must have a value set", strings.Join(b.path, "."))
+	}
+
+	if err := validateKeyValue(value); err != nil {
+		return "", extractError(CodeInvalidBody, "the body field %v has an invalid value: %v", strings.Join(b.path, "."), err)
+	}
+
+	return value, nil
+}
+
+type restoredBody struct {
+	io.Reader
+	io.Closer
+}
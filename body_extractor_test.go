@@ -0,0 +1,102 @@
+package redis_rate_limiter
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyFieldExtractor_Extract(t *testing.T) {
+	tt := []struct {
+		name      string
+		extractor Extractor
+		body      string
+		key       string
+		err       string
+	}{
+		{
+			name:      "extracts a top level string field",
+			extractor: NewBodyFieldExtractor("sender"),
+			body:      `{"sender": "some-user", "data": [1, 2, 3]}`,
+			key:       "some-user",
+		},
+		{
+			name:      "extracts a nested number field",
+			extractor: NewBodyFieldExtractor("sender.id"),
+			body:      `{"sender": {"id": 12345678901234567890}}`,
+			key:       "12345678901234567890",
+		},
+		{
+			name:      "fails when the field is missing",
+			extractor: NewBodyFieldExtractor("sender.id"),
+			body:      `{"sender": {"name": "some-user"}}`,
+			err:       "the body field sender.id must have a value set",
+		},
+		{
+			name:      "fails when the field is an object",
+			extractor: NewBodyFieldExtractor("sender"),
+			body:      `{"sender": {"name": "some-user"}}`,
+			err:       "the body field sender must be a string or a number",
+		},
+		{
+			name:      "fails when the body is not JSON",
+			extractor: NewBodyFieldExtractor("sender"),
+			body:      `sender=some-user`,
+			err:       "failed to parse request body as JSON: invalid character 's' looking for beginning of value",
+		},
+		{
+			name:      "fails when the field has control characters",
+			extractor: NewBodyFieldExtractor("sender"),
+			body:      `{"sender": "some\nuser"}`,
+			err:       "the body field sender has an invalid value: it has control characters",
+		},
+		{
+			name:      "fails when the field is too long",
+			extractor: NewBodyFieldExtractor("sender"),
+			body:      `{"sender": "` + strings.Repeat("a", MaxHeaderValueLength+1) + `"}`,
+			err:       fmt.Sprintf("the body field sender has an invalid value: it is longer than %v bytes", MaxHeaderValueLength),
+		},
+		{
+			name:      "fails when there is data after the JSON value",
+			extractor: NewBodyFieldExtractor("sender"),
+			body:      `{"sender": "some-user"} {"sender": "other-user"}`,
+			err:       "the request body must have a single JSON value",
+		},
+		{
+			name:      "allows spaces after the JSON value",
+			extractor: NewBodyFieldExtractor("sender"),
+			body:      "{\"sender\": \"some-user\"}\n",
+			key:       "some-user",
+		},
+		{
+			name:      "fails when the body is over the limit",
+			extractor: NewBodyFieldExtractorWithLimit("sender", 10),
+			body:      `{"sender": "some-user"}`,
+			err:       "the request body is larger than 10 bytes",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/webhook", strings.NewReader(ts.body))
+
+			key, err := ts.extractor.Extract(req)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, ts.key, key)
+			}
+
+			// the body must be fully readable by the wrapped handler either way
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, ts.body, string(body))
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ Strategy  = &cardinalityGuardStrategy{}
+	_ KeyNamer  = &cardinalityGuardStrategy{}
+	_ Refunder  = &cardinalityGuardStrategy{}
+	_ Committer = &cardinalityGuardStrategy{}
+
+	// cardinalityScript adds the key to the HyperLogLog of the window and returns the count before and after it, a
+	// key that changes the count is (most likely) new.
+	cardinalityScript = redis.NewScript(`
+local before = redis.call('PFCOUNT', KEYS[1])
+redis.call('PFADD', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return {before, redis.call('PFCOUNT', KEYS[1])}
+`)
+
+	// ErrKeyCardinalityExceeded is returned by the cardinality guard for new keys once there are too many distinct
+	// keys in the window and the guard is configured to refuse them.
+	ErrKeyCardinalityExceeded = errors.New("too many distinct keys")
+)
+
+const (
+	// CardinalityKeyPrefix is prepended to the guard name and the window number to build the HyperLogLog key of every
+	// window, like `rl:cardinality:api:26418855` for a guard named `api`.
+	CardinalityKeyPrefix = "rl:cardinality:"
+)
+
+// CardinalityGuardConfig configures NewCardinalityGuardStrategy.
+type CardinalityGuardConfig struct {
+	// Name identifies the guard in its Redis keys, so guards that share a Redis (like the ones of different services)
+	// count their keys separately. It must be set.
+	Name string
+	// MaxKeys is how many distinct keys are expected within a `Window`.
+	MaxKeys uint64
+	// Window is the period distinct keys are counted over, like a minute.
+	Window time.Duration
+	// Refuse, when set, fails requests for keys that were not seen in the window yet with ErrKeyCardinalityExceeded
+	// once there are more than `MaxKeys`, keys seen before the limit was reached keep working. The HyperLogLog can't
+	// tell if a key is new without adding it, so a refused key that comes back in the same window is let through.
+	// When not set the guard only calls `OnExceeded`.
+	Refuse bool
+	// OnExceeded is called with the approximate number of distinct keys the first time a window goes over
+	// `MaxKeys` (once per window for every process), it runs synchronously so start a goroutine in it if it's slow.
+	OnExceeded func(ctx context.Context, count uint64)
+}
+
+// NewCardinalityGuardStrategy creates a strategy that counts the distinct keys (the request `Key` with the `Action`)
+// seen in every window before delegating to `inner`, as a safety net against extractors that produce a new key for
+// every request (like keying on a trace ID), which would fill Redis with one request keys. Keys are counted with a
+// HyperLogLog per window, so the count is approximate (within about 1%) and takes at most 12kb per window no matter
+// how many keys there are, at the cost of one extra round trip per request. Being approximate, a new key that doesn't
+// change the count is taken as one that was already seen.
+func NewCardinalityGuardStrategy(inner Strategy, client *redis.Client, now func() time.Time, config *CardinalityGuardConfig) Strategy {
+	return &cardinalityGuardStrategy{
+		inner:  inner,
+		client: client,
+		now:    now,
+		config: config,
+		// no window has gone over the limit yet
+		exceeded: -1,
+	}
+}
+
+type cardinalityGuardStrategy struct {
+	inner  Strategy
+	client *redis.Client
+	now    func() time.Time
+	config *CardinalityGuardConfig
+	// exceeded is the last window OnExceeded was called for
+	exceeded int64
+}
+
+// Run counts the key and runs the inner strategy, unless the key is new and the guard refuses new keys.
+func (c *cardinalityGuardStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	if c.config.Name == "" {
+		return nil, errors.New("the cardinality guard must have a name")
+	}
+
+	// windows are in milliseconds, anything shorter has no window
+	if c.config.Window < time.Millisecond {
+		return nil, errors.Errorf("the cardinality guard window %v must be at least 1ms", c.config.Window)
+	}
+
+	now := r.now(c.now)
+	window := now.UnixMilli() / c.config.Window.Milliseconds()
+	windowEnd := time.UnixMilli((window + 1) * c.config.Window.Milliseconds())
+	key := c.cardinalityKey(window)
+
+	counts, err := int64s(cardinalityScript.Run(ctx, c.client, []string{key}, r.redisKey(), windowEnd.Sub(now).Milliseconds()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to count distinct keys on %v", key)
+	}
+
+	if total := uint64(counts[1]); total > c.config.MaxKeys {
+		if c.config.OnExceeded != nil && atomic.SwapInt64(&c.exceeded, window) != window {
+			c.config.OnExceeded(ctx, total)
+		}
+
+		if c.config.Refuse && counts[1] > counts[0] {
+			return nil, errors.Wrapf(ErrKeyCardinalityExceeded, "%v distinct keys seen, the limit is %v, refusing key %v", total, c.config.MaxKeys, r.redisKey())
+		}
+	}
+
+	return c.inner.Run(ctx, r)
+}
+
+// KeyFor returns the keys of the inner strategy followed by the HyperLogLog key for the current window, which is
+// shared by all requests of the guard. Guards with a `Window` under 1ms have no window and only return the keys of the
+// inner strategy.
+func (c *cardinalityGuardStrategy) KeyFor(r *Request) []string {
+	if c.config.Window < time.Millisecond {
+		return keysFor(c.inner, r)
+	}
+
+	window := r.now(c.now).UnixMilli() / c.config.Window.Milliseconds()
+	return append(keysFor(c.inner, r), c.cardinalityKey(window))
+}
+
+// Refund gives back the request on the inner strategy.
+func (c *cardinalityGuardStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, c.inner, r)
+}
+
+// Commit settles the request on the inner strategy.
+func (c *cardinalityGuardStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, c.inner, r, actualCost)
+}
+
+func (c *cardinalityGuardStrategy) unwrap() Strategy {
+	return c.inner
+}
+
+func (c *cardinalityGuardStrategy) cardinalityKey(window int64) string {
+	return CardinalityKeyPrefix + c.config.Name + ":" + strconv.FormatInt(window, 10)
+}
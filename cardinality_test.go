@@ -0,0 +1,142 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCardinalityGuardStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name     string
+		refuse   bool
+		refused  []string
+		exceeded []uint64
+	}{
+		{
+			name:     "only reports when there are too many keys",
+			exceeded: []uint64{4},
+		},
+		{
+			name:     "refuses new keys when there are too many keys",
+			refuse:   true,
+			refused:  []string{"user-4", "user-5"},
+			exceeded: []uint64{4},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			var exceeded []uint64
+
+			strategy := NewCardinalityGuardStrategy(NewRecordingStrategy(nil), client, func() time.Time {
+				return now
+			}, &CardinalityGuardConfig{
+				Name:    "api",
+				MaxKeys: 3,
+				Window:  time.Minute,
+				Refuse:  ts.refuse,
+				OnExceeded: func(ctx context.Context, count uint64) {
+					exceeded = append(exceeded, count)
+				},
+			})
+
+			var refused []string
+
+			for _, key := range []string{"user-1", "user-2", "user-3", "user-4", "user-1", "user-5"} {
+				_, err := strategy.Run(context.Background(), &Request{
+					Key:      key,
+					Limit:    10,
+					Duration: time.Minute,
+				})
+				if errors.Is(err, ErrKeyCardinalityExceeded) {
+					refused = append(refused, key)
+					continue
+				}
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, ts.refused, refused)
+			assert.Equal(t, ts.exceeded, exceeded)
+			assert.Equal(t, 30*time.Second, server.TTL("rl:cardinality:api:26418855"))
+
+			// a new window starts counting from zero
+			now = now.Add(time.Minute)
+
+			_, err = strategy.Run(context.Background(), &Request{
+				Key:      "user-6",
+				Limit:    10,
+				Duration: time.Minute,
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCardinalityGuardStrategy_RunWithShortWindow(t *testing.T) {
+	strategy := NewCardinalityGuardStrategy(NewRecordingStrategy(nil), nil, time.Now, &CardinalityGuardConfig{
+		Name:    "api",
+		MaxKeys: 3,
+		Window:  time.Microsecond,
+	})
+
+	_, err := strategy.Run(context.Background(), &Request{Key: "some-user"})
+	assert.EqualError(t, err, "the cardinality guard window 1µs must be at least 1ms")
+	assert.Empty(t, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+}
+
+func TestCardinalityGuardStrategy_RunWithManyGuards(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	guard := func(name string) Strategy {
+		return NewCardinalityGuardStrategy(NewRecordingStrategy(nil), client, clock, &CardinalityGuardConfig{
+			Name:    name,
+			MaxKeys: 1,
+			Window:  time.Minute,
+			Refuse:  true,
+		})
+	}
+
+	_, err = guard("api").Run(context.Background(), &Request{Key: "user-1"})
+	require.NoError(t, err)
+
+	// the keys of other guards don't count against this one
+	_, err = guard("admin").Run(context.Background(), &Request{Key: "user-2"})
+	require.NoError(t, err)
+
+	_, err = guard("api").Run(context.Background(), &Request{Key: "user-3"})
+	assert.ErrorIs(t, err, ErrKeyCardinalityExceeded)
+
+	assert.Equal(t, []string{"rl:cardinality:admin:26418855", "rl:cardinality:api:26418855"}, server.Keys())
+
+	_, err = guard("").Run(context.Background(), &Request{Key: "user-1"})
+	assert.EqualError(t, err, "the cardinality guard must have a name")
+}
@@ -0,0 +1,114 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+var (
+	_ Strategy = &carryoverStrategy{}
+	_ KeyNamer = &carryoverStrategy{}
+
+	// carryoverScript counts the request in the current window if it fits under the limit plus what was left unused
+	// in the previous window (up to the cap). ARGV has the limit, the cap, the cost and the TTL of the window, which
+	// keeps it around for the next window to read. It returns the total and whether the request was counted.
+	carryoverScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+local allowed = limit + math.min(math.max(limit - previous, 0), tonumber(ARGV[2]))
+local total = tonumber(redis.call('GET', KEYS[1]) or '0')
+if total + tonumber(ARGV[3]) > allowed then
+  return {total, 0}
+end
+total = redis.call('INCRBY', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {total, 1}
+`)
+)
+
+// NewCarryoverStrategy creates a fixed window strategy (with windows aligned to the Unix epoch, like the fixed
+// window bucket strategy) where the requests a client didn't use in a window carry over to the next one, up to
+// `maxCarryover`. A client with a limit of 100 that made 70 requests in a window can make 130 in the next one with
+// a `maxCarryover` of 50 or more, but only 110 with a `maxCarryover` of 10. Only the `Limit` of a window carries over,
+// not what was carried into it, so requests never pile up for more than one window, and a client that made no
+// requests in the previous window (including new clients) gets the whole `maxCarryover`.
+//
+// Every window has its own counter at the request key with the window appended (like `some-user:26419189`) that
+// is kept until the end of the next window. Denied requests are not counted. As the handler only knows the `Limit`,
+// the remaining requests it reports don't include the carryover.
+func NewCarryoverStrategy(client *redis.Client, now func() time.Time, maxCarryover uint64) Strategy {
+	return &carryoverStrategy{
+		client:       client,
+		now:          now,
+		maxCarryover: maxCarryover,
+	}
+}
+
+type carryoverStrategy struct {
+	client       *redis.Client
+	now          func() time.Time
+	maxCarryover uint64
+}
+
+// Run counts the request in the window it falls in if it fits under the limit with the carryover of the previous
+// window.
+func (c *carryoverStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	key := r.redisKey()
+
+	// windows are in milliseconds, anything shorter has no window
+	if r.Duration < time.Millisecond {
+		return nil, errors.Errorf("the duration %v for key %v must be at least 1ms", r.Duration, key)
+	}
+
+	now := r.now(c.now)
+	window := now.UnixMilli() / r.Duration.Milliseconds()
+	windowStart := time.UnixMilli(window * r.Duration.Milliseconds()).In(now.Location())
+	windowEnd := windowStart.Add(r.Duration)
+
+	keys := []string{c.windowKey(r, window), c.windowKey(r, window-1)}
+	// the counter is read by the next window, so it's kept until that one is over
+	ttl := windowEnd.Add(r.Duration).Sub(now).Milliseconds()
+
+	reply, err := int64s(carryoverScript.Run(ctx, c.client, keys, r.Limit, c.maxCarryover, r.cost(), ttl))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run carryover script for key %v", key)
+	}
+
+	if reply[1] != 1 {
+		return &Result{
+			State:         Deny,
+			TotalRequests: uint64(reply[0]),
+			ExpiresAt:     windowEnd,
+			Reason:        ReasonGuardRejected,
+			WindowStart:   windowStart,
+			WindowEnd:     windowEnd,
+		}, nil
+	}
+
+	return &Result{
+		State:         Allow,
+		TotalRequests: uint64(reply[0]),
+		ExpiresAt:     windowEnd,
+		Reason:        ReasonUnderLimit,
+		WindowStart:   windowStart,
+		WindowEnd:     windowEnd,
+	}, nil
+}
+
+// KeyFor returns the keys of the window the request falls in and the previous one, which depend on the time of the
+// request. Requests with a `Duration` under 1ms have no window and no keys.
+func (c *carryoverStrategy) KeyFor(r *Request) []string {
+	if r.Duration < time.Millisecond {
+		return nil
+	}
+
+	window := r.now(c.now).UnixMilli() / r.Duration.Milliseconds()
+	return []string{c.windowKey(r, window), c.windowKey(r, window-1)}
+}
+
+func (c *carryoverStrategy) windowKey(r *Request, window int64) string {
+	return r.redisKey() + ":" + strconv.FormatInt(window, 10)
+}
@@ -0,0 +1,100 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCarryoverStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	strategy := NewCarryoverStrategy(client, func() time.Time {
+		return now
+	}, 2)
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		states  []State
+		totals  []uint64
+	}{
+		{
+			name:   "new clients get the whole carryover",
+			states: []State{Allow, Allow, Allow, Allow, Allow, Deny},
+			totals: []uint64{1, 2, 3, 4, 5, 5},
+		},
+		{
+			name:    "nothing carries over after using the whole limit",
+			advance: time.Minute,
+			states:  []State{Allow, Allow, Allow, Deny},
+			totals:  []uint64{1, 2, 3, 3},
+		},
+		{
+			name:    "uses a single request",
+			advance: time.Minute,
+			states:  []State{Allow},
+			totals:  []uint64{1},
+		},
+		{
+			name:    "carries over the unused requests up to the cap",
+			advance: time.Minute,
+			states:  []State{Allow, Allow, Allow, Allow, Allow, Deny},
+			totals:  []uint64{1, 2, 3, 4, 5, 5},
+		},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+
+		states := make([]State, 0, len(step.states))
+		totals := make([]uint64, 0, len(step.totals))
+
+		for range step.states {
+			result, err := strategy.Run(context.Background(), &Request{
+				Key:      "some-user",
+				Limit:    3,
+				Duration: time.Minute,
+			})
+			require.NoError(t, err, step.name)
+
+			states = append(states, result.State)
+			totals = append(totals, result.TotalRequests)
+
+			assert.Equal(t, now.Truncate(time.Minute).Add(time.Minute), result.ExpiresAt, step.name)
+		}
+
+		assert.Equal(t, step.states, states, step.name)
+		assert.Equal(t, step.totals, totals, step.name)
+	}
+
+	// the counter is kept until the end of the next window
+	assert.Equal(t, []string{"some-user:26418858", "some-user:26418857"}, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user", Duration: time.Minute}))
+	assert.Equal(t, 90*time.Second, server.TTL("some-user:26418858"))
+}
+
+func TestCarryoverStrategy_RunWithShortDuration(t *testing.T) {
+	strategy := NewCarryoverStrategy(nil, time.Now, 1)
+	request := &Request{
+		Key:      "some-user",
+		Limit:    3,
+		Duration: time.Microsecond,
+	}
+
+	_, err := strategy.Run(context.Background(), request)
+	assert.EqualError(t, err, "the duration 1µs for key some-user must be at least 1ms")
+	assert.Empty(t, strategy.(KeyNamer).KeyFor(request))
+}
@@ -0,0 +1,48 @@
+package redis_rate_limiter
+
+import (
+	"time"
+)
+
+// ResultsEqualIgnoringTime compares two results ignoring the fields computed from the current time (`ExpiresAt`,
+// `WindowStart` and `WindowEnd`), so tests that don't control the clock can still compare whole results.
+// Two nil results are equal.
+func ResultsEqualIgnoringTime(a *Result, b *Result) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return withoutTime(*a) == withoutTime(*b)
+}
+
+// ResultsEqualWithin compares two results allowing the fields computed from the current time to be up to
+// `tolerance` apart, for tests that run the strategy with the real clock.
+func ResultsEqualWithin(a *Result, b *Result, tolerance time.Duration) bool {
+	if !ResultsEqualIgnoringTime(a, b) {
+		return false
+	}
+
+	if a == nil {
+		return true
+	}
+
+	return within(a.ExpiresAt, b.ExpiresAt, tolerance) &&
+		within(a.WindowStart, b.WindowStart, tolerance) &&
+		within(a.WindowEnd, b.WindowEnd, tolerance)
+}
+
+func withoutTime(r Result) Result {
+	r.ExpiresAt = time.Time{}
+	r.WindowStart = time.Time{}
+	r.WindowEnd = time.Time{}
+	return r
+}
+
+func within(a time.Time, b time.Time, tolerance time.Duration) bool {
+	d := a.Sub(b)
+	if d < 0 {
+		d = -d
+	}
+
+	return d <= tolerance
+}
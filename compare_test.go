@@ -0,0 +1,92 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestResultsEqualIgnoringTime(t *testing.T) {
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	result := &Result{
+		State:         Allow,
+		TotalRequests: 1,
+		ExpiresAt:     now.Add(time.Minute),
+		Reason:        ReasonUnderLimit,
+		WindowStart:   now,
+		WindowEnd:     now.Add(time.Minute),
+	}
+
+	tt := []struct {
+		name      string
+		a         *Result
+		b         *Result
+		tolerance time.Duration
+		equal     bool
+		within    bool
+	}{
+		{
+			name:   "the same result",
+			a:      result,
+			b:      result,
+			equal:  true,
+			within: true,
+		},
+		{
+			name:   "both nil",
+			equal:  true,
+			within: true,
+		},
+		{
+			name: "one of them nil",
+			a:    result,
+		},
+		{
+			name: "times a second apart",
+			a:    result,
+			b: &Result{
+				State:         Allow,
+				TotalRequests: 1,
+				ExpiresAt:     now.Add(time.Minute + time.Second),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   now.Add(time.Second),
+				WindowEnd:     now.Add(time.Minute + time.Second),
+			},
+			tolerance: time.Second,
+			equal:     true,
+			within:    true,
+		},
+		{
+			name: "times past the tolerance",
+			a:    result,
+			b: &Result{
+				State:         Allow,
+				TotalRequests: 1,
+				ExpiresAt:     now.Add(2 * time.Minute),
+				Reason:        ReasonUnderLimit,
+			},
+			tolerance: time.Second,
+			equal:     true,
+		},
+		{
+			name: "different totals",
+			a:    result,
+			b: &Result{
+				State:         Allow,
+				TotalRequests: 2,
+				ExpiresAt:     now.Add(time.Minute),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   now,
+				WindowEnd:     now.Add(time.Minute),
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			assert.Equal(t, ts.equal, ResultsEqualIgnoringTime(ts.a, ts.b))
+			assert.Equal(t, ts.within, ResultsEqualWithin(ts.a, ts.b, ts.tolerance))
+		})
+	}
+}
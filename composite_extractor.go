@@ -0,0 +1,63 @@
+package redis_rate_limiter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	_ Extractor = &compositeExtractor{}
+
+	// compositeEscaper escapes the separator (and the escape character itself) in the keys of the extractors, so
+	// keys like `a|b` + `c` and `a` + `b|c` don't produce the same composite key.
+	compositeEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+)
+
+const (
+	compositeSeparator = "|"
+)
+
+// NewCompositeExtractor creates an extractor that joins the keys of many extractors, like the client IP and the
+// route, into a single key. The keys are always joined in the order the extractors were given, separated by `|`
+// (with any `|` or `\` inside of them escaped with a `\`), so the same client always gets the same key as long as
+// the extractors are given in the same order. Changing the order changes the keys of every client, which resets
+// their counters. If any extractor fails or returns an empty key the composite fails.
+func NewCompositeExtractor(extractors ...Extractor) Extractor {
+	return &compositeExtractor{
+		extractors: append([]Extractor{}, extractors...),
+	}
+}
+
+type compositeExtractor struct {
+	extractors []Extractor
+}
+
+// Extract runs every extractor in order and joins their keys.
+func (c *compositeExtractor) Extract(r *http.Request) (string, error) {
+	if len(c.extractors) == 0 {
+		return "", extractError(CodeMisconfigured, "the composite extractor has no extractors")
+	}
+
+	keys := make([]string, 0, len(c.extractors))
+
+	for x, extractor := range c.extractors {
+		key, err := extractor.Extract(r)
+		if err != nil {
+			// the code of the extractor that failed is kept
+			return "", &ExtractError{
+				code:    errorCode(err),
+				message: fmt.Sprintf("extractor %v failed", x),
+				err:     err,
+			}
+		}
+
+		if key == "" {
+			return "", extractError(CodeEmptyKey, "extractor %v returned an empty key", x)
+		}
+
+		keys = append(keys, compositeEscaper.Replace(key))
+	}
+
+	return strings.Join(keys, compositeSeparator), nil
+}
@@ -0,0 +1,118 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompositeExtractor_Extract(t *testing.T) {
+	tt := []struct {
+		name       string
+		extractors []Extractor
+		headers    map[string]string
+		key        string
+		err        string
+	}{
+		{
+			name: "joins the keys in the order the extractors were given",
+			extractors: []Extractor{
+				NewHTTPHeadersExtractor("X-User-ID"),
+				NewHTTPHeadersExtractor(forwardedFor),
+			},
+			headers: map[string]string{forwardedFor: "10.10.10.10", "X-User-ID": "some-user"},
+			key:     "some-user|10.10.10.10",
+		},
+		{
+			name: "escapes separators inside the keys",
+			extractors: []Extractor{
+				NewHTTPHeadersExtractor("X-User-ID"),
+				NewHTTPHeadersExtractor(forwardedFor),
+			},
+			headers: map[string]string{forwardedFor: `10|10\10`, "X-User-ID": "some|user"},
+			key:     `some\|user|10\|10\\10`,
+		},
+		{
+			name: "fails if any extractor fails",
+			extractors: []Extractor{
+				NewHTTPHeadersExtractor("X-User-ID"),
+				NewHTTPHeadersExtractor(forwardedFor),
+			},
+			headers: map[string]string{"X-User-ID": "some-user"},
+			err:     "extractor 1 failed: the header X-Forwarded-For must have a value set",
+		},
+		{
+			name: "fails if any extractor returns an empty key",
+			extractors: []Extractor{
+				NewHTTPHeadersExtractor("X-User-ID"),
+				extractorFunc(func(r *http.Request) (string, error) {
+					return "", nil
+				}),
+			},
+			headers: map[string]string{"X-User-ID": "some-user"},
+			err:     "extractor 1 returned an empty key",
+		},
+		{
+			name: "fails without extractors",
+			err:  "the composite extractor has no extractors",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			for name, value := range ts.headers {
+				req.Header.Set(name, value)
+			}
+
+			key, err := NewCompositeExtractor(ts.extractors...).Extract(req)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, ts.key, key)
+			}
+		})
+	}
+}
+
+func TestCompositeExtractor_ExtractIsDeterministic(t *testing.T) {
+	headers := [][2]string{
+		{forwardedFor, "10.10.10.10"},
+		{"X-User-ID", "some-user"},
+		{"X-Org-ID", "some-org"},
+		{"X-Unrelated", "some-value"},
+	}
+
+	extractors := []Extractor{
+		NewHTTPHeadersExtractor("X-Org-ID"),
+		NewHTTPHeadersExtractor("X-User-ID", forwardedFor),
+	}
+
+	random := rand.New(rand.NewSource(1))
+
+	for x := 0; x < 50; x++ {
+		// the order headers are set on the request must not matter
+		random.Shuffle(len(headers), func(i, j int) {
+			headers[i], headers[j] = headers[j], headers[i]
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		for _, header := range headers {
+			req.Header.Set(header[0], header[1])
+		}
+
+		given := append([]Extractor{}, extractors...)
+		composite := NewCompositeExtractor(given...)
+
+		// changing the slice the extractors were given in must not change the composite
+		given[0], given[1] = given[1], given[0]
+
+		key, err := composite.Extract(req)
+		require.NoError(t, err)
+		assert.Equal(t, "some-org|some-user-10.10.10.10", key)
+	}
+}
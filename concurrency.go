@@ -0,0 +1,205 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrConcurrencyLimitReached is returned when all slots for a key are already taken.
+	ErrConcurrencyLimitReached = errors.New("concurrency limit reached")
+
+	// acquireScript removes leases that were not refreshed in time (the process holding them is most likely gone),
+	// then adds the new member only if there is still a free slot. This has to be a script as the count and the add
+	// must happen atomically, otherwise two clients could see the same free slot and both take it.
+	acquireScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+local count = redis.call('ZCARD', KEYS[1])
+if count < tonumber(ARGV[3]) then
+  redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+  redis.call('PEXPIRE', KEYS[1], ARGV[5])
+  return {1, count + 1}
+end
+return {0, count}
+`)
+)
+
+const (
+	// releaseTimeout is how long releasing a slot can take, a slot that fails to be released is reclaimed once its
+	// lease is over.
+	releaseTimeout = 5 * time.Second
+)
+
+// NewConcurrencyLimiter creates a limiter that caps how many operations (connections, requests, jobs) can be in
+// flight at the same time for a key. `limit` is the maximum number of slots per key and `lease` is how long a slot
+// is held without being refreshed before it is considered abandoned and reclaimed. Leases are kept in milliseconds,
+// so it fails for a `lease` shorter than 1ms.
+func NewConcurrencyLimiter(client *redis.Client, now func() time.Time, limit uint64, lease time.Duration) (*ConcurrencyLimiter, error) {
+	if lease < time.Millisecond {
+		return nil, errors.Errorf("the concurrency lease %v must be at least 1ms", lease)
+	}
+
+	return &ConcurrencyLimiter{
+		client: client,
+		now:    now,
+		limit:  limit,
+		lease:  lease,
+	}, nil
+}
+
+// ConcurrencyLimiter uses a sorted set per key where every member is a slot currently taken and the score is the
+// last time the slot was refreshed. Slots are not counted over a window like the other strategies, they're held
+// until they're released, so a client that never finishes keeps its slot taken for as long as it refreshes it.
+type ConcurrencyLimiter struct {
+	client *redis.Client
+	now    func() time.Time
+	limit  uint64
+	lease  time.Duration
+}
+
+// Acquire tries to take a slot for the key. If a slot was available `ok` is true and `release` must be called
+// once the operation is done to give the slot back, calling it more than once is safe. If there were no slots
+// available `ok` is false and `release` is nil. `inFlight` is how many slots are taken for the key, including the
+// new one when `ok` is true, so callers can decide to wait or fail when the limit is reached.
+//
+// The slot is not refreshed, so the operation holding it must finish within the lease. Once the lease is over the
+// slot is reclaimed by the next Acquire, even if it was never released, and more than `limit` operations could be
+// running at the same time. Use ConnectionGuard for operations that can take longer than the lease, it refreshes the
+// slot for as long as it is held.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context, key string) (release func(), inFlight int64, ok bool, err error) {
+	member, inFlight, ok, err := c.acquire(ctx, key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if !ok {
+		return nil, inFlight, false, nil
+	}
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			c.release(key, member)
+		})
+	}, inFlight, true, nil
+}
+
+func (c *ConcurrencyLimiter) acquire(ctx context.Context, key string) (string, int64, bool, error) {
+	member := uuid.New().String()
+	now := c.now()
+
+	result, err := int64s(acquireScript.Run(ctx, c.client, []string{key},
+		now.UnixMilli(),
+		now.Add(-c.lease).UnixMilli(),
+		c.limit,
+		member,
+		c.lease.Milliseconds(),
+	))
+	if err != nil {
+		return "", 0, false, errors.Wrapf(err, "failed to acquire slot for key %v", key)
+	}
+
+	return member, result[1], result[0] == 1, nil
+}
+
+// release gives the slot back. the caller's context might already be gone by the time the slot is released, so we
+// use a new one here, otherwise the slot would be held until the lease expires. it has a timeout so a Redis that
+// doesn't answer can't block the caller forever.
+func (c *ConcurrencyLimiter) release(key string, member string) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+
+	c.client.ZRem(ctx, key, member)
+}
+
+// refresh bumps the score of a member so it isn't reclaimed while the operation holding it is still going.
+// XX makes sure we don't add the member back if it was already released or reclaimed.
+func (c *ConcurrencyLimiter) refresh(ctx context.Context, key string, member string) error {
+	p := c.client.Pipeline()
+	p.ZAddXX(ctx, key, &redis.Z{
+		Score:  float64(c.now().UnixMilli()),
+		Member: member,
+	})
+	p.PExpire(ctx, key, c.lease)
+
+	if _, err := p.Exec(ctx); err != nil {
+		return errors.Wrapf(err, "failed to refresh slot %v for key %v", member, key)
+	}
+
+	return nil
+}
+
+// ConnectionGuard holds a slot for a long lived connection (like a WebSocket) for as long as it is open. The slot is
+// refreshed periodically in the background so it doesn't expire while the connection is alive, once the connection
+// closes call `release` to give the slot back. If `ctx` is cancelled the refreshing stops and the slot is released.
+// When all slots are taken it returns `ErrConcurrencyLimitReached`.
+func (c *ConcurrencyLimiter) ConnectionGuard(ctx context.Context, key string) (release func(), err error) {
+	member, inFlight, ok, err := c.acquire(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, errors.Wrapf(ErrConcurrencyLimitReached, "key %v already has %v connections", key, inFlight)
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+
+	release = func() {
+		once.Do(func() {
+			close(done)
+			c.release(key, member)
+		})
+	}
+
+	go func() {
+		// refreshing at half the lease gives us one more chance to refresh before the slot is reclaimed
+		ticker := time.NewTicker(c.lease / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				release()
+				return
+			case <-ticker.C:
+				// a failed refresh is not fatal, the next tick will try again before the lease is over
+				_ = c.refresh(ctx, key, member)
+			}
+		}
+	}()
+
+	return release, nil
+}
+
+// int64s reads the reply of a script that returns a table of integers.
+func int64s(cmd *redis.Cmd) ([]int64, error) {
+	reply, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("expected a list of integers but got %T", reply)
+	}
+
+	result := make([]int64, 0, len(values))
+	for _, v := range values {
+		i, ok := v.(int64)
+		if !ok {
+			return nil, errors.Errorf("expected an integer but got %T", v)
+		}
+		result = append(result, i)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter_Acquire(t *testing.T) {
+	tt := []struct {
+		name     string
+		acquires int
+		releases int
+		advance  time.Duration
+		inFlight int64
+		ok       bool
+	}{
+		{
+			name:     "acquires a slot when under the limit",
+			acquires: 2,
+			inFlight: 2,
+			ok:       true,
+		},
+		{
+			name:     "fails to acquire when all slots are taken",
+			acquires: 3,
+			inFlight: 2,
+			ok:       false,
+		},
+		{
+			name:     "acquires a slot once a slot is released",
+			acquires: 3,
+			releases: 1,
+			inFlight: 2,
+			ok:       true,
+		},
+		{
+			name:     "reclaims slots that were not refreshed within the lease",
+			acquires: 3,
+			advance:  time.Minute,
+			inFlight: 1,
+			ok:       true,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			limiter, err := NewConcurrencyLimiter(client, func() time.Time {
+				return now
+			}, 2, 30*time.Second)
+			require.NoError(t, err)
+
+			var releases []func()
+			var inFlight int64
+			var ok bool
+
+			for x := 0; x < ts.acquires; x++ {
+				if x == ts.acquires-1 {
+					for _, release := range releases[:ts.releases] {
+						release()
+					}
+					now = now.Add(ts.advance)
+				}
+
+				var release func()
+				release, inFlight, ok, err = limiter.Acquire(context.Background(), "some-user")
+				require.NoError(t, err)
+				if ok {
+					releases = append(releases, release)
+				}
+			}
+
+			assert.Equal(t, ts.ok, ok)
+			assert.Equal(t, ts.inFlight, inFlight)
+		})
+	}
+}
+
+func TestConcurrencyLimiter_ConnectionGuard(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	limiter, err := NewConcurrencyLimiter(client, time.Now, 1, time.Minute)
+	require.NoError(t, err)
+
+	release, err := limiter.ConnectionGuard(context.Background(), "some-user")
+	require.NoError(t, err)
+
+	_, err = limiter.ConnectionGuard(context.Background(), "some-user")
+	assert.True(t, errors.Is(err, ErrConcurrencyLimitReached))
+
+	release()
+	release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = limiter.ConnectionGuard(ctx, "some-user")
+	require.NoError(t, err)
+
+	// cancelling the context releases the slot in the background
+	cancel()
+	assert.Eventually(t, func() bool {
+		return client.ZCard(context.Background(), "some-user").Val() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewConcurrencyLimiter_WithShortLease(t *testing.T) {
+	_, err := NewConcurrencyLimiter(nil, time.Now, 1, time.Nanosecond)
+	assert.EqualError(t, err, "the concurrency lease 1ns must be at least 1ms")
+}
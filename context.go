@@ -0,0 +1,48 @@
+package redis_rate_limiter
+
+import (
+	"context"
+)
+
+type resultContextKey struct{}
+
+// resultHolder is stored in the context instead of the result itself so handlers that run before the rate limiter
+// can see the result it stored once it's done.
+type resultHolder struct {
+	result *Result
+}
+
+// WithResultContext returns a context the rate limiting handler will store its decision in. The handler always
+// stores its decision in the context of the request it sends to the wrapped handler, this is only needed by
+// middleware that runs before the rate limiter (like access logs) and wants to read the decision once the rate
+// limiter returns, including for requests that were denied:
+//
+//	ctx := WithResultContext(r.Context())
+//	limiter.ServeHTTP(w, r.WithContext(ctx))
+//	result, ok := ResultFromContext(ctx)
+func WithResultContext(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(resultContextKey{}).(*resultHolder); ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, resultContextKey{}, &resultHolder{})
+}
+
+// ResultFromContext returns the decision the rate limiting handler made for the request, if it made one. Requests
+// that were not checked (like when the kill switch is off or the key is empty and allowed) have no result.
+func ResultFromContext(ctx context.Context) (*Result, bool) {
+	holder, ok := ctx.Value(resultContextKey{}).(*resultHolder)
+	if !ok || holder.result == nil {
+		return nil, false
+	}
+
+	return holder.result, true
+}
+
+// contextWithResult stores the result in the holder already in the context or in a new one.
+func contextWithResult(ctx context.Context, result *Result) context.Context {
+	ctx = WithResultContext(ctx)
+	ctx.Value(resultContextKey{}).(*resultHolder).result = result
+
+	return ctx
+}
@@ -0,0 +1,101 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResultFromContext(t *testing.T) {
+	tt := []struct {
+		name          string
+		strategy      Strategy
+		ip            string
+		status        int
+		handlerResult *Result
+		outerResult   *Result
+		strategyCalls int
+	}{
+		{
+			name:          "stores the result of allowed requests",
+			strategy:      NewRecordingStrategy(nil),
+			ip:            "10.10.10.10",
+			status:        http.StatusOK,
+			handlerResult: &Result{State: Allow, Reason: ReasonUnderLimit},
+			outerResult:   &Result{State: Allow, Reason: ReasonUnderLimit},
+			strategyCalls: 1,
+		},
+		{
+			name:          "stores the result of denied requests",
+			strategy:      NewRecordingStrategy(&denyAllStrategy{}),
+			ip:            "10.10.10.10",
+			status:        http.StatusTooManyRequests,
+			outerResult:   &Result{State: Deny, Reason: ReasonOverLimit},
+			strategyCalls: 1,
+		},
+		{
+			name:          "stores a result for allowlisted keys",
+			strategy:      NewRecordingStrategy(&denyAllStrategy{}),
+			ip:            "10.0.0.1",
+			status:        http.StatusOK,
+			handlerResult: &Result{State: Allow, Reason: ReasonAllowlisted},
+			outerResult:   &Result{State: Allow, Reason: ReasonAllowlisted},
+		},
+		{
+			name:        "stores a result for denylisted keys",
+			strategy:    NewRecordingStrategy(nil),
+			ip:          "10.66.66.66",
+			status:      http.StatusForbidden,
+			outerResult: &Result{State: Deny, Reason: ReasonDenylisted},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			var handlerResult *Result
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				result, ok := ResultFromContext(r.Context())
+				require.True(t, ok)
+				handlerResult = result
+			}}, &RateLimiterConfig{
+				Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:    ts.strategy,
+				Expiration:  time.Minute,
+				MaxRequests: 10,
+				Allowlist:   []string{"10.0.0.1"},
+				Denylist:    []string{"10.66.66.66"},
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.Header.Set(forwardedFor, ts.ip)
+
+			ctx := WithResultContext(req.Context())
+
+			w := httptest.NewRecorder()
+			wrapper.ServeHTTP(w, req.WithContext(ctx))
+
+			assert.Equal(t, ts.status, w.Code)
+			assert.Equal(t, ts.handlerResult, handlerResult)
+
+			outerResult, ok := ResultFromContext(ctx)
+			require.True(t, ok)
+			assert.Equal(t, ts.outerResult, outerResult)
+
+			assert.Len(t, ts.strategy.(*RecordingStrategy).Calls(), ts.strategyCalls)
+		})
+	}
+}
+
+func TestResultFromContext_WithoutResult(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+
+	_, ok := ResultFromContext(req.Context())
+	assert.False(t, ok)
+
+	_, ok = ResultFromContext(WithResultContext(req.Context()))
+	assert.False(t, ok)
+}
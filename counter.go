@@ -3,35 +3,150 @@ package redis_rate_limiter
 import (
 	"context"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"io"
 	"time"
 )
 
 var (
-	_ Strategy = &counterStrategy{}
+	_ Strategy  = &counterStrategy{}
+	_ Refunder  = &counterStrategy{}
+	_ Decayer   = &counterStrategy{}
+	_ Committer = &counterStrategy{}
+	_ Consumer  = &counterStrategy{}
+	_ io.Closer = &counterStrategy{}
+	_ KeyNamer  = &counterStrategy{}
+
+	// incrementScript increments the counter by the cost of the request only if it fits under the limit and records
+	// the nonce of the request with the total it produced. If the same nonce shows up again (the response was lost
+	// and the command was retried) the recorded total is returned instead of incrementing the counter a second time.
+	incrementScript = redis.NewScript(`
+local applied = redis.call('GET', KEYS[2])
+if applied then
+  return {tonumber(applied), 1}
+end
+local total = tonumber(redis.call('GET', KEYS[1]) or '0')
+if total + tonumber(ARGV[3]) > tonumber(ARGV[1]) then
+  return {total, 0}
+end
+total = redis.call('INCRBY', KEYS[1], ARGV[3])
+redis.call('SET', KEYS[2], total, 'PX', ARGV[2])
+return {total, 1}
+`)
+
+	// refundScript gives back the cost of one request, never taking the counter below zero, and forgets the nonce so
+	// a replay of the refunded request would be counted again. The cost is only given back if the nonce was still
+	// there, so refunding the same request twice (like a refund that is retried) only gives it back once.
+	refundScript = redis.NewScript(`
+if redis.call('DEL', KEYS[2]) == 0 then
+  return 0
+end
+local total = tonumber(redis.call('GET', KEYS[1]) or '0')
+local by = math.min(total, tonumber(ARGV[1]))
+if by > 0 then
+  redis.call('DECRBY', KEYS[1], by)
+end
+return 1
+`)
+
+	// commitScript moves the counter by the difference between the actual and the reserved cost, never taking it
+	// below zero. If the counter is gone the window the request was counted in is over and there is nothing to settle.
+	commitScript = redis.NewScript(`
+local total = tonumber(redis.call('GET', KEYS[1]))
+if not total then
+  return 0
+end
+local by = tonumber(ARGV[1]) - tonumber(ARGV[2])
+if by > 0 then
+  return redis.call('INCRBY', KEYS[1], by)
+end
+by = math.min(total, -by)
+if by > 0 then
+  return redis.call('DECRBY', KEYS[1], by)
+end
+return total
+`)
+
+	// consumeScript takes as much of ARGV[2] as fits under the limit and makes sure the counter has a TTL, it returns
+	// how much was taken, the counter after it and its TTL.
+	consumeScript = redis.NewScript(`
+local total = tonumber(redis.call('GET', KEYS[1]) or '0')
+local granted = math.min(tonumber(ARGV[2]), math.max(tonumber(ARGV[1]) - total, 0))
+if granted > 0 then
+  total = redis.call('INCRBY', KEYS[1], granted)
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[3])
+  ttl = tonumber(ARGV[3])
+end
+return {granted, total, ttl}
+`)
+
+	// decayScript decrements the counter by up to ARGV[1] but never below zero, keeping the TTL of the key.
+	decayScript = redis.NewScript(`
+local total = tonumber(redis.call('GET', KEYS[1]) or '0')
+local by = math.min(total, tonumber(ARGV[1]))
+if by > 0 then
+  redis.call('DECRBY', KEYS[1], by)
+end
+return by
+`)
 )
 
 const (
 	keyThatDoesNotExist = -2
 	keyWithoutExpire    = -1
+	// nonceTTL is how long a request nonce is remembered, it only has to outlive the retries for a single request.
+	nonceTTL = 10 * time.Second
 )
 
-func NewCounterStrategy(client *redis.Client, now func() time.Time) *counterStrategy {
+func NewCounterStrategy(client *redis.Client, now func() time.Time, opts ...StrategyOption) *counterStrategy {
+	options := newStrategyOptions(client, opts)
+
 	return &counterStrategy{
-		client: client,
-		now:    now,
+		client:  options.database(client),
+		now:     now,
+		options: options,
 	}
 }
 
 type counterStrategy struct {
-	client *redis.Client
-	now    func() time.Time
+	client  *redis.Client
+	now     func() time.Time
+	options *strategyOptions
 }
 
 // Run this implementation uses a simple counter with an expiration set to the rate limit duration.
 // This implementation is funtional but not very effective if you have to deal with bursty traffic as
 // it will still allow a client to burn through it's full limit quickly once the key expires.
+// `TotalRequests` is always the value of the counter after the decision was made, allowed requests are counted
+// and denied ones are not, so a client at the limit sees `Limit` on both the last allowed and every denied request.
+// The increment is idempotent per `Request.Nonce` (one is generated if it's empty) so a retried command doesn't
+// count the same request twice.
+// Changing the `Duration` doesn't change the TTL of keys that already exist, they keep the window they were created
+// with until they expire, see WithReconciledTTL to cut short windows that are longer than the current `Duration`.
+// Requests with a `Cost` increment the counter by it, which allows counting things other than requests (like bytes
+// sent), and are only allowed if their whole cost fits under the limit.
 func (c *counterStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	r = c.options.request(r)
+
+	result, err := c.run(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.options.countDenied(ctx, c.client, r, result)
+}
+
+func (c *counterStrategy) run(ctx context.Context, r *Request) (*Result, error) {
+	key := r.redisKey()
+
+	// TTLs are set in milliseconds, anything shorter would create a key without an expiration
+	if r.Duration < time.Millisecond {
+		return nil, errors.Errorf("the duration %v for key %v must be at least 1ms", r.Duration, key)
+	}
 
 	// a pipeline in redis is a way to send multiple commands that will all be run together.
 	// this is not a transaction and there are many ways in which these commands could fail
@@ -39,12 +154,12 @@ func (c *counterStrategy) Run(ctx context.Context, r *Request) (*Result, error)
 	// is a network performance optimization.
 
 	// here we try to get the current value and also try to set an expiration on it
-	getPipeline := c.client.Pipeline()
-	getResult := getPipeline.Get(ctx, r.Key)
-	ttlResult := getPipeline.TTL(ctx, r.Key)
+	getPipeline := c.options.reader.Pipeline()
+	getResult := getPipeline.Get(ctx, key)
+	ttlResult := getPipeline.PTTL(ctx, key)
 
 	if _, err := getPipeline.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
-		return nil, errors.Wrapf(err, "failed to execute pipeline with get and ttl to key %v", r.Key)
+		return nil, errors.Wrapf(err, "failed to execute pipeline with get and pttl to key %v", key)
 	}
 
 	var ttlDuration time.Duration
@@ -59,37 +174,68 @@ func (c *counterStrategy) Run(ctx context.Context, r *Request) (*Result, error)
 	// to it anyway as it means this is a new key that will be incremented below.
 	if d, err := ttlResult.Result(); err != nil || d == keyWithoutExpire || d == keyThatDoesNotExist {
 		ttlDuration = r.Duration
-		if err := c.client.Expire(ctx, r.Key, r.Duration).Err(); err != nil {
-			return nil, errors.Wrapf(err, "failed to set an expiration to key %v", r.Key)
+		if err := c.client.PExpire(ctx, key, r.Duration).Err(); err != nil {
+			return nil, errors.Wrapf(err, "failed to set an expiration to key %v", key)
+		}
+	} else if c.options.reconcile && d > r.Duration {
+		// the key was created with a longer duration, its window is cut short to the current one
+		ttlDuration = r.Duration
+		if err := c.client.PExpire(ctx, key, r.Duration).Err(); err != nil {
+			return nil, errors.Wrapf(err, "failed to reconcile the expiration of key %v", key)
 		}
 	} else {
 		ttlDuration = d
 	}
 
-	expiresAt := c.now().Add(ttlDuration)
+	expiresAt := r.now(c.now).Add(ttlDuration)
+	// the window started when the key was created, a full duration before it expires
+	windowStart := expiresAt.Add(-r.Duration)
 
 	if total, err := getResult.Uint64(); err != nil && errors.Is(err, redis.Nil) {
 
-	} else if total >= r.Limit {
+	} else if total+r.cost() > r.Limit {
 		return &Result{
 			State:         Deny,
 			TotalRequests: total,
 			ExpiresAt:     expiresAt,
+			Reason:        ReasonGuardRejected,
+			WindowStart:   windowStart,
+			WindowEnd:     expiresAt,
 		}, nil
 	}
 
-	incrResult := c.client.Incr(ctx, r.Key)
+	nonce := r.Nonce
+	if nonce == "" {
+		nonce = uuid.New().String()
+	}
+
+	nonceExpiration := nonceTTL
+	if r.Duration < nonceExpiration {
+		nonceExpiration = r.Duration
+	}
 
-	totalRequests, err := incrResult.Uint64()
+	// another request for the same key could have incremented the counter between our GET and here, so the
+	// script checks the limit again before incrementing. if that pushed us over the limit this request is denied
+	// without being counted, so `TotalRequests` is the same as on the GET path above.
+	result, err := int64s(incrementScript.Run(ctx, c.client, []string{key, c.nonceKey(key, nonce)},
+		r.Limit,
+		nonceExpiration.Milliseconds(),
+		r.cost(),
+	))
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to increment key %v", r.Key)
+		return nil, errors.Wrapf(err, "failed to increment key %v", key)
 	}
 
-	if totalRequests > r.Limit {
+	totalRequests := uint64(result[0])
+
+	if result[1] != 1 {
 		return &Result{
 			State:         Deny,
 			TotalRequests: totalRequests,
 			ExpiresAt:     expiresAt,
+			Reason:        ReasonOverLimit,
+			WindowStart:   windowStart,
+			WindowEnd:     expiresAt,
 		}, nil
 	}
 
@@ -97,5 +243,111 @@ func (c *counterStrategy) Run(ctx context.Context, r *Request) (*Result, error)
 		State:         Allow,
 		TotalRequests: totalRequests,
 		ExpiresAt:     expiresAt,
+		Reason:        ReasonUnderLimit,
+		WindowStart:   windowStart,
+		WindowEnd:     expiresAt,
 	}, nil
 }
+
+// KeyFor returns the counter key, the key that remembers the nonce when the request has one and the denied counter
+// key when it is enabled.
+func (c *counterStrategy) KeyFor(r *Request) []string {
+	key := r.redisKey()
+	if r.Nonce == "" {
+		return append([]string{key}, c.options.keys(r)...)
+	}
+
+	return append([]string{key, c.nonceKey(key, r.Nonce)}, c.options.keys(r)...)
+}
+
+// Refund decrements the counter by the cost of a request that was allowed, so the request must have the same `Cost`
+// it had when it was run. The counter doesn't know which window the request was counted in, so if the key expired
+// between the request and the refund the refund goes to the new window. The nonce is what tells if the request was
+// already refunded, so refunds made after the nonce was forgotten (10 seconds after the request, or its `Duration` if
+// that's shorter) do nothing, like refunds of requests that were denied.
+func (c *counterStrategy) Refund(ctx context.Context, r *Request) error {
+	key := r.redisKey()
+
+	if err := refundScript.Run(ctx, c.client, []string{key, c.nonceKey(key, r.Nonce)}, r.cost()).Err(); err != nil {
+		return errors.Wrapf(err, "failed to refund request %v for key %v", r.Nonce, key)
+	}
+
+	return nil
+}
+
+// Commit settles a request that reserved its `Cost` by moving the counter by the difference to `actualCost`. Like
+// refunds, the counter doesn't know which window the request was counted in, so the difference goes to the current
+// window if the key expired and was created again.
+func (c *counterStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	key := r.redisKey()
+
+	if err := commitScript.Run(ctx, c.client, []string{key}, actualCost, r.cost()).Err(); err != nil {
+		return errors.Wrapf(err, "failed to commit request %v for key %v", r.Nonce, key)
+	}
+
+	return nil
+}
+
+// TryConsume takes as many of the `n` units as fit under the limit for the key in a single atomic step, the limit
+// and duration are the ones from WithDefaultLimit, as there is no `Request` to take them from. The result is
+// `Allow` if anything was taken (with ReasonPartial if it wasn't all of it) and `Deny` if nothing was.
+func (c *counterStrategy) TryConsume(ctx context.Context, key string, n uint64) (uint64, *Result, error) {
+	r := c.options.request(&Request{Key: key})
+
+	if r.Limit == 0 || r.Duration < time.Millisecond {
+		return 0, nil, errors.Errorf("consuming from key %v needs a default limit and duration, see WithDefaultLimit", key)
+	}
+
+	values, err := int64s(consumeScript.Run(ctx, c.client, []string{key}, r.Limit, n, r.Duration.Milliseconds()))
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to consume %v from key %v", n, key)
+	}
+
+	granted := uint64(values[0])
+
+	// the key doesn't exist if nothing was ever taken from it
+	ttl := r.Duration
+	if values[2] > 0 {
+		ttl = time.Duration(values[2]) * time.Millisecond
+	}
+
+	expiresAt := r.now(c.now).Add(ttl)
+
+	result := &Result{
+		State:         Allow,
+		TotalRequests: uint64(values[1]),
+		ExpiresAt:     expiresAt,
+		Reason:        ReasonUnderLimit,
+		WindowStart:   expiresAt.Add(-r.Duration),
+		WindowEnd:     expiresAt,
+	}
+
+	switch {
+	case granted == 0 && n > 0:
+		result.State = Deny
+		result.Reason = ReasonGuardRejected
+	case granted < n:
+		result.Reason = ReasonPartial
+	}
+
+	return granted, result, nil
+}
+
+// Close closes the client the strategy created for WithDB, it does nothing if the strategy runs on the client it
+// was created with.
+func (c *counterStrategy) Close() error {
+	return c.options.close()
+}
+
+func (c *counterStrategy) nonceKey(key string, nonce string) string {
+	return key + ":nonce:" + nonce
+}
+
+// Decay decrements the counter by `by` (or down to zero if it's smaller than that), the window is not changed.
+func (c *counterStrategy) Decay(ctx context.Context, key string, by uint64) error {
+	if err := decayScript.Run(ctx, c.client, []string{key}, by).Err(); err != nil {
+		return errors.Wrapf(err, "failed to decay key %v", key)
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -30,6 +31,9 @@ func TestCounterStrategy_Run(t *testing.T) {
 				State:         Allow,
 				TotalRequests: 50,
 				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
 			},
 			runs: 50,
 		},
@@ -44,9 +48,46 @@ func TestCounterStrategy_Run(t *testing.T) {
 				State:         Deny,
 				TotalRequests: 100,
 				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonGuardRejected,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
 			},
 			runs: 101,
 		},
+		{
+			name: "returns Allow with 99 total requests at 99 runs",
+			request: &Request{
+				Key:      "some-user",
+				Limit:    100,
+				Duration: time.Minute,
+			},
+			lastResult: &Result{
+				State:         Allow,
+				TotalRequests: 99,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+			},
+			runs: 99,
+		},
+		{
+			name: "returns Allow with 100 total requests at 100 runs",
+			request: &Request{
+				Key:      "some-user",
+				Limit:    100,
+				Duration: time.Minute,
+			},
+			lastResult: &Result{
+				State:         Allow,
+				TotalRequests: 100,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+			},
+			runs: 100,
+		},
 		{
 			name: "expires and starts again as it goes over the TTL",
 			request: &Request{
@@ -58,6 +99,9 @@ func TestCounterStrategy_Run(t *testing.T) {
 				State:         Allow,
 				TotalRequests: 39,
 				ExpiresAt:     time.Date(2020, time.March, 25, 10, 17, 32, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 16, 32, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 17, 32, 0, time.UTC),
 			},
 			runs:    100,
 			advance: time.Second,
@@ -101,3 +145,670 @@ func TestCounterStrategy_Run(t *testing.T) {
 		})
 	}
 }
+
+func TestCounterStrategy_RunWithLimitReachedAfterGuard(t *testing.T) {
+	primary, err := miniredis.Run()
+	require.NoError(t, err)
+	defer primary.Close()
+
+	replica, err := miniredis.Run()
+	require.NoError(t, err)
+	defer replica.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: primary.Addr(),
+	})
+	defer client.Close()
+
+	reader := redis.NewClient(&redis.Options{
+		Addr: replica.Addr(),
+	})
+	defer reader.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	// the replica hasn't seen the requests that filled the key yet, so the GET guard lets the request through and
+	// it's the script that finds the key at the limit
+	require.NoError(t, primary.Set("some-user", "100"))
+	primary.SetTTL("some-user", time.Minute)
+
+	counter := NewCounterStrategy(client, func() time.Time {
+		return now
+	}, WithReadClient(reader))
+
+	result, err := counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    100,
+		Duration: time.Minute,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, &Result{
+		State:         Deny,
+		TotalRequests: 100,
+		ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+		Reason:        ReasonOverLimit,
+		WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+		WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+	}, result)
+
+	// the request was denied without being counted
+	total, err := primary.Get("some-user")
+	require.NoError(t, err)
+	assert.Equal(t, "100", total)
+}
+
+func TestCounterStrategy_RunWithNonce(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewCounterStrategy(client, time.Now)
+
+	request := &Request{
+		Key:      "some-user",
+		Limit:    100,
+		Duration: time.Minute,
+		Nonce:    "request-1",
+	}
+
+	// replaying the same request must not count it again
+	for x := 0; x < 3; x++ {
+		result, err := counter.Run(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), result.TotalRequests)
+	}
+
+	request.Nonce = "request-2"
+
+	result, err := counter.Run(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), result.TotalRequests)
+}
+
+func TestCounterStrategy_RunSubSecondDuration(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	counter := NewCounterStrategy(client, func() time.Time {
+		return now
+	})
+
+	request := &Request{
+		Key:      "some-user",
+		Limit:    2,
+		Duration: 200 * time.Millisecond,
+	}
+
+	for x := 0; x < 3; x++ {
+		_, err := counter.Run(context.Background(), request)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 200*time.Millisecond, server.TTL("some-user"))
+
+	server.FastForward(150 * time.Millisecond)
+	now = now.Add(150 * time.Millisecond)
+
+	result, err := counter.Run(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, State(Deny), result.State)
+	assert.Equal(t, time.Date(2020, 3, 25, 10, 15, 30, int(200*time.Millisecond), time.UTC), result.ExpiresAt)
+
+	server.FastForward(50 * time.Millisecond)
+	now = now.Add(50 * time.Millisecond)
+
+	// the window is over, so the key is gone and counting starts again
+	result, err = counter.Run(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, State(Allow), result.State)
+	assert.Equal(t, uint64(1), result.TotalRequests)
+
+	_, err = counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    2,
+		Duration: 500 * time.Microsecond,
+	})
+	assert.EqualError(t, err, "the duration 500µs for key some-user must be at least 1ms")
+}
+
+func TestCounterStrategy_RunWithCost(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewCounterStrategy(client, time.Now)
+
+	type outcome struct {
+		State         State
+		TotalRequests uint64
+	}
+
+	outcomes := make([]outcome, 0, 4)
+
+	for x, cost := range []uint64{400, 400, 300, 200} {
+		result, err := counter.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    1000,
+			Duration: time.Minute,
+			Cost:     cost,
+			Nonce:    "request-" + strconv.Itoa(x),
+		})
+		require.NoError(t, err)
+		outcomes = append(outcomes, outcome{State: result.State, TotalRequests: result.TotalRequests})
+	}
+
+	assert.Equal(t, []outcome{
+		{State: Allow, TotalRequests: 400},
+		{State: Allow, TotalRequests: 800},
+		{State: Deny, TotalRequests: 800},
+		{State: Allow, TotalRequests: 1000},
+	}, outcomes)
+
+	// refunding gives back the whole cost of the request
+	require.NoError(t, counter.Refund(context.Background(), &Request{
+		Key:   "some-user",
+		Cost:  400,
+		Nonce: "request-0",
+	}))
+
+	total, err := server.Get("some-user")
+	require.NoError(t, err)
+	assert.Equal(t, "600", total)
+
+	// refunding the same request again or a request that was denied gives nothing back
+	for _, nonce := range []string{"request-0", "request-2"} {
+		require.NoError(t, counter.Refund(context.Background(), &Request{
+			Key:   "some-user",
+			Cost:  400,
+			Nonce: nonce,
+		}))
+	}
+
+	total, err = server.Get("some-user")
+	require.NoError(t, err)
+	assert.Equal(t, "600", total)
+}
+
+func TestCounterStrategy_Decay(t *testing.T) {
+	tt := []struct {
+		name  string
+		runs  int
+		by    uint64
+		total uint64
+	}{
+		{
+			name:  "decrements the counter",
+			runs:  10,
+			by:    4,
+			total: 7,
+		},
+		{
+			name:  "never goes below zero",
+			runs:  3,
+			by:    10,
+			total: 1,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			counter := NewCounterStrategy(client, time.Now)
+			request := &Request{
+				Key:      "some-user",
+				Limit:    100,
+				Duration: time.Minute,
+			}
+
+			for x := 0; x < ts.runs; x++ {
+				_, err := counter.Run(context.Background(), request)
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, counter.Decay(context.Background(), request.Key, ts.by))
+
+			result, err := counter.Run(context.Background(), request)
+			require.NoError(t, err)
+			assert.Equal(t, ts.total, result.TotalRequests)
+		})
+	}
+}
+
+func TestCounterStrategy_RunWithAction(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewCounterStrategy(client, time.Now)
+
+	for x := 0; x < 5; x++ {
+		_, err := counter.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    5,
+			Duration: time.Hour,
+			Action:   "password-reset",
+		})
+		require.NoError(t, err)
+	}
+
+	// the same key without an action has its own counter
+	result, err := counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    100,
+		Duration: time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), result.TotalRequests)
+
+	result, err = counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    5,
+		Duration: time.Hour,
+		Action:   "password-reset",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Deny, result.State)
+	assert.True(t, server.Exists("some-user:a:password-reset"))
+}
+
+func TestCounterStrategy_RunWithDefaultLimit(t *testing.T) {
+	tt := []struct {
+		name     string
+		request  Request
+		states   []State
+		duration time.Duration
+	}{
+		{
+			name:     "uses the defaults for requests without limits",
+			request:  Request{Key: "some-user"},
+			states:   []State{Allow, Allow, Deny},
+			duration: time.Minute,
+		},
+		{
+			name:     "uses the request limit when set",
+			request:  Request{Key: "some-user", Limit: 3},
+			states:   []State{Allow, Allow, Allow},
+			duration: time.Minute,
+		},
+		{
+			name:     "uses the request duration when set",
+			request:  Request{Key: "some-user", Duration: time.Hour},
+			states:   []State{Allow, Allow, Deny},
+			duration: time.Hour,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			counter := NewCounterStrategy(client, func() time.Time {
+				return now
+			}, WithDefaultLimit(2, time.Minute))
+
+			states := make([]State, 0, len(ts.states))
+
+			for range ts.states {
+				request := ts.request
+				result, err := counter.Run(context.Background(), &request)
+				require.NoError(t, err)
+
+				states = append(states, result.State)
+				assert.Equal(t, now.Add(ts.duration), result.ExpiresAt)
+				assert.Equal(t, ts.request, request)
+			}
+
+			assert.Equal(t, ts.states, states)
+		})
+	}
+}
+
+func TestCounterStrategy_RunWithChangedDuration(t *testing.T) {
+	tt := []struct {
+		name      string
+		opts      []StrategyOption
+		durations []time.Duration
+		ttl       time.Duration
+	}{
+		{
+			name:      "keeps the longer TTL of existing keys by default",
+			durations: []time.Duration{5 * time.Minute, 5 * time.Minute, time.Minute},
+			ttl:       5 * time.Minute,
+		},
+		{
+			name:      "cuts the longer TTL of existing keys when reconciling",
+			opts:      []StrategyOption{WithReconciledTTL()},
+			durations: []time.Duration{5 * time.Minute, 5 * time.Minute, time.Minute},
+			ttl:       time.Minute,
+		},
+		{
+			name:      "keeps the shorter TTL of existing keys by default",
+			durations: []time.Duration{time.Minute, time.Minute, 5 * time.Minute},
+			ttl:       time.Minute,
+		},
+		{
+			name:      "keeps the shorter TTL of existing keys when reconciling",
+			opts:      []StrategyOption{WithReconciledTTL()},
+			durations: []time.Duration{time.Minute, time.Minute, 5 * time.Minute},
+			ttl:       time.Minute,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			counter := NewCounterStrategy(client, func() time.Time {
+				return now
+			}, ts.opts...)
+
+			var result *Result
+
+			// the TTL is only set once the key exists, so the first duration is used twice
+			for _, duration := range ts.durations {
+				result, err = counter.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    10,
+					Duration: duration,
+				})
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, now.Add(ts.ttl), result.ExpiresAt)
+			assert.Equal(t, ts.ttl, server.TTL("some-user"))
+			assert.Equal(t, uint64(3), result.TotalRequests)
+		})
+	}
+}
+
+func TestCounterStrategy_RunWithDB(t *testing.T) {
+	tt := []struct {
+		name     string
+		clientDB int
+		opts     []StrategyOption
+		db       int
+	}{
+		{
+			name:     "runs on the database of the client",
+			clientDB: 2,
+			db:       2,
+		},
+		{
+			name:     "runs on the database set with the option",
+			clientDB: 0,
+			opts:     []StrategyOption{WithDB(3)},
+			db:       3,
+		},
+		{
+			name:     "reuses the client already on the database",
+			clientDB: 3,
+			opts:     []StrategyOption{WithDB(3)},
+			db:       3,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+				DB:   ts.clientDB,
+			})
+			defer client.Close()
+
+			counter := NewCounterStrategy(client, time.Now, ts.opts...)
+
+			for x := 0; x < 2; x++ {
+				_, err := counter.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    10,
+					Duration: time.Minute,
+				})
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, ts.db, counter.client.Options().DB)
+			assert.Equal(t, ts.db, counter.options.reader.(*redis.Client).Options().DB)
+
+			for db := 0; db < 4; db++ {
+				if db == ts.db {
+					assert.Contains(t, server.DB(db).Keys(), "some-user", "db %v", db)
+				} else {
+					assert.Empty(t, server.DB(db).Keys(), "db %v", db)
+				}
+			}
+
+			// the application keeps using its client on its own database
+			require.NoError(t, client.Set(context.Background(), "app-key", "1", 0).Err())
+			assert.Contains(t, server.DB(ts.clientDB).Keys(), "app-key")
+
+			// closing the strategy only closes the client it created
+			require.NoError(t, counter.Close())
+			assert.NoError(t, client.Ping(context.Background()).Err())
+			assert.Equal(t, ts.clientDB != ts.db, counter.client.Ping(context.Background()).Err() == redis.ErrClosed)
+		})
+	}
+}
+
+func TestCounterStrategy_RunWithDeniedCounter(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewCounterStrategy(client, time.Now, WithDeniedCounter(time.Minute))
+
+	request := func() *Result {
+		result, err := counter.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    1,
+			Duration: time.Hour,
+		})
+		require.NoError(t, err)
+		return result
+	}
+
+	counts := make([]uint64, 0, 4)
+	for x := 0; x < 3; x++ {
+		counts = append(counts, request().DeniedCount)
+	}
+
+	assert.Equal(t, []uint64{0, 1, 2}, counts)
+	assert.Equal(t, time.Minute, server.TTL("some-user:denied"))
+
+	// the denied counter expires on its own, while the client is still over the limit
+	server.FastForward(2 * time.Minute)
+
+	result := request()
+	assert.Equal(t, State(Deny), result.State)
+	assert.Equal(t, uint64(1), result.DeniedCount)
+}
+
+func TestCounterStrategy_Commit(t *testing.T) {
+	tt := []struct {
+		name     string
+		actual   uint64
+		expire   bool
+		expected string
+	}{
+		{
+			name:     "gives back the difference when the actual cost is smaller",
+			actual:   2,
+			expected: "3",
+		},
+		{
+			name:     "keeps the count when the actual cost is the reserved one",
+			actual:   5,
+			expected: "6",
+		},
+		{
+			name:     "consumes more when the actual cost is larger",
+			actual:   12,
+			expected: "13",
+		},
+		{
+			name:     "gives back everything for a zero cost",
+			actual:   0,
+			expected: "1",
+		},
+		{
+			name:   "does nothing once the window is over",
+			actual: 2,
+			expire: true,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			counter := NewCounterStrategy(client, time.Now)
+
+			run := func(r *Request) {
+				result, err := counter.Run(context.Background(), r)
+				require.NoError(t, err)
+				require.Equal(t, State(Allow), result.State)
+			}
+
+			run(&Request{Key: "some-user", Limit: 10, Duration: time.Minute})
+
+			reserved := &Request{
+				Key:      "some-user",
+				Limit:    10,
+				Duration: time.Minute,
+				Cost:     5,
+				Nonce:    "request-1",
+			}
+			run(reserved)
+
+			if ts.expire {
+				server.FastForward(time.Minute)
+			}
+
+			require.NoError(t, counter.Commit(context.Background(), reserved, ts.actual))
+
+			if ts.expected == "" {
+				assert.False(t, server.Exists("some-user"))
+				return
+			}
+
+			value, err := server.Get("some-user")
+			require.NoError(t, err)
+			assert.Equal(t, ts.expected, value)
+		})
+	}
+}
+
+func TestCounterStrategy_TryConsume(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	counter := NewCounterStrategy(client, func() time.Time {
+		return now
+	}, WithDefaultLimit(50, time.Minute))
+
+	tt := []struct {
+		n       uint64
+		allowed uint64
+		total   uint64
+		state   State
+		reason  Reason
+	}{
+		{n: 20, allowed: 20, total: 20, state: Allow, reason: ReasonUnderLimit},
+		{n: 20, allowed: 20, total: 40, state: Allow, reason: ReasonUnderLimit},
+		{n: 20, allowed: 10, total: 50, state: Allow, reason: ReasonPartial},
+		{n: 20, allowed: 0, total: 50, state: Deny, reason: ReasonGuardRejected},
+	}
+
+	for _, ts := range tt {
+		allowed, result, err := counter.TryConsume(context.Background(), "some-user", ts.n)
+		require.NoError(t, err)
+
+		assert.Equal(t, ts.allowed, allowed)
+		assert.Equal(t, &Result{
+			State:         ts.state,
+			TotalRequests: ts.total,
+			ExpiresAt:     now.Add(time.Minute),
+			Reason:        ts.reason,
+			WindowStart:   now,
+			WindowEnd:     now.Add(time.Minute),
+		}, result)
+	}
+
+	assert.Equal(t, time.Minute, server.TTL("some-user"))
+
+	_, _, err = NewCounterStrategy(client, time.Now).TryConsume(context.Background(), "some-user", 1)
+	assert.EqualError(t, err, "consuming from key some-user needs a default limit and duration, see WithDefaultLimit")
+}
@@ -0,0 +1,112 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	_ Strategy  = &debounceStrategy{}
+	_ Pipelined = &debounceStrategy{}
+	_ KeyNamer  = &debounceStrategy{}
+)
+
+// NewDebounceStrategy creates a strategy that allows at most one request every `Request.Duration` for a key, the
+// `Request.Limit` is ignored. This is the usual "cooldown" pattern, like only allowing a password reset email to be
+// sent once a minute.
+func NewDebounceStrategy(client *redis.Client, now func() time.Time) Strategy {
+	return &debounceStrategy{
+		client: client,
+		now:    now,
+	}
+}
+
+type debounceStrategy struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+// Run this implementation uses a single key with a TTL of `Duration`, if we can create the key the request is allowed
+// and if it already exists the client is still in the cooldown period. `SET NX` makes the check and the write
+// atomic and the TTL of the key tells us how long until the client can try again.
+func (d *debounceStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	p := d.client.Pipeline()
+	interpret := d.RunPipelined(ctx, p, r)
+
+	if _, err := p.Exec(ctx); err != nil {
+		if _, cmdErr := interpret(); cmdErr != nil {
+			return nil, cmdErr
+		}
+
+		return nil, errors.Wrapf(err, "failed to execute debounce pipeline for key: %v", r.redisKey())
+	}
+
+	return interpret()
+}
+
+// RunPipelined adds the SET NX and PTTL to the pipeline, this is exactly what `Run` does.
+func (d *debounceStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	key := r.redisKey()
+
+	// TTLs are set in milliseconds, anything shorter would create a key without an expiration
+	if r.Duration < time.Millisecond {
+		return func() (*Result, error) {
+			return nil, errors.Errorf("the duration %v for key %v must be at least 1ms", r.Duration, key)
+		}
+	}
+
+	set := p.SetNX(ctx, key, 1, r.Duration)
+	ttl := p.PTTL(ctx, key)
+	now := r.now(d.now)
+
+	return func() (*Result, error) {
+		if err := commandError(key, set, ttl); err != nil {
+			return nil, err
+		}
+
+		if set.Val() {
+			return &Result{
+				State:         Allow,
+				TotalRequests: 1,
+				ExpiresAt:     now.Add(r.Duration),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   now,
+				WindowEnd:     now.Add(r.Duration),
+			}, nil
+		}
+
+		// keys are always created with a TTL, if there isn't one something else wrote to the key and we
+		// don't want to block the client forever, so the cooldown starts now. The pipeline has already run,
+		// so the repair is a command of its own.
+		remaining := ttl.Val()
+		if remaining < 0 {
+			remaining = r.Duration
+			if err := d.client.PExpire(ctx, key, r.Duration).Err(); err != nil {
+				return nil, errors.Wrapf(err, "failed to set an expiration to key %v", key)
+			}
+		}
+
+		// the cooldown started a full duration before it ends
+		expiresAt := now.Add(remaining)
+
+		return &Result{
+			State:         Deny,
+			TotalRequests: 1,
+			ExpiresAt:     expiresAt,
+			Reason:        ReasonCooldown,
+			WindowStart:   expiresAt.Add(-r.Duration),
+			WindowEnd:     expiresAt,
+		}, nil
+	}
+}
+
+func (d *debounceStrategy) pipeline() redis.Pipeliner {
+	return d.client.Pipeline()
+}
+
+// KeyFor returns the cooldown key.
+func (d *debounceStrategy) KeyFor(r *Request) []string {
+	return []string{r.redisKey()}
+}
@@ -0,0 +1,186 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDebounceStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name       string
+		runs       int64
+		lastResult *Result
+		advance    time.Duration
+	}{
+		{
+			name: "returns Allow for the first request",
+			lastResult: &Result{
+				State:         Allow,
+				TotalRequests: 1,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+			},
+			runs: 1,
+		},
+		{
+			name: "returns Deny with the remaining cooldown",
+			lastResult: &Result{
+				State:         Deny,
+				TotalRequests: 1,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonCooldown,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+			},
+			runs:    3,
+			advance: 20 * time.Second,
+		},
+		{
+			name: "returns Allow once the cooldown is over",
+			lastResult: &Result{
+				State:         Allow,
+				TotalRequests: 1,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 17, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 17, 30, 0, time.UTC),
+			},
+			runs:    4,
+			advance: 20 * time.Second,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			strategy := NewDebounceStrategy(client, func() time.Time {
+				return now
+			})
+
+			var lastResult *Result
+
+			for x := int64(0); x < ts.runs; x++ {
+				if x > 0 {
+					server.FastForward(ts.advance)
+					now = now.Add(ts.advance)
+				}
+
+				lastResult, err = strategy.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    1,
+					Duration: time.Minute,
+				})
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, ts.lastResult, lastResult)
+		})
+	}
+}
+
+func TestDebounceStrategy_RunWithoutExpiration(t *testing.T) {
+	tt := []struct {
+		name      string
+		pipelined bool
+	}{
+		{name: "sets the expiration on run"},
+		{name: "sets the expiration on pipelined runs", pipelined: true},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			strategy := NewDebounceStrategy(client, func() time.Time {
+				return now
+			})
+
+			// something else wrote the key without a TTL
+			require.NoError(t, server.Set("some-user", "1"))
+
+			request := &Request{Key: "some-user", Duration: time.Minute}
+
+			var result *Result
+
+			if ts.pipelined {
+				p := client.Pipeline()
+				interpret := strategy.(Pipelined).RunPipelined(context.Background(), p, request)
+				_, err = p.Exec(context.Background())
+				require.NoError(t, err)
+
+				result, err = interpret()
+			} else {
+				result, err = strategy.Run(context.Background(), request)
+			}
+			require.NoError(t, err)
+
+			// the cooldown starts now instead of blocking the client forever
+			assert.Equal(t, &Result{
+				State:         Deny,
+				TotalRequests: 1,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonCooldown,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+			}, result)
+			assert.Equal(t, time.Minute, server.TTL("some-user"))
+		})
+	}
+}
+
+func TestDebounceStrategy_RunWithShortDuration(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewDebounceStrategy(client, time.Now)
+	request := &Request{
+		Key:      "some-user",
+		Duration: time.Microsecond,
+	}
+
+	_, err = strategy.Run(context.Background(), request)
+	assert.EqualError(t, err, "the duration 1µs for key some-user must be at least 1ms")
+
+	p := client.Pipeline()
+	interpret := strategy.(Pipelined).RunPipelined(context.Background(), p, request)
+	_, err = p.Exec(context.Background())
+	require.NoError(t, err)
+
+	_, err = interpret()
+	assert.EqualError(t, err, "the duration 1µs for key some-user must be at least 1ms")
+
+	// the client isn't debounced forever by a key without an expiration
+	assert.Empty(t, server.Keys())
+}
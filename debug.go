@@ -0,0 +1,123 @@
+package redis_rate_limiter
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DebugErrorWindow is how far back errors count as recent on the DebugState.
+	DebugErrorWindow = time.Minute
+	// maxRecentErrors caps how many error times are kept, past it the recent error count stops growing.
+	maxRecentErrors = 1000
+)
+
+// Debuggable is implemented by the handler created by NewHTTPRateLimiterHandler, type assert it to get its state.
+type Debuggable interface {
+	DebugState() *DebugState
+}
+
+// DebugState is a snapshot of the in process state of a handler, meant to be served from an internal debug
+// endpoint. Building it never touches Redis.
+type DebugState struct {
+	// Limits has the main limit (with an empty name) followed by the extra limits.
+	Limits      []LimitSummary `json:"limits"`
+	FailureMode FailureMode    `json:"failure_mode"`
+	// Enabled is false when the kill switch turned rate limiting off.
+	Enabled bool `json:"enabled"`
+	// Degraded is true when the handler fails open and the strategy failed within the DebugErrorWindow, which means
+	// requests are (at least partly) going through without being rate limited.
+	Degraded bool `json:"degraded"`
+	// RecentErrors is how many times the strategy failed within the DebugErrorWindow.
+	RecentErrors int `json:"recent_errors"`
+	// LastError is the last error returned by the strategy and LastErrorAt when it happened, both are empty if it
+	// never failed.
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// CacheSize is how many entries the strategy has in memory, for strategies with a cache (like
+	// NewNegativeCacheStrategy), zero for the others.
+	CacheSize int `json:"cache_size"`
+}
+
+// LimitSummary describes one of the limits of the handler.
+type LimitSummary struct {
+	Name        string        `json:"name"`
+	MaxRequests uint64        `json:"max_requests"`
+	Expiration  time.Duration `json:"expiration"`
+}
+
+// DebugState returns a snapshot of the state of the handler.
+func (h *httpRateLimiterHandler) DebugState() *DebugState {
+	now := h.now()
+	recent, last, lastAt := h.errors.snapshot(now)
+
+	state := &DebugState{
+		Limits:       make([]LimitSummary, 0, len(h.limits)),
+		FailureMode:  h.config.FailureMode,
+		Enabled:      h.config.KillSwitch == nil || h.config.KillSwitch.Enabled(),
+		Degraded:     h.config.FailureMode == FailOpen && recent > 0,
+		RecentErrors: recent,
+		LastError:    last,
+	}
+
+	if !lastAt.IsZero() {
+		state.LastErrorAt = &lastAt
+	}
+
+	for _, limit := range h.limits {
+		state.Limits = append(state.Limits, LimitSummary{
+			Name:        limit.Name,
+			MaxRequests: limit.MaxRequests,
+			Expiration:  limit.Expiration,
+		})
+	}
+
+	if cache, ok := h.config.Strategy.(interface{ Len() int }); ok {
+		state.CacheSize = cache.Len()
+	}
+
+	return state
+}
+
+// errorTracker keeps the times of the recent strategy errors and the last one.
+type errorTracker struct {
+	mutex  sync.Mutex
+	times  []time.Time
+	last   string
+	lastAt time.Time
+}
+
+func (e *errorTracker) record(now time.Time, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.prune(now)
+
+	if len(e.times) < maxRecentErrors {
+		e.times = append(e.times, now)
+	}
+
+	e.last = err.Error()
+	e.lastAt = now
+}
+
+func (e *errorTracker) snapshot(now time.Time) (int, string, time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.prune(now)
+
+	return len(e.times), e.last, e.lastAt
+}
+
+// prune drops the errors older than the DebugErrorWindow, times are kept in order so they're all at the start.
+func (e *errorTracker) prune(now time.Time) {
+	cutoff := now.Add(-DebugErrorWindow)
+
+	x := 0
+	for x < len(e.times) && e.times[x].Before(cutoff) {
+		x++
+	}
+
+	e.times = e.times[x:]
+}
@@ -0,0 +1,106 @@
+package redis_rate_limiter
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPRateLimiterHandler_DebugState(t *testing.T) {
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	killSwitch := NewKillSwitch()
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}, &RateLimiterConfig{
+		Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:    &failingStrategy{},
+		Expiration:  time.Minute,
+		MaxRequests: 10,
+		FailureMode: FailOpen,
+		KillSwitch:  killSwitch,
+		Limits: []LimitConfig{
+			{Name: "user", Extractor: NewHTTPHeadersExtractor("X-User"), Expiration: time.Hour, MaxRequests: 100},
+		},
+	})
+	wrapper.(*httpRateLimiterHandler).now = func() time.Time {
+		return now
+	}
+
+	debuggable := wrapper.(Debuggable)
+
+	assert.Equal(t, &DebugState{
+		Limits: []LimitSummary{
+			{MaxRequests: 10, Expiration: time.Minute},
+			{Name: "user", MaxRequests: 100, Expiration: time.Hour},
+		},
+		FailureMode: FailOpen,
+		Enabled:     true,
+	}, debuggable.DebugState())
+
+	// a handler that never failed has no error fields at all
+	encoded, err := json.Marshal(debuggable.DebugState())
+	require.NoError(t, err)
+	assert.NotContains(t, string(encoded), "last_error")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+	req.Header.Set(forwardedFor, "10.10.10.10")
+	req.Header.Set("X-User", "some-user")
+
+	w := httptest.NewRecorder()
+	wrapper.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	state := debuggable.DebugState()
+	assert.True(t, state.Degraded)
+	assert.Equal(t, 2, state.RecentErrors)
+	assert.Equal(t, "i/o timeout", state.LastError)
+	require.NotNil(t, state.LastErrorAt)
+	assert.Equal(t, now, *state.LastErrorAt)
+
+	// errors stop being recent once they're older than the window
+	now = now.Add(DebugErrorWindow + time.Second)
+	killSwitch.SetEnabled(false)
+
+	state = debuggable.DebugState()
+	assert.False(t, state.Degraded)
+	assert.False(t, state.Enabled)
+	assert.Equal(t, 0, state.RecentErrors)
+	assert.Equal(t, "i/o timeout", state.LastError)
+}
+
+func TestHTTPRateLimiterHandler_DebugStateCacheSize(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}, &RateLimiterConfig{
+		Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:    NewNegativeCacheStrategy(NewCounterStrategy(client, time.Now), time.Now, 0.5, 100),
+		Expiration:  time.Minute,
+		MaxRequests: 1,
+	})
+
+	for _, ip := range []string{"10.10.10.10", "10.10.10.10", "10.10.10.11"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		req.Header.Set(forwardedFor, ip)
+
+		wrapper.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 1, wrapper.(Debuggable).DebugState().CacheSize)
+}
@@ -0,0 +1,109 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ Strategy  = &DecisionStreamStrategy{}
+	_ KeyNamer  = &DecisionStreamStrategy{}
+	_ Refunder  = &DecisionStreamStrategy{}
+	_ Committer = &DecisionStreamStrategy{}
+	_ Pipelined = &DecisionStreamStrategy{}
+)
+
+// Decision is a result sent by a DecisionStreamStrategy, with the key it was made for and when.
+type Decision struct {
+	Key    string
+	Action string
+	At     time.Time
+	Result *Result
+}
+
+// NewDecisionStreamStrategy creates a strategy that makes decisions with `inner` and sends every one of them to
+// `decisions`, like to drive a live view of allowed and denied requests. Sends never block, decisions are dropped
+// when the channel is full, so give it a buffer large enough for the consumer to keep up. Calls that failed on the
+// inner strategy are not sent. The channel belongs to the caller, the strategy never closes it. Unlike the
+// TeeStrategy there is no goroutine involved, the consumer reads from the channel at its own pace.
+func NewDecisionStreamStrategy(inner Strategy, decisions chan<- Decision) *DecisionStreamStrategy {
+	return &DecisionStreamStrategy{
+		inner:     inner,
+		decisions: decisions,
+		now:       time.Now,
+	}
+}
+
+// DecisionStreamStrategy is the strategy created by NewDecisionStreamStrategy.
+type DecisionStreamStrategy struct {
+	inner     Strategy
+	decisions chan<- Decision
+	now       func() time.Time
+	dropped   uint64
+}
+
+// Run returns whatever the inner strategy returns and sends the decision if there's room in the channel.
+func (s *DecisionStreamStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	result, err := s.inner.Run(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.send(r, result)
+
+	return result, nil
+}
+
+// RunPipelined is the same as Run, the decision is sent once the result is interpreted.
+func (s *DecisionStreamStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	interpret := runPipelined(ctx, s.inner, p, r)
+
+	return func() (*Result, error) {
+		result, err := interpret()
+		if err != nil {
+			return nil, err
+		}
+
+		s.send(r, result)
+
+		return result, nil
+	}
+}
+
+// Refund gives back the request on the inner strategy, no decision is sent for it.
+func (s *DecisionStreamStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, s.inner, r)
+}
+
+// Commit settles the request on the inner strategy, no decision is sent for it.
+func (s *DecisionStreamStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, s.inner, r, actualCost)
+}
+
+// KeyFor returns the keys of the inner strategy.
+func (s *DecisionStreamStrategy) KeyFor(r *Request) []string {
+	return keysFor(s.inner, r)
+}
+
+// Dropped is how many decisions were not sent because the channel was full.
+func (s *DecisionStreamStrategy) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *DecisionStreamStrategy) unwrap() Strategy {
+	return s.inner
+}
+
+func (s *DecisionStreamStrategy) pipeline() redis.Pipeliner {
+	return pipelineFor(s.inner)
+}
+
+func (s *DecisionStreamStrategy) send(r *Request, result *Result) {
+	select {
+	case s.decisions <- Decision{Key: r.Key, Action: r.Action, At: r.now(s.now), Result: result}:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
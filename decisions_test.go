@@ -0,0 +1,57 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDecisionStreamStrategy_Run(t *testing.T) {
+	decisions := make(chan Decision, 2)
+	strategy := NewDecisionStreamStrategy(NewRecordingStrategy(nil), decisions)
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	strategy.now = func() time.Time {
+		return now
+	}
+
+	at := time.Date(2020, 3, 25, 10, 0, 0, 0, time.UTC)
+
+	for _, r := range []*Request{
+		{Key: "user-a", Action: "login", Limit: 10, Duration: time.Minute},
+		{Key: "user-b", Limit: 10, Duration: time.Minute, At: at},
+		{Key: "user-c", Limit: 10, Duration: time.Minute},
+	} {
+		result, err := strategy.Run(context.Background(), r)
+		require.NoError(t, err)
+		assert.Equal(t, State(Allow), result.State)
+	}
+
+	close(decisions)
+
+	var received []Decision
+	for decision := range decisions {
+		received = append(received, decision)
+	}
+
+	result := &Result{State: Allow, Reason: ReasonUnderLimit}
+
+	// the channel only had room for two, the last decision was dropped instead of blocking
+	assert.Equal(t, []Decision{
+		{Key: "user-a", Action: "login", At: now, Result: result},
+		{Key: "user-b", At: at, Result: result},
+	}, received)
+	assert.Equal(t, uint64(1), strategy.Dropped())
+}
+
+func TestDecisionStreamStrategy_RunWithError(t *testing.T) {
+	decisions := make(chan Decision, 1)
+	strategy := NewDecisionStreamStrategy(&failingStrategy{}, decisions)
+
+	_, err := strategy.Run(context.Background(), &Request{Key: "user-a", Limit: 10, Duration: time.Minute})
+	assert.Error(t, err)
+	assert.Empty(t, decisions)
+	assert.Equal(t, uint64(0), strategy.Dropped())
+}
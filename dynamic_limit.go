@@ -0,0 +1,156 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+var (
+	_ Strategy  = &dynamicLimitStrategy{}
+	_ KeyNamer  = &dynamicLimitStrategy{}
+	_ Refunder  = &dynamicLimitStrategy{}
+	_ Committer = &dynamicLimitStrategy{}
+)
+
+const (
+	// DynamicLimitKeyPrefix is prepended to the request key to build the hash that holds its limits.
+	DynamicLimitKeyPrefix = "rl:config:"
+	// maxDynamicLimitEntries caps how many keys the config cache holds, past it the oldest configs are dropped.
+	maxDynamicLimitEntries = 10000
+	dynamicLimitField      = "limit"
+	dynamicDurationField   = "duration_ms"
+)
+
+// NewDynamicLimitStrategy creates a strategy that reads the limit and duration for every key from Redis before
+// delegating to `inner`, so an admin tool can change a customer's limits live. The config for a key is a hash at
+// `rl:config:<key>` with a `limit` field (the max requests) and a `duration_ms` field (the window in milliseconds),
+// either one can be missing and missing fields (or a missing hash) fall back to the values in the `Request`.
+// Configs are cached in memory for `cacheTTL` so Redis is not read on every request, which also means changes take
+// up to `cacheTTL` to be picked up.
+func NewDynamicLimitStrategy(inner Strategy, client redis.Cmdable, now func() time.Time, cacheTTL time.Duration) Strategy {
+	return &dynamicLimitStrategy{
+		inner:    inner,
+		client:   client,
+		now:      now,
+		cacheTTL: cacheTTL,
+		cache:    newTTLCache(maxDynamicLimitEntries),
+	}
+}
+
+type dynamicLimitStrategy struct {
+	inner    Strategy
+	client   redis.Cmdable
+	now      func() time.Time
+	cacheTTL time.Duration
+	cache    *ttlCache
+}
+
+type dynamicLimitEntry struct {
+	limit    uint64
+	duration time.Duration
+}
+
+// Run overlays the limits found for the key on a copy of the request and runs the inner strategy with it.
+func (d *dynamicLimitStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	request, err := d.request(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.inner.Run(ctx, request)
+}
+
+// Refund gives back the request, with the limits found for the key, on the inner strategy.
+func (d *dynamicLimitStrategy) Refund(ctx context.Context, r *Request) error {
+	request, err := d.request(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	return refund(ctx, d.inner, request)
+}
+
+// Commit settles the request, with the limits found for the key, on the inner strategy.
+func (d *dynamicLimitStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	request, err := d.request(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	return commit(ctx, d.inner, request, actualCost)
+}
+
+// KeyFor returns the config key followed by the keys of the inner strategy. The inner keys are for the request as
+// given, if the inner strategy names keys after the duration (like the fixed window) and the config overrides it
+// the keys used will be different.
+func (d *dynamicLimitStrategy) KeyFor(r *Request) []string {
+	return append([]string{DynamicLimitKeyPrefix + r.Key}, keysFor(d.inner, r)...)
+}
+
+// Len returns how many configs are currently cached, including ones that have expired but were not evicted yet.
+func (d *dynamicLimitStrategy) Len() int {
+	return d.cache.len()
+}
+
+func (d *dynamicLimitStrategy) unwrap() Strategy {
+	return d.inner
+}
+
+// request returns a copy of the request with the limits found for its key.
+func (d *dynamicLimitStrategy) request(ctx context.Context, r *Request) (*Request, error) {
+	entry, err := d.config(ctx, r.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	request := *r
+
+	if entry.limit != 0 {
+		request.Limit = entry.limit
+	}
+
+	if entry.duration != 0 {
+		request.Duration = entry.duration
+	}
+
+	return &request, nil
+}
+
+func (d *dynamicLimitStrategy) config(ctx context.Context, key string) (*dynamicLimitEntry, error) {
+	now := d.now()
+
+	if value, until, ok := d.cache.get(key); ok && now.Before(until) {
+		return value.(*dynamicLimitEntry), nil
+	}
+
+	configKey := DynamicLimitKeyPrefix + key
+
+	values, err := d.client.HMGet(ctx, configKey, dynamicLimitField, dynamicDurationField).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read limits from %v", configKey)
+	}
+
+	entry := &dynamicLimitEntry{}
+
+	// missing fields come back as nil and are left as zero, which means use the value from the request
+	if value, ok := values[0].(string); ok {
+		if entry.limit, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid %v field on %v", dynamicLimitField, configKey)
+		}
+	}
+
+	if value, ok := values[1].(string); ok {
+		milliseconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %v field on %v", dynamicDurationField, configKey)
+		}
+		entry.duration = time.Duration(milliseconds) * time.Millisecond
+	}
+
+	d.cache.put(key, entry, now.Add(d.cacheTTL))
+
+	return entry, nil
+}
@@ -0,0 +1,125 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDynamicLimitStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name     string
+		config   map[string]string
+		limit    uint64
+		duration time.Duration
+		err      string
+	}{
+		{
+			name:     "uses the request values when there is no config",
+			limit:    10,
+			duration: time.Minute,
+		},
+		{
+			name:     "uses the limit and duration from the config",
+			config:   map[string]string{"limit": "500", "duration_ms": "3600000"},
+			limit:    500,
+			duration: time.Hour,
+		},
+		{
+			name:     "uses the request values for missing fields",
+			config:   map[string]string{"limit": "500"},
+			limit:    500,
+			duration: time.Minute,
+		},
+		{
+			name:   "fails for invalid values",
+			config: map[string]string{"limit": "lots"},
+			err:    "invalid limit field on rl:config:some-user: strconv.ParseUint: parsing \"lots\": invalid syntax",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			for field, value := range ts.config {
+				server.HSet("rl:config:some-user", field, value)
+			}
+
+			recorder := NewRecordingStrategy(nil)
+			strategy := NewDynamicLimitStrategy(recorder, client, time.Now, time.Minute)
+
+			request := &Request{
+				Key:      "some-user",
+				Limit:    10,
+				Duration: time.Minute,
+			}
+
+			_, err = strategy.Run(context.Background(), request)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+				return
+			}
+			require.NoError(t, err)
+
+			calls := recorder.Calls()
+			require.Len(t, calls, 1)
+			assert.Equal(t, ts.limit, calls[0].Request.Limit)
+			assert.Equal(t, ts.duration, calls[0].Request.Duration)
+
+			// the caller's request is never changed
+			assert.Equal(t, uint64(10), request.Limit)
+			assert.Equal(t, time.Minute, request.Duration)
+		})
+	}
+}
+
+func TestDynamicLimitStrategy_RunCachesConfig(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	recorder := NewRecordingStrategy(nil)
+	strategy := NewDynamicLimitStrategy(recorder, client, func() time.Time {
+		return now
+	}, 10*time.Second)
+
+	server.HSet("rl:config:some-user", "limit", "500")
+
+	limits := make([]uint64, 0, 3)
+
+	for _, change := range []string{"", "1000", ""} {
+		if change != "" {
+			server.HSet("rl:config:some-user", "limit", change)
+		} else {
+			now = now.Add(15 * time.Second)
+		}
+
+		_, err := strategy.Run(context.Background(), &Request{Key: "some-user", Limit: 10, Duration: time.Minute})
+		require.NoError(t, err)
+
+		calls := recorder.Calls()
+		limits = append(limits, calls[len(calls)-1].Request.Limit)
+	}
+
+	// the change is only picked up once the cached config expires
+	assert.Equal(t, []uint64{500, 500, 1000}, limits)
+}
@@ -0,0 +1,121 @@
+package redis_rate_limiter
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// CommandError is returned by the strategies when a specific Redis command fails, so callers can tell which part of
+// the algorithm is failing (like removing expired entries vs adding new ones) with `errors.As`. `Command` is the
+// lowercase name of the Redis command, like `zadd`.
+type CommandError struct {
+	Command string
+	Key     string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("redis command %v failed for key %v: %v", e.Command, e.Key, e.Err)
+}
+
+// Unwrap returns the error returned by Redis.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the error returned by Redis, this is the github.com/pkg/errors version of Unwrap.
+func (e *CommandError) Cause() error {
+	return e.Err
+}
+
+// commandError returns a CommandError for the first command that failed or nil if none of them did. The commands
+// should be given in the order they were sent as the first failure is usually the one that matters.
+func commandError(key string, cmds ...redis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return &CommandError{
+				Command: cmd.Name(),
+				Key:     key,
+				Err:     err,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Codes of the errors returned by the built-in extractors, they're stable so clients can act on them.
+const (
+	// CodeExtractionFailed is the code of extractor errors that don't have one, like the ones of custom extractors.
+	CodeExtractionFailed = "extraction_failed"
+	// CodeMissingHeader means a header the key is built from was not sent.
+	CodeMissingHeader = "missing_header"
+	// CodeInvalidHeader means a header the key is built from has a value that can't be used in a key.
+	CodeInvalidHeader = "invalid_header"
+	// CodeInvalidIP means the client IP could not be parsed.
+	CodeInvalidIP = "invalid_ip"
+	// CodeNoClientCertificate means the request was not made with a TLS client certificate.
+	CodeNoClientCertificate = "no_client_certificate"
+	// CodeMissingBodyField means the body field the key is built from was not sent.
+	CodeMissingBodyField = "missing_body_field"
+	// CodeInvalidBody means the body could not be read or parsed, or the field the key is built from has the wrong type.
+	CodeInvalidBody = "invalid_body"
+	// CodeBodyTooLarge means the body is larger than the extractor reads.
+	CodeBodyTooLarge = "body_too_large"
+	// CodeEmptyKey means the key is empty.
+	CodeEmptyKey = "empty_key"
+	// CodeMissingUpstream means the upstream the request is sent to was not set on its context.
+	CodeMissingUpstream = "missing_upstream"
+	// CodeMisconfigured means the extractor can't work with the configuration it was given.
+	CodeMisconfigured = "misconfigured"
+)
+
+// CodedError is implemented by errors with a machine readable code, like the ones returned by the built-in
+// extractors. The handler sends the code of extractor errors on the JSON bodies.
+type CodedError interface {
+	error
+	Code() string
+}
+
+// ExtractError is the error returned by the built-in extractors.
+type ExtractError struct {
+	code    string
+	message string
+	err     error
+}
+
+func extractError(code string, format string, args ...interface{}) *ExtractError {
+	return &ExtractError{
+		code:    code,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *ExtractError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+
+	return e.message + ": " + e.err.Error()
+}
+
+// Code is one of the `Code` constants.
+func (e *ExtractError) Code() string {
+	return e.code
+}
+
+// Unwrap returns the error of the extractor this error wraps, if any.
+func (e *ExtractError) Unwrap() error {
+	return e.err
+}
+
+// errorCode returns the code of the first CodedError in the chain, or CodeExtractionFailed if there is none.
+func errorCode(err error) string {
+	var coded CodedError
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+
+	return CodeExtractionFailed
+}
@@ -0,0 +1,102 @@
+package redis_rate_limiter
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExtractError_Code(t *testing.T) {
+	tt := []struct {
+		name      string
+		extractor Extractor
+		request   func(r *http.Request)
+		code      string
+	}{
+		{
+			name:      "missing header",
+			extractor: NewHTTPHeadersExtractor("X-API-Key"),
+			code:      CodeMissingHeader,
+		},
+		{
+			name:      "invalid header",
+			extractor: NewHTTPHeadersExtractor("X-API-Key"),
+			request: func(r *http.Request) {
+				r.Header.Set("X-API-Key", "some\x00key")
+			},
+			code: CodeInvalidHeader,
+		},
+		{
+			name:      "invalid IP",
+			extractor: NewIPExtractor(nil),
+			request: func(r *http.Request) {
+				r.RemoteAddr = "not-an-ip"
+			},
+			code: CodeInvalidIP,
+		},
+		{
+			name:      "no client certificate",
+			extractor: NewTLSCertExtractor(),
+			code:      CodeNoClientCertificate,
+		},
+		{
+			name:      "missing body field",
+			extractor: NewBodyFieldExtractor("user.id"),
+			code:      CodeMissingBodyField,
+		},
+		{
+			name:      "invalid body",
+			extractor: NewBodyFieldExtractor("user.id"),
+			request: func(r *http.Request) {
+				*r = *httptest.NewRequest(http.MethodPost, "http://example.com/foo", strings.NewReader("{"))
+			},
+			code: CodeInvalidBody,
+		},
+		{
+			name:      "body too large",
+			extractor: NewBodyFieldExtractorWithLimit("user.id", 2),
+			request: func(r *http.Request) {
+				*r = *httptest.NewRequest(http.MethodPost, "http://example.com/foo", strings.NewReader(`{"user":{"id":1}}`))
+			},
+			code: CodeBodyTooLarge,
+		},
+		{
+			name:      "composite keeps the code of the extractor that failed",
+			extractor: NewCompositeExtractor(NewIPExtractor(nil), NewHTTPHeadersExtractor("X-API-Key")),
+			code:      CodeMissingHeader,
+		},
+		{
+			name:      "misconfigured composite",
+			extractor: NewCompositeExtractor(),
+			code:      CodeMisconfigured,
+		},
+		{
+			name:      "normalizing keeps the code of the inner extractor",
+			extractor: NewNormalizingExtractor(NewHTTPHeadersExtractor("X-API-Key"), strings.ToLower),
+			code:      CodeMissingHeader,
+		},
+		{
+			name: "custom extractors without a code",
+			extractor: extractorFunc(func(r *http.Request) (string, error) {
+				return "", fmt.Errorf("no session")
+			}),
+			code: CodeExtractionFailed,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			if ts.request != nil {
+				ts.request(req)
+			}
+
+			_, err := ts.extractor.Extract(req)
+			assert.Error(t, err)
+			assert.Equal(t, ts.code, errorCode(err))
+		})
+	}
+}
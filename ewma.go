@@ -0,0 +1,127 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"math"
+	"time"
+)
+
+var (
+	_ Strategy = &ewmaStrategy{}
+	_ KeyNamer = &ewmaStrategy{}
+
+	// ewmaScript decays the value of the key for the time elapsed since it was last updated and adds the cost of the
+	// request if it fits under the limit. The key expires once the value would have decayed below the resolution,
+	// by then it's as good as zero. It returns whether the request was added and the value after the decision in
+	// thousandths of a request, as Redis truncates numbers returned by scripts to integers. Values for denied requests
+	// are rounded up, so the time they're told to wait is never too short.
+	ewmaScript = redis.NewScript(`
+local stored = redis.call('HMGET', KEYS[1], 'value', 'updated')
+local now = tonumber(ARGV[1])
+local duration = tonumber(ARGV[2])
+local value = tonumber(stored[1] or '0')
+local elapsed = math.max(now - tonumber(stored[2] or ARGV[1]), 0)
+value = value * math.exp(-elapsed / duration)
+if value + tonumber(ARGV[3]) > tonumber(ARGV[4]) then
+  return {0, math.ceil(value * 1000)}
+end
+value = value + tonumber(ARGV[3])
+redis.call('HSET', KEYS[1], 'value', tostring(value), 'updated', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], math.ceil(duration * math.log(value * 1000)))
+return {1, math.floor(value * 1000)}
+`)
+)
+
+const (
+	// ewmaResolution is how many parts of a request the script returns, values below one part are as good as zero.
+	ewmaResolution = 1000
+)
+
+// NewEWMAStrategy creates a strategy that keeps an exponentially weighted moving average of the requests of every
+// key instead of counting them over a window. The value of a key decays continuously, losing about two thirds of it
+// every `Duration`, and every request adds its `Cost` to it. With a steady rate the value settles at the requests
+// made in a `Duration`, so requests are denied once the rate goes over `Limit / Duration`. As old requests fade out
+// instead of rolling off all at once a brief burst only denies for a little while, but a sustained high rate keeps
+// the value at the limit.
+//
+// Every key is a hash with the value and when it was last updated, at the request key. The decay is computed from
+// the time of the requests (from `now` or `Request.At`), not the Redis clock.
+func NewEWMAStrategy(client redis.Cmdable, now func() time.Time) Strategy {
+	return &ewmaStrategy{
+		client: client,
+		now:    now,
+	}
+}
+
+type ewmaStrategy struct {
+	client redis.Cmdable
+	now    func() time.Time
+}
+
+// Run decays the value of the key and adds the request if it fits under the limit, denied requests are not added.
+// `TotalRequests` is the value after the decision rounded to the closest request. Allowed requests expire a
+// `Duration` from now and denied ones when the value has decayed enough for the request to fit. A key that hasn't
+// been allowed a request for long enough to decay below a thousandth of a request expires.
+func (e *ewmaStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	key := r.redisKey()
+
+	// TTLs are set in milliseconds, anything shorter would never decay
+	if r.Duration < time.Millisecond {
+		return nil, errors.Errorf("the duration %v for key %v must be at least 1ms", r.Duration, key)
+	}
+
+	now := r.now(e.now)
+
+	// a request that costs more than the limit can never be allowed, the value doesn't matter
+	if r.cost() > r.Limit {
+		return &Result{
+			State:     Deny,
+			ExpiresAt: now.Add(r.Duration),
+			Reason:    ReasonOverLimit,
+		}, nil
+	}
+
+	reply, err := int64s(ewmaScript.Run(ctx, e.client, []string{key}, now.UnixMilli(), r.Duration.Milliseconds(), r.cost(), r.Limit))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run ewma script for key %v", key)
+	}
+
+	value := float64(reply[1]) / ewmaResolution
+	total := uint64(math.Round(value))
+
+	if reply[0] == 1 {
+		return &Result{
+			State:         Allow,
+			TotalRequests: total,
+			ExpiresAt:     now.Add(r.Duration),
+			Reason:        ReasonUnderLimit,
+		}, nil
+	}
+
+	return &Result{
+		State:         Deny,
+		TotalRequests: total,
+		ExpiresAt:     now.Add(ewmaRetryAfter(value, float64(r.Limit-r.cost()), r.Duration)),
+		Reason:        ReasonGuardRejected,
+	}, nil
+}
+
+// ewmaRetryAfter is how long `value` takes to decay to `target`, which is when a request that only fits once the
+// value is at most `target` is allowed. A target of zero is never reached, so it waits for the value to be as good
+// as zero.
+func ewmaRetryAfter(value float64, target float64, duration time.Duration) time.Duration {
+	target = math.Max(target, 1.0/ewmaResolution)
+	if value <= target {
+		return 0
+	}
+
+	// rounded up to the millisecond, like the times the script works with
+	return time.Duration(math.Ceil(float64(duration.Milliseconds())*math.Log(value/target))) * time.Millisecond
+}
+
+// KeyFor returns the key of the hash with the value.
+func (e *ewmaStrategy) KeyFor(r *Request) []string {
+	return []string{r.redisKey()}
+}
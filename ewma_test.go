@@ -0,0 +1,76 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestEWMAStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	strategy := NewEWMAStrategy(client, func() time.Time {
+		return now
+	})
+
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		cost      uint64
+		state     State
+		total     uint64
+		expiresAt time.Duration
+	}{
+		{name: "allows the first request", state: Allow, total: 1, expiresAt: time.Minute},
+		{name: "allows a burst up to the limit", state: Allow, total: 2, expiresAt: time.Minute},
+		{name: "reaches the limit", state: Allow, total: 3, expiresAt: time.Minute},
+		{name: "denies until the value decays enough for the request", state: Deny, total: 3, expiresAt: 24328 * time.Millisecond},
+		{name: "allows once the value decayed", advance: 25 * time.Second, state: Allow, total: 3, expiresAt: time.Minute},
+		{name: "denies requests that don't fit yet", cost: 2, state: Deny, total: 3, expiresAt: 65476 * time.Millisecond},
+		{name: "forgets old requests", advance: 10 * time.Minute, state: Allow, total: 1, expiresAt: time.Minute},
+		{name: "denies requests that cost more than the limit", cost: 4, state: Deny, total: 0, expiresAt: time.Minute},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+
+		result, err := strategy.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    3,
+			Duration: time.Minute,
+			Cost:     step.cost,
+		})
+		require.NoError(t, err, step.name)
+
+		assert.Equal(t, step.state, result.State, step.name)
+		assert.Equal(t, step.total, result.TotalRequests, step.name)
+		assert.Equal(t, now.Add(step.expiresAt), result.ExpiresAt, step.name)
+	}
+
+	// the key expires once the value would be below a thousandth of a request
+	assert.Equal(t, 6*time.Minute+54474*time.Millisecond, server.TTL("some-user"))
+}
+
+func TestEWMAStrategy_RunWithShortDuration(t *testing.T) {
+	strategy := NewEWMAStrategy(nil, time.Now)
+
+	_, err := strategy.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    3,
+		Duration: time.Microsecond,
+	})
+	assert.EqualError(t, err, "the duration 1µs for key some-user must be at least 1ms")
+}
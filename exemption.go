@@ -0,0 +1,107 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+var (
+	_ Strategy  = &ExemptionStrategy{}
+	_ KeyNamer  = &ExemptionStrategy{}
+	_ Refunder  = &ExemptionStrategy{}
+	_ Committer = &ExemptionStrategy{}
+)
+
+const (
+	// ExemptionKeyPrefix is prepended to the request key to get the flag that exempts it from rate limiting.
+	ExemptionKeyPrefix = "rl:exempt:"
+)
+
+// NewExemptionStrategy creates a strategy that allows every request for keys that are exempt from rate limiting and
+// runs `inner` for the others. A key is exempt while the flag at ExemptionKeyPrefix followed by the request `Key`
+// (so all its actions) exists in Redis, whatever its value, like `SET rl:exempt:some-customer 1`. This works like the
+// kill switch for a single key, it can be set for the whole cluster at runtime and given a TTL to expire on its own.
+//
+// Whether a key is exempt is cached in memory for `ttl`, so setting or removing a flag takes up to `ttl` to apply
+// and keys only cost an EXISTS once every `ttl`. At most `maxSize` keys are cached. If the flag can't be read the
+// last known value is used (or the key isn't exempt if there is none), so a Redis outage doesn't exempt anyone.
+func NewExemptionStrategy(inner Strategy, client redis.Cmdable, now func() time.Time, ttl time.Duration, maxSize int) *ExemptionStrategy {
+	return &ExemptionStrategy{
+		inner:  inner,
+		client: client,
+		now:    now,
+		ttl:    ttl,
+		cache:  newTTLCache(maxSize),
+	}
+}
+
+// ExemptionStrategy is the strategy created by NewExemptionStrategy.
+type ExemptionStrategy struct {
+	inner  Strategy
+	client redis.Cmdable
+	now    func() time.Time
+	ttl    time.Duration
+	cache  *ttlCache
+}
+
+// Run allows the request if its key is exempt, otherwise it runs the inner strategy.
+func (e *ExemptionStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	if !e.exempt(ctx, r.Key) {
+		return e.inner.Run(ctx, r)
+	}
+
+	return &Result{
+		State:  Allow,
+		Reason: ReasonExempt,
+	}, nil
+}
+
+// KeyFor returns the keys of the inner strategy followed by the exemption flag.
+func (e *ExemptionStrategy) KeyFor(r *Request) []string {
+	return append(keysFor(e.inner, r), ExemptionKeyPrefix+r.Key)
+}
+
+// Refund gives back the request on the inner strategy unless the key is exempt, exempt requests were never counted.
+func (e *ExemptionStrategy) Refund(ctx context.Context, r *Request) error {
+	if e.exempt(ctx, r.Key) {
+		return nil
+	}
+
+	return refund(ctx, e.inner, r)
+}
+
+// Commit settles the request on the inner strategy unless the key is exempt.
+func (e *ExemptionStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	if e.exempt(ctx, r.Key) {
+		return nil
+	}
+
+	return commit(ctx, e.inner, r, actualCost)
+}
+
+func (e *ExemptionStrategy) unwrap() Strategy {
+	return e.inner
+}
+
+func (e *ExemptionStrategy) exempt(ctx context.Context, key string) bool {
+	// the cache is for the flag, which isn't per request, so it uses the clock and not `Request.At`
+	now := e.now()
+
+	value, until, ok := e.cache.get(key)
+	exempt := ok && value.(bool)
+
+	if ok && now.Before(until) {
+		return exempt
+	}
+
+	count, err := e.client.Exists(ctx, ExemptionKeyPrefix+key).Result()
+	if err != nil {
+		// keep the last known value, the next request tries again
+		return exempt
+	}
+
+	e.cache.put(key, count > 0, now.Add(e.ttl))
+
+	return count > 0
+}
@@ -0,0 +1,105 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExemptionStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	strategy := NewExemptionStrategy(&denyAllStrategy{}, client, func() time.Time {
+		return now
+	}, 5*time.Second, 10)
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		change  func()
+		reason  Reason
+	}{
+		{name: "runs the inner strategy for keys without the flag", reason: ReasonOverLimit},
+		{
+			name: "keeps the cached value until it expires",
+			change: func() {
+				require.NoError(t, server.Set("rl:exempt:some-user", "1"))
+			},
+			reason: ReasonOverLimit,
+		},
+		{name: "allows once the flag is read again", advance: 5 * time.Second, reason: ReasonExempt},
+		{
+			name: "keeps the key exempt until the cached value expires",
+			change: func() {
+				server.Del("rl:exempt:some-user")
+			},
+			reason: ReasonExempt,
+		},
+		{name: "goes back to the inner strategy once the flag is gone", advance: 5 * time.Second, reason: ReasonOverLimit},
+		{
+			name: "exempts all actions of the key",
+			change: func() {
+				require.NoError(t, server.Set("rl:exempt:some-user", "1"))
+			},
+			advance: 5 * time.Second,
+			reason:  ReasonExempt,
+		},
+		{
+			name:    "keeps the last known value when the flag can't be read",
+			change:  server.Close,
+			advance: 5 * time.Second,
+			reason:  ReasonExempt,
+		},
+	}
+
+	for x, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+
+		now = now.Add(step.advance)
+
+		request := &Request{Key: "some-user", Limit: 1, Duration: time.Minute}
+		if x%2 == 1 {
+			request.Action = "login"
+		}
+
+		result, err := strategy.Run(context.Background(), request)
+		require.NoError(t, err, step.name)
+		assert.Equal(t, step.reason, result.Reason, step.name)
+	}
+
+	assert.Equal(t, []string{"rl:exempt:some-user"}, strategy.KeyFor(&Request{Key: "some-user", Action: "login"}))
+}
+
+func TestExemptionStrategy_RunWithoutFlag(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewExemptionStrategy(&denyAllStrategy{}, client, time.Now, time.Minute, 10)
+
+	// a Redis outage doesn't exempt keys that were never read
+	server.Close()
+
+	result, err := strategy.Run(context.Background(), &Request{Key: "some-user", Limit: 1, Duration: time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, &Result{State: Deny, Reason: ReasonOverLimit}, result)
+}
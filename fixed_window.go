@@ -0,0 +1,115 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+var (
+	_ Strategy  = &fixedWindowBucketStrategy{}
+	_ Pipelined = &fixedWindowBucketStrategy{}
+	_ KeyNamer  = &fixedWindowBucketStrategy{}
+)
+
+// NewFixedWindowBucketStrategy creates a fixed window strategy where the window is part of the Redis key, so every
+// window gets its own counter and old windows are cleaned up by Redis expiring their keys.
+func NewFixedWindowBucketStrategy(client *redis.Client, now func() time.Time) Strategy {
+	return &fixedWindowBucketStrategy{
+		client: client,
+		now:    now,
+	}
+}
+
+type fixedWindowBucketStrategy struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+// Run this implementation splits time in windows of `Duration` (aligned to the Unix epoch) and keys the counter by
+// the window the request falls in, like `some-user:26419189`. As the key changes once the window is over there is no
+// need to check the TTL like the counter strategy does, every request is a single round trip with an INCR and a
+// PEXPIRE that makes sure the key goes away once its window is over. Denied requests are also counted, so
+// `TotalRequests` can go over the `Limit`. Like every fixed window, a client can make `Limit` requests at the end of
+// a window and `Limit` more at the start of the next one.
+func (f *fixedWindowBucketStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	p := f.client.Pipeline()
+	interpret := f.RunPipelined(ctx, p, r)
+
+	if _, err := p.Exec(ctx); err != nil {
+		if _, cmdErr := interpret(); cmdErr != nil {
+			return nil, cmdErr
+		}
+
+		return nil, errors.Wrapf(err, "failed to execute fixed window pipeline for key: %v", r.redisKey())
+	}
+
+	return interpret()
+}
+
+// RunPipelined adds the INCR and PEXPIRE to the pipeline, this is exactly what `Run` does.
+func (f *fixedWindowBucketStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	// windows are in milliseconds, anything shorter has no window
+	if r.Duration < time.Millisecond {
+		return func() (*Result, error) {
+			return nil, errors.Errorf("the duration %v for key %v must be at least 1ms", r.Duration, r.redisKey())
+		}
+	}
+
+	now := r.now(f.now)
+	window := now.UnixMilli() / r.Duration.Milliseconds()
+	windowStart := time.UnixMilli(window * r.Duration.Milliseconds()).In(now.Location())
+	windowEnd := windowStart.Add(r.Duration)
+	key := f.windowKey(r, window)
+
+	incr := p.Incr(ctx, key)
+	expire := p.PExpire(ctx, key, windowEnd.Sub(now))
+
+	return func() (*Result, error) {
+		if err := commandError(key, incr, expire); err != nil {
+			return nil, err
+		}
+
+		totalRequests := uint64(incr.Val())
+
+		if totalRequests > r.Limit {
+			return &Result{
+				State:         Deny,
+				TotalRequests: totalRequests,
+				ExpiresAt:     windowEnd,
+				Reason:        ReasonOverLimit,
+				WindowStart:   windowStart,
+				WindowEnd:     windowEnd,
+			}, nil
+		}
+
+		return &Result{
+			State:         Allow,
+			TotalRequests: totalRequests,
+			ExpiresAt:     windowEnd,
+			Reason:        ReasonUnderLimit,
+			WindowStart:   windowStart,
+			WindowEnd:     windowEnd,
+		}, nil
+	}
+}
+
+func (f *fixedWindowBucketStrategy) pipeline() redis.Pipeliner {
+	return f.client.Pipeline()
+}
+
+// KeyFor returns the key of the window the request falls in, which depends on the time of the request. Requests
+// with a `Duration` under 1ms have no window and no keys.
+func (f *fixedWindowBucketStrategy) KeyFor(r *Request) []string {
+	if r.Duration < time.Millisecond {
+		return nil
+	}
+
+	return []string{f.windowKey(r, r.now(f.now).UnixMilli()/r.Duration.Milliseconds())}
+}
+
+func (f *fixedWindowBucketStrategy) windowKey(r *Request, window int64) string {
+	return r.redisKey() + ":" + strconv.FormatInt(window, 10)
+}
@@ -0,0 +1,142 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFixedWindowBucketStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name       string
+		runs       int64
+		request    *Request
+		lastResult *Result
+		advance    time.Duration
+	}{
+		{
+			name: "returns Allow for requests under limit",
+			request: &Request{
+				Key:      "some-user",
+				Limit:    100,
+				Duration: time.Minute,
+			},
+			lastResult: &Result{
+				State:         Allow,
+				TotalRequests: 50,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 0, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 0, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 0, 0, time.UTC),
+			},
+			runs: 50,
+		},
+		{
+			name: "returns Deny for requests over limit",
+			request: &Request{
+				Key:      "some-user",
+				Limit:    100,
+				Duration: time.Minute,
+			},
+			lastResult: &Result{
+				State:         Deny,
+				TotalRequests: 101,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 0, 0, time.UTC),
+				Reason:        ReasonOverLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 0, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 0, 0, time.UTC),
+			},
+			runs: 101,
+		},
+		{
+			name: "starts a new window once the current one is over",
+			request: &Request{
+				Key:      "some-user",
+				Limit:    100,
+				Duration: time.Minute,
+			},
+			lastResult: &Result{
+				State:         Allow,
+				TotalRequests: 10,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 17, 0, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 16, 0, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 17, 0, 0, time.UTC),
+			},
+			runs:    40,
+			advance: time.Second,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			strategy := NewFixedWindowBucketStrategy(client, func() time.Time {
+				return now
+			})
+
+			var lastResult *Result
+
+			for x := int64(0); x < ts.runs; x++ {
+				lastResult, err = strategy.Run(context.Background(), ts.request)
+				require.NoError(t, err)
+
+				if ts.advance != 0 {
+					server.FastForward(ts.advance)
+					now = now.Add(ts.advance)
+				}
+			}
+
+			assert.Equal(t, ts.lastResult, lastResult)
+
+			// the key for the 10:15 window is gone once that window is over
+			assert.Equal(t, ts.advance == 0, server.Exists("some-user:26418855"))
+		})
+	}
+}
+
+func TestFixedWindowBucketStrategy_RunWithShortDuration(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewFixedWindowBucketStrategy(client, time.Now)
+	request := &Request{
+		Key:      "some-user",
+		Limit:    3,
+		Duration: time.Microsecond,
+	}
+
+	_, err = strategy.Run(context.Background(), request)
+	assert.EqualError(t, err, "the duration 1µs for key some-user must be at least 1ms")
+
+	p := client.Pipeline()
+	interpret := strategy.(Pipelined).RunPipelined(context.Background(), p, request)
+	_, err = p.Exec(context.Background())
+	require.NoError(t, err)
+
+	_, err = interpret()
+	assert.EqualError(t, err, "the duration 1µs for key some-user must be at least 1ms")
+
+	assert.Empty(t, strategy.(KeyNamer).KeyFor(request))
+	assert.Empty(t, server.Keys())
+}
@@ -0,0 +1,89 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+var (
+	_ Strategy  = &freeAllowanceStrategy{}
+	_ KeyNamer  = &freeAllowanceStrategy{}
+	_ Refunder  = &freeAllowanceStrategy{}
+	_ Committer = &freeAllowanceStrategy{}
+
+	// freeScript counts the request against the free allowance if the whole cost still fits in it, it returns the
+	// requests used from the allowance and whether this one was counted. Once the allowance is used up the counter
+	// isn't touched anymore, so it stays at the allowance.
+	freeScript = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+if used + tonumber(ARGV[2]) > tonumber(ARGV[1]) then
+  return {used, 0}
+end
+return {redis.call('INCRBY', KEYS[1], ARGV[2]), 1}
+`)
+)
+
+// NewFreeAllowanceStrategy creates a strategy that allows the first `free` requests of every key without limiting
+// them, like a free trial, and only runs `inner` once they're used up. The free requests are counted over the whole
+// life of the key (with the `Cost` of the requests, a request that doesn't fit in what's left goes to `inner`) in a
+// counter without a TTL at the request key with `:free` appended, so remove it to give a client its allowance back.
+// Free requests are not counted by `inner`, the client gets its full limit once the allowance is over.
+func NewFreeAllowanceStrategy(inner Strategy, client *redis.Client, free uint64) Strategy {
+	return &freeAllowanceStrategy{
+		inner:  inner,
+		client: client,
+		free:   free,
+	}
+}
+
+type freeAllowanceStrategy struct {
+	inner  Strategy
+	client *redis.Client
+	free   uint64
+}
+
+// Run allows requests that fit in the free allowance and runs the inner strategy for the others. Free requests have
+// the requests used from the allowance as their `TotalRequests`.
+func (f *freeAllowanceStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	reply, err := int64s(freeScript.Run(ctx, f.client, []string{freeAllowanceKey(r)}, f.free, r.cost()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check free allowance for key %v", r.redisKey())
+	}
+
+	if reply[1] != 1 {
+		return f.inner.Run(ctx, r)
+	}
+
+	return &Result{
+		State:         Allow,
+		TotalRequests: uint64(reply[0]),
+		Reason:        ReasonFreeAllowance,
+	}, nil
+}
+
+// KeyFor returns the keys of the inner strategy followed by the free allowance counter.
+func (f *freeAllowanceStrategy) KeyFor(r *Request) []string {
+	return append(keysFor(f.inner, r), freeAllowanceKey(r))
+}
+
+// Refund gives back the request on the inner strategy, requests served from the allowance were never counted there,
+// so refunding them does nothing and they aren't given back to the allowance.
+func (f *freeAllowanceStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, f.inner, r)
+}
+
+// Commit settles the request on the inner strategy. There's no telling if a request was served from the allowance
+// once it's over, so a commit for one settles the difference on the inner counter if it already counted requests for
+// the key (the sorted set ignores requests it never counted).
+func (f *freeAllowanceStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, f.inner, r, actualCost)
+}
+
+func (f *freeAllowanceStrategy) unwrap() Strategy {
+	return f.inner
+}
+
+func freeAllowanceKey(r *Request) string {
+	return r.redisKey() + ":free"
+}
@@ -0,0 +1,99 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFreeAllowanceStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewFreeAllowanceStrategy(NewCounterStrategy(client, time.Now), client, 3)
+
+	steps := []struct {
+		name    string
+		cost    uint64
+		advance time.Duration
+		state   State
+		reason  Reason
+		total   uint64
+	}{
+		{name: "allows the first free request", state: Allow, reason: ReasonFreeAllowance, total: 1},
+		{name: "counts the cost against the allowance", cost: 2, state: Allow, reason: ReasonFreeAllowance, total: 3},
+		{name: "limits once the allowance is used up", state: Allow, reason: ReasonUnderLimit, total: 1},
+		{name: "denies over the limit", state: Deny, reason: ReasonGuardRejected, total: 1},
+		{name: "never gives the allowance back", advance: time.Hour, state: Allow, reason: ReasonUnderLimit, total: 1},
+	}
+
+	for _, step := range steps {
+		server.FastForward(step.advance)
+
+		result, err := strategy.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    1,
+			Duration: time.Minute,
+			Cost:     step.cost,
+		})
+		require.NoError(t, err, step.name)
+
+		assert.Equal(t, step.state, result.State, step.name)
+		assert.Equal(t, step.reason, result.Reason, step.name)
+		assert.Equal(t, step.total, result.TotalRequests, step.name)
+	}
+
+	used, err := server.Get("some-user:free")
+	require.NoError(t, err)
+	assert.Equal(t, "3", used)
+	assert.Equal(t, time.Duration(0), server.TTL("some-user:free"))
+}
+
+func TestFreeAllowanceStrategy_RunWithLargeCost(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewFreeAllowanceStrategy(NewCounterStrategy(client, time.Now), client, 3)
+
+	// the request doesn't fit in the allowance, so it's limited and the allowance is kept for later
+	result, err := strategy.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    10,
+		Duration: time.Minute,
+		Cost:     5,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ReasonUnderLimit, result.Reason)
+	assert.Equal(t, uint64(5), result.TotalRequests)
+
+	result, err = strategy.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    10,
+		Duration: time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ReasonFreeAllowance, result.Reason)
+	assert.Equal(t, uint64(1), result.TotalRequests)
+}
+
+func TestFreeAllowanceStrategy_KeyFor(t *testing.T) {
+	strategy := NewFreeAllowanceStrategy(NewSortedSetCounterStrategy(nil, time.Now), nil, 3)
+
+	assert.Equal(t, []string{"some-user", "some-user:free"}, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+}
@@ -0,0 +1,112 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+var (
+	_ Strategy  = &globalCeilingStrategy{}
+	_ KeyNamer  = &globalCeilingStrategy{}
+	_ Refunder  = &globalCeilingStrategy{}
+	_ Committer = &globalCeilingStrategy{}
+)
+
+const (
+	// GlobalCeilingKeyPrefix is prepended to the window number to build the key of the global counter of every window.
+	GlobalCeilingKeyPrefix = "rl:global:"
+)
+
+// NewGlobalCeilingStrategy creates a strategy that caps the requests taken from all clients combined at
+// `globalLimit` every `duration`, as backpressure for a fragile downstream, and only runs `inner` for requests under
+// the ceiling. The global counter is a fixed window (like the fixed window bucket strategy, with the window in the
+// key) counted with a single INCRBY and PEXPIRE round trip before `inner` runs, so once the ceiling is hit requests
+// are denied without any per key work. Every request is counted, including the ones denied by the ceiling or by
+// `inner`, so a lot of denied traffic keeps the ceiling hit until the window is over.
+func NewGlobalCeilingStrategy(inner Strategy, client *redis.Client, now func() time.Time, globalLimit uint64, duration time.Duration) Strategy {
+	return &globalCeilingStrategy{
+		inner:    inner,
+		client:   client,
+		now:      now,
+		limit:    globalLimit,
+		duration: duration,
+	}
+}
+
+type globalCeilingStrategy struct {
+	inner    Strategy
+	client   *redis.Client
+	now      func() time.Time
+	limit    uint64
+	duration time.Duration
+}
+
+// Run counts the request on the global counter and denies it if that takes the counter over the ceiling, otherwise
+// it runs the inner strategy. Requests denied by the ceiling have the global counter as their `TotalRequests`.
+func (g *globalCeilingStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	if g.duration < time.Millisecond {
+		return nil, errors.Errorf("the global ceiling duration %v must be at least 1ms", g.duration)
+	}
+
+	now := r.now(g.now)
+	window := now.UnixMilli() / g.duration.Milliseconds()
+	windowStart := time.UnixMilli(window * g.duration.Milliseconds()).In(now.Location())
+	windowEnd := windowStart.Add(g.duration)
+	key := globalCeilingKey(window)
+
+	p := g.client.Pipeline()
+	incr := p.IncrBy(ctx, key, int64(r.cost()))
+	expire := p.PExpire(ctx, key, windowEnd.Sub(now))
+
+	if _, err := p.Exec(ctx); err != nil {
+		if cmdErr := commandError(key, incr, expire); cmdErr != nil {
+			return nil, cmdErr
+		}
+
+		return nil, errors.Wrapf(err, "failed to execute global ceiling pipeline for key %v", key)
+	}
+
+	if total := uint64(incr.Val()); total > g.limit {
+		return &Result{
+			State:         Deny,
+			TotalRequests: total,
+			ExpiresAt:     windowEnd,
+			Reason:        ReasonGlobalCeiling,
+			WindowStart:   windowStart,
+			WindowEnd:     windowEnd,
+		}, nil
+	}
+
+	return g.inner.Run(ctx, r)
+}
+
+// KeyFor returns the keys of the inner strategy followed by the global counter for the current window, which is
+// shared by all requests.
+func (g *globalCeilingStrategy) KeyFor(r *Request) []string {
+	if g.duration < time.Millisecond {
+		return keysFor(g.inner, r)
+	}
+
+	return append(keysFor(g.inner, r), globalCeilingKey(r.now(g.now).UnixMilli()/g.duration.Milliseconds()))
+}
+
+// Refund gives back the request on the inner strategy. The global counter keeps it, like it keeps denied requests.
+func (g *globalCeilingStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, g.inner, r)
+}
+
+// Commit settles the request on the inner strategy.
+func (g *globalCeilingStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, g.inner, r, actualCost)
+}
+
+func (g *globalCeilingStrategy) unwrap() Strategy {
+	return g.inner
+}
+
+func globalCeilingKey(window int64) string {
+	return GlobalCeilingKeyPrefix + strconv.FormatInt(window, 10)
+}
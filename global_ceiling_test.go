@@ -0,0 +1,109 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestGlobalCeilingStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	strategy := NewGlobalCeilingStrategy(NewCounterStrategy(client, clock), client, clock, 3, time.Minute)
+
+	steps := []struct {
+		name    string
+		key     string
+		advance time.Duration
+		state   State
+		reason  Reason
+	}{
+		{name: "allows the first client", key: "user-a", state: Allow, reason: ReasonUnderLimit},
+		{name: "denies over the per key limit", key: "user-a", state: Deny, reason: ReasonGuardRejected},
+		{name: "allows another client", key: "user-b", state: Allow, reason: ReasonUnderLimit},
+		{name: "denies everyone over the ceiling", key: "user-c", state: Deny, reason: ReasonGlobalCeiling},
+		{name: "allows again once the window is over", key: "user-c", advance: 30 * time.Second, state: Allow, reason: ReasonUnderLimit},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+
+		result, err := strategy.Run(context.Background(), &Request{
+			Key:      step.key,
+			Limit:    1,
+			Duration: time.Minute,
+		})
+		require.NoError(t, err, step.name)
+
+		assert.Equal(t, step.state, result.State, step.name)
+		assert.Equal(t, step.reason, result.Reason, step.name)
+
+		if step.reason == ReasonGlobalCeiling {
+			assert.Equal(t, &Result{
+				State:         Deny,
+				TotalRequests: 4,
+				ExpiresAt:     time.Date(2020, 3, 25, 10, 16, 0, 0, time.UTC),
+				Reason:        ReasonGlobalCeiling,
+				WindowStart:   time.Date(2020, 3, 25, 10, 15, 0, 0, time.UTC),
+				WindowEnd:     time.Date(2020, 3, 25, 10, 16, 0, 0, time.UTC),
+			}, result)
+		}
+	}
+
+	// the request denied by the ceiling never got to the per key counter
+	total, err := server.Get("user-c")
+	require.NoError(t, err)
+	assert.Equal(t, "1", total)
+}
+
+func TestGlobalCeilingStrategy_RunWithCommandError(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	require.NoError(t, server.Set(globalCeilingKey(now.UnixMilli()/time.Minute.Milliseconds()), "not-a-number"))
+
+	strategy := NewGlobalCeilingStrategy(NewCounterStrategy(client, clock), client, clock, 3, time.Minute)
+
+	_, err = strategy.Run(context.Background(), &Request{
+		Key:      "user-a",
+		Limit:    1,
+		Duration: time.Minute,
+	})
+	assert.EqualError(t, err, "redis command incrby failed for key rl:global:26418855: ERR value is not an integer or out of range")
+}
+
+func TestGlobalCeilingStrategy_KeyFor(t *testing.T) {
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	strategy := NewGlobalCeilingStrategy(NewSortedSetCounterStrategy(nil, time.Now), nil, func() time.Time {
+		return now
+	}, 3, time.Minute)
+
+	assert.Equal(t, []string{"some-user", "rl:global:26418855"}, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+}
@@ -1,32 +1,239 @@
 package redis_rate_limiter
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
-	_            http.Handler = &httpRateLimiterHandler{}
-	_            Extractor    = &httpHeaderExtractor{}
-	stateStrings              = map[State]string{
-		Allow: "Allow",
-		Deny:  "Deny",
-	}
+	_ http.Handler = &httpRateLimiterHandler{}
+	_ Debuggable   = &httpRateLimiterHandler{}
+	_ Extractor    = &httpHeaderExtractor{}
+
+	_ http.Flusher  = &statusRecorder{}
+	_ http.Hijacker = &statusRecorder{}
 )
 
 const (
 	rateLimitingTotalRequests = "Rate-Limiting-Total-Requests"
 	rateLimitingState         = "Rate-Limiting-State"
 	rateLimitingExpiresAt     = "Rate-Limiting-Expires-At"
+	rateLimitingReason        = "Rate-Limiting-Reason"
+	rateLimitPolicy           = "RateLimit-Policy"
+	rateLimitRemaining        = "X-RateLimit-Remaining"
+	rateLimitSecret           = "X-RateLimit-Secret"
+	retryAfter                = "Retry-After"
+	serverTiming              = "Server-Timing"
+	rateLimitBypass           = "RateLimit-Bypass"
+	rateLimitKey              = "X-RateLimit-Key"
+	deniedMessage             = "you have sent too many requests to this service, slow down please"
+	concurrencyMessage        = "you have too many requests in flight to this service, wait for them to finish"
+	forbiddenMessage          = "you are not allowed to send requests to this service"
+	problemType               = "https://datatracker.ietf.org/doc/html/rfc6585#section-4"
+)
+
+const (
+	// AllowStateValue is the default value of the state header for allowed requests.
+	AllowStateValue = "Allow"
+	// DenyStateValue is the default value of the state header for denied requests.
+	DenyStateValue = "Deny"
+)
+
+const (
+	// MaxHeaderValueLength is the longest header value, in bytes, the header extractor accepts, it also applies to the
+	// fields read by the body field extractor.
+	MaxHeaderValueLength = 1024
+)
+
+// HeaderNames are the names of the headers the handler sends with the rate limiting state on every response,
+// a header with an empty name is not sent at all.
+type HeaderNames struct {
+	TotalRequests string
+	State         string
+	ExpiresAt     string
+	// ResetSeconds is a header with how many seconds until the limit resets, like `60`, whatever the
+	// `ExpiresAtFormat` is, for clients that expect a `X-RateLimit-Reset` in seconds.
+	ResetSeconds string
+	// ResetDate is a header with when the limit resets as an HTTP date, like `Wed, 25 Mar 2020 10:16:30 GMT`, for
+	// clients that parse it like a `Retry-After` or an `Expires`.
+	ResetDate string
+}
+
+// DefaultHeaderNames returns the header names used when the config doesn't set any, the reset headers are not sent
+// by default. To send them on top of the defaults set them on the names this returns.
+func DefaultHeaderNames() *HeaderNames {
+	return &HeaderNames{
+		TotalRequests: rateLimitingTotalRequests,
+		State:         rateLimitingState,
+		ExpiresAt:     rateLimitingExpiresAt,
+	}
+}
+
+// StateValues are the values sent on the state header, to match clients that expect other tokens, like
+// `allowed` and `blocked`.
+type StateValues struct {
+	Allow string
+	Deny  string
+}
+
+// DefaultStateValues returns the state values used when the config doesn't set any.
+func DefaultStateValues() *StateValues {
+	return &StateValues{
+		Allow: AllowStateValue,
+		Deny:  DenyStateValue,
+	}
+}
+
+// DenyBodyFormat defines how the body of a denied (429) response is written.
+type DenyBodyFormat int
+
+const (
+	// DenyBodyText sends a plain text message, this is the default.
+	DenyBodyText DenyBodyFormat = iota
+	// DenyBodyJSON sends an `application/json` object with the message and the retry-after in seconds.
+	DenyBodyJSON
+	// DenyBodyProblemJSON sends an RFC 7807 `application/problem+json` document with a `retry_after` extension.
+	DenyBodyProblemJSON
+)
+
+// ExpiresAtFormat defines how the expires at header value is formatted.
+type ExpiresAtFormat int
+
+const (
+	// ExpiresAtRFC3339 formats it as an RFC 3339 date, like `2020-03-25T10:16:30Z`, this is the default.
+	ExpiresAtRFC3339 ExpiresAtFormat = iota
+	// ExpiresAtUnix formats it as the Unix epoch in seconds, like `1585131390`.
+	ExpiresAtUnix
+	// ExpiresAtDeltaSeconds formats it as how many seconds from now until it expires, like `60`. This is what the
+	// RateLimit-Reset header from the RateLimit header fields draft uses.
+	ExpiresAtDeltaSeconds
+)
+
+// TrustedUpstreamConfig allows an upstream rate limiter (like one at the edge of a multi tier proxy setup) to tell
+// the handler it has already checked the request. When the request has the shared secret and a valid remaining
+// count the handler doesn't check Redis, it sends the request to the wrapped handler with headers built from the
+// remaining count, so requests are not counted twice by both limiters.
+type TrustedUpstreamConfig struct {
+	// Secret is shared with the upstream limiter, it must be long and random as anyone that knows it can skip
+	// rate limiting. An empty secret disables this.
+	Secret string
+	// SecretHeader is the header that carries the secret, defaults to `X-RateLimit-Secret`. It's removed from the
+	// request before it gets to the wrapped handler.
+	SecretHeader string
+	// RemainingHeader is the header with the remaining requests computed upstream, defaults to `X-RateLimit-Remaining`.
+	RemainingHeader string
+}
+
+// EmptyKeyBehavior defines what the handler does when the extractor returns an empty key. Using the empty key
+// as is would put every client that produces it in the same bucket, so it's never done.
+type EmptyKeyBehavior int
+
+const (
+	// EmptyKeyError responds with a 400, this is the default.
+	EmptyKeyError EmptyKeyBehavior = iota
+	// EmptyKeyAllow skips rate limiting and sends the request straight to the wrapped handler.
+	EmptyKeyAllow
+	// EmptyKeyFallback rate limits the request using `RateLimiterConfig.FallbackKey` as its key.
+	EmptyKeyFallback
 )
 
+// FailureMode defines what the handler does when the strategy fails, like when Redis can't be reached or is too
+// slow to answer.
+type FailureMode int
+
+const (
+	// FailClosed responds with a 500 and doesn't call the wrapped handler, this is the default.
+	FailClosed FailureMode = iota
+	// FailOpen sends the request to the wrapped handler without rate limiting it. Responses to requests that went
+	// through with any of their limits unchecked get a `RateLimit-Bypass: backend-unavailable` header (see
+	// BypassBackendUnavailable), so logs and the edge can tell limiting was off for them. The header is set before
+	// the wrapped handler is called, so it can read it from the response headers.
+	FailOpen
+	// FailUnavailable responds with a 503 and a `Retry-After` of `RateLimiterConfig.UnavailableRetryAfter`, which
+	// tells clients to back off for a while, shedding load while Redis is in trouble.
+	FailUnavailable
+)
+
+const (
+	// BypassBackendUnavailable is the `RateLimit-Bypass` header value for requests that went through with FailOpen
+	// because the strategy failed.
+	BypassBackendUnavailable = "backend-unavailable"
+)
+
+const (
+	// DefaultUnavailableRetryAfter is the retry after sent with FailUnavailable when the config doesn't set one.
+	DefaultUnavailableRetryAfter = 5 * time.Second
+)
+
+// LimitConfig is an extra limit evaluated by the handler on top of the main one, with its own extractor and
+// limits, like a per user limit on top of the per IP one.
+type LimitConfig struct {
+	// Name identifies the limit, it's used as the `Action` of the requests sent to the strategy (so the limits
+	// don't share counters even if their extractors produce the same key) and appended to the rate limiting
+	// header names (like `Rate-Limiting-State-User` for a limit named `user`). It must be set and unique within the config.
+	Name        string
+	Extractor   Extractor
+	Expiration  time.Duration
+	MaxRequests uint64
+}
+
+// HeaderBudget caps the rate limiting headers sent when there are many limits, so responses don't grow past the
+// header size limits of proxies in front of the service. When the headers don't fit, the tightest limits are
+// reported: the ones that denied the request first, then the ones with the fewest requests left.
+type HeaderBudget struct {
+	// MaxLimits is how many limits get headers and entries on the policy header, zero means all of them.
+	MaxLimits int
+	// MaxBytes caps the size of the names and values of the rate limiting headers for all limits combined (and of
+	// the policy header value on its own), zero means no cap. The tightest limit is always reported, even if it
+	// doesn't fit.
+	MaxBytes int
+}
+
+type deniedBody struct {
+	Error      string `json:"error"`
+	RetryAfter int64  `json:"retry_after"`
+}
+
+type extractErrorBody struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+type extractProblemBody struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Code   string `json:"code"`
+}
+
+type problemBody struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	RetryAfter int64  `json:"retry_after"`
+}
+
 // Extractor represents the way we will extract a key from an HTTP request, this could be
 // a value from a header, request path, method used, user authentication information, any information that
 // is available at the HTTP request that wouldn't cause side effects if it was collected (this object shouldn't
-// read the body of the request).
+// read the body of the request, the only exception is the opt-in NewBodyFieldExtractor).
 type Extractor interface {
 	Extract(r *http.Request) (string, error)
 }
@@ -37,13 +244,19 @@ type httpHeaderExtractor struct {
 
 // Extract extracts a collection of http headers and joins them to build the key that will be used for
 // rate limiting. You should use headers that are guaranteed to be unique for a client.
+// Header values come straight from the client, so they are checked before becoming part of a key: every value
+// must be valid UTF-8, have at most MaxHeaderValueLength bytes (after trimming spaces) and no control characters
+// (like new lines), otherwise an error is returned. This bounds the size of the keys (and the memory they use in
+// Redis) to the number of headers times MaxHeaderValueLength.
 func (h *httpHeaderExtractor) Extract(r *http.Request) (string, error) {
 	values := make([]string, 0, len(h.headers))
 
 	for _, key := range h.headers {
 		// if we can't find a value for the headers, give up and return an error.
 		if value := strings.TrimSpace(r.Header.Get(key)); value == "" {
-			return "", fmt.Errorf("the header %v must have a value set", key)
+			return "", extractError(CodeMissingHeader, "the header %v must have a value set", key)
+		} else if err := validateKeyValue(value); err != nil {
+			return "", extractError(CodeInvalidHeader, "the header %v has an invalid value: %v", key, err)
 		} else {
 			values = append(values, value)
 		}
@@ -52,6 +265,38 @@ func (h *httpHeaderExtractor) Extract(r *http.Request) (string, error) {
 	return strings.Join(values, "-"), nil
 }
 
+// validateKeyValue checks a value that comes from the client before it becomes part of a key, so it can't make keys
+// arbitrarily large or break the places they are logged at.
+func validateKeyValue(value string) error {
+	if len(value) > MaxHeaderValueLength {
+		return fmt.Errorf("it is longer than %v bytes", MaxHeaderValueLength)
+	}
+
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("it is not valid UTF-8")
+	}
+
+	for _, c := range value {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("it has control characters")
+		}
+	}
+
+	return nil
+}
+
+// ContentLengthCost uses the `Content-Length` of the request as its cost, to limit how many bytes clients send
+// instead of how many requests. Requests without a body cost the same as a single byte. It fails for requests that
+// don't declare their length upfront (like chunked uploads), as the body would have to be read to know it. Use it
+// with the counter strategy, the sorted set strategy fails for costs over MaxSortedSetCost.
+func ContentLengthCost(r *http.Request) (uint64, error) {
+	if r.ContentLength < 0 {
+		return 0, fmt.Errorf("the request must have a Content-Length")
+	}
+
+	return uint64(r.ContentLength), nil
+}
+
 // NewHTTPHeadersExtractor creates a new HTTP header extractor
 func NewHTTPHeadersExtractor(headers ...string) Extractor {
 	return &httpHeaderExtractor{headers: headers}
@@ -64,22 +309,158 @@ type RateLimiterConfig struct {
 	Strategy    Strategy
 	Expiration  time.Duration
 	MaxRequests uint64
+	// DenyBodyFormat selects the body sent when a request is denied, defaults to plain text. It's also used for the
+	// 400 sent when the key can't be extracted, the JSON bodies then have the code of the error (see CodedError).
+	DenyBodyFormat DenyBodyFormat
+	// ExposeReason adds a header with the `Reason` of the decision, meant for debugging.
+	ExposeReason bool
+	// ExposeKeyHeader adds a `X-RateLimit-Key` header with the key the extractor returned for every limit (with the
+	// limit name appended for the extra limits), to find out why two clients share a counter. It's meant for
+	// debugging only and must not be turned on in production: keys are usually client IPs, API keys, user IDs or
+	// certificate subjects, so it sends identity information (or credentials) back in every response.
+	ExposeKeyHeader bool
+	// EmptyKey defines what happens when the extractor returns an empty key, defaults to a 400 response.
+	EmptyKey EmptyKeyBehavior
+	// FallbackKey is the key used for requests with an empty key when `EmptyKey` is `EmptyKeyFallback`.
+	FallbackKey string
+	// CountStatus, when set, only counts requests that got a response status it returns true for, like only
+	// counting requests that created something. Requests are still counted before the wrapped handler runs (so
+	// concurrent requests can't all get in before any of them is counted) and are refunded once it's done if the
+	// status doesn't match, so this requires a Strategy that implements Refunder.
+	CountStatus func(status int) bool
+	// RefundOnStatus, when set, refunds requests that got a response status it returns true for, like 5xx responses
+	// so server errors don't burn the client's budget. It works like CountStatus (and requires a Refunder as well),
+	// when both are set a request is refunded if either of them says so.
+	RefundOnStatus func(status int) bool
+	// Headers overrides the names of the rate limiting headers, when nil DefaultHeaderNames is used.
+	Headers *HeaderNames
+	// StateValues overrides the values of the state header, when nil DefaultStateValues is used.
+	StateValues *StateValues
+	// ExposePolicy adds a `RateLimit-Policy` header with the limit and window, like `50;w=60`, to every response so
+	// clients can configure themselves without having to find out the limits by trial and error.
+	ExposePolicy bool
+	// ExpiresAtFormat selects how the expires at header is formatted, defaults to RFC 3339.
+	ExpiresAtFormat ExpiresAtFormat
+	// TrustedUpstream, when set, skips rate limiting for requests already checked by a trusted upstream limiter.
+	TrustedUpstream *TrustedUpstreamConfig
+	// Limits are evaluated after the main limit using the same Strategy, a request is only allowed if it is allowed
+	// by all of them. Every limit is evaluated (and sends its own headers) even when an earlier one denied the
+	// request, so a request denied by one limit still counts towards the others that allowed it, unless CountStatus
+	// is set, in which case it's refunded from them.
+	Limits []LimitConfig
+	// HeaderBudget, when set, caps the rate limiting headers sent for the main limit and the `Limits`, by default
+	// headers are sent for all of them.
+	HeaderBudget *HeaderBudget
+	// RetryAfterJitter adds a random delay from zero up to it to the `Retry-After` sent on denied requests, so
+	// clients that were denied at the same time don't all come back at the same time. The window itself doesn't
+	// change, only what clients are told.
+	RetryAfterJitter time.Duration
+	// MaxRetryAfter, when set, caps how long denied clients are told to wait in the `Retry-After` header (and the
+	// JSON bodies) and how far out the expires at header says the limit resets, so clients of long windows aren't
+	// told to come back in an hour. Clients that come back earlier are denied again until the real reset, the limit
+	// itself doesn't change, only what clients are told. It's applied after the `RetryAfterJitter`.
+	MaxRetryAfter time.Duration
+	// FailureMode selects what happens when the strategy returns an error, defaults to FailClosed.
+	FailureMode FailureMode
+	// UnavailableRetryAfter is the `Retry-After` sent with FailUnavailable, defaults to DefaultUnavailableRetryAfter.
+	UnavailableRetryAfter time.Duration
+	// Cost, when set, computes the `Cost` of every request, like ContentLengthCost for limiting bytes instead of
+	// requests (`MaxRequests` is then the number of bytes). The same cost is used for all limits, so the strategy
+	// must support costs. Requests it fails for get a 400.
+	Cost func(r *http.Request) (uint64, error)
+	// ResponseSizeCost charges the bytes of the body the wrapped handler wrote as the cost of the request, which
+	// limits the bandwidth of the responses even when they're streamed without a `Content-Length`. The cost is only
+	// known after the request was allowed, so the `Cost` (or 1 without it) is reserved up front and settled to the
+	// bytes written once the wrapped handler is done: a response that takes the client over the limit is still sent
+	// in full and the requests after it are denied. It requires a Strategy that implements Committer, like the
+	// counter strategy, the sorted set strategy can't be used as it would keep a member per byte.
+	ResponseSizeCost bool
+	// Allowlist has keys that are never rate limited, like internal services. A request is allowed if the key of
+	// any of its limits is on it, without any limit being checked.
+	Allowlist []string
+	// Denylist has keys that are always denied with a 403, like abusive clients. A request is denied if the key of
+	// any of its limits is on it, without any limit being checked. It takes precedence over the Allowlist.
+	Denylist []string
+	// ServerTiming adds a `Server-Timing` entry with how long checking the limits took and the decision, like
+	// `ratelimit;dur=2.3;desc="allow"`, so it shows up in the browser developer tools. It exposes how the limiter
+	// works, so it's off by default.
+	ServerTiming bool
+	// PreWrite, when set, is called with the decision once it's made and the rate limiting headers are set, before
+	// the denied response is written or the wrapped handler is called, so it can add headers based on the result.
+	// It's called for allowed and denied requests (including the ones on the allowlist or denylist and the ones
+	// checked by a trusted upstream) but not when no limit could be checked. It must not write the status or the body.
+	PreWrite func(w http.ResponseWriter, result *Result)
+	// KillSwitch, when set and disabled, sends every request straight to the wrapped handler without rate limiting.
+	KillSwitch *KillSwitch
+	// ConcurrencyLimiter, when set, caps how many requests each client can have in flight: a slot is held for the
+	// key of the main limit (with `:concurrency` appended) while the wrapped handler runs, so a client can't open
+	// many slow requests at the same time. It's checked after the other limits allowed the request, without a
+	// Strategy only the concurrency is limited. Slots are released once the wrapped handler returns (even if it
+	// panics) and refreshed in the background while it runs. Requests that find all slots taken get
+	// `ConcurrencyStatus` and errors are handled like strategy errors, following the `FailureMode`.
+	ConcurrencyLimiter *ConcurrencyLimiter
+	// ConcurrencyStatus is the status sent when all slots of the ConcurrencyLimiter are taken, defaults to 429.
+	ConcurrencyStatus int
+	// Debug logs every limit checked to the Logger, with the key, the limit, the result and how long the strategy
+	// took, followed by the decision for the request. It logs the keys (which can be IPs or API keys) and an entry
+	// per limit for every request, so it's meant for local debugging and not for production.
+	Debug bool
+	// Logger is where `Debug` logs to, nothing is logged without it.
+	Logger Logger
 }
 
 // NewHTTPRateLimiterHandler wraps an existing http.Handler object performing rate limiting before
 // sending the request to the wrapped handler. If any errors happen while trying to rate limit a request
 // or if the request is denied, the rate limiting handler will send a response to the client and will not
 // call the wrapped handler.
+//
+// Handlers can be chained (like one per tier) but prefer a single handler with `Limits`, as it sends headers for
+// all limits. When chained, the outer handler wins: an inner handler that finds the rate limiting headers already
+// set keeps them and only sends its own if it denies the request, as it's the one responding. The policy header
+// is the exception, every handler appends its limits to it.
 func NewHTTPRateLimiterHandler(originalHandler http.Handler, config *RateLimiterConfig) http.Handler {
+	limits := make([]LimitConfig, 0, len(config.Limits)+1)
+	limits = append(limits, LimitConfig{
+		Extractor:   config.Extractor,
+		Expiration:  config.Expiration,
+		MaxRequests: config.MaxRequests,
+	})
+	limits = append(limits, config.Limits...)
+
 	return &httpRateLimiterHandler{
-		handler: originalHandler,
-		config:  config,
+		handler:   originalHandler,
+		config:    config,
+		limits:    limits,
+		allowlist: keySet(config.Allowlist),
+		denylist:  keySet(config.Denylist),
+		now:       time.Now,
+		random:    rand.Int63n,
+		errors:    &errorTracker{},
+	}
+}
+
+// Limit returns a middleware that wraps handlers with NewHTTPRateLimiterHandler, so limits can be set per route and
+// composed with other middleware, like `mux.Handle("/login", Limit(loginConfig)(loginHandler))`. Every handler it
+// wraps gets its own rate limiting handler, but the keys only come from the extractors, so routes whose configs
+// share a strategy (or a Redis) count against the same keys. Give those routes extractors that tell them apart,
+// like a NewNormalizingExtractor that adds the route to the key.
+func Limit(config *RateLimiterConfig) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return NewHTTPRateLimiterHandler(handler, config)
 	}
 }
 
 type httpRateLimiterHandler struct {
 	handler http.Handler
 	config  *RateLimiterConfig
+	// limits has the main limit (with an empty name) followed by the extra limits from the config
+	limits    []LimitConfig
+	allowlist map[string]struct{}
+	denylist  map[string]struct{}
+	now       func() time.Time
+	// random returns a number from 0 up to n (exclusive), it's used for the retry after jitter
+	random func(n int64) int64
+	errors *errorTracker
 }
 
 func (h *httpRateLimiterHandler) writeRespone(writer http.ResponseWriter, status int, msg string, args ...interface{}) {
@@ -90,41 +471,843 @@ func (h *httpRateLimiterHandler) writeRespone(writer http.ResponseWriter, status
 	}
 }
 
+func (h *httpRateLimiterHandler) writeJSON(writer http.ResponseWriter, contentType string, status int, body interface{}) {
+	writer.Header().Set("Content-Type", contentType)
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		fmt.Printf("failed to write body to HTTP request: %v", err)
+	}
+}
+
+func (h *httpRateLimiterHandler) expiresAt(result *Result) string {
+	switch h.config.ExpiresAtFormat {
+	case ExpiresAtUnix:
+		return strconv.FormatInt(h.advertisedExpiresAt(result).Unix(), 10)
+	case ExpiresAtDeltaSeconds:
+		return strconv.FormatInt(h.retryAfter(result), 10)
+	default:
+		return h.advertisedExpiresAt(result).Format(time.RFC3339)
+	}
+}
+
+// advertisedExpiresAt is the expiration told to clients, capped at `MaxRetryAfter` from now when it's set.
+func (h *httpRateLimiterHandler) advertisedExpiresAt(result *Result) time.Time {
+	if h.config.MaxRetryAfter <= 0 {
+		return result.ExpiresAt
+	}
+
+	if latest := h.now().Add(h.config.MaxRetryAfter); result.ExpiresAt.After(latest) {
+		return latest.In(result.ExpiresAt.Location())
+	}
+
+	return result.ExpiresAt
+}
+
+// writeUnavailable tells the client the service can't take requests right now and when to try again.
+func (h *httpRateLimiterHandler) writeUnavailable(writer http.ResponseWriter, err error) {
+	retry := h.config.UnavailableRetryAfter
+	if retry <= 0 {
+		retry = DefaultUnavailableRetryAfter
+	}
+
+	writer.Header().Set(retryAfter, strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+	h.writeRespone(writer, http.StatusServiceUnavailable, "rate limiting is unavailable, try again later: %v", err)
+}
+
+// policy formats the limits following the RateLimit header fields draft, the window is in seconds. With a header
+// budget the limits that allow the fewest requests per second are the ones reported.
+func (h *httpRateLimiterHandler) policy() string {
+	limits := h.limits
+	budget := h.config.HeaderBudget
+
+	if budget != nil {
+		limits = append([]LimitConfig{}, h.limits...)
+		sort.SliceStable(limits, func(i, j int) bool {
+			return float64(limits[i].MaxRequests)/limits[i].Expiration.Seconds() < float64(limits[j].MaxRequests)/limits[j].Expiration.Seconds()
+		})
+	}
+
+	policies := make([]string, 0, len(limits))
+	size := 0
+
+	for i, limit := range limits {
+		policy := fmt.Sprintf("%v;w=%v", limit.MaxRequests, int64(math.Ceil(limit.Expiration.Seconds())))
+
+		if budget != nil && i > 0 {
+			if budget.MaxLimits > 0 && i >= budget.MaxLimits {
+				break
+			}
+
+			// the 2 is the comma and space that separate the policies
+			if budget.MaxBytes > 0 && size+len(policy)+2 > budget.MaxBytes {
+				break
+			}
+		}
+
+		policies = append(policies, policy)
+		size += len(policy) + 2
+	}
+
+	return strings.Join(policies, ", ")
+}
+
+// retryAfter is how many seconds the client should wait before trying again, rounded up so clients
+// that follow it to the letter don't come back a little too early and get denied again.
+func (h *httpRateLimiterHandler) retryAfter(result *Result) int64 {
+	return h.retryAfterWithJitter(result, 0)
+}
+
+func (h *httpRateLimiterHandler) retryAfterWithJitter(result *Result, jitter time.Duration) int64 {
+	wait := result.ExpiresAt.Sub(h.now()) + jitter
+	if h.config.MaxRetryAfter > 0 && wait > h.config.MaxRetryAfter {
+		wait = h.config.MaxRetryAfter
+	}
+
+	seconds := math.Ceil(wait.Seconds())
+	if seconds < 0 {
+		return 0
+	}
+
+	return int64(seconds)
+}
+
+// jitter is a random delay up to the configured jitter, in milliseconds so short jitters still spread clients.
+func (h *httpRateLimiterHandler) jitter() time.Duration {
+	if h.config.RetryAfterJitter < time.Millisecond {
+		return 0
+	}
+
+	return time.Duration(h.random(h.config.RetryAfterJitter.Milliseconds()+1)) * time.Millisecond
+}
+
+// writeExtractError tells the client the key could not be extracted from the request, with the code of the error on
+// the JSON bodies.
+func (h *httpRateLimiterHandler) writeExtractError(writer http.ResponseWriter, err error) {
+	message := fmt.Sprintf("failed to collect rate limiting key from request: %v", err)
+
+	switch h.config.DenyBodyFormat {
+	case DenyBodyJSON:
+		h.writeJSON(writer, "application/json", http.StatusBadRequest, &extractErrorBody{
+			Error: message,
+			Code:  errorCode(err),
+		})
+	case DenyBodyProblemJSON:
+		h.writeJSON(writer, "application/problem+json", http.StatusBadRequest, &extractProblemBody{
+			Type:   "about:blank",
+			Title:  http.StatusText(http.StatusBadRequest),
+			Status: http.StatusBadRequest,
+			Detail: message,
+			Code:   errorCode(err),
+		})
+	default:
+		h.writeRespone(writer, http.StatusBadRequest, "%v", message)
+	}
+}
+
+func (h *httpRateLimiterHandler) writeDenied(writer http.ResponseWriter, result *Result) {
+	retry := h.retryAfterWithJitter(result, h.jitter())
+	writer.Header().Set(retryAfter, strconv.FormatInt(retry, 10))
+	h.preWrite(writer, result)
+
+	switch h.config.DenyBodyFormat {
+	case DenyBodyJSON:
+		h.writeJSON(writer, "application/json", http.StatusTooManyRequests, &deniedBody{
+			Error:      deniedMessage,
+			RetryAfter: retry,
+		})
+	case DenyBodyProblemJSON:
+		h.writeJSON(writer, "application/problem+json", http.StatusTooManyRequests, &problemBody{
+			Type:       problemType,
+			Title:      http.StatusText(http.StatusTooManyRequests),
+			Status:     http.StatusTooManyRequests,
+			Detail:     deniedMessage,
+			RetryAfter: retry,
+		})
+	default:
+		h.writeRespone(writer, http.StatusTooManyRequests, deniedMessage)
+	}
+}
+
 // ServeHTTP performs rate limiting with the configuration it was provided and if there were not errors
 // and the request was allowed it is sent to the wrapped handler. It also adds rate limiting headers that will be
 // sent to the client to make it aware of what state it is in terms of rate limiting.
 func (h *httpRateLimiterHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	key, err := h.config.Extractor.Extract(request)
-	if err != nil {
-		h.writeRespone(writer, http.StatusBadRequest, "failed to collect rate limiting key from request: %v", err)
+	if h.config.KillSwitch != nil && !h.config.KillSwitch.Enabled() {
+		h.handler.ServeHTTP(writer, request)
 		return
 	}
 
-	result, err := h.config.Strategy.Run(request.Context(), &Request{
-		Key:      key,
-		Limit:    h.config.MaxRequests,
-		Duration: h.config.Expiration,
-	})
+	// an outer handler already sent its headers, they're kept unless this handler denies the request
+	chained := h.chained(writer)
 
-	if err != nil {
-		h.writeRespone(writer, http.StatusInternalServerError, "failed to run rate limiting for request: %v", err)
+	if h.config.ExposePolicy {
+		policy := h.policy()
+		if existing := writer.Header().Get(rateLimitPolicy); existing != "" {
+			policy = existing + ", " + policy
+		}
+		writer.Header().Set(rateLimitPolicy, policy)
+	}
+
+	if result, ok := h.trustedUpstream(request); ok {
+		if !chained {
+			h.writeHeaders(writer, "", result)
+		}
+		h.preWrite(writer, result)
+		h.handler.ServeHTTP(writer, h.withResult(request, result))
 		return
 	}
 
+	var refunder Refunder
+
+	if h.config.CountStatus != nil || h.config.RefundOnStatus != nil {
+		var ok bool
+		if refunder, ok = h.config.Strategy.(Refunder); !ok || !supportsRefunds(h.config.Strategy) {
+			h.writeRespone(writer, http.StatusInternalServerError, "the rate limiting strategy does not support refunds")
+			return
+		}
+	}
+
+	var committer Committer
+
+	if h.config.ResponseSizeCost {
+		var ok bool
+		if committer, ok = h.config.Strategy.(Committer); !ok || !supportsCommits(h.config.Strategy) {
+			h.writeRespone(writer, http.StatusInternalServerError, "the rate limiting strategy does not support commits")
+			return
+		}
+	}
+
+	var cost uint64
+
+	if h.config.Cost != nil {
+		var err error
+		if cost, err = h.config.Cost(request); err != nil {
+			h.writeRespone(writer, http.StatusBadRequest, "failed to compute the cost of the request: %v", err)
+			return
+		}
+	}
+
+	// all keys are extracted before any limit is checked so listed keys don't count against the other limits
+	keys := make([]limitKey, 0, len(h.limits))
+
+	for _, limit := range h.limits {
+		key, err := limit.Extractor.Extract(request)
+		if err != nil {
+			if h.debugging() {
+				h.debug(request, "failed to extract the rate limiting key", "limit", limit.Name, "error", err.Error())
+			}
+
+			h.writeExtractError(writer, err)
+			return
+		}
+
+		if key == "" {
+			switch h.config.EmptyKey {
+			case EmptyKeyAllow:
+				continue
+			case EmptyKeyFallback:
+				key = h.config.FallbackKey
+			default:
+				h.writeExtractError(writer, extractError(CodeEmptyKey, "the key is empty"))
+				return
+			}
+		}
+
+		keys = append(keys, limitKey{limit: limit, key: key})
+	}
+
+	if h.config.ExposeKeyHeader && !chained {
+		for _, k := range keys {
+			writer.Header().Set(limitHeader(rateLimitKey, k.limit.Name), k.key)
+		}
+	}
+
+	if result, ok := h.listed(keys); ok {
+		request = h.withResult(request, result)
+		h.preWrite(writer, result)
+
+		if result.State == Deny {
+			h.writeRespone(writer, http.StatusForbidden, forbiddenMessage)
+			return
+		}
+
+		h.handler.ServeHTTP(writer, request)
+		return
+	}
+
+	allowed := make([]*Request, 0, len(keys))
+	evaluated := make([]evaluatedLimit, 0, len(keys))
+	var denied *Result
+	bypassed := false
+	started := h.now()
+
+	// without a strategy only the concurrency is limited
+	limited := keys
+	if h.config.Strategy == nil {
+		limited = nil
+	}
+
+	for _, k := range limited {
+		limit, key := k.limit, k.key
+
+		limitRequest := &Request{
+			Key:      key,
+			Limit:    limit.MaxRequests,
+			Duration: limit.Expiration,
+			Action:   limit.Name,
+			Cost:     cost,
+		}
+
+		if refunder != nil || committer != nil {
+			// the nonce is what identifies this request when it has to be refunded or committed
+			limitRequest.Nonce = uuid.New().String()
+		}
+
+		var limitStarted time.Time
+		if h.debugging() {
+			limitStarted = h.now()
+		}
+
+		result, err := h.config.Strategy.Run(request.Context(), limitRequest)
+
+		if err != nil {
+			if h.debugging() {
+				h.debug(request, "failed to check the rate limit",
+					"limit", limit.Name,
+					"key", key,
+					"error", err.Error(),
+					"duration", h.now().Sub(limitStarted),
+				)
+			}
+
+			h.errors.record(h.now(), err)
+
+			switch h.config.FailureMode {
+			case FailOpen:
+				// this limit can't be checked, the request is still checked by the other limits
+				bypassed = true
+				continue
+			case FailUnavailable:
+				h.writeUnavailable(writer, err)
+			default:
+				h.writeRespone(writer, http.StatusInternalServerError, "failed to run rate limiting for request: %v", err)
+			}
+			h.refund(refunder, allowed)
+			return
+		}
+
+		if h.debugging() {
+			h.debug(request, "checked the rate limit",
+				"limit", limit.Name,
+				"key", key,
+				"max_requests", limit.MaxRequests,
+				"expiration", limit.Expiration,
+				"state", decisionName(result.State),
+				"total_requests", result.TotalRequests,
+				"reason", string(result.Reason),
+				"expires_at", result.ExpiresAt,
+				"duration", h.now().Sub(limitStarted),
+			)
+		}
+
+		evaluated = append(evaluated, evaluatedLimit{
+			name:   limit.Name,
+			limit:  limit.MaxRequests,
+			result: result,
+		})
+
+		if result.State == Deny {
+			// the client can only come back once all limits that denied it have expired
+			if denied == nil || result.ExpiresAt.After(denied.ExpiresAt) {
+				denied = result
+			}
+			continue
+		}
+
+		allowed = append(allowed, limitRequest)
+	}
+
 	// set the rate limiting headers both on allow or deny results so the client knows what is going on
-	writer.Header().Set(rateLimitingTotalRequests, strconv.FormatUint(result.TotalRequests, 10))
-	writer.Header().Set(rateLimitingState, stateStrings[result.State])
-	writer.Header().Set(rateLimitingExpiresAt, result.ExpiresAt.Format(time.RFC3339))
+	if !chained || denied != nil {
+		h.writeLimitHeaders(writer, evaluated)
+	}
+
+	if h.config.ServerTiming {
+		h.writeServerTiming(writer, h.now().Sub(started), denied)
+	}
+
+	if h.debugging() {
+		decision := State(Allow)
+		if denied != nil {
+			decision = Deny
+		}
+
+		h.debug(request, "rate limited the request",
+			"state", decisionName(decision),
+			"limits", len(evaluated),
+			"bypassed", bypassed,
+			"duration", h.now().Sub(started),
+		)
+	}
 
 	// when the state is Deny, just return a 429 response to the client and stop the request handling flow
-	if result.State == Deny {
-		h.writeRespone(writer, http.StatusTooManyRequests, "you have sent too many requests to this service, slow down please")
+	if denied != nil {
+		// nothing after this reads the request, this is for middleware that runs before the handler
+		h.withResult(request, denied)
+		h.writeDenied(writer, denied)
+		h.refund(refunder, allowed)
 		return
 	}
 
+	if h.config.ConcurrencyLimiter != nil {
+		release, err := h.acquireSlot(request, keys)
+
+		switch {
+		case err == nil:
+			// deferred so the slot is given back even if the wrapped handler panics
+			defer release()
+		case errors.Is(err, ErrConcurrencyLimitReached):
+			h.writeRespone(writer, h.concurrencyStatus(), concurrencyMessage)
+			h.refund(refunder, allowed)
+			return
+		case h.config.FailureMode == FailOpen:
+			h.errors.record(h.now(), err)
+			bypassed = true
+		case h.config.FailureMode == FailUnavailable:
+			h.errors.record(h.now(), err)
+			h.writeUnavailable(writer, err)
+			h.refund(refunder, allowed)
+			return
+		default:
+			h.errors.record(h.now(), err)
+			h.writeRespone(writer, http.StatusInternalServerError, "failed to run rate limiting for request: %v", err)
+			h.refund(refunder, allowed)
+			return
+		}
+	}
+
+	if bypassed {
+		writer.Header().Set(rateLimitBypass, BypassBackendUnavailable)
+	}
+
+	if len(evaluated) > 0 {
+		result := tightest(evaluated)
+		request = h.withResult(request, result)
+		h.preWrite(writer, result)
+	}
+
 	// if the request was not denied we assume it was allowed and call the wrapped handler.
 	// by leaving this to the end we make sure the wrapped handler is only called once and doesn't have to worry
 	// about any rate limiting at all (it doesn't even have to know there was rate limiting happening for this request)
 	// as we have already set the headers, so when the handler flushes the response the headers above will be sent.
-	h.handler.ServeHTTP(writer, request)
+	if refunder == nil && committer == nil {
+		h.handler.ServeHTTP(writer, request)
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: writer}
+	h.handler.ServeHTTP(recorder, request)
+
+	if !h.counted(recorder.Status()) {
+		h.refund(refunder, allowed)
+		return
+	}
+
+	h.commit(committer, allowed, recorder.Written())
+}
+
+// acquireSlot takes a concurrency slot for the key of the main limit, requests without it (like the ones with an
+// empty key that are allowed) are not limited and get a release that does nothing.
+func (h *httpRateLimiterHandler) acquireSlot(request *http.Request, keys []limitKey) (func(), error) {
+	for _, k := range keys {
+		if k.limit.Name == "" {
+			return h.config.ConcurrencyLimiter.ConnectionGuard(request.Context(), k.key+":concurrency")
+		}
+	}
+
+	return func() {}, nil
+}
+
+func (h *httpRateLimiterHandler) concurrencyStatus() int {
+	if h.config.ConcurrencyStatus == 0 {
+		return http.StatusTooManyRequests
+	}
+
+	return h.config.ConcurrencyStatus
+}
+
+// preWrite calls the PreWrite hook when it's set.
+func (h *httpRateLimiterHandler) preWrite(writer http.ResponseWriter, result *Result) {
+	if h.config.PreWrite != nil {
+		h.config.PreWrite(writer, result)
+	}
+}
+
+// writeServerTiming adds a `Server-Timing` entry for the limits, chained handlers add one each.
+func (h *httpRateLimiterHandler) writeServerTiming(writer http.ResponseWriter, took time.Duration, denied *Result) {
+	decision := "allow"
+	if denied != nil {
+		decision = "deny"
+	}
+
+	duration := strconv.FormatFloat(float64(took)/float64(time.Millisecond), 'f', 1, 64)
+	writer.Header().Add(serverTiming, fmt.Sprintf("ratelimit;dur=%v;desc=\"%v\"", duration, decision))
+}
+
+// counted checks if a request that got a response with the status should still be counted.
+func (h *httpRateLimiterHandler) counted(status int) bool {
+	if h.config.CountStatus != nil && !h.config.CountStatus(status) {
+		return false
+	}
+
+	return h.config.RefundOnStatus == nil || !h.config.RefundOnStatus(status)
+}
+
+// limitKey is the key extracted from the request for one of the limits.
+type limitKey struct {
+	limit LimitConfig
+	key   string
+}
+
+// listed returns the result for requests with a key on the denylist or the allowlist.
+func (h *httpRateLimiterHandler) listed(keys []limitKey) (*Result, bool) {
+	for _, k := range keys {
+		if _, ok := h.denylist[k.key]; ok {
+			return &Result{
+				State:  Deny,
+				Reason: ReasonDenylisted,
+			}, true
+		}
+	}
+
+	for _, k := range keys {
+		if _, ok := h.allowlist[k.key]; ok {
+			return &Result{
+				State:  Allow,
+				Reason: ReasonAllowlisted,
+			}, true
+		}
+	}
+
+	return nil, false
+}
+
+// withResult returns the request with the result stored in its context, see ResultFromContext. If the context
+// came from WithResultContext the result is also visible to whoever created it.
+func (h *httpRateLimiterHandler) withResult(request *http.Request, result *Result) *http.Request {
+	return request.WithContext(contextWithResult(request.Context(), result))
+}
+
+// keySet builds a set out of a list of keys, nil if the list is empty.
+func keySet(keys []string) map[string]struct{} {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+
+	return set
+}
+
+// refund gives back the requests counted by the limits, it does nothing without a refunder.
+func (h *httpRateLimiterHandler) refund(refunder Refunder, requests []*Request) {
+	if refunder == nil {
+		return
+	}
+
+	for _, r := range requests {
+		// the request might have been cancelled by now but the refund must still happen
+		if err := refunder.Refund(context.Background(), r); err != nil {
+			fmt.Printf("failed to refund request for key %v: %v", r.Key, err)
+		}
+	}
+}
+
+func (h *httpRateLimiterHandler) commit(committer Committer, requests []*Request, actualCost uint64) {
+	if committer == nil {
+		return
+	}
+
+	for _, r := range requests {
+		// the request might have been cancelled by now but the commit must still happen
+		if err := committer.Commit(context.Background(), r, actualCost); err != nil {
+			fmt.Printf("failed to commit request for key %v: %v", r.Key, err)
+		}
+	}
+}
+
+// evaluatedLimit is the result of one of the limits of the handler for a request.
+type evaluatedLimit struct {
+	name   string
+	limit  uint64
+	result *Result
+}
+
+// remaining is how many requests are left on the limit.
+func (e evaluatedLimit) remaining() uint64 {
+	if e.result.State == Deny || e.result.TotalRequests >= e.limit {
+		return 0
+	}
+
+	return e.limit - e.result.TotalRequests
+}
+
+// tightest returns the result of the limit with the fewest requests left.
+func tightest(evaluated []evaluatedLimit) *Result {
+	result := evaluated[0]
+	for _, e := range evaluated[1:] {
+		if e.remaining() < result.remaining() {
+			result = e
+		}
+	}
+
+	return result.result
+}
+
+// writeLimitHeaders sets the rate limiting headers for every limit that was evaluated, within the header budget.
+func (h *httpRateLimiterHandler) writeLimitHeaders(writer http.ResponseWriter, evaluated []evaluatedLimit) {
+	budget := h.config.HeaderBudget
+	if budget == nil {
+		for _, e := range evaluated {
+			h.writeHeaders(writer, e.name, e.result)
+		}
+		return
+	}
+
+	evaluated = append([]evaluatedLimit{}, evaluated...)
+	sort.SliceStable(evaluated, func(i, j int) bool {
+		return evaluated[i].remaining() < evaluated[j].remaining()
+	})
+
+	size := 0
+
+	for i, e := range evaluated {
+		headers := h.headers(e.name, e.result)
+
+		if i > 0 {
+			if budget.MaxLimits > 0 && i >= budget.MaxLimits {
+				return
+			}
+
+			if budget.MaxBytes > 0 && size+headersSize(headers) > budget.MaxBytes {
+				return
+			}
+		}
+
+		for _, header := range headers {
+			writer.Header().Set(header[0], header[1])
+		}
+
+		size += headersSize(headers)
+	}
+}
+
+// writeHeaders sets the rate limiting headers for a result.
+func (h *httpRateLimiterHandler) writeHeaders(writer http.ResponseWriter, name string, result *Result) {
+	for _, header := range h.headers(name, result) {
+		writer.Header().Set(header[0], header[1])
+	}
+}
+
+// headers returns the names and values of the rate limiting headers for a result, the headers for the extra limits
+// have the limit name appended to them so they don't overwrite the headers of the main limit. Disabled headers are
+// not included.
+func (h *httpRateLimiterHandler) headers(name string, result *Result) [][2]string {
+	names := h.headerNames()
+	headers := make([][2]string, 0, 4)
+
+	add := func(header string, value string) {
+		if header != "" {
+			headers = append(headers, [2]string{limitHeader(header, name), value})
+		}
+	}
+
+	add(names.TotalRequests, strconv.FormatUint(result.TotalRequests, 10))
+	add(names.State, h.stateValue(result.State))
+
+	// results that didn't come from a strategy might not know when the window expires
+	if !result.ExpiresAt.IsZero() {
+		add(names.ExpiresAt, h.expiresAt(result))
+
+		// the reset headers are off by default, so they only read the clock when enabled
+		if names.ResetSeconds != "" {
+			add(names.ResetSeconds, strconv.FormatInt(h.retryAfter(result), 10))
+		}
+		if names.ResetDate != "" {
+			add(names.ResetDate, h.advertisedExpiresAt(result).UTC().Format(http.TimeFormat))
+		}
+	}
+
+	if h.config.ExposeReason {
+		add(rateLimitingReason, string(result.Reason))
+	}
+
+	return headers
+}
+
+func (h *httpRateLimiterHandler) headerNames() *HeaderNames {
+	if h.config.Headers == nil {
+		return DefaultHeaderNames()
+	}
+
+	return h.config.Headers
+}
+
+// stateValue is the value of the state header for a state.
+func (h *httpRateLimiterHandler) stateValue(state State) string {
+	values := h.config.StateValues
+	if values == nil {
+		values = DefaultStateValues()
+	}
+
+	if state == Deny {
+		return values.Deny
+	}
+
+	return values.Allow
+}
+
+// chained checks if the rate limiting headers were already set by an outer handler.
+func (h *httpRateLimiterHandler) chained(writer http.ResponseWriter) bool {
+	names := h.headerNames()
+
+	for _, header := range []string{names.TotalRequests, names.State, names.ExpiresAt, names.ResetSeconds, names.ResetDate} {
+		if header != "" && writer.Header().Get(header) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headersSize is how many bytes the names and values of the headers take.
+func headersSize(headers [][2]string) int {
+	size := 0
+	for _, header := range headers {
+		size += len(header[0]) + len(header[1])
+	}
+
+	return size
+}
+
+// limitHeader appends the name of a limit to a header name, disabled headers (with an empty name) stay disabled.
+func limitHeader(header string, name string) string {
+	if header == "" || name == "" {
+		return header
+	}
+
+	return header + "-" + name
+}
+
+// trustedUpstream checks if the request comes from a trusted upstream limiter and builds the result from the
+// remaining count it sent. Requests with the wrong secret or an invalid count are rate limited as usual.
+func (h *httpRateLimiterHandler) trustedUpstream(request *http.Request) (*Result, bool) {
+	config := h.config.TrustedUpstream
+	if config == nil || config.Secret == "" {
+		return nil, false
+	}
+
+	secretHeader := config.SecretHeader
+	if secretHeader == "" {
+		secretHeader = rateLimitSecret
+	}
+
+	remainingHeader := config.RemainingHeader
+	if remainingHeader == "" {
+		remainingHeader = rateLimitRemaining
+	}
+
+	secret := request.Header.Get(secretHeader)
+	// the secret must never get to the wrapped handler, it could end up in logs
+	request.Header.Del(secretHeader)
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(config.Secret)) != 1 {
+		return nil, false
+	}
+
+	remaining, err := strconv.ParseUint(strings.TrimSpace(request.Header.Get(remainingHeader)), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	var total uint64
+	if remaining < h.config.MaxRequests {
+		total = h.config.MaxRequests - remaining
+	}
+
+	return &Result{
+		State:         Allow,
+		TotalRequests: total,
+		Reason:        ReasonTrustedUpstream,
+	}, true
+}
+
+// statusRecorder keeps the status code the wrapped handler sent and how many bytes it wrote so they can be inspected
+// once the handler is done. It forwards Flush and Hijack to the writer it wraps when it supports them and unwraps to
+// it for http.ResponseController, so streaming responses and connection upgrades keep working behind it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written uint64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.written += uint64(n)
+	return n, err
+}
+
+// Flush sends what was written so far to the client if the wrapped writer supports it, flushing sends a 200 if the
+// handler didn't send a status yet.
+func (s *statusRecorder) Flush() {
+	flusher, ok := s.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	flusher.Flush()
+}
+
+// Hijack takes over the connection, like for a WebSocket upgrade, it fails if the wrapped writer doesn't support it.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking the connection")
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped writer, so http.ResponseController can reach the features this one doesn't forward.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Written is how many bytes of the body the handler wrote.
+func (s *statusRecorder) Written() uint64 {
+	return s.written
+}
+
+// Status is the status code sent by the handler, a handler that doesn't write anything sends a 200.
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
 }
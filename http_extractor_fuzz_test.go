@@ -0,0 +1,53 @@
+//go:build go1.18
+// +build go1.18
+
+package redis_rate_limiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func FuzzHTTPHeaderExtractor_Extract(f *testing.F) {
+	f.Add("10.10.10.10")
+	f.Add("  some-user  ")
+	f.Add("some-user\r\nX-Injected: true")
+	f.Add("some\x00user")
+	f.Add(strings.Repeat("a", MaxHeaderValueLength+1))
+	f.Add("\xff\xfe")
+
+	extractor := NewHTTPHeadersExtractor(forwardedFor)
+
+	f.Fuzz(func(t *testing.T, value string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		// bypasses the header canonicalization so the raw value gets to the extractor
+		req.Header[forwardedFor] = []string{value}
+
+		key, err := extractor.Extract(req)
+		if err != nil {
+			return
+		}
+
+		if key == "" {
+			t.Fatalf("an empty key was returned for %q", value)
+		}
+
+		if len(key) > MaxHeaderValueLength {
+			t.Fatalf("the key for %q is longer than %v bytes", value, MaxHeaderValueLength)
+		}
+
+		if !utf8.ValidString(key) {
+			t.Fatalf("the key for %q is not valid UTF-8", value)
+		}
+
+		for _, c := range key {
+			if unicode.IsControl(c) {
+				t.Fatalf("the key for %q has control characters", value)
+			}
+		}
+	})
+}
@@ -1,13 +1,18 @@
 package redis_rate_limiter
 
 import (
+	"bytes"
+	"context"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,6 +23,7 @@ const (
 
 var (
 	_ http.Handler = &handleFuncWrapper{}
+	_ Extractor    = extractorFunc(nil)
 )
 
 type handleFuncWrapper struct {
@@ -28,6 +34,12 @@ func (h *handleFuncWrapper) ServeHTTP(writer http.ResponseWriter, request *http.
 	h.handleFunc(writer, request)
 }
 
+type extractorFunc func(r *http.Request) (string, error)
+
+func (e extractorFunc) Extract(r *http.Request) (string, error) {
+	return e(r)
+}
+
 func TestNewHTTPHeadersExtractor(t *testing.T) {
 	tt := []struct {
 		name               string
@@ -37,6 +49,7 @@ func TestNewHTTPHeadersExtractor(t *testing.T) {
 		advance            time.Duration
 		lastResponseStatus int
 		matchedHeaders     map[string]string
+		lastBody           string
 	}{
 		{
 			name: "a request that is not rate limited",
@@ -49,13 +62,15 @@ func TestNewHTTPHeadersExtractor(t *testing.T) {
 			matchedHeaders: map[string]string{
 				rateLimitingState:         "Allow",
 				rateLimitingTotalRequests: "10",
+				rateLimitPolicy:           "50;w=60",
 			},
 			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
 				return &RateLimiterConfig{
-					Extractor:   NewHTTPHeadersExtractor(forwardedFor),
-					Strategy:    NewCounterStrategy(client, now),
-					Expiration:  time.Minute,
-					MaxRequests: 50,
+					Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:     NewCounterStrategy(client, now),
+					Expiration:   time.Minute,
+					MaxRequests:  50,
+					ExposePolicy: true,
 				}
 			},
 		},
@@ -70,13 +85,286 @@ func TestNewHTTPHeadersExtractor(t *testing.T) {
 			matchedHeaders: map[string]string{
 				rateLimitingState:         "Deny",
 				rateLimitingTotalRequests: "50",
+				rateLimitingReason:        "guard_rejected",
 			},
 			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
 				return &RateLimiterConfig{
-					Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+					Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:     NewSortedSetCounterStrategy(client, now),
+					Expiration:   time.Minute,
+					MaxRequests:  50,
+					ExposeReason: true,
+				}
+			},
+		},
+		{
+			name: "a request that is rate limited with a JSON body",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+			},
+			totalRequests:      51,
+			lastResponseStatus: http.StatusTooManyRequests,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				"Content-Type": "application/json",
+				retryAfter:     "10",
+			},
+			lastBody: `{"error":"you have sent too many requests to this service, slow down please","retry_after":10}` + "\n",
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:      NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:       NewSortedSetCounterStrategy(client, now),
+					Expiration:     time.Minute,
+					MaxRequests:    50,
+					DenyBodyFormat: DenyBodyJSON,
+				}
+			},
+		},
+		{
+			name: "a request that is rate limited with a problem details body",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+			},
+			totalRequests:      51,
+			lastResponseStatus: http.StatusTooManyRequests,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				"Content-Type": "application/problem+json",
+				retryAfter:     "10",
+			},
+			lastBody: `{"type":"https://datatracker.ietf.org/doc/html/rfc6585#section-4","title":"Too Many Requests","status":429,"detail":"you have sent too many requests to this service, slow down please","retry_after":10}` + "\n",
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:      NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:       NewSortedSetCounterStrategy(client, now),
+					Expiration:     time.Minute,
+					MaxRequests:    50,
+					DenyBodyFormat: DenyBodyProblemJSON,
+				}
+			},
+		},
+		{
+			name:               "an empty key fails the request by default",
+			builder:            func(r *http.Request) {},
+			totalRequests:      3,
+			lastResponseStatus: http.StatusBadRequest,
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor: extractorFunc(func(r *http.Request) (string, error) {
+						return "", nil
+					}),
+					Strategy:    NewSortedSetCounterStrategy(client, now),
+					Expiration:  time.Minute,
+					MaxRequests: 2,
+				}
+			},
+		},
+		{
+			name:               "an empty key bypasses rate limiting when allowed",
+			builder:            func(r *http.Request) {},
+			totalRequests:      3,
+			lastResponseStatus: http.StatusOK,
+			matchedHeaders: map[string]string{
+				rateLimitingState: "",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor: extractorFunc(func(r *http.Request) (string, error) {
+						return "", nil
+					}),
+					Strategy:    NewSortedSetCounterStrategy(client, now),
+					Expiration:  time.Minute,
+					MaxRequests: 2,
+					EmptyKey:    EmptyKeyAllow,
+				}
+			},
+		},
+		{
+			name:               "an empty key uses the fallback key",
+			builder:            func(r *http.Request) {},
+			totalRequests:      3,
+			lastResponseStatus: http.StatusTooManyRequests,
+			matchedHeaders: map[string]string{
+				rateLimitingState: "Deny",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor: extractorFunc(func(r *http.Request) (string, error) {
+						return "", nil
+					}),
 					Strategy:    NewSortedSetCounterStrategy(client, now),
 					Expiration:  time.Minute,
+					MaxRequests: 2,
+					EmptyKey:    EmptyKeyFallback,
+					FallbackKey: "anonymous",
+				}
+			},
+		},
+		{
+			name: "a request with custom header names",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+			},
+			totalRequests:      10,
+			lastResponseStatus: http.StatusOK,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				"X-RateLimit-Used":        "10",
+				"X-RateLimit-State":       "Allow",
+				rateLimitingState:         "",
+				rateLimitingTotalRequests: "",
+				rateLimitingExpiresAt:     "",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:    NewCounterStrategy(client, now),
+					Expiration:  time.Minute,
+					MaxRequests: 50,
+					Headers: &HeaderNames{
+						TotalRequests: "X-RateLimit-Used",
+						State:         "X-RateLimit-State",
+					},
+				}
+			},
+		},
+		{
+			name: "a request with custom state values",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+			},
+			totalRequests:      10,
+			lastResponseStatus: http.StatusOK,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingState: "allowed",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:    NewCounterStrategy(client, now),
+					Expiration:  time.Minute,
 					MaxRequests: 50,
+					StateValues: &StateValues{Allow: "allowed", Deny: "blocked"},
+				}
+			},
+		},
+		{
+			name: "a denied request with custom state values",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+			},
+			totalRequests:      11,
+			lastResponseStatus: http.StatusTooManyRequests,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingState: "blocked",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:    NewCounterStrategy(client, now),
+					Expiration:  time.Minute,
+					MaxRequests: 10,
+					StateValues: &StateValues{Allow: "allowed", Deny: "blocked"},
+				}
+			},
+		},
+		{
+			name: "formats expires at as unix seconds",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+			},
+			totalRequests:      10,
+			lastResponseStatus: http.StatusOK,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingExpiresAt: "1585131399",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:       NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:        NewCounterStrategy(client, now),
+					Expiration:      time.Minute,
+					MaxRequests:     50,
+					ExpiresAtFormat: ExpiresAtUnix,
+				}
+			},
+		},
+		{
+			name: "formats expires at as delta seconds",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+			},
+			totalRequests:      10,
+			lastResponseStatus: http.StatusOK,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingExpiresAt: "60",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:       NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:        NewCounterStrategy(client, now),
+					Expiration:      time.Minute,
+					MaxRequests:     50,
+					ExpiresAtFormat: ExpiresAtDeltaSeconds,
+				}
+			},
+		},
+		{
+			name: "a request from a trusted upstream skips rate limiting",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+				r.Header.Set(rateLimitSecret, "s3cr3t")
+				r.Header.Set(rateLimitRemaining, "1")
+			},
+			totalRequests:      5,
+			lastResponseStatus: http.StatusOK,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingState:         "Allow",
+				rateLimitingTotalRequests: "1",
+				rateLimitingReason:        "trusted_upstream",
+				rateLimitSecret:           "",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:     NewCounterStrategy(client, now),
+					Expiration:   time.Minute,
+					MaxRequests:  2,
+					ExposeReason: true,
+					TrustedUpstream: &TrustedUpstreamConfig{
+						Secret: "s3cr3t",
+					},
+				}
+			},
+		},
+		{
+			name: "a request with the wrong upstream secret is rate limited",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+				r.Header.Set(rateLimitSecret, "wrong")
+				r.Header.Set(rateLimitRemaining, "1")
+			},
+			totalRequests:      5,
+			lastResponseStatus: http.StatusTooManyRequests,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingState:  "Deny",
+				rateLimitingReason: "guard_rejected",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:     NewCounterStrategy(client, now),
+					Expiration:   time.Minute,
+					MaxRequests:  2,
+					ExposeReason: true,
+					TrustedUpstream: &TrustedUpstreamConfig{
+						Secret: "s3cr3t",
+					},
 				}
 			},
 		},
@@ -97,6 +385,118 @@ func TestNewHTTPHeadersExtractor(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "a request that is rate limited by one of many limits",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+				r.Header.Set("X-User-ID", "some-user")
+			},
+			totalRequests:      6,
+			lastResponseStatus: http.StatusTooManyRequests,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingState:                   "Allow",
+				rateLimitingTotalRequests:           "6",
+				rateLimitingState + "-User":         "Deny",
+				rateLimitingTotalRequests + "-User": "5",
+				rateLimitPolicy:                     "50;w=60, 5;w=3600",
+				retryAfter:                          "3595",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:     NewSortedSetCounterStrategy(client, now),
+					Expiration:   time.Minute,
+					MaxRequests:  50,
+					ExposePolicy: true,
+					Limits: []LimitConfig{
+						{
+							Name:        "user",
+							Extractor:   NewHTTPHeadersExtractor("X-User-ID"),
+							Expiration:  time.Hour,
+							MaxRequests: 5,
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "a request with many limits and a header budget",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+				r.Header.Set("X-User-ID", "some-user")
+				r.Header.Set("X-Org-ID", "some-org")
+			},
+			totalRequests:      3,
+			lastResponseStatus: http.StatusOK,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingTotalRequests:           "3",
+				rateLimitingTotalRequests + "-User": "3",
+				rateLimitingTotalRequests + "-Org":  "",
+				rateLimitPolicy:                     "100;w=86400, 5;w=3600",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:     NewSortedSetCounterStrategy(client, now),
+					Expiration:   time.Minute,
+					MaxRequests:  50,
+					ExposePolicy: true,
+					HeaderBudget: &HeaderBudget{
+						MaxLimits: 2,
+					},
+					Limits: []LimitConfig{
+						{
+							Name:        "user",
+							Extractor:   NewHTTPHeadersExtractor("X-User-ID"),
+							Expiration:  time.Hour,
+							MaxRequests: 5,
+						},
+						{
+							Name:        "org",
+							Extractor:   NewHTTPHeadersExtractor("X-Org-ID"),
+							Expiration:  24 * time.Hour,
+							MaxRequests: 100,
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "a request with many limits and a header byte budget",
+			builder: func(r *http.Request) {
+				r.Header.Set(forwardedFor, "10.10.10.10")
+				r.Header.Set("X-User-ID", "some-user")
+			},
+			totalRequests:      1,
+			lastResponseStatus: http.StatusOK,
+			advance:            time.Second,
+			matchedHeaders: map[string]string{
+				rateLimitingTotalRequests:           "",
+				rateLimitingTotalRequests + "-User": "1",
+				rateLimitingState + "-User":         "Allow",
+			},
+			config: func(client *redis.Client, now func() time.Time) *RateLimiterConfig {
+				return &RateLimiterConfig{
+					Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+					Strategy:    NewSortedSetCounterStrategy(client, now),
+					Expiration:  time.Minute,
+					MaxRequests: 50,
+					HeaderBudget: &HeaderBudget{
+						MaxBytes: 100,
+					},
+					Limits: []LimitConfig{
+						{
+							Name:        "user",
+							Extractor:   NewHTTPHeadersExtractor("X-User-ID"),
+							Expiration:  time.Hour,
+							MaxRequests: 5,
+						},
+					},
+				}
+			},
+		},
 	}
 
 	for _, ts := range tt {
@@ -111,7 +511,7 @@ func TestNewHTTPHeadersExtractor(t *testing.T) {
 			})
 			defer client.Close()
 
-			now := time.Now()
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
 			nowGenerator := func() time.Time {
 				return now
 			}
@@ -121,6 +521,7 @@ func TestNewHTTPHeadersExtractor(t *testing.T) {
 			}
 
 			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, ts.config(client, nowGenerator))
+			wrapper.(*httpRateLimiterHandler).now = nowGenerator
 
 			var lastResponse *http.Response
 
@@ -140,6 +541,1170 @@ func TestNewHTTPHeadersExtractor(t *testing.T) {
 				got := lastResponse.Header.Get(key)
 				assert.Equalf(t, value, got, "expected header %v to have value %v but was %v", key, value, got)
 			}
+
+			if ts.lastBody != "" {
+				body, err := io.ReadAll(lastResponse.Body)
+				require.NoError(t, err)
+				assert.Equal(t, ts.lastBody, string(body))
+			}
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_CountStatus(t *testing.T) {
+	tt := []struct {
+		name     string
+		strategy func(client *redis.Client, now func() time.Time) Strategy
+	}{
+		{
+			name: "refunds requests on the counter strategy",
+			strategy: func(client *redis.Client, now func() time.Time) Strategy {
+				return NewCounterStrategy(client, now)
+			},
+		},
+		{
+			name: "refunds requests on the sorted set strategy",
+			strategy: func(client *redis.Client, now func() time.Time) Strategy {
+				return NewSortedSetCounterStrategy(client, now)
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("fail") != "" {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, &RateLimiterConfig{
+				Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:    ts.strategy(client, time.Now),
+				Expiration:  time.Minute,
+				MaxRequests: 2,
+				CountStatus: func(status int) bool {
+					return status == http.StatusCreated
+				},
+			})
+
+			statuses := make([]int, 0, 8)
+
+			for _, url := range []string{"/?fail=1", "/?fail=1", "/?fail=1", "/?fail=1", "/", "/?fail=1", "/", "/"} {
+				req := httptest.NewRequest(http.MethodPost, "http://example.com"+url, nil)
+				req.Header.Set(forwardedFor, "10.10.10.10")
+
+				w := httptest.NewRecorder()
+				wrapper.ServeHTTP(w, req)
+				statuses = append(statuses, w.Result().StatusCode)
+			}
+
+			assert.Equal(t, []int{
+				http.StatusUnprocessableEntity,
+				http.StatusUnprocessableEntity,
+				http.StatusUnprocessableEntity,
+				http.StatusUnprocessableEntity,
+				http.StatusCreated,
+				http.StatusUnprocessableEntity,
+				http.StatusCreated,
+				http.StatusTooManyRequests,
+			}, statuses)
 		})
 	}
 }
+
+func TestHTTPRateLimiterHandler_RefundOnStatus(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, &RateLimiterConfig{
+		Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:    NewCounterStrategy(client, time.Now),
+		Expiration:  time.Minute,
+		MaxRequests: 2,
+		RefundOnStatus: func(status int) bool {
+			return status >= http.StatusInternalServerError
+		},
+	})
+
+	statuses := make([]int, 0, 6)
+
+	for _, url := range []string{"/?fail=1", "/?fail=1", "/?fail=1", "/", "/", "/"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+url, nil)
+		req.Header.Set(forwardedFor, "10.10.10.10")
+
+		w := httptest.NewRecorder()
+		wrapper.ServeHTTP(w, req)
+		statuses = append(statuses, w.Result().StatusCode)
+	}
+
+	assert.Equal(t, []int{
+		http.StatusInternalServerError,
+		http.StatusInternalServerError,
+		http.StatusInternalServerError,
+		http.StatusOK,
+		http.StatusOK,
+		http.StatusTooManyRequests,
+	}, statuses)
+}
+
+func TestHTTPRateLimiterHandler_RefundOnStatusWithRoutedStrategy(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	counter := NewCounterStrategy(client, time.Now)
+	sortedSet := NewSortedSetCounterStrategy(client, time.Now)
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, &RateLimiterConfig{
+		Extractor: NewHTTPHeadersExtractor(forwardedFor),
+		Strategy: NewRoutedStrategy(func(key string) Strategy {
+			if strings.HasPrefix(key, "10.") {
+				return counter
+			}
+
+			return sortedSet
+		}),
+		Expiration:  time.Minute,
+		MaxRequests: 2,
+		RefundOnStatus: func(status int) bool {
+			return status >= http.StatusInternalServerError
+		},
+	})
+
+	for _, ip := range []string{"10.10.10.10", "192.168.0.1"} {
+		t.Run(ip, func(t *testing.T) {
+			statuses := make([]int, 0, 6)
+
+			for _, url := range []string{"/?fail=1", "/?fail=1", "/?fail=1", "/", "/", "/"} {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com"+url, nil)
+				req.Header.Set(forwardedFor, ip)
+
+				w := httptest.NewRecorder()
+				wrapper.ServeHTTP(w, req)
+				statuses = append(statuses, w.Result().StatusCode)
+			}
+
+			assert.Equal(t, []int{
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+				http.StatusOK,
+				http.StatusOK,
+				http.StatusTooManyRequests,
+			}, statuses)
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_FlushWithCountStatus(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	var unwrapped http.ResponseWriter
+	var hijackErr error
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: first\n\n")
+
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+		flusher.Flush()
+
+		unwrapped = w.(interface{ Unwrap() http.ResponseWriter }).Unwrap()
+		_, _, hijackErr = w.(http.Hijacker).Hijack()
+	}
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, &RateLimiterConfig{
+		Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:    NewCounterStrategy(client, time.Now),
+		Expiration:  time.Minute,
+		MaxRequests: 2,
+		CountStatus: func(status int) bool {
+			return status == http.StatusOK
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/events", nil)
+	req.Header.Set(forwardedFor, "10.10.10.10")
+
+	w := httptest.NewRecorder()
+	wrapper.ServeHTTP(w, req)
+
+	assert.True(t, w.Flushed)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "data: first\n\n", w.Body.String())
+	assert.Same(t, w, unwrapped)
+	// the recorder can't be hijacked, so neither can the writer wrapping it
+	assert.EqualError(t, hijackErr, "the response writer doesn't support hijacking the connection")
+
+	// the flushed response was counted
+	total, err := server.Get("10.10.10.10")
+	require.NoError(t, err)
+	assert.Equal(t, "1", total)
+}
+
+func TestHTTPRateLimiterHandler_ServerTiming(t *testing.T) {
+	tt := []struct {
+		name         string
+		serverTiming bool
+		timings      [][]string
+	}{
+		{
+			name:         "adds the duration and decision when enabled",
+			serverTiming: true,
+			timings: [][]string{
+				{`ratelimit;dur=2.3;desc="allow"`},
+				{`ratelimit;dur=2.3;desc="deny"`},
+			},
+		},
+		{
+			name:    "doesn't add anything by default",
+			timings: [][]string{nil, nil},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, &RateLimiterConfig{
+				Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:     NewCounterStrategy(client, time.Now),
+				Expiration:   time.Minute,
+				MaxRequests:  1,
+				ServerTiming: ts.serverTiming,
+			})
+
+			// every call to the clock moves it forward, so checking the limits takes one step
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			wrapper.(*httpRateLimiterHandler).now = func() time.Time {
+				now = now.Add(2300 * time.Microsecond)
+				return now
+			}
+
+			for _, timings := range ts.timings {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.Header.Set(forwardedFor, "10.10.10.10")
+
+				w := httptest.NewRecorder()
+				wrapper.ServeHTTP(w, req)
+				assert.Equal(t, timings, w.Result().Header.Values(serverTiming))
+			}
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_PreWrite(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, &RateLimiterConfig{
+		Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:    NewCounterStrategy(client, time.Now),
+		Expiration:  time.Minute,
+		MaxRequests: 1,
+		Denylist:    []string{"10.10.10.11"},
+		PreWrite: func(w http.ResponseWriter, result *Result) {
+			// the rate limiting headers are already set when the hook runs
+			w.Header().Set("X-Decision", string(result.Reason)+";"+w.Header().Get(rateLimitingState))
+		},
+	})
+
+	tt := []struct {
+		ip       string
+		status   int
+		decision string
+	}{
+		{ip: "10.10.10.10", status: http.StatusOK, decision: "under_limit;Allow"},
+		{ip: "10.10.10.10", status: http.StatusTooManyRequests, decision: "guard_rejected;Deny"},
+		{ip: "10.10.10.11", status: http.StatusForbidden, decision: "denylisted;"},
+	}
+
+	for _, ts := range tt {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set(forwardedFor, ts.ip)
+
+		w := httptest.NewRecorder()
+		wrapper.ServeHTTP(w, req)
+
+		assert.Equal(t, ts.status, w.Result().StatusCode)
+		assert.Equal(t, ts.decision, w.Result().Header.Get("X-Decision"))
+	}
+}
+
+func TestHTTPRateLimiterHandler_ResponseSizeCost(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		// written in two parts, like a streamed response without a content length
+		_, _ = w.Write(bytes.Repeat([]byte("a"), size/2))
+		_, _ = w.Write(bytes.Repeat([]byte("a"), size-size/2))
+	}
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: handler}, &RateLimiterConfig{
+		Extractor:        NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:         NewCounterStrategy(client, time.Now),
+		Expiration:       time.Minute,
+		MaxRequests:      100,
+		ResponseSizeCost: true,
+	})
+
+	statuses := make([]int, 0, 3)
+
+	for _, size := range []int{60, 60, 1} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/?size="+strconv.Itoa(size), nil)
+		req.Header.Set(forwardedFor, "10.10.10.10")
+
+		w := httptest.NewRecorder()
+		wrapper.ServeHTTP(w, req)
+		statuses = append(statuses, w.Result().StatusCode)
+	}
+
+	// the second response is sent in full even if it takes the client over the limit
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses)
+
+	total, err := server.Get("10.10.10.10")
+	require.NoError(t, err)
+	assert.Equal(t, "120", total)
+}
+
+func TestHTTPRateLimiterHandler_ResponseSizeCostWithoutCommitter(t *testing.T) {
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}, &RateLimiterConfig{
+		Extractor:        NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:         NewFixedWindowBucketStrategy(nil, time.Now),
+		Expiration:       time.Minute,
+		MaxRequests:      100,
+		ResponseSizeCost: true,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set(forwardedFor, "10.10.10.10")
+
+	w := httptest.NewRecorder()
+	wrapper.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	assert.Equal(t, "the rate limiting strategy does not support commits", w.Body.String())
+}
+
+func TestHTTPRateLimiterHandler_ExtractErrorCode(t *testing.T) {
+	tt := []struct {
+		name        string
+		format      DenyBodyFormat
+		headers     map[string]string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "sends the error as text by default",
+			contentType: "text/plain",
+			body:        "failed to collect rate limiting key from request: the header X-Forwarded-For must have a value set",
+		},
+		{
+			name:        "sends the code on JSON bodies",
+			format:      DenyBodyJSON,
+			contentType: "application/json",
+			body:        `{"error":"failed to collect rate limiting key from request: the header X-Forwarded-For must have a value set","code":"missing_header"}` + "\n",
+		},
+		{
+			name:        "sends the code on problem JSON bodies",
+			format:      DenyBodyProblemJSON,
+			contentType: "application/problem+json",
+			body:        `{"type":"about:blank","title":"Bad Request","status":400,"detail":"failed to collect rate limiting key from request: the header X-Forwarded-For must have a value set","code":"missing_header"}` + "\n",
+		},
+		{
+			name:        "sends the code of empty keys",
+			format:      DenyBodyJSON,
+			headers:     map[string]string{forwardedFor: "10.10.10.10"},
+			contentType: "application/json",
+			body:        `{"error":"failed to collect rate limiting key from request: the key is empty","code":"empty_key"}` + "\n",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			extractor := NewHTTPHeadersExtractor(forwardedFor)
+			if len(ts.headers) > 0 {
+				extractor = NewNormalizingExtractor(extractor, func(string) string {
+					return ""
+				})
+			}
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, &RateLimiterConfig{
+				Extractor:      extractor,
+				Strategy:       NewRecordingStrategy(nil),
+				Expiration:     time.Minute,
+				MaxRequests:    100,
+				DenyBodyFormat: ts.format,
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			for name, value := range ts.headers {
+				req.Header.Set(name, value)
+			}
+
+			w := httptest.NewRecorder()
+			wrapper.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+			assert.Equal(t, ts.contentType, w.Result().Header.Get("Content-Type"))
+			assert.Equal(t, ts.body, w.Body.String())
+		})
+	}
+}
+
+func TestHTTPHeaderExtractor_Extract(t *testing.T) {
+	tt := []struct {
+		name  string
+		value string
+		key   string
+		err   string
+	}{
+		{
+			name:  "trims the header value",
+			value: "  10.10.10.10  ",
+			key:   "10.10.10.10",
+		},
+		{
+			name:  "rejects values with control characters",
+			value: "some-user\r\nX-Injected: true",
+			err:   "the header X-Forwarded-For has an invalid value: it has control characters",
+		},
+		{
+			name:  "rejects values that are not valid UTF-8",
+			value: "\xff\xfe",
+			err:   "the header X-Forwarded-For has an invalid value: it is not valid UTF-8",
+		},
+		{
+			name:  "rejects values that are too long",
+			value: strings.Repeat("a", MaxHeaderValueLength+1),
+			err:   "the header X-Forwarded-For has an invalid value: it is longer than 1024 bytes",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.Header[forwardedFor] = []string{ts.value}
+
+			key, err := NewHTTPHeadersExtractor(forwardedFor).Extract(req)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, ts.key, key)
+			}
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_RetryAfterJitter(t *testing.T) {
+	tt := []struct {
+		name       string
+		random     func(n int64) int64
+		retryAfter string
+	}{
+		{
+			name: "adds nothing with the smallest jitter",
+			random: func(n int64) int64 {
+				return 0
+			},
+			retryAfter: "60",
+		},
+		{
+			name: "adds up to the configured jitter",
+			random: func(n int64) int64 {
+				return n - 1
+			},
+			retryAfter: "65",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			nowGenerator := func() time.Time {
+				return now
+			}
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, &RateLimiterConfig{
+				Extractor:        NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:         NewSortedSetCounterStrategy(client, nowGenerator),
+				Expiration:       time.Minute,
+				MaxRequests:      1,
+				RetryAfterJitter: 5 * time.Second,
+			})
+			wrapper.(*httpRateLimiterHandler).now = nowGenerator
+			wrapper.(*httpRateLimiterHandler).random = ts.random
+
+			var lastResponse *http.Response
+
+			for x := 0; x < 2; x++ {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+				req.Header.Set(forwardedFor, "10.10.10.10")
+
+				w := httptest.NewRecorder()
+				wrapper.ServeHTTP(w, req)
+				lastResponse = w.Result()
+			}
+
+			assert.Equal(t, http.StatusTooManyRequests, lastResponse.StatusCode)
+			assert.Equal(t, ts.retryAfter, lastResponse.Header.Get(retryAfter))
+			// only the advice to the client changes, not the window
+			assert.Equal(t, "2020-03-25T10:16:30Z", lastResponse.Header.Get(rateLimitingExpiresAt))
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_MaxRetryAfter(t *testing.T) {
+	tt := []struct {
+		name          string
+		maxRetryAfter time.Duration
+		format        ExpiresAtFormat
+		retryAfter    string
+		expiresAt     string
+	}{
+		{
+			name:       "tells clients the real wait by default",
+			retryAfter: "3600",
+			expiresAt:  "2020-03-25T11:15:30Z",
+		},
+		{
+			name:          "caps the wait and the expiration",
+			maxRetryAfter: 30 * time.Second,
+			retryAfter:    "30",
+			expiresAt:     "2020-03-25T10:16:00Z",
+		},
+		{
+			name:          "caps unix expirations",
+			maxRetryAfter: 30 * time.Second,
+			format:        ExpiresAtUnix,
+			retryAfter:    "30",
+			expiresAt:     "1585131360",
+		},
+		{
+			name:          "caps delta seconds expirations",
+			maxRetryAfter: 30 * time.Second,
+			format:        ExpiresAtDeltaSeconds,
+			retryAfter:    "30",
+			expiresAt:     "30",
+		},
+		{
+			name:          "doesn't change shorter waits",
+			maxRetryAfter: 2 * time.Hour,
+			retryAfter:    "3600",
+			expiresAt:     "2020-03-25T11:15:30Z",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			nowGenerator := func() time.Time {
+				return now
+			}
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, &RateLimiterConfig{
+				Extractor:       NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:        NewSortedSetCounterStrategy(client, nowGenerator),
+				Expiration:      time.Hour,
+				MaxRequests:     1,
+				MaxRetryAfter:   ts.maxRetryAfter,
+				ExpiresAtFormat: ts.format,
+			})
+			wrapper.(*httpRateLimiterHandler).now = nowGenerator
+
+			var lastResponse *http.Response
+
+			for x := 0; x < 2; x++ {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+				req.Header.Set(forwardedFor, "10.10.10.10")
+
+				w := httptest.NewRecorder()
+				wrapper.ServeHTTP(w, req)
+				lastResponse = w.Result()
+			}
+
+			assert.Equal(t, http.StatusTooManyRequests, lastResponse.StatusCode)
+			assert.Equal(t, ts.retryAfter, lastResponse.Header.Get(retryAfter))
+			assert.Equal(t, ts.expiresAt, lastResponse.Header.Get(rateLimitingExpiresAt))
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_ResetHeaders(t *testing.T) {
+	tt := []struct {
+		name          string
+		headers       func() *HeaderNames
+		maxRetryAfter time.Duration
+		expected      map[string]string
+	}{
+		{
+			name:    "doesn't send the reset headers by default",
+			headers: DefaultHeaderNames,
+			expected: map[string]string{
+				"X-RateLimit-Reset":      "",
+				"X-RateLimit-Reset-Date": "",
+				rateLimitingExpiresAt:    "2020-03-25T11:15:30Z",
+			},
+		},
+		{
+			name: "sends the reset in seconds and as a date",
+			headers: func() *HeaderNames {
+				names := DefaultHeaderNames()
+				names.ResetSeconds = "X-RateLimit-Reset"
+				names.ResetDate = "X-RateLimit-Reset-Date"
+				return names
+			},
+			expected: map[string]string{
+				"X-RateLimit-Reset":      "3600",
+				"X-RateLimit-Reset-Date": "Wed, 25 Mar 2020 11:15:30 GMT",
+				rateLimitingExpiresAt:    "2020-03-25T11:15:30Z",
+			},
+		},
+		{
+			name: "caps both at the max retry after",
+			headers: func() *HeaderNames {
+				return &HeaderNames{ResetSeconds: "X-RateLimit-Reset", ResetDate: "X-RateLimit-Reset-Date"}
+			},
+			maxRetryAfter: 30 * time.Second,
+			expected: map[string]string{
+				"X-RateLimit-Reset":      "30",
+				"X-RateLimit-Reset-Date": "Wed, 25 Mar 2020 10:16:00 GMT",
+				rateLimitingExpiresAt:    "",
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			nowGenerator := func() time.Time {
+				return now
+			}
+
+			config := &RateLimiterConfig{
+				Extractor:     NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:      NewSortedSetCounterStrategy(client, nowGenerator),
+				Expiration:    time.Hour,
+				MaxRequests:   1,
+				MaxRetryAfter: ts.maxRetryAfter,
+				Headers:       ts.headers(),
+			}
+			require.NoError(t, config.Validate())
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, config)
+			wrapper.(*httpRateLimiterHandler).now = nowGenerator
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.Header.Set(forwardedFor, "10.10.10.10")
+
+			w := httptest.NewRecorder()
+			wrapper.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			for header, value := range ts.expected {
+				assert.Equal(t, value, w.Header().Get(header), header)
+			}
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_ExposeKeyHeader(t *testing.T) {
+	tt := []struct {
+		name     string
+		expose   bool
+		expected map[string]string
+	}{
+		{
+			name: "doesn't send the keys by default",
+			expected: map[string]string{
+				"X-RateLimit-Key":      "",
+				"X-RateLimit-Key-user": "",
+			},
+		},
+		{
+			name:   "sends the key of every limit",
+			expose: true,
+			expected: map[string]string{
+				"X-RateLimit-Key":      "10.10.10.10",
+				"X-RateLimit-Key-user": "some-user",
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, &RateLimiterConfig{
+				Extractor:       NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:        NewSortedSetCounterStrategy(client, time.Now),
+				Expiration:      time.Minute,
+				MaxRequests:     1,
+				ExposeKeyHeader: ts.expose,
+				Limits: []LimitConfig{
+					{Name: "user", Extractor: NewHTTPHeadersExtractor("X-User"), Expiration: time.Minute, MaxRequests: 1},
+				},
+			})
+
+			// denied requests get the keys too
+			for _, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+				req.Header.Set(forwardedFor, "10.10.10.10")
+				req.Header.Set("X-User", "some-user")
+
+				w := httptest.NewRecorder()
+				wrapper.ServeHTTP(w, req)
+
+				assert.Equal(t, status, w.Code)
+				for header, value := range ts.expected {
+					assert.Equal(t, value, w.Header().Get(header), header)
+				}
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewSortedSetCounterStrategy(client, time.Now)
+
+	route := func(prefix string) Extractor {
+		return NewNormalizingExtractor(NewHTTPHeadersExtractor(forwardedFor), func(key string) string {
+			return prefix + key
+		})
+	}
+
+	login := Limit(&RateLimiterConfig{
+		Extractor:   route("login:"),
+		Strategy:    strategy,
+		Expiration:  time.Minute,
+		MaxRequests: 1,
+	})
+
+	search := Limit(&RateLimiterConfig{
+		Extractor:   route("search:"),
+		Strategy:    strategy,
+		Expiration:  time.Minute,
+		MaxRequests: 3,
+	})
+
+	ok := &handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}
+
+	mux := http.NewServeMux()
+	mux.Handle("/login", login(ok))
+	mux.Handle("/search", search(ok))
+	mux.Handle("/health", ok)
+
+	statuses := map[string][]int{}
+
+	for _, path := range []string{"/login", "/search", "/health"} {
+		for x := 0; x < 3; x++ {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+			req.Header.Set(forwardedFor, "10.10.10.10")
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			statuses[path] = append(statuses[path], w.Code)
+		}
+	}
+
+	assert.Equal(t, map[string][]int{
+		"/login":  {http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		"/search": {http.StatusOK, http.StatusOK, http.StatusOK},
+		"/health": {http.StatusOK, http.StatusOK, http.StatusOK},
+	}, statuses)
+}
+
+func TestHTTPRateLimiterHandler_ConcurrencyLimiter(t *testing.T) {
+	tt := []struct {
+		name     string
+		strategy bool
+		status   int
+		nested   int
+	}{
+		{
+			name:     "denies requests over the concurrency limit",
+			strategy: true,
+			nested:   http.StatusTooManyRequests,
+		},
+		{
+			name:   "limits only the concurrency without a strategy",
+			nested: http.StatusTooManyRequests,
+		},
+		{
+			name:   "sends the configured status",
+			status: http.StatusServiceUnavailable,
+			nested: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			limiter, err := NewConcurrencyLimiter(client, time.Now, 1, time.Minute)
+			require.NoError(t, err)
+
+			config := &RateLimiterConfig{
+				Extractor:          NewHTTPHeadersExtractor(forwardedFor),
+				Expiration:         time.Minute,
+				MaxRequests:        10,
+				ConcurrencyLimiter: limiter,
+				ConcurrencyStatus:  ts.status,
+			}
+
+			if ts.strategy {
+				config.Strategy = NewCounterStrategy(client, time.Now)
+			}
+
+			var wrapper http.Handler
+			var nested []int
+
+			newRequest := func(path string) *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+				req.Header.Set(forwardedFor, "10.10.10.10")
+				return req
+			}
+
+			wrapper = NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/panic":
+					panic("something went wrong")
+				case "/slow":
+					// a second request from the same client while this one is still in flight
+					inner := httptest.NewRecorder()
+					wrapper.ServeHTTP(inner, newRequest("/fast"))
+					nested = append(nested, inner.Code)
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}}, config)
+
+			w := httptest.NewRecorder()
+			wrapper.ServeHTTP(w, newRequest("/slow"))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, []int{ts.nested}, nested)
+
+			// the slot is released even if the handler panics
+			assert.Panics(t, func() {
+				wrapper.ServeHTTP(httptest.NewRecorder(), newRequest("/panic"))
+			})
+
+			w = httptest.NewRecorder()
+			wrapper.ServeHTTP(w, newRequest("/fast"))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			count, err := client.ZCard(context.Background(), "10.10.10.10:concurrency").Result()
+			require.NoError(t, err)
+			assert.Equal(t, int64(0), count)
+		})
+	}
+}
+
+type failingStrategy struct{}
+
+func (f *failingStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	return nil, errors.New("i/o timeout")
+}
+
+func TestHTTPRateLimiterHandler_FailureMode(t *testing.T) {
+	tt := []struct {
+		name       string
+		config     *RateLimiterConfig
+		status     int
+		retryAfter string
+		body       string
+		bypass     string
+	}{
+		{
+			name:   "fails closed by default",
+			config: &RateLimiterConfig{},
+			status: http.StatusInternalServerError,
+			body:   "failed to run rate limiting for request: i/o timeout",
+		},
+		{
+			name:   "sends the request to the handler when failing open",
+			config: &RateLimiterConfig{FailureMode: FailOpen},
+			status: http.StatusOK,
+			body:   "Request received!",
+			bypass: BypassBackendUnavailable,
+		},
+		{
+			name:       "sends a 503 with the default retry after",
+			config:     &RateLimiterConfig{FailureMode: FailUnavailable},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "5",
+			body:       "rate limiting is unavailable, try again later: i/o timeout",
+		},
+		{
+			name:       "sends a 503 with the configured retry after",
+			config:     &RateLimiterConfig{FailureMode: FailUnavailable, UnavailableRetryAfter: 1500 * time.Millisecond},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "2",
+			body:       "rate limiting is unavailable, try again later: i/o timeout",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			ts.config.Extractor = NewHTTPHeadersExtractor(forwardedFor)
+			ts.config.Strategy = &failingStrategy{}
+			ts.config.Expiration = time.Minute
+			ts.config.MaxRequests = 10
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "Request received!")
+			}}, ts.config)
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.Header.Set(forwardedFor, "10.10.10.10")
+
+			w := httptest.NewRecorder()
+			wrapper.ServeHTTP(w, req)
+
+			assert.Equal(t, ts.status, w.Code)
+			assert.Equal(t, ts.retryAfter, w.Header().Get(retryAfter))
+			assert.Equal(t, ts.body, w.Body.String())
+			assert.Equal(t, ts.bypass, w.Header().Get(rateLimitBypass))
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_ContentLengthCost(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}, &RateLimiterConfig{
+		Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:    NewCounterStrategy(client, time.Now),
+		Expiration:  time.Minute,
+		MaxRequests: 100,
+		Cost:        ContentLengthCost,
+	})
+
+	statuses := make([]int, 0, 5)
+
+	for _, size := range []int{40, 40, 40, 20, -1} {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader(strings.Repeat("a", 40)))
+		req.Header.Set(forwardedFor, "10.10.10.10")
+		req.ContentLength = int64(size)
+
+		w := httptest.NewRecorder()
+		wrapper.ServeHTTP(w, req)
+		statuses = append(statuses, w.Code)
+	}
+
+	assert.Equal(t, []int{
+		http.StatusOK,
+		http.StatusOK,
+		http.StatusTooManyRequests,
+		http.StatusOK,
+		http.StatusBadRequest,
+	}, statuses)
+}
+
+func TestHTTPRateLimiterHandler_Chained(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewCounterStrategy(client, time.Now)
+
+	inner := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}, &RateLimiterConfig{
+		Extractor:    NewHTTPHeadersExtractor("X-User"),
+		Strategy:     strategy,
+		Expiration:   time.Minute,
+		MaxRequests:  2,
+		ExposePolicy: true,
+	})
+
+	outer := NewHTTPRateLimiterHandler(inner, &RateLimiterConfig{
+		Extractor:    NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:     strategy,
+		Expiration:   time.Minute,
+		MaxRequests:  10,
+		ExposePolicy: true,
+	})
+
+	// the totals on allowed requests are the ones from the outer handler, which counts every user
+	tt := []struct {
+		user   string
+		status int
+		state  string
+		total  string
+	}{
+		{user: "other-user", status: http.StatusOK, state: "Allow", total: "1"},
+		{user: "some-user", status: http.StatusOK, state: "Allow", total: "2"},
+		{user: "some-user", status: http.StatusOK, state: "Allow", total: "3"},
+		// the inner handler denied the request, so its headers are sent
+		{user: "some-user", status: http.StatusTooManyRequests, state: "Deny", total: "2"},
+	}
+
+	for _, ts := range tt {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		req.Header.Set(forwardedFor, "10.10.10.10")
+		req.Header.Set("X-User", ts.user)
+
+		w := httptest.NewRecorder()
+		outer.ServeHTTP(w, req)
+
+		assert.Equal(t, ts.status, w.Code)
+		assert.Equal(t, ts.state, w.Header().Get(rateLimitingState))
+		assert.Equal(t, ts.total, w.Header().Get(rateLimitingTotalRequests))
+		assert.Equal(t, "10;w=60, 2;w=60", w.Header().Get(rateLimitPolicy))
+	}
+}
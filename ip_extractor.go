@@ -0,0 +1,170 @@
+package redis_rate_limiter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	_ Extractor = &ipExtractor{}
+)
+
+const (
+	// DefaultIPv4PrefixLength keys IPv4 clients by their full address.
+	DefaultIPv4PrefixLength = 32
+	// DefaultIPv6PrefixLength keys IPv6 clients by their /64, the usual allocation for a single customer.
+	DefaultIPv6PrefixLength = 64
+	// DefaultMaxForwardedFor is how many X-Forwarded-For entries are read when IPExtractorConfig doesn't set
+	// `MaxForwardedFor`.
+	DefaultMaxForwardedFor = 20
+
+	forwardedForHeader = "X-Forwarded-For"
+)
+
+// IPExtractorConfig configures how client IPs are grouped into keys. IPv6 clients usually get a whole /64 (or more)
+// and can rotate addresses inside of it at will, so keying on the full address would give them a new bucket for
+// every address. Zero values use DefaultIPv4PrefixLength and DefaultIPv6PrefixLength.
+type IPExtractorConfig struct {
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+	// TrustedProxies is how many proxies in front of the service append the address they got the request from to
+	// `X-Forwarded-For`. When set the client IP is the entry that many positions from the end of the header, as the
+	// entries before it can be sent by the client. By default the header is ignored.
+	TrustedProxies int
+	// MaxForwardedFor is how many `X-Forwarded-For` entries are read from the end of the header, so a huge header
+	// can't make parsing it expensive, defaults to DefaultMaxForwardedFor. Entries before them are never parsed.
+	MaxForwardedFor int
+}
+
+type ipExtractor struct {
+	ipv4Mask        net.IPMask
+	ipv6Mask        net.IPMask
+	trustedProxies  int
+	maxForwardedFor int
+}
+
+// NewIPExtractor creates an extractor that uses the IP of the client connection (`RemoteAddr`) as the key, grouped
+// into the network prefix set in the config. A nil config uses the defaults. The key is the network in CIDR notation,
+// like `2001:db8:1:2::/64` or `10.10.10.10/32`.
+//
+// With `TrustedProxies` set the IP comes from `X-Forwarded-For` instead. If the header has fewer entries than there
+// are trusted proxies (or more than `MaxForwardedFor` would have to be read) or the entry isn't a valid IP (like the
+// `unknown` some proxies send) the request falls back to `RemoteAddr` instead of failing.
+func NewIPExtractor(config *IPExtractorConfig) Extractor {
+	ipv4Prefix := DefaultIPv4PrefixLength
+	ipv6Prefix := DefaultIPv6PrefixLength
+	maxForwardedFor := DefaultMaxForwardedFor
+	trustedProxies := 0
+
+	if config != nil {
+		if config.IPv4PrefixLength != 0 {
+			ipv4Prefix = config.IPv4PrefixLength
+		}
+		if config.IPv6PrefixLength != 0 {
+			ipv6Prefix = config.IPv6PrefixLength
+		}
+		if config.MaxForwardedFor > 0 {
+			maxForwardedFor = config.MaxForwardedFor
+		}
+		trustedProxies = config.TrustedProxies
+	}
+
+	return &ipExtractor{
+		ipv4Mask:        net.CIDRMask(ipv4Prefix, 8*net.IPv4len),
+		ipv6Mask:        net.CIDRMask(ipv6Prefix, 8*net.IPv6len),
+		trustedProxies:  trustedProxies,
+		maxForwardedFor: maxForwardedFor,
+	}
+}
+
+// Extract parses the client IP and returns the network it belongs to.
+func (e *ipExtractor) Extract(r *http.Request) (string, error) {
+	if forwarded, ok := e.forwardedFor(r); ok {
+		return e.network(forwarded)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RemoteAddr is not required to have a port
+		host = r.RemoteAddr
+	}
+
+	return e.network(host)
+}
+
+// forwardedFor returns the IP the last trusted proxy got the request from. The entries are walked from the end of
+// the last header without splitting it, so only the entries that are needed (up to `maxForwardedFor`) are read.
+func (e *ipExtractor) forwardedFor(r *http.Request) (string, bool) {
+	if e.trustedProxies <= 0 || e.trustedProxies > e.maxForwardedFor {
+		return "", false
+	}
+
+	values := r.Header.Values(forwardedForHeader)
+	entries := 0
+
+	for x := len(values) - 1; x >= 0; x-- {
+		value := values[x]
+
+		for {
+			entry := value
+			next := strings.LastIndexByte(value, ',')
+			if next >= 0 {
+				entry = value[next+1:]
+				value = value[:next]
+			}
+
+			entries++
+			if entries == e.trustedProxies {
+				return forwardedIP(entry)
+			}
+
+			if next < 0 {
+				break
+			}
+		}
+	}
+
+	return "", false
+}
+
+// forwardedIP parses an `X-Forwarded-For` entry, some proxies add the port to it.
+func forwardedIP(entry string) (string, bool) {
+	entry = strings.TrimSpace(entry)
+
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+
+	if net.ParseIP(entry) == nil {
+		return "", false
+	}
+
+	return entry, true
+}
+
+func (e *ipExtractor) network(value string) (string, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", extractError(CodeInvalidIP, "the value %q is not a valid IP", value)
+	}
+
+	mask := e.ipv6Mask
+
+	// IPv4 mapped IPv6 addresses are treated as IPv4 so the same client always gets the same key
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		mask = e.ipv4Mask
+	}
+
+	if mask == nil {
+		return "", extractError(CodeMisconfigured, "invalid prefix length for IP %v", value)
+	}
+
+	network := &net.IPNet{
+		IP:   ip.Mask(mask),
+		Mask: mask,
+	}
+
+	return network.String(), nil
+}
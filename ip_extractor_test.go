@@ -0,0 +1,150 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPExtractor_Extract(t *testing.T) {
+	tt := []struct {
+		name       string
+		config     *IPExtractorConfig
+		remoteAddr string
+		key        string
+		err        string
+	}{
+		{
+			name:       "uses the full IPv4 address by default",
+			remoteAddr: "10.10.10.10:5678",
+			key:        "10.10.10.10/32",
+		},
+		{
+			name:       "groups IPv6 addresses by /64 by default",
+			remoteAddr: "[2001:db8:1:2:3:4:5:6]:5678",
+			key:        "2001:db8:1:2::/64",
+		},
+		{
+			name:       "treats IPv4 mapped IPv6 addresses as IPv4",
+			remoteAddr: "[::ffff:10.10.10.10]:5678",
+			key:        "10.10.10.10/32",
+		},
+		{
+			name:       "uses the configured prefix lengths",
+			config:     &IPExtractorConfig{IPv4PrefixLength: 24, IPv6PrefixLength: 48},
+			remoteAddr: "10.10.10.10",
+			key:        "10.10.10.0/24",
+		},
+		{
+			name:       "uses the configured IPv6 prefix length",
+			config:     &IPExtractorConfig{IPv4PrefixLength: 24, IPv6PrefixLength: 48},
+			remoteAddr: "[2001:db8:1:2:3:4:5:6]:5678",
+			key:        "2001:db8:1::/48",
+		},
+		{
+			name:       "fails for invalid addresses",
+			remoteAddr: "not-an-ip:5678",
+			err:        `the value "not-an-ip" is not a valid IP`,
+		},
+		{
+			name:       "fails for invalid prefix lengths",
+			config:     &IPExtractorConfig{IPv4PrefixLength: 33},
+			remoteAddr: "10.10.10.10:5678",
+			err:        "invalid prefix length for IP 10.10.10.10",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.RemoteAddr = ts.remoteAddr
+
+			key, err := NewIPExtractor(ts.config).Extract(req)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, ts.key, key)
+		})
+	}
+}
+
+func TestIPExtractor_ExtractForwardedFor(t *testing.T) {
+	tt := []struct {
+		name      string
+		config    *IPExtractorConfig
+		forwarded []string
+		key       string
+	}{
+		{
+			name:      "ignores the header by default",
+			forwarded: []string{"10.10.10.11"},
+			key:       "10.10.10.10/32",
+		},
+		{
+			name:      "uses the entry added by the only trusted proxy",
+			config:    &IPExtractorConfig{TrustedProxies: 1},
+			forwarded: []string{"10.10.10.12, 10.10.10.11"},
+			key:       "10.10.10.11/32",
+		},
+		{
+			name:      "uses the entry added by the first of many trusted proxies",
+			config:    &IPExtractorConfig{TrustedProxies: 2},
+			forwarded: []string{"10.10.10.13,10.10.10.12", "10.10.10.11"},
+			key:       "10.10.10.12/32",
+		},
+		{
+			name:      "ignores garbage sent by the client before the trusted entries",
+			config:    &IPExtractorConfig{TrustedProxies: 1},
+			forwarded: []string{"not-an-ip,,, 10.10.10.11"},
+			key:       "10.10.10.11/32",
+		},
+		{
+			name:      "removes the port added by some proxies",
+			config:    &IPExtractorConfig{TrustedProxies: 1},
+			forwarded: []string{"[2001:db8:1:2:3:4:5:6]:5678"},
+			key:       "2001:db8:1:2::/64",
+		},
+		{
+			name:      "falls back to the remote address for malformed entries",
+			config:    &IPExtractorConfig{TrustedProxies: 1},
+			forwarded: []string{"10.10.10.11, unknown"},
+			key:       "10.10.10.10/32",
+		},
+		{
+			name:      "falls back to the remote address when there are fewer entries than trusted proxies",
+			config:    &IPExtractorConfig{TrustedProxies: 3},
+			forwarded: []string{"10.10.10.12, 10.10.10.11"},
+			key:       "10.10.10.10/32",
+		},
+		{
+			name:   "falls back to the remote address without the header",
+			config: &IPExtractorConfig{TrustedProxies: 1},
+			key:    "10.10.10.10/32",
+		},
+		{
+			name:      "falls back to the remote address when the trusted entry is past the max entries",
+			config:    &IPExtractorConfig{TrustedProxies: 3, MaxForwardedFor: 2},
+			forwarded: []string{"10.10.10.13, 10.10.10.12, 10.10.10.11"},
+			key:       "10.10.10.10/32",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.RemoteAddr = "10.10.10.10:5678"
+			for _, value := range ts.forwarded {
+				req.Header.Add(forwardedFor, value)
+			}
+
+			key, err := NewIPExtractor(ts.config).Extract(req)
+			require.NoError(t, err)
+			assert.Equal(t, ts.key, key)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultKillSwitchInterval is how often Watch reads the switch from Redis when the interval given isn't positive.
+	DefaultKillSwitchInterval = 5 * time.Second
+)
+
+// NewKillSwitch creates a switch, enabled, that turns rate limiting off at runtime without a redeploy, like during
+// an incident where the limiter itself is the problem. Set it as `RateLimiterConfig.KillSwitch`, the same switch can
+// be shared by many handlers.
+func NewKillSwitch() *KillSwitch {
+	return &KillSwitch{}
+}
+
+// KillSwitch is the switch created by NewKillSwitch, it is safe to use from multiple goroutines.
+type KillSwitch struct {
+	disabled int32
+}
+
+// SetEnabled turns rate limiting on or off. When off handlers send every request straight to the wrapped handler.
+func (k *KillSwitch) SetEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+
+	atomic.StoreInt32(&k.disabled, disabled)
+}
+
+// Enabled returns true if rate limiting is on.
+func (k *KillSwitch) Enabled() bool {
+	return atomic.LoadInt32(&k.disabled) == 0
+}
+
+// Watch reads `key` from Redis every `interval` and sets the switch from it until the context is done, so the switch
+// can be flipped for the whole cluster at once with a SET. The value is parsed like a bool (`true`, `false`, `1`,
+// `0`), a missing key turns rate limiting on. If Redis can't be reached or the value is invalid the switch stays as
+// it was, so a Redis outage doesn't turn rate limiting on or off by itself. An `interval` that isn't positive uses
+// DefaultKillSwitchInterval. Run it in its own goroutine.
+func (k *KillSwitch) Watch(ctx context.Context, client redis.Cmdable, key string, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultKillSwitchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// errors are not fatal, the next tick tries again
+		_ = k.refresh(ctx, client, key)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *KillSwitch) refresh(ctx context.Context, client redis.Cmdable, key string) error {
+	value, err := client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		k.SetEnabled(true)
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to read kill switch key %v", key)
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.Wrapf(err, "invalid value for kill switch key %v", key)
+	}
+
+	k.SetEnabled(enabled)
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKillSwitch_ServeHTTP(t *testing.T) {
+	killSwitch := NewKillSwitch()
+
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}, &RateLimiterConfig{
+		Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+		Strategy:    NewRecordingStrategy(&denyAllStrategy{}),
+		Expiration:  time.Minute,
+		MaxRequests: 10,
+		KillSwitch:  killSwitch,
+	})
+
+	statuses := make([]int, 0, 3)
+
+	for _, enabled := range []bool{true, false, true} {
+		killSwitch.SetEnabled(enabled)
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		req.Header.Set(forwardedFor, "10.10.10.10")
+
+		w := httptest.NewRecorder()
+		wrapper.ServeHTTP(w, req)
+		statuses = append(statuses, w.Result().StatusCode)
+	}
+
+	assert.Equal(t, []int{http.StatusTooManyRequests, http.StatusOK, http.StatusTooManyRequests}, statuses)
+}
+
+func TestKillSwitch_Watch(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	killSwitch := NewKillSwitch()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go killSwitch.Watch(ctx, client, "rate-limiting-enabled", 5*time.Millisecond)
+
+	require.NoError(t, server.Set("rate-limiting-enabled", "false"))
+	assert.Eventually(t, func() bool {
+		return !killSwitch.Enabled()
+	}, time.Second, 5*time.Millisecond)
+
+	// invalid values keep the switch as it was
+	require.NoError(t, server.Set("rate-limiting-enabled", "maybe"))
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, killSwitch.Enabled())
+
+	server.Del("rate-limiting-enabled")
+	assert.Eventually(t, killSwitch.Enabled, time.Second, 5*time.Millisecond)
+}
+
+func TestKillSwitch_WatchWithoutInterval(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	require.NoError(t, server.Set("rate-limiting-enabled", "false"))
+
+	killSwitch := NewKillSwitch()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	// falls back to the default interval instead of panicking, the switch is read right away
+	go func() {
+		defer close(done)
+		killSwitch.Watch(ctx, client, "rate-limiting-enabled", 0)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return !killSwitch.Enabled()
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,78 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+var (
+	_ Strategy  = &limitReachedStrategy{}
+	_ KeyNamer  = &limitReachedStrategy{}
+	_ Refunder  = &limitReachedStrategy{}
+	_ Committer = &limitReachedStrategy{}
+)
+
+// NewLimitReachedStrategy creates a strategy that calls `onLimitReached` only when a key goes from being allowed to
+// being denied, instead of on every denied request, which is what you want for alerts like "customer X hit their
+// limit". When a key is denied a marker is written to Redis that expires with the window, the callback only runs
+// if the marker didn't exist yet, so it runs once per window for a key and again if the key is denied in a later
+// window. The callback runs synchronously before the result is returned, start a goroutine in it if it's slow.
+func NewLimitReachedStrategy(inner Strategy, client *redis.Client, now func() time.Time, onLimitReached func(ctx context.Context, r *Request, result *Result)) Strategy {
+	return &limitReachedStrategy{
+		inner:          inner,
+		client:         client,
+		now:            now,
+		onLimitReached: onLimitReached,
+	}
+}
+
+type limitReachedStrategy struct {
+	inner          Strategy
+	client         *redis.Client
+	now            func() time.Time
+	onLimitReached func(ctx context.Context, r *Request, result *Result)
+}
+
+// Run runs the inner strategy and checks the marker on denied results. Failing to write the marker doesn't fail
+// the request, the callback just doesn't run.
+func (l *limitReachedStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	result, err := l.inner.Run(ctx, r)
+	if err != nil || result.State != Deny {
+		return result, err
+	}
+
+	ttl := result.ExpiresAt.Sub(r.now(l.now))
+	if result.ExpiresAt.IsZero() || ttl <= 0 {
+		ttl = r.Duration
+	}
+
+	if created, err := l.client.SetNX(ctx, limitReachedKey(r), 1, ttl).Result(); err == nil && created {
+		l.onLimitReached(ctx, r, result)
+	}
+
+	return result, nil
+}
+
+// KeyFor returns the keys of the inner strategy and the marker key.
+func (l *limitReachedStrategy) KeyFor(r *Request) []string {
+	return append(keysFor(l.inner, r), limitReachedKey(r))
+}
+
+// Refund gives back the request on the inner strategy.
+func (l *limitReachedStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, l.inner, r)
+}
+
+// Commit settles the request on the inner strategy.
+func (l *limitReachedStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, l.inner, r, actualCost)
+}
+
+func (l *limitReachedStrategy) unwrap() Strategy {
+	return l.inner
+}
+
+func limitReachedKey(r *Request) string {
+	return r.redisKey() + ":limited"
+}
@@ -0,0 +1,77 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLimitReachedStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name    string
+		runs    int
+		advance time.Duration
+		calls   int
+	}{
+		{
+			name:  "does not call the callback while the key is allowed",
+			runs:  5,
+			calls: 0,
+		},
+		{
+			name:  "calls the callback once when the key is denied",
+			runs:  20,
+			calls: 1,
+		},
+		{
+			name:    "calls the callback again on a later window",
+			runs:    20,
+			advance: 10 * time.Second,
+			calls:   2,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			clock := func() time.Time {
+				return now
+			}
+
+			calls := 0
+			strategy := NewLimitReachedStrategy(NewFixedWindowBucketStrategy(client, clock), client, clock, func(ctx context.Context, r *Request, result *Result) {
+				assert.Equal(t, Deny, result.State)
+				calls++
+			})
+
+			for x := 0; x < ts.runs; x++ {
+				_, err := strategy.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    5,
+					Duration: time.Minute,
+				})
+				require.NoError(t, err)
+
+				if ts.advance != 0 {
+					server.FastForward(ts.advance)
+					now = now.Add(ts.advance)
+				}
+			}
+
+			assert.Equal(t, ts.calls, calls)
+		})
+	}
+}
@@ -2,9 +2,15 @@ package redis_rate_limiter
 
 import (
 	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strings"
 	"time"
 )
 
+// actionEscaper escapes the characters of an `Action` that would add segments to its Redis keys.
+var actionEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
 // Request defines a request that needs to be checked if it will be rate limited or not.
 // The `Key` is the identifier you're using for the client making calls. This could be a user/account ID if the user is
 // signed into your application, the IP of the client making requests (this might not be reliable if you're not behind a
@@ -12,10 +18,55 @@ import (
 // same client so we can correctly identify that this is the same app calling anywhere.
 // `Limit` is the amount of requests the client is allowed to make over the `Duration` period. If you set this to
 // 100 and `Duration` to `1m` you'd have at most 100 requests over a minute.
+// `Nonce` optionally identifies this logical request, strategies that support it will count a request with the same
+// nonce only once, so it's safe to retry a call that failed after the request was counted.
+// `At` is the time the request should be evaluated at, when it's zero the strategy clock is used. This allows
+// replaying events with their original timestamps. The counter strategy relies on Redis expiring keys, so for it
+// `At` only changes the `ExpiresAt` that is reported, the sorted set strategy uses it for the whole window.
+// `Action` optionally names what the client is doing (like `password-reset`), requests with different actions are
+// counted separately for the same `Key`, so each action can have its own limit without building composite keys. The
+// action is kept in its own segment of the Redis keys, after the `Key` and an `a` segment (`some-user:a:login`).
+// `Cost` is how much of the `Limit` the request uses, for requests that are more expensive than others, zero is
+// the same as one. Strategies that don't support costs count every request as one.
 type Request struct {
 	Key      string
 	Limit    uint64
 	Duration time.Duration
+	Nonce    string
+	At       time.Time
+	Action   string
+	Cost     uint64
+}
+
+// redisKey is the key the strategies store the request under, the `Key` when there's no `Action`, otherwise the `Key`
+// followed by an `a` segment and the `Action`, with its `%` and `:` escaped. The `a` segment keeps actions away from the
+// suffixes the strategies append (like `:denied` or a window), and escaping keeps an action from adding segments of its
+// own, so `u` with the action `x` (`u:a:x`) never shares a key with `u:x` or with another action. Keys that have an
+// `a` segment of their own (like `u:a:x`) are reserved for actions.
+func (r *Request) redisKey() string {
+	if r.Action == "" {
+		return r.Key
+	}
+
+	return r.Key + ":a:" + actionEscaper.Replace(r.Action)
+}
+
+// cost is how much of the limit the request uses, at least one.
+func (r *Request) cost() uint64 {
+	if r.Cost == 0 {
+		return 1
+	}
+
+	return r.Cost
+}
+
+// now returns the time the request should be evaluated at, `At` if it is set or the strategy clock otherwise.
+func (r *Request) now(clock func() time.Time) time.Time {
+	if !r.At.IsZero() {
+		return r.At
+	}
+
+	return clock()
 }
 
 // State is the result of evaluating the rate limit, either `Deny` or `Allow` a request.
@@ -26,14 +77,60 @@ const (
 	Allow       = 1
 )
 
+// Reason is a machine readable explanation of why a decision was made, it's meant to help when debugging why a
+// client was allowed or denied.
+type Reason string
+
+const (
+	// ReasonUnderLimit means the request was counted and the client is still under the limit.
+	ReasonUnderLimit Reason = "under_limit"
+	// ReasonOverLimit means the request was counted and that put the client over the limit.
+	ReasonOverLimit Reason = "over_limit"
+	// ReasonGuardRejected means the client was already at the limit so the request was denied without being counted.
+	ReasonGuardRejected Reason = "guard_rejected"
+	// ReasonCooldown means the client made a request too soon after the previous one.
+	ReasonCooldown Reason = "cooldown"
+	// ReasonNotSampled means the request was allowed without being checked as it was not sampled for limiting.
+	ReasonNotSampled Reason = "not_sampled"
+	// ReasonTrustedUpstream means the request was already checked by a trusted upstream limiter.
+	ReasonTrustedUpstream Reason = "trusted_upstream"
+	// ReasonCachedDeny means the request was denied from a local cache of clients that are over the limit.
+	ReasonCachedDeny Reason = "cached_deny"
+	// ReasonAllowlisted means the request was allowed without being checked as its key is on the allowlist.
+	ReasonAllowlisted Reason = "allowlisted"
+	// ReasonDenylisted means the request was denied without being checked as its key is on the denylist.
+	ReasonDenylisted Reason = "denylisted"
+	// ReasonPartial means only part of what the client asked for fit under the limit and that part was granted.
+	ReasonPartial Reason = "partial"
+	// ReasonBlocked means the request was denied without being checked as the client is blocked for repeatedly
+	// hitting the limit.
+	ReasonBlocked Reason = "blocked"
+	// ReasonFreeAllowance means the request was allowed without being checked as it was one of the free requests
+	// the client gets before being rate limited.
+	ReasonFreeAllowance Reason = "free_allowance"
+	// ReasonGlobalCeiling means the request was denied without being checked as the service is taking as many
+	// requests as it can from all clients combined.
+	ReasonGlobalCeiling Reason = "global_ceiling"
+	// ReasonExempt means the request was allowed without being checked as its key is exempt from rate limiting.
+	ReasonExempt Reason = "exempt"
+)
+
 // Result represents the response to a check if a client should be rate limited or not. The `State` will be either
 // `Allow` or `Deny`, `TotalRequests` holds the number of requests this specific caller has already made over
-// the current period of time and `ExpiresAt` defines when the rate limit will expire/roll over for clients that
-// have gone over the limit.
+// the current period of time after this decision was made (so it includes the current request if it was allowed)
+// and `ExpiresAt` defines when the rate limit will expire/roll over for clients that have gone over the limit.
+// `Reason` explains how the strategy got to the `State`. `WindowStart` and `WindowEnd` are the bounds of the window
+// `TotalRequests` was counted over, they're zero for results that were not counted over a window.
 type Result struct {
 	State         State
 	TotalRequests uint64
 	ExpiresAt     time.Time
+	Reason        Reason
+	WindowStart   time.Time
+	WindowEnd     time.Time
+	// DeniedCount is how many times the key was denied during the denied counter TTL, including this request. It's
+	// only set on denied requests by strategies created with WithDeniedCounter.
+	DeniedCount uint64
 }
 
 // Strategy is the interface the rate limit implementations must implement to be used, it takes a `Request` and
@@ -42,3 +139,145 @@ type Result struct {
 type Strategy interface {
 	Run(ctx context.Context, r *Request) (*Result, error)
 }
+
+// Refunder is implemented by strategies that can give back a request that was already counted, the request is
+// identified by its `Nonce`, so it must be set when the request is first run. This allows counting a request up
+// front and deciding later if it should have been counted at all (like only counting requests that succeeded).
+type Refunder interface {
+	Refund(ctx context.Context, r *Request) error
+}
+
+// Committer is implemented by strategies that can settle the cost of a request once it's known, for operations
+// where the real cost is only known after they're done (like the rows a query returned). The request is run with
+// the cost reserved up front as its `Cost` and a `Nonce`, then committed with the cost it really had: the
+// difference is given back if it's smaller and consumed (even past the limit) if it's larger. The request given to
+// `Commit` must be the one that was run and allowed, and it must only be committed once.
+type Committer interface {
+	Commit(ctx context.Context, r *Request, actualCost uint64) error
+}
+
+// Consumer is implemented by strategies that can grant part of what was asked for, for clients that can work with
+// less than they asked for (like a producer sending a batch of messages that can send the rest later). Unlike a
+// request with a `Cost`, which is all or nothing, TryConsume takes as many of the `n` units as fit under the limit
+// and returns how many it took.
+type Consumer interface {
+	TryConsume(ctx context.Context, key string, n uint64) (allowed uint64, result *Result, err error)
+}
+
+// Decayer is implemented by strategies that can forgive part of the usage a key has accumulated in the current
+// window, like after a client had its limit raised and shouldn't have to wait for the window to roll over.
+type Decayer interface {
+	Decay(ctx context.Context, key string, by uint64) error
+}
+
+// Pipelined is implemented by strategies that can run as part of a pipeline owned by the caller, so rate limiting
+// can share a single round trip to Redis with other commands. `RunPipelined` only adds commands to the pipeline,
+// the caller must execute it and then call the returned function to get the result. Strategies might skip
+// optimizations that need an extra round trip (like read only guards) when running pipelined.
+type Pipelined interface {
+	RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error)
+}
+
+// Pinger is implemented by strategies backed by Redis that can check if Redis is reachable, like for a readiness
+// probe that shouldn't let traffic in while the limiter can't make decisions.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Verifier is implemented by strategies backed by Redis that can check they're able to run every command they need,
+// like when Redis runs with ACLs that only allow some commands or keys. It's meant to be called on startup so a
+// misconfigured ACL fails right away with a clear error instead of on the first requests.
+type Verifier interface {
+	Verify(ctx context.Context) error
+}
+
+// KeyNamer is implemented by strategies that can tell which Redis keys they would use for a request, so tools that
+// inspect Redis directly don't have to know how every strategy names its keys. Decorators return the keys of the
+// strategies they wrap plus their own.
+//
+// The decorators in this package are also Refunders, Committers and Pipelined, forwarding to the strategy they wrap
+// when it implements them and failing when it doesn't. Decorators that run commands of their own before the strategy
+// they wrap need their own round trip and are not Pipelined.
+type KeyNamer interface {
+	KeyFor(r *Request) []string
+}
+
+// keysFor returns the keys the strategy would use for the request, or nothing if it doesn't implement KeyNamer.
+func keysFor(s Strategy, r *Request) []string {
+	if namer, ok := s.(KeyNamer); ok {
+		return namer.KeyFor(r)
+	}
+
+	return nil
+}
+
+// decorator is implemented by the strategies in this package that wrap a single strategy, so checks that are made
+// before running requests (like if refunds are supported) look at the strategy that counts them.
+type decorator interface {
+	unwrap() Strategy
+}
+
+// innermost returns the strategy wrapped by all the decorators around `s`, or `s` if it isn't a decorator.
+func innermost(s Strategy) Strategy {
+	for {
+		d, ok := s.(decorator)
+		if !ok || d.unwrap() == nil {
+			return s
+		}
+
+		s = d.unwrap()
+	}
+}
+
+// supportsRefunds tells if refunds given to the strategy reach a Refunder. Routed strategies pick the strategy per
+// key, so they're assumed to support them and fail per request if the one picked doesn't.
+func supportsRefunds(s Strategy) bool {
+	_, ok := innermost(s).(Refunder)
+	return ok
+}
+
+// supportsCommits is the same as supportsRefunds for Committer.
+func supportsCommits(s Strategy) bool {
+	_, ok := innermost(s).(Committer)
+	return ok
+}
+
+// refund gives back the request on the strategy, or fails if it doesn't implement Refunder.
+func refund(ctx context.Context, s Strategy, r *Request) error {
+	if refunder, ok := s.(Refunder); ok {
+		return refunder.Refund(ctx, r)
+	}
+
+	return errors.Errorf("the strategy %T does not support refunds", s)
+}
+
+// commit settles the request on the strategy, or fails if it doesn't implement Committer.
+func commit(ctx context.Context, s Strategy, r *Request, actualCost uint64) error {
+	if committer, ok := s.(Committer); ok {
+		return committer.Commit(ctx, r, actualCost)
+	}
+
+	return errors.Errorf("the strategy %T does not support commits", s)
+}
+
+// runPipelined adds the commands for the request to the pipeline, the returned function fails if the strategy
+// isn't Pipelined.
+func runPipelined(ctx context.Context, s Strategy, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	if pipelined, ok := s.(Pipelined); ok {
+		return pipelined.RunPipelined(ctx, p, r)
+	}
+
+	return func() (*Result, error) {
+		return nil, errors.Errorf("the strategy %T can't run pipelined", s)
+	}
+}
+
+// pipelineFor returns a pipeline on the client of the strategy, or nil if it isn't one of the pipelined strategies
+// of this package.
+func pipelineFor(s Strategy) redis.Pipeliner {
+	if owner, ok := s.(pipeliner); ok {
+		return owner.pipeline()
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestKeyNamer_KeyFor(t *testing.T) {
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	tt := []struct {
+		name     string
+		strategy func(client *redis.Client) Strategy
+		request  *Request
+		keys     []string
+	}{
+		{
+			name: "counter strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewCounterStrategy(client, clock)
+			},
+			request: &Request{Key: "some-user", Action: "login", Nonce: "request-1", Duration: time.Minute},
+			keys:    []string{"some-user:a:login", "some-user:a:login:nonce:request-1"},
+		},
+		{
+			name: "sorted set strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewSortedSetCounterStrategy(client, clock)
+			},
+			request: &Request{Key: "some-user", Duration: time.Minute},
+			keys:    []string{"some-user"},
+		},
+		{
+			name: "fixed window strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewFixedWindowBucketStrategy(client, clock)
+			},
+			request: &Request{Key: "some-user", Duration: time.Minute},
+			keys:    []string{"some-user:26418855"},
+		},
+		{
+			name: "debounce strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewDebounceStrategy(client, clock)
+			},
+			request: &Request{Key: "some-user", Duration: time.Minute},
+			keys:    []string{"some-user"},
+		},
+		{
+			name: "limit reached decorator",
+			strategy: func(client *redis.Client) Strategy {
+				return NewLimitReachedStrategy(NewSortedSetCounterStrategy(client, clock), client, clock, func(ctx context.Context, r *Request, result *Result) {})
+			},
+			request: &Request{Key: "some-user", Duration: time.Minute},
+			keys:    []string{"some-user", "some-user:limited"},
+		},
+		{
+			name: "dynamic limit decorator",
+			strategy: func(client *redis.Client) Strategy {
+				return NewDynamicLimitStrategy(NewDebounceStrategy(client, clock), client, clock, time.Minute)
+			},
+			request: &Request{Key: "some-user", Duration: time.Minute},
+			keys:    []string{"rl:config:some-user", "some-user"},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			strategy := ts.strategy(client)
+
+			namer, ok := strategy.(KeyNamer)
+			require.True(t, ok)
+			assert.Equal(t, ts.keys, namer.KeyFor(ts.request))
+
+			_, err = strategy.Run(context.Background(), ts.request)
+			require.NoError(t, err)
+
+			// every key that was written must have been named
+			assert.Subset(t, ts.keys, server.Keys())
+		})
+	}
+}
+
+func TestRequest_RedisKey(t *testing.T) {
+	tt := []struct {
+		name     string
+		request  *Request
+		expected string
+	}{
+		{name: "uses the key without an action", request: &Request{Key: "u:x"}, expected: "u:x"},
+		{name: "keeps the action in its own segment", request: &Request{Key: "u", Action: "x"}, expected: "u:a:x"},
+		{name: "doesn't share keys with decorator suffixes", request: &Request{Key: "u", Action: "denied"}, expected: "u:a:denied"},
+		{name: "escapes separators in the action", request: &Request{Key: "u", Action: "x:denied"}, expected: "u:a:x%3Adenied"},
+		{name: "escapes the escape character in the action", request: &Request{Key: "u", Action: "x%3Adenied"}, expected: "u:a:x%253Adenied"},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			assert.Equal(t, ts.expected, ts.request.redisKey())
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package redis_rate_limiter
+
+import (
+	"net/http"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+)
+
+// Logger is a structured logger, `keysAndValues` alternate between a key (always a string) and its value, like
+// `"key", "some-user", "total_requests", 3`, which is how most structured loggers take fields (like zap's
+// SugaredLogger `Debugw` or logr) so they only need a small adapter.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+}
+
+// debugging is true when `Debug` is on and there is a Logger, the fields are only built when it is.
+func (h *httpRateLimiterHandler) debugging() bool {
+	return h.config.Debug && h.config.Logger != nil
+}
+
+// debug logs to the Logger. Every entry starts with the method, path, remote address and the `X-Request-Id` header
+// (when sent) of the request, so all entries for a request can be found together.
+func (h *httpRateLimiterHandler) debug(request *http.Request, msg string, keysAndValues ...interface{}) {
+	fields := make([]interface{}, 0, 8+len(keysAndValues))
+	fields = append(fields, "method", request.Method, "path", request.URL.Path, "remote_addr", request.RemoteAddr)
+
+	if id := request.Header.Get(requestIDHeader); id != "" {
+		fields = append(fields, "request_id", id)
+	}
+
+	h.config.Logger.Debug(msg, append(fields, keysAndValues...)...)
+}
+
+// decisionName is how a state is logged.
+func decisionName(state State) string {
+	if state == Allow {
+		return "allow"
+	}
+
+	return "deny"
+}
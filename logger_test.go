@@ -0,0 +1,135 @@
+package redis_rate_limiter
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type logEntry struct {
+	msg    string
+	fields []interface{}
+}
+
+type recordingLogger struct {
+	entries []logEntry
+}
+
+func (l *recordingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.entries = append(l.entries, logEntry{msg: msg, fields: keysAndValues})
+}
+
+func TestHTTPRateLimiterHandler_Debug(t *testing.T) {
+	tt := []struct {
+		name    string
+		debug   bool
+		entries []logEntry
+	}{
+		{
+			name:  "logs every limit and the decision",
+			debug: true,
+			entries: []logEntry{
+				{
+					msg: "checked the rate limit",
+					fields: []interface{}{
+						"method", http.MethodGet,
+						"path", "/foo",
+						"remote_addr", "192.0.2.1:1234",
+						"request_id", "some-request",
+						"limit", "",
+						"key", "10.10.10.10",
+						"max_requests", uint64(1),
+						"expiration", time.Minute,
+						"state", "deny",
+						"total_requests", uint64(1),
+						"reason", string(ReasonGuardRejected),
+						"expires_at", time.Date(2020, 3, 25, 10, 16, 30, 0, time.UTC),
+						"duration", time.Millisecond,
+					},
+				},
+				{
+					msg: "rate limited the request",
+					fields: []interface{}{
+						"method", http.MethodGet,
+						"path", "/foo",
+						"remote_addr", "192.0.2.1:1234",
+						"request_id", "some-request",
+						"state", "deny",
+						"limits", 1,
+						"bypassed", false,
+						"duration", 3 * time.Millisecond,
+					},
+				},
+				{
+					msg: "failed to extract the rate limiting key",
+					fields: []interface{}{
+						"method", http.MethodGet,
+						"path", "/foo",
+						"remote_addr", "192.0.2.1:1234",
+						"limit", "",
+						"error", "the header X-Forwarded-For must have a value set",
+					},
+				},
+			},
+		},
+		{
+			name: "doesn't log by default",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			logger := &recordingLogger{}
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			// the key is at the limit already, so the clock is only read by the handler
+			require.NoError(t, server.Set("10.10.10.10", "1"))
+			server.SetTTL("10.10.10.10", time.Minute)
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, &RateLimiterConfig{
+				Extractor: NewHTTPHeadersExtractor(forwardedFor),
+				Strategy: NewCounterStrategy(client, func() time.Time {
+					return time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+				}),
+				Expiration:  time.Minute,
+				MaxRequests: 1,
+				Debug:       ts.debug,
+				Logger:      logger,
+			})
+
+			// every call to the clock moves it forward a millisecond
+			wrapper.(*httpRateLimiterHandler).now = func() time.Time {
+				now = now.Add(time.Millisecond)
+				return now
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set(forwardedFor, "10.10.10.10")
+			req.Header.Set("X-Request-Id", "some-request")
+			wrapper.ServeHTTP(httptest.NewRecorder(), req)
+
+			req = httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			wrapper.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, ts.entries, logger.entries)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	_ Strategy  = &counterMigrationStrategy{}
+	_ KeyNamer  = &counterMigrationStrategy{}
+	_ Refunder  = &counterMigrationStrategy{}
+	_ Committer = &counterMigrationStrategy{}
+
+	// migrationScript replaces a counter with a sorted set holding a member for every request it counted. ARGV has
+	// the time of the request, the duration and the cap on the members added, all members get the score that makes
+	// them roll off the window when the counter would have expired. Keys GET can't read (already a sorted set or
+	// missing) are left alone. It returns how many members were added.
+	migrationScript = redis.NewScript(`
+local value = redis.pcall('GET', KEYS[1])
+if type(value) ~= 'string' then
+  return 0
+end
+local count = tonumber(value)
+if not count then
+  return redis.error_reply('the counter is not a number')
+end
+local score = tonumber(ARGV[1])
+local duration = tonumber(ARGV[2])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 and ttl < duration then
+  score = score - duration + ttl
+end
+redis.call('DEL', KEYS[1])
+count = math.min(count, tonumber(ARGV[3]))
+for x = 1, count do
+  redis.call('ZADD', KEYS[1], score, 'migrated:' .. x)
+end
+return math.max(count, 0)
+`)
+)
+
+// MigrateCounter moves the count of a key from the counter strategy to the sorted set strategy, so clients don't get
+// their limit back when switching strategies. Both strategies keep a key at the same name, so the counter is
+// replaced with a sorted set that has a member for every request it counted, capped at `Limit` (which denies just
+// the same) and at MaxSortedSetCost, so a large counter doesn't keep Redis busy adding members. The members are as
+// old as they need to be to roll off the window when the counter would have expired, or made at `now` if the counter
+// has no TTL or a longer one than `Duration`.
+//
+// Keys that are already sorted sets or don't exist are left alone, so it's safe to run it for any key and more than
+// once. It returns how many members were added.
+func MigrateCounter(ctx context.Context, client redis.Cmdable, r *Request, now time.Time) (uint64, error) {
+	key := r.redisKey()
+
+	limit := r.Limit
+	if limit == 0 || limit > MaxSortedSetCost {
+		limit = MaxSortedSetCost
+	}
+
+	added, err := migrationScript.Run(ctx, client, []string{key},
+		now.UnixMilli(), r.Duration.Milliseconds(), limit).Uint64()
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to migrate counter %v", key)
+	}
+
+	return added, nil
+}
+
+// NewCounterMigrationStrategy creates a strategy that runs MigrateCounter for every request before running `inner`,
+// which should be a sorted set strategy, so counters are migrated the first time their key is used after the switch.
+// It costs an extra round trip per request, remove it once the old counters have expired.
+func NewCounterMigrationStrategy(inner Strategy, client redis.Cmdable, now func() time.Time) Strategy {
+	return &counterMigrationStrategy{
+		inner:  inner,
+		client: client,
+		now:    now,
+	}
+}
+
+type counterMigrationStrategy struct {
+	inner  Strategy
+	client redis.Cmdable
+	now    func() time.Time
+}
+
+// Run migrates the counter of the key, if there is one, and runs the inner strategy.
+func (c *counterMigrationStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	if _, err := MigrateCounter(ctx, c.client, r, r.now(c.now)); err != nil {
+		return nil, err
+	}
+
+	return c.inner.Run(ctx, r)
+}
+
+// KeyFor returns the keys of the inner strategy, the counter is at the same key as the sorted set.
+func (c *counterMigrationStrategy) KeyFor(r *Request) []string {
+	return keysFor(c.inner, r)
+}
+
+// Refund gives back the request on the inner strategy.
+func (c *counterMigrationStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, c.inner, r)
+}
+
+// Commit settles the request on the inner strategy.
+func (c *counterMigrationStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, c.inner, r, actualCost)
+}
+
+func (c *counterMigrationStrategy) unwrap() Strategy {
+	return c.inner
+}
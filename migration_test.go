@@ -0,0 +1,187 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMigrateCounter(t *testing.T) {
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	tt := []struct {
+		name    string
+		setup   func(server *miniredis.Miniredis)
+		limit   uint64
+		added   uint64
+		members []string
+		score   time.Time
+		err     string
+	}{
+		{
+			name: "rolls the requests off when the counter would have expired",
+			setup: func(server *miniredis.Miniredis) {
+				require.NoError(t, server.Set("some-user", "3"))
+				server.SetTTL("some-user", 40*time.Second)
+			},
+			limit:   10,
+			added:   3,
+			members: []string{"migrated:1", "migrated:2", "migrated:3"},
+			score:   now.Add(-20 * time.Second),
+		},
+		{
+			name: "adds the requests now for counters without a TTL",
+			setup: func(server *miniredis.Miniredis) {
+				require.NoError(t, server.Set("some-user", "2"))
+			},
+			limit:   10,
+			added:   2,
+			members: []string{"migrated:1", "migrated:2"},
+			score:   now,
+		},
+		{
+			name: "caps the requests at the limit",
+			setup: func(server *miniredis.Miniredis) {
+				require.NoError(t, server.Set("some-user", "30"))
+			},
+			limit:   2,
+			added:   2,
+			members: []string{"migrated:1", "migrated:2"},
+			score:   now,
+		},
+		{
+			name: "leaves sorted sets alone",
+			setup: func(server *miniredis.Miniredis) {
+				_, err := server.ZAdd("some-user", 100, "some-request")
+				require.NoError(t, err)
+			},
+			limit:   10,
+			members: []string{"some-request"},
+			score:   time.UnixMilli(100),
+		},
+		{
+			name:  "does nothing for missing keys",
+			setup: func(server *miniredis.Miniredis) {},
+			limit: 10,
+		},
+		{
+			name: "fails for counters that are not numbers",
+			setup: func(server *miniredis.Miniredis) {
+				require.NoError(t, server.Set("some-user", "not-a-number"))
+			},
+			limit: 10,
+			err:   "failed to migrate counter some-user: the counter is not a number",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			ts.setup(server)
+
+			added, err := MigrateCounter(context.Background(), client, &Request{
+				Key:      "some-user",
+				Limit:    ts.limit,
+				Duration: time.Minute,
+			}, now)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, ts.added, added)
+
+			members, err := client.ZRangeWithScores(context.Background(), "some-user", 0, -1).Result()
+			require.NoError(t, err)
+			require.Len(t, members, len(ts.members))
+
+			for x, member := range members {
+				assert.Equal(t, ts.members[x], member.Member)
+				assert.Equal(t, float64(ts.score.UnixMilli()), member.Score)
+			}
+		})
+	}
+}
+
+func TestMigrateCounter_WithoutLimit(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	require.NoError(t, server.Set("some-user", "25000"))
+
+	// without a limit the members are still capped, the script would otherwise block Redis
+	added, err := MigrateCounter(context.Background(), client, &Request{
+		Key:      "some-user",
+		Duration: time.Minute,
+	}, time.Now())
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(MaxSortedSetCost), added)
+	assert.Equal(t, int64(MaxSortedSetCost), client.ZCard(context.Background(), "some-user").Val())
+}
+
+func TestCounterMigrationStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	request := &Request{
+		Key:      "some-user",
+		Limit:    5,
+		Duration: time.Minute,
+	}
+
+	counter := NewCounterStrategy(client, clock)
+	for x := 0; x < 3; x++ {
+		_, err := counter.Run(context.Background(), request)
+		require.NoError(t, err)
+	}
+
+	now = now.Add(20 * time.Second)
+	server.FastForward(20 * time.Second)
+
+	strategy := NewCounterMigrationStrategy(NewSortedSetCounterStrategy(client, clock), client, clock)
+
+	totals := make([]uint64, 0, 3)
+
+	for _, advance := range []time.Duration{0, 0, 40 * time.Second} {
+		now = now.Add(advance)
+
+		result, err := strategy.Run(context.Background(), request)
+		require.NoError(t, err)
+		totals = append(totals, result.TotalRequests)
+	}
+
+	// the counted requests roll off when the counter would have expired
+	assert.Equal(t, []uint64{4, 5, 3}, totals)
+	assert.Equal(t, []string{"some-user"}, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+}
@@ -0,0 +1,180 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	_ Strategy = &MultiWindowStrategy{}
+	_ KeyNamer = &MultiWindowStrategy{}
+
+	// multiWindowScript removes the requests that rolled off the longest window, counts the requests in every window
+	// and only adds the request (as `cost` members, like the sorted set strategy does) if it fits in all of them.
+	// ARGV has the request score, item, cost, expired maximum and TTL followed by the limit and ZCOUNT minimum of
+	// every window, it returns whether the request was added followed by the total of every window before adding it.
+	multiWindowScript = redis.NewScript(`
+local cost = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[4])
+local result = {1}
+for x = 6, #ARGV, 2 do
+  local total = redis.call('ZCOUNT', KEYS[1], ARGV[x + 1], '+inf')
+  if total + cost > tonumber(ARGV[x]) then
+    result[1] = 0
+  end
+  table.insert(result, total)
+end
+if result[1] == 1 then
+  redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+  for x = 1, cost - 1 do
+    redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2] .. ':' .. x)
+  end
+  redis.call('PEXPIRE', KEYS[1], ARGV[5])
+end
+return result
+`)
+)
+
+// WindowLimit is one of the windows of a MultiWindowStrategy, `Limit` requests every `Duration`.
+type WindowLimit struct {
+	Limit    uint64
+	Duration time.Duration
+}
+
+// NewMultiWindowStrategy creates a strategy that enforces many rolling windows on the same key, like 60 requests
+// a minute and 1000 an hour, checking and counting all of them in a single script. A request is only counted if
+// it fits in every window, so unlike running a strategy per window (or the handler `Limits`) a request denied by
+// one window is never counted by the others. The windows replace the `Limit` and `Duration` of the requests.
+//
+// Requests are kept in a single sorted set (like the sorted set strategy, with the same window boundaries) until
+// they roll off the longest window, so it takes memory for every request made within it.
+func NewMultiWindowStrategy(client redis.Cmdable, now func() time.Time, windows ...WindowLimit) *MultiWindowStrategy {
+	return &MultiWindowStrategy{
+		client:  client,
+		now:     now,
+		windows: append([]WindowLimit{}, windows...),
+	}
+}
+
+// MultiWindowStrategy is the strategy created by NewMultiWindowStrategy.
+type MultiWindowStrategy struct {
+	client  redis.Cmdable
+	now     func() time.Time
+	windows []WindowLimit
+}
+
+// Run checks the request against every window and returns a single result. Denied requests get the result of the
+// window that denied them for the longest and allowed ones the result of the window with the fewest requests left.
+func (m *MultiWindowStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	results, err := m.RunWindows(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var denied *Result
+	evaluated := make([]evaluatedLimit, 0, len(results))
+
+	for x, result := range results {
+		if result.State == Deny && (denied == nil || result.ExpiresAt.After(denied.ExpiresAt)) {
+			denied = result
+		}
+
+		evaluated = append(evaluated, evaluatedLimit{
+			limit:  m.windows[x].Limit,
+			result: result,
+		})
+	}
+
+	if denied != nil {
+		return denied, nil
+	}
+
+	return tightest(evaluated), nil
+}
+
+// RunWindows checks the request against every window and returns a result for each of them, in the order the
+// windows were given. When the request is denied the windows it would have gone over are denied with
+// ReasonGuardRejected and the others are allowed with the requests they already had, as the request wasn't counted.
+func (m *MultiWindowStrategy) RunWindows(ctx context.Context, r *Request) ([]*Result, error) {
+	key := r.redisKey()
+
+	if len(m.windows) == 0 {
+		return nil, errors.Errorf("the multi window strategy for key %v has no windows", key)
+	}
+
+	now := r.now(m.now)
+
+	score, err := sortedSetScore(key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	longest := m.windows[0].Duration
+	for _, window := range m.windows {
+		// TTLs are set in milliseconds and the scores are milliseconds, anything shorter has no window
+		if window.Duration < time.Millisecond {
+			return nil, errors.Errorf("the duration %v for key %v must be at least 1ms", window.Duration, key)
+		}
+
+		if window.Duration > longest {
+			longest = window.Duration
+		}
+	}
+
+	// like the sorted set strategy every unit of cost is a member
+	if r.cost() > MaxSortedSetCost {
+		return nil, errors.Errorf("the cost %v for key %v is over the %v the multi window strategy can count", r.cost(), key, MaxSortedSetCost)
+	}
+
+	item := r.Nonce
+	if item == "" {
+		item = uuid.New().String()
+	}
+
+	args := make([]interface{}, 0, 5+len(m.windows)*2)
+	args = append(args, score, item, r.cost(), expiredMaximum(now.Add(-longest)), longest.Milliseconds())
+
+	for _, window := range m.windows {
+		args = append(args, window.Limit, windowMinimum(now.Add(-window.Duration)))
+	}
+
+	reply, err := int64s(multiWindowScript.Run(ctx, m.client, []string{key}, args...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run multi window script for key %v", key)
+	}
+
+	added := reply[0] == 1
+	results := make([]*Result, 0, len(m.windows))
+
+	for x, window := range m.windows {
+		total := uint64(reply[x+1])
+
+		result := &Result{
+			State:         Allow,
+			TotalRequests: total,
+			ExpiresAt:     now.Add(window.Duration),
+			Reason:        ReasonUnderLimit,
+			WindowStart:   now.Add(-window.Duration),
+			WindowEnd:     now,
+		}
+
+		if added {
+			result.TotalRequests += r.cost()
+		} else if total+r.cost() > window.Limit {
+			result.State = Deny
+			result.Reason = ReasonGuardRejected
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// KeyFor returns the key of the sorted set all windows share.
+func (m *MultiWindowStrategy) KeyFor(r *Request) []string {
+	return []string{r.redisKey()}
+}
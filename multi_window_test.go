@@ -0,0 +1,143 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMultiWindowStrategy_RunWindows(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	strategy := NewMultiWindowStrategy(client, func() time.Time {
+		return now
+	}, WindowLimit{Limit: 2, Duration: time.Minute}, WindowLimit{Limit: 3, Duration: time.Hour})
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		states  []State
+		totals  []uint64
+	}{
+		{name: "counts the request in every window", states: []State{Allow, Allow}, totals: []uint64{1, 1}},
+		{name: "reaches the minute limit", states: []State{Allow, Allow}, totals: []uint64{2, 2}},
+		{name: "denies over the minute limit without counting in the hour", states: []State{Deny, Allow}, totals: []uint64{2, 2}},
+		{name: "allows once the minute rolls over", advance: time.Minute, states: []State{Allow, Allow}, totals: []uint64{1, 3}},
+		{name: "denies over the hour limit without counting in the minute", states: []State{Allow, Deny}, totals: []uint64{1, 3}},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+
+		results, err := strategy.RunWindows(context.Background(), &Request{Key: "some-user"})
+		require.NoError(t, err, step.name)
+		require.Len(t, results, 2, step.name)
+
+		for x, result := range results {
+			assert.Equal(t, step.states[x], result.State, step.name)
+			assert.Equal(t, step.totals[x], result.TotalRequests, step.name)
+		}
+
+		assert.Equal(t, now.Add(time.Minute), results[0].ExpiresAt, step.name)
+		assert.Equal(t, now.Add(time.Hour), results[1].ExpiresAt, step.name)
+	}
+
+	count, err := client.ZCard(context.Background(), "some-user").Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.Equal(t, time.Hour, server.TTL("some-user"))
+}
+
+func TestMultiWindowStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name    string
+		windows []WindowLimit
+		runs    int
+		result  *Result
+		err     string
+	}{
+		{
+			name:    "returns the window with the fewest requests left when allowed",
+			windows: []WindowLimit{{Limit: 10, Duration: time.Minute}, {Limit: 3, Duration: time.Hour}},
+			runs:    2,
+			result: &Result{
+				State:         Allow,
+				TotalRequests: 2,
+				ExpiresAt:     time.Date(2020, time.March, 25, 11, 15, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 9, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+			},
+		},
+		{
+			name:    "returns the window that denies for the longest when denied",
+			windows: []WindowLimit{{Limit: 1, Duration: time.Minute}, {Limit: 1, Duration: time.Hour}},
+			runs:    2,
+			result: &Result{
+				State:         Deny,
+				TotalRequests: 1,
+				ExpiresAt:     time.Date(2020, time.March, 25, 11, 15, 30, 0, time.UTC),
+				Reason:        ReasonGuardRejected,
+				WindowStart:   time.Date(2020, time.March, 25, 9, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+			},
+		},
+		{
+			name: "fails without windows",
+			runs: 1,
+			err:  "the multi window strategy for key some-user has no windows",
+		},
+		{
+			name:    "fails for windows shorter than a millisecond",
+			windows: []WindowLimit{{Limit: 1, Duration: time.Minute}, {Limit: 1, Duration: time.Microsecond}},
+			runs:    1,
+			err:     "the duration 1µs for key some-user must be at least 1ms",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			strategy := NewMultiWindowStrategy(client, func() time.Time {
+				return now
+			}, ts.windows...)
+
+			var result *Result
+
+			for x := 0; x < ts.runs; x++ {
+				result, err = strategy.Run(context.Background(), &Request{Key: "some-user"})
+			}
+
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, ts.result, result)
+		})
+	}
+}
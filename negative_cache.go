@@ -0,0 +1,146 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+var (
+	_ Strategy  = &NegativeCacheStrategy{}
+	_ KeyNamer  = &NegativeCacheStrategy{}
+	_ Refunder  = &NegativeCacheStrategy{}
+	_ Committer = &NegativeCacheStrategy{}
+	_ Pipelined = &NegativeCacheStrategy{}
+)
+
+// NewNegativeCacheStrategy creates a strategy that remembers, in memory, keys that were denied by the inner strategy
+// and denies them again without going to Redis until a `fraction` (from 0 to 1) of the window has passed (or the
+// result expires, whatever comes first). This protects Redis from clients that keep hammering the service once
+// they're over the limit, at the cost of denying them for a little longer in the rolling window strategies if their
+// oldest requests expire while they're cached. At most `maxSize` keys are cached.
+func NewNegativeCacheStrategy(inner Strategy, now func() time.Time, fraction float64, maxSize int) *NegativeCacheStrategy {
+	return &NegativeCacheStrategy{
+		inner:    inner,
+		now:      now,
+		fraction: fraction,
+		cache:    newTTLCache(maxSize),
+	}
+}
+
+// NegativeCacheStrategy is the strategy created by NewNegativeCacheStrategy.
+type NegativeCacheStrategy struct {
+	inner    Strategy
+	now      func() time.Time
+	fraction float64
+	cache    *ttlCache
+}
+
+// Run returns the cached deny for the key if there is one, otherwise runs the inner strategy and caches the result
+// if it was a deny.
+func (n *NegativeCacheStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	now := r.now(n.now)
+
+	if result := n.get(r.redisKey(), now); result != nil {
+		return result, nil
+	}
+
+	result, err := n.inner.Run(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	n.remember(r, now, result)
+
+	return result, nil
+}
+
+// RunPipelined is the same as Run, requests with a cached deny don't add commands to the pipeline.
+func (n *NegativeCacheStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	now := r.now(n.now)
+
+	if result := n.get(r.redisKey(), now); result != nil {
+		return func() (*Result, error) {
+			return result, nil
+		}
+	}
+
+	interpret := runPipelined(ctx, n.inner, p, r)
+
+	return func() (*Result, error) {
+		result, err := interpret()
+		if err != nil {
+			return nil, err
+		}
+
+		n.remember(r, now, result)
+
+		return result, nil
+	}
+}
+
+// Refund gives back the request on the inner strategy.
+func (n *NegativeCacheStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, n.inner, r)
+}
+
+// Commit settles the request on the inner strategy.
+func (n *NegativeCacheStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, n.inner, r, actualCost)
+}
+
+// KeyFor returns the keys of the inner strategy.
+func (n *NegativeCacheStrategy) KeyFor(r *Request) []string {
+	return keysFor(n.inner, r)
+}
+
+// Len returns how many keys are currently cached, including ones that have expired but were not evicted yet.
+func (n *NegativeCacheStrategy) Len() int {
+	return n.cache.len()
+}
+
+func (n *NegativeCacheStrategy) unwrap() Strategy {
+	return n.inner
+}
+
+func (n *NegativeCacheStrategy) pipeline() redis.Pipeliner {
+	return pipelineFor(n.inner)
+}
+
+// remember caches the result if it was a deny.
+func (n *NegativeCacheStrategy) remember(r *Request, now time.Time, result *Result) {
+	if result.State == Deny {
+		until := now.Add(time.Duration(float64(r.Duration) * n.fraction))
+		if !result.ExpiresAt.IsZero() && result.ExpiresAt.Before(until) {
+			until = result.ExpiresAt
+		}
+
+		// results that are already over are not worth caching
+		if now.Before(until) {
+			n.cache.put(r.redisKey(), result, until)
+		}
+	}
+}
+
+func (n *NegativeCacheStrategy) get(key string, now time.Time) *Result {
+	value, until, ok := n.cache.get(key)
+	if !ok {
+		return nil
+	}
+
+	if !now.Before(until) {
+		n.cache.remove(key)
+		return nil
+	}
+
+	result := value.(*Result)
+
+	return &Result{
+		State:         Deny,
+		TotalRequests: result.TotalRequests,
+		ExpiresAt:     result.ExpiresAt,
+		Reason:        ReasonCachedDeny,
+		WindowStart:   result.WindowStart,
+		WindowEnd:     result.WindowEnd,
+	}
+}
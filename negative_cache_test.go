@@ -0,0 +1,97 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestNegativeCacheStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name    string
+		runs    int
+		advance time.Duration
+		state   State
+		reason  Reason
+	}{
+		{
+			name:   "runs the inner strategy while the key is allowed",
+			runs:   2,
+			state:  Allow,
+			reason: ReasonUnderLimit,
+		},
+		{
+			name:   "denies from the cache once the key was denied",
+			runs:   5,
+			state:  Deny,
+			reason: ReasonCachedDeny,
+		},
+		{
+			name:    "goes back to the inner strategy once the cached deny is over",
+			runs:    5,
+			advance: 10 * time.Second,
+			state:   Deny,
+			reason:  ReasonGuardRejected,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			clock := func() time.Time {
+				return now
+			}
+
+			strategy := NewNegativeCacheStrategy(NewSortedSetCounterStrategy(client, clock), clock, 0.1, 10)
+
+			var lastResult *Result
+
+			for x := 0; x < ts.runs; x++ {
+				if x == ts.runs-1 {
+					now = now.Add(ts.advance)
+				}
+
+				lastResult, err = strategy.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    2,
+					Duration: time.Minute,
+				})
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, ts.state, lastResult.State)
+			assert.Equal(t, ts.reason, lastResult.Reason)
+		})
+	}
+}
+
+func TestNegativeCacheStrategy_RunIsBounded(t *testing.T) {
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	strategy := NewNegativeCacheStrategy(&denyAllStrategy{}, func() time.Time {
+		return now
+	}, 0.5, 5)
+
+	for x := 0; x < 20; x++ {
+		_, err := strategy.Run(context.Background(), &Request{
+			Key:      fmt.Sprintf("user-%v", x),
+			Duration: time.Minute,
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 5, strategy.Len())
+}
@@ -0,0 +1,35 @@
+package redis_rate_limiter
+
+import (
+	"net/http"
+)
+
+var (
+	_ Extractor = &normalizingExtractor{}
+)
+
+// NewNormalizingExtractor creates an extractor that runs `normalize` on the keys of `inner`, like strings.ToLower
+// so API keys sent with different casing share a counter. Errors from `inner` are returned as they are and
+// `normalize` isn't called for them. A key `normalize` turns into an empty string is handled by the handler like
+// any other empty key.
+func NewNormalizingExtractor(inner Extractor, normalize func(string) string) Extractor {
+	return &normalizingExtractor{
+		inner:     inner,
+		normalize: normalize,
+	}
+}
+
+type normalizingExtractor struct {
+	inner     Extractor
+	normalize func(string) string
+}
+
+// Extract runs the inner extractor and normalizes its key.
+func (n *normalizingExtractor) Extract(r *http.Request) (string, error) {
+	key, err := n.inner.Extract(r)
+	if err != nil {
+		return "", err
+	}
+
+	return n.normalize(key), nil
+}
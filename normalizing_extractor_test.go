@@ -0,0 +1,57 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizingExtractor_Extract(t *testing.T) {
+	tt := []struct {
+		name      string
+		headers   map[string]string
+		normalize func(string) string
+		key       string
+		err       string
+	}{
+		{
+			name:      "normalizes the key",
+			headers:   map[string]string{"X-API-Key": "Some-KEY"},
+			normalize: strings.ToLower,
+			key:       "some-key",
+		},
+		{
+			name:    "can normalize to an empty key",
+			headers: map[string]string{"X-API-Key": "?"},
+			normalize: func(key string) string {
+				return strings.Trim(key, "?")
+			},
+			key: "",
+		},
+		{
+			name:      "returns the errors of the inner extractor",
+			normalize: strings.ToLower,
+			err:       "the header X-API-Key must have a value set",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			for name, value := range ts.headers {
+				req.Header.Set(name, value)
+			}
+
+			key, err := NewNormalizingExtractor(NewHTTPHeadersExtractor("X-API-Key"), ts.normalize).Extract(req)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, ts.key, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	// deniedScript counts a denied request and sets the TTL when the counter is created, so it counts the denials
+	// over a fixed period starting at the first one instead of being extended by every new denial.
+	deniedScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+)
+
+// StrategyOption customizes the Redis backed strategies.
+type StrategyOption func(o *strategyOptions)
+
+type strategyOptions struct {
+	reader      redis.Cmdable
+	limit       uint64
+	duration    time.Duration
+	deniedTTL   time.Duration
+	reconcile   bool
+	grandfather bool
+	compact     bool
+	db          *int
+	// dedicated is the client created for the database set with WithDB, the only one the options own
+	dedicated *redis.Client
+}
+
+func newStrategyOptions(client redis.Cmdable, opts []StrategyOption) *strategyOptions {
+	o := &strategyOptions{
+		reader: client,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithReadClient sends the read only commands a strategy runs before deciding to write (the GET and PTTL on the
+// counter strategy and the ZCOUNT guard on the sorted set strategy) to `reader` instead of the main client. This is
+// meant for a read replica (or a client like go-redis' failover cluster client with replica routing), so clients
+// that are already over the limit and keep sending requests are denied without touching the primary. Writes always
+// go to the main client.
+//
+// Replicas lag behind the primary, so the reads can be a little stale. A client right at the limit could get a
+// few more requests in than it should on the sorted set strategy before the replica catches up, and a counter key
+// created a few milliseconds ago might not be on the replica yet, which makes the counter strategy set its TTL
+// again, extending its first window by about the replication lag.
+func WithReadClient(reader redis.Cmdable) StrategyOption {
+	return func(o *strategyOptions) {
+		o.reader = reader
+	}
+}
+
+// WithDefaultLimit sets the `Limit` and `Duration` used for requests that leave them as zero, so a strategy that
+// always enforces the same limit doesn't need them on every `Request`. Requests that set them still override the
+// defaults.
+func WithDefaultLimit(limit uint64, duration time.Duration) StrategyOption {
+	return func(o *strategyOptions) {
+		o.limit = limit
+		o.duration = duration
+	}
+}
+
+// WithDeniedCounter keeps a second counter for every key that is only incremented when a request is denied, its
+// value is returned as the `DeniedCount` of denied results. This is meant for abuse scoring, like blocking clients
+// for longer the more they keep hitting the limit. The counter starts on the first denial and expires `ttl` after
+// it, so it's the number of denials within that period. It's kept at the request key with `:denied` appended and
+// costs an extra command on every denied request.
+func WithDeniedCounter(ttl time.Duration) StrategyOption {
+	return func(o *strategyOptions) {
+		o.deniedTTL = ttl
+	}
+}
+
+// WithReconciledTTL makes the counter strategy bring the TTL of existing keys down to the request `Duration` when
+// it's longer, which happens when the `Duration` is made shorter (like going from 5m to 1m) while keys created with
+// the old one still exist. Without it those keys keep their old TTL, so clients keep the longer window until the key
+// expires. A `Duration` made longer is never applied to existing keys, with or without this option, as the counter
+// can't tell how long ago its window started: the current window ends when it would have and the next one uses the
+// new `Duration`. Reconciling costs an extra command on the first request for the key after the change.
+func WithReconciledTTL() StrategyOption {
+	return func(o *strategyOptions) {
+		o.reconcile = true
+	}
+}
+
+// WithGrandfatheredLimits makes the sorted set strategy apply a lowered `Limit` only to the requests made after it
+// was lowered, so clients already over the new limit are not denied until the requests they made before the change
+// roll off the window. Without it the new limit applies to the whole window right away. The last limit and when it
+// was lowered are kept in a hash at the request key with `:limit` appended, which is read before every request and
+// written with every allowed one. While the requests from before the change are in the window, `TotalRequests` only
+// counts the ones made after it. A raised limit keeps counting from when the limit was last lowered, as counting
+// fewer requests only allows more. It only applies to `Run`, pipelined requests count the whole window.
+func WithGrandfatheredLimits() StrategyOption {
+	return func(o *strategyOptions) {
+		o.grandfather = true
+	}
+}
+
+// WithCompactMembers makes the sorted set strategy add the requests without a `Nonce` as the 16 bytes of a random
+// UUID instead of its 36 character text form. Members are as unique as they were but 20 bytes shorter, which saves
+// about a fifth of the memory a request takes (around 100 bytes with the text form, see the sorted set strategy) on
+// keys with large windows and a lot of traffic. The members are binary, so they show up escaped in redis-cli and
+// MONITOR. Requests with a `Nonce` still use it as their member, as they must be found by it.
+func WithCompactMembers() StrategyOption {
+	return func(o *strategyOptions) {
+		o.compact = true
+	}
+}
+
+// WithDB makes the counter and sorted set strategies run their commands on the Redis logical database `db`, to keep
+// the limiter keys apart from the application data. The database is a property of the connection (go-redis sends a
+// SELECT when it opens one), so a client can't run commands on another database without affecting everyone else
+// using it. Instead, when the client is on another database the strategy creates its own client with the same
+// options (and its own connection pool) on `db`. The strategies implement io.Closer, call Close once the strategy
+// isn't used anymore to close that client, it never closes the client the strategy was created with. Hooks added to
+// the client with AddHook are not copied. Clients that aren't a *redis.Client (like cluster clients, Redis Cluster
+// only has database 0) and the WithReadClient client are used as they are.
+//
+// Only NewCounterStrategy and NewSortedSetCounterStrategy take options. The other strategies and the ones wrapping
+// them with a client of their own (like NewWarmupStrategy or NewCardinalityGuardStrategy) run on the database of the
+// client they are given, so give them a client on `db` to keep all of the limiter keys in it.
+func WithDB(db int) StrategyOption {
+	return func(o *strategyOptions) {
+		o.db = &db
+	}
+}
+
+// database returns a client on the database set with WithDB, the client itself if it's already on it or the option
+// isn't set. The reader follows the client if it's the same.
+func (o *strategyOptions) database(client *redis.Client) *redis.Client {
+	if o.db == nil || client == nil || client.Options().DB == *o.db {
+		return client
+	}
+
+	options := *client.Options()
+	options.DB = *o.db
+	o.dedicated = redis.NewClient(&options)
+
+	if reader, ok := o.reader.(*redis.Client); ok && reader == client {
+		o.reader = o.dedicated
+	}
+
+	return o.dedicated
+}
+
+// close closes the client created by database, if there is one.
+func (o *strategyOptions) close() error {
+	if o.dedicated == nil {
+		return nil
+	}
+
+	return o.dedicated.Close()
+}
+
+// member returns an unique member for a request that doesn't have a nonce.
+func (o *strategyOptions) member() string {
+	id := uuid.New()
+	if o.compact {
+		return string(id[:])
+	}
+
+	return id.String()
+}
+
+// countDenied increments the denied counter for denied results when it's enabled.
+func (o *strategyOptions) countDenied(ctx context.Context, client redis.Cmdable, r *Request, result *Result) (*Result, error) {
+	if o.deniedTTL <= 0 || result.State != Deny {
+		return result, nil
+	}
+
+	count, err := deniedScript.Run(ctx, client, []string{deniedKey(r)}, o.deniedTTL.Milliseconds()).Uint64()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to count denied request for key %v", r.redisKey())
+	}
+
+	result.DeniedCount = count
+
+	return result, nil
+}
+
+// keys returns the extra keys the options use for a request.
+func (o *strategyOptions) keys(r *Request) []string {
+	if o.deniedTTL <= 0 {
+		return nil
+	}
+
+	return []string{deniedKey(r)}
+}
+
+func deniedKey(r *Request) string {
+	return r.redisKey() + ":denied"
+}
+
+// request fills the zero `Limit` and `Duration` of a request with the defaults, it returns a copy if it changes
+// anything so the caller's request is never modified.
+func (o *strategyOptions) request(r *Request) *Request {
+	if (r.Limit != 0 || o.limit == 0) && (r.Duration != 0 || o.duration == 0) {
+		return r
+	}
+
+	request := *r
+
+	if request.Limit == 0 {
+		request.Limit = o.limit
+	}
+
+	if request.Duration == 0 {
+		request.Duration = o.duration
+	}
+
+	return &request
+}
@@ -0,0 +1,73 @@
+// Package otel has the OpenTelemetry instrumentation for the rate limiter, it's a module of its own so the core
+// package doesn't depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+	ratelimiter "github.com/mauricio/redis-rate-limiter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	_ ratelimiter.Strategy = &tracedStrategy{}
+)
+
+const (
+	spanName = "ratelimiter.Run"
+)
+
+// NewTracedStrategy creates a strategy that wraps every call to `inner` in a span, so rate limiting checks (and the
+// Redis round trips inside them) show up in traces as children of the request being limited. The span has the key,
+// action, limit and duration of the request and the state, total requests and reason of the result. Errors are
+// recorded on the span and returned as is. Keys often identify clients (IPs, user ids), so make sure they can go
+// to your tracing backend.
+func NewTracedStrategy(inner ratelimiter.Strategy, tracer trace.Tracer) ratelimiter.Strategy {
+	return &tracedStrategy{
+		inner:  inner,
+		tracer: tracer,
+	}
+}
+
+type tracedStrategy struct {
+	inner  ratelimiter.Strategy
+	tracer trace.Tracer
+}
+
+// Run starts a span, runs the inner strategy with the span in the context and records the result on it.
+func (t *tracedStrategy) Run(ctx context.Context, r *ratelimiter.Request) (*ratelimiter.Result, error) {
+	ctx, span := t.tracer.Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("ratelimiter.key", r.Key),
+			attribute.String("ratelimiter.action", r.Action),
+			attribute.Int64("ratelimiter.limit", int64(r.Limit)),
+			attribute.Int64("ratelimiter.duration_ms", r.Duration.Milliseconds()),
+		),
+	)
+	defer span.End()
+
+	result, err := t.inner.Run(ctx, r)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.String("ratelimiter.state", state(result.State)),
+		attribute.Int64("ratelimiter.total_requests", int64(result.TotalRequests)),
+		attribute.String("ratelimiter.reason", string(result.Reason)),
+	)
+
+	return result, nil
+}
+
+func state(s ratelimiter.State) string {
+	if s == ratelimiter.Allow {
+		return "allow"
+	}
+
+	return "deny"
+}
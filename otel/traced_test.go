@@ -0,0 +1,93 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	ratelimiter "github.com/mauricio/redis-rate-limiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+type strategyFunc func(ctx context.Context, r *ratelimiter.Request) (*ratelimiter.Result, error)
+
+func (s strategyFunc) Run(ctx context.Context, r *ratelimiter.Request) (*ratelimiter.Result, error) {
+	return s(ctx, r)
+}
+
+func TestTracedStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name       string
+		inner      strategyFunc
+		attributes []attribute.KeyValue
+		status     codes.Code
+		err        string
+	}{
+		{
+			name: "records the result on the span",
+			inner: func(ctx context.Context, r *ratelimiter.Request) (*ratelimiter.Result, error) {
+				return &ratelimiter.Result{
+					State:         ratelimiter.Deny,
+					TotalRequests: 10,
+					Reason:        ratelimiter.ReasonOverLimit,
+				}, nil
+			},
+			attributes: []attribute.KeyValue{
+				attribute.String("ratelimiter.key", "some-user"),
+				attribute.String("ratelimiter.action", "login"),
+				attribute.Int64("ratelimiter.limit", 10),
+				attribute.Int64("ratelimiter.duration_ms", 60000),
+				attribute.String("ratelimiter.state", "deny"),
+				attribute.Int64("ratelimiter.total_requests", 10),
+				attribute.String("ratelimiter.reason", "over_limit"),
+			},
+			status: codes.Unset,
+		},
+		{
+			name: "records errors on the span",
+			inner: func(ctx context.Context, r *ratelimiter.Request) (*ratelimiter.Result, error) {
+				return nil, errors.New("redis is down")
+			},
+			attributes: []attribute.KeyValue{
+				attribute.String("ratelimiter.key", "some-user"),
+				attribute.String("ratelimiter.action", "login"),
+				attribute.Int64("ratelimiter.limit", 10),
+				attribute.Int64("ratelimiter.duration_ms", 60000),
+			},
+			status: codes.Error,
+			err:    "redis is down",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+			strategy := NewTracedStrategy(ts.inner, provider.Tracer("test"))
+
+			_, err := strategy.Run(context.Background(), &ratelimiter.Request{
+				Key:      "some-user",
+				Action:   "login",
+				Limit:    10,
+				Duration: time.Minute,
+			})
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			spans := recorder.Ended()
+			require.Len(t, spans, 1)
+			assert.Equal(t, spanName, spans[0].Name())
+			assert.Equal(t, ts.attributes, spans[0].Attributes())
+			assert.Equal(t, ts.status, spans[0].Status().Code)
+		})
+	}
+}
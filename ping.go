@@ -0,0 +1,56 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	_ Pinger = &counterStrategy{}
+	_ Pinger = &sortedSetCounter{}
+	_ Pinger = &fixedWindowBucketStrategy{}
+	_ Pinger = &debounceStrategy{}
+)
+
+const (
+	// DefaultPingTimeout bounds a ping when the context doesn't have a deadline of its own.
+	DefaultPingTimeout = time.Second
+)
+
+// Ping sends a PING to the Redis the strategy writes to.
+func (c *counterStrategy) Ping(ctx context.Context) error {
+	return ping(ctx, c.client)
+}
+
+// Ping sends a PING to the Redis the strategy writes to.
+func (s *sortedSetCounter) Ping(ctx context.Context) error {
+	return ping(ctx, s.client)
+}
+
+// Ping sends a PING to the Redis the strategy writes to.
+func (f *fixedWindowBucketStrategy) Ping(ctx context.Context) error {
+	return ping(ctx, f.client)
+}
+
+// Ping sends a PING to the Redis the strategy writes to.
+func (d *debounceStrategy) Ping(ctx context.Context) error {
+	return ping(ctx, d.client)
+}
+
+// ping is a single PING, it's the cheapest command Redis has, bounded by DefaultPingTimeout if the context has no
+// deadline so a probe never hangs on an unresponsive server.
+func ping(ctx context.Context, client redis.Cmdable) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultPingTimeout)
+		defer cancel()
+	}
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		return errors.Wrap(err, "failed to ping redis")
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestStrategy_Ping(t *testing.T) {
+	tt := []struct {
+		name     string
+		strategy func(client *redis.Client) Strategy
+	}{
+		{
+			name: "counter strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewCounterStrategy(client, time.Now)
+			},
+		},
+		{
+			name: "sorted set strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewSortedSetCounterStrategy(client, time.Now)
+			},
+		},
+		{
+			name: "fixed window strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewFixedWindowBucketStrategy(client, time.Now)
+			},
+		},
+		{
+			name: "debounce strategy",
+			strategy: func(client *redis.Client) Strategy {
+				return NewDebounceStrategy(client, time.Now)
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr:       server.Addr(),
+				MaxRetries: -1,
+			})
+			defer client.Close()
+
+			pinger, ok := ts.strategy(client).(Pinger)
+			require.True(t, ok)
+
+			require.NoError(t, pinger.Ping(context.Background()))
+
+			server.Close()
+
+			err = pinger.Ping(context.Background())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "failed to ping redis")
+		})
+	}
+}
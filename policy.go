@@ -0,0 +1,129 @@
+package redis_rate_limiter
+
+var (
+	_ PolicyExporter = &httpRateLimiterHandler{}
+)
+
+const (
+	// PolicyCostRequests means every request counts as one against the limits.
+	PolicyCostRequests = "requests"
+	// PolicyCostCustom means requests count as the cost computed by `RateLimiterConfig.Cost`.
+	PolicyCostCustom = "custom"
+	// PolicyCostResponseSize means requests count as the bytes of their response body.
+	PolicyCostResponseSize = "response_size"
+)
+
+// PolicyExporter is implemented by the handler created by NewHTTPRateLimiterHandler, type assert it to get the
+// policy it enforces.
+type PolicyExporter interface {
+	Policy() *Policy
+}
+
+// Policy describes the limits a handler enforces and the headers it tells clients about them with, after the
+// defaults are applied. It's meant to be served as JSON (like at `/ratelimit/policy`) to generate documentation
+// or for clients to configure themselves. Nothing secret is in it, the trusted upstream secret and the allowlist
+// and denylist are left out.
+type Policy struct {
+	// Limits has the main limit (with an empty name) followed by the extra limits.
+	Limits []PolicyLimit `json:"limits"`
+	// Cost is what requests count as against the limits, one of the `PolicyCost` constants.
+	Cost string `json:"cost"`
+	// StateValues are the values of the state header.
+	StateValues PolicyStateValues `json:"state_values"`
+	// ExpiresAtFormat is how the expires at header is formatted, `rfc3339`, `unix` or `delta_seconds`.
+	ExpiresAtFormat string `json:"expires_at_format"`
+	// RetryAfterHeader is the header denied responses say how many seconds to wait in.
+	RetryAfterHeader string `json:"retry_after_header"`
+	// PolicyHeader is the header with the policy of the limits, empty when it's not sent.
+	PolicyHeader string `json:"policy_header,omitempty"`
+	// MaxRetryAfterSeconds is the longest wait clients are told about, zero when there is no cap.
+	MaxRetryAfterSeconds float64 `json:"max_retry_after_seconds,omitempty"`
+}
+
+// PolicyLimit is one of the limits of a Policy.
+type PolicyLimit struct {
+	Name          string  `json:"name"`
+	MaxRequests   uint64  `json:"max_requests"`
+	WindowSeconds float64 `json:"window_seconds"`
+	// Headers are the names of the headers the limit is reported in, the extra limits have their name appended.
+	// Disabled headers are empty.
+	Headers PolicyHeaders `json:"headers"`
+}
+
+// PolicyHeaders are the names of the rate limiting headers of a limit, the reason is only sent when it's exposed.
+type PolicyHeaders struct {
+	TotalRequests string `json:"total_requests,omitempty"`
+	State         string `json:"state,omitempty"`
+	ExpiresAt     string `json:"expires_at,omitempty"`
+	ResetSeconds  string `json:"reset_seconds,omitempty"`
+	ResetDate     string `json:"reset_date,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// PolicyStateValues are the values of the state header.
+type PolicyStateValues struct {
+	Allow string `json:"allow"`
+	Deny  string `json:"deny"`
+}
+
+// Policy returns the policy the handler enforces, building it never touches Redis.
+func (h *httpRateLimiterHandler) Policy() *Policy {
+	names := h.headerNames()
+
+	policy := &Policy{
+		Limits: make([]PolicyLimit, 0, len(h.limits)),
+		Cost:   PolicyCostRequests,
+		StateValues: PolicyStateValues{
+			Allow: h.stateValue(Allow),
+			Deny:  h.stateValue(Deny),
+		},
+		ExpiresAtFormat:      expiresAtFormatName(h.config.ExpiresAtFormat),
+		RetryAfterHeader:     retryAfter,
+		MaxRetryAfterSeconds: h.config.MaxRetryAfter.Seconds(),
+	}
+
+	switch {
+	case h.config.ResponseSizeCost:
+		policy.Cost = PolicyCostResponseSize
+	case h.config.Cost != nil:
+		policy.Cost = PolicyCostCustom
+	}
+
+	if h.config.ExposePolicy {
+		policy.PolicyHeader = rateLimitPolicy
+	}
+
+	for _, limit := range h.limits {
+		headers := PolicyHeaders{
+			TotalRequests: limitHeader(names.TotalRequests, limit.Name),
+			State:         limitHeader(names.State, limit.Name),
+			ExpiresAt:     limitHeader(names.ExpiresAt, limit.Name),
+			ResetSeconds:  limitHeader(names.ResetSeconds, limit.Name),
+			ResetDate:     limitHeader(names.ResetDate, limit.Name),
+		}
+
+		if h.config.ExposeReason {
+			headers.Reason = limitHeader(rateLimitingReason, limit.Name)
+		}
+
+		policy.Limits = append(policy.Limits, PolicyLimit{
+			Name:          limit.Name,
+			MaxRequests:   limit.MaxRequests,
+			WindowSeconds: limit.Expiration.Seconds(),
+			Headers:       headers,
+		})
+	}
+
+	return policy
+}
+
+func expiresAtFormatName(format ExpiresAtFormat) string {
+	switch format {
+	case ExpiresAtUnix:
+		return "unix"
+	case ExpiresAtDeltaSeconds:
+		return "delta_seconds"
+	default:
+		return "rfc3339"
+	}
+}
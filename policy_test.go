@@ -0,0 +1,125 @@
+package redis_rate_limiter
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPRateLimiterHandler_Policy(t *testing.T) {
+	tt := []struct {
+		name   string
+		config *RateLimiterConfig
+		policy *Policy
+	}{
+		{
+			name: "resolves the defaults",
+			config: &RateLimiterConfig{
+				Expiration:  time.Minute,
+				MaxRequests: 10,
+			},
+			policy: &Policy{
+				Limits: []PolicyLimit{
+					{
+						MaxRequests:   10,
+						WindowSeconds: 60,
+						Headers: PolicyHeaders{
+							TotalRequests: "Rate-Limiting-Total-Requests",
+							State:         "Rate-Limiting-State",
+							ExpiresAt:     "Rate-Limiting-Expires-At",
+						},
+					},
+				},
+				Cost:             PolicyCostRequests,
+				StateValues:      PolicyStateValues{Allow: "Allow", Deny: "Deny"},
+				ExpiresAtFormat:  "rfc3339",
+				RetryAfterHeader: "Retry-After",
+			},
+		},
+		{
+			name: "includes every limit and option",
+			config: &RateLimiterConfig{
+				Expiration:      time.Minute,
+				MaxRequests:     10,
+				Headers:         &HeaderNames{TotalRequests: "X-RateLimit-Used", ExpiresAt: "X-RateLimit-Reset", ResetDate: "X-RateLimit-Reset-Date"},
+				StateValues:     &StateValues{Allow: "allowed", Deny: "blocked"},
+				ExpiresAtFormat: ExpiresAtDeltaSeconds,
+				ExposePolicy:    true,
+				ExposeReason:    true,
+				MaxRetryAfter:   30 * time.Second,
+				Cost: func(r *http.Request) (uint64, error) {
+					return 1, nil
+				},
+				Limits: []LimitConfig{
+					{Name: "user", Expiration: 500 * time.Millisecond, MaxRequests: 2},
+				},
+			},
+			policy: &Policy{
+				Limits: []PolicyLimit{
+					{
+						MaxRequests:   10,
+						WindowSeconds: 60,
+						Headers: PolicyHeaders{
+							TotalRequests: "X-RateLimit-Used",
+							ExpiresAt:     "X-RateLimit-Reset",
+							ResetDate:     "X-RateLimit-Reset-Date",
+							Reason:        "Rate-Limiting-Reason",
+						},
+					},
+					{
+						Name:          "user",
+						MaxRequests:   2,
+						WindowSeconds: 0.5,
+						Headers: PolicyHeaders{
+							TotalRequests: "X-RateLimit-Used-user",
+							ExpiresAt:     "X-RateLimit-Reset-user",
+							ResetDate:     "X-RateLimit-Reset-Date-user",
+							Reason:        "Rate-Limiting-Reason-user",
+						},
+					},
+				},
+				Cost:                 PolicyCostCustom,
+				StateValues:          PolicyStateValues{Allow: "allowed", Deny: "blocked"},
+				ExpiresAtFormat:      "delta_seconds",
+				RetryAfterHeader:     "Retry-After",
+				PolicyHeader:         "RateLimit-Policy",
+				MaxRetryAfterSeconds: 30,
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, ts.config)
+
+			assert.Equal(t, ts.policy, wrapper.(PolicyExporter).Policy())
+		})
+	}
+}
+
+func TestHTTPRateLimiterHandler_PolicyJSON(t *testing.T) {
+	wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}, &RateLimiterConfig{
+		Expiration:       time.Minute,
+		MaxRequests:      10,
+		ResponseSizeCost: true,
+		Headers:          &HeaderNames{State: "X-RateLimit-State"},
+	})
+
+	body, err := json.Marshal(wrapper.(PolicyExporter).Policy())
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"limits": [{"name": "", "max_requests": 10, "window_seconds": 60, "headers": {"state": "X-RateLimit-State"}}],
+		"cost": "response_size",
+		"state_values": {"allow": "Allow", "deny": "Deny"},
+		"expires_at_format": "rfc3339",
+		"retry_after_header": "Retry-After"
+	}`, string(body))
+}
@@ -0,0 +1,123 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	_ Strategy  = &progressiveStrategy{}
+	_ KeyNamer  = &progressiveStrategy{}
+	_ Refunder  = &progressiveStrategy{}
+	_ Committer = &progressiveStrategy{}
+
+	// strikeScript counts a denial and blocks the client for `base * factor ^ (strikes - 1)`, capped at `max`. The
+	// strikes are kept until the client goes a full `max` without being denied after the block is over, so clients
+	// that come back to hit the limit again get longer and longer blocks.
+	strikeScript = redis.NewScript(`
+local strikes = redis.call('INCR', KEYS[2])
+local block = math.floor(math.min(tonumber(ARGV[1]) * math.pow(tonumber(ARGV[2]), strikes - 1), tonumber(ARGV[3])))
+if block < 1 then
+  block = 1
+end
+redis.call('SET', KEYS[1], strikes, 'PX', block)
+redis.call('PEXPIRE', KEYS[2], block + tonumber(ARGV[3]))
+return {strikes, block}
+`)
+)
+
+// NewProgressiveStrategy creates a strategy that blocks clients that keep hitting the limit for longer and longer.
+// Every time `inner` denies a request the client gets a strike and is blocked for `base` times `factor` to the
+// power of the strikes it had before, up to `max`, so with a base of a minute and a factor of 2 the blocks are 1, 2,
+// 4, 8 minutes and so on. While blocked every request is denied without running `inner`, so it isn't counted there
+// and doesn't add strikes. Strikes are forgotten once the client goes `max` without being denied after its last block.
+func NewProgressiveStrategy(inner Strategy, client *redis.Client, now func() time.Time, base time.Duration, max time.Duration, factor float64) Strategy {
+	return &progressiveStrategy{
+		inner:  inner,
+		client: client,
+		now:    now,
+		base:   base,
+		max:    max,
+		factor: factor,
+	}
+}
+
+type progressiveStrategy struct {
+	inner  Strategy
+	client *redis.Client
+	now    func() time.Time
+	base   time.Duration
+	max    time.Duration
+	factor float64
+}
+
+// Run denies blocked clients and runs the inner strategy for everyone else, blocking the client if it was denied.
+func (p *progressiveStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	now := r.now(p.now)
+
+	blocked, err := p.client.PTTL(ctx, progressiveBlockKey(r)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check block for key %v", r.redisKey())
+	}
+
+	// PTTL is negative if the key doesn't exist
+	if blocked > 0 {
+		return &Result{
+			State:     Deny,
+			ExpiresAt: now.Add(blocked),
+			Reason:    ReasonBlocked,
+		}, nil
+	}
+
+	result, err := p.inner.Run(ctx, r)
+	if err != nil || result.State != Deny {
+		return result, err
+	}
+
+	strike, err := int64s(strikeScript.Run(ctx, p.client, []string{progressiveBlockKey(r), progressiveStrikesKey(r)},
+		p.base.Milliseconds(),
+		p.factor,
+		p.max.Milliseconds(),
+	))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to block key %v", r.redisKey())
+	}
+
+	// the client can only come back once the block is over, even if the inner window ends before it
+	if expiresAt := now.Add(time.Duration(strike[1]) * time.Millisecond); expiresAt.After(result.ExpiresAt) {
+		blockedResult := *result
+		blockedResult.ExpiresAt = expiresAt
+		result = &blockedResult
+	}
+
+	return result, nil
+}
+
+// KeyFor returns the keys of the inner strategy followed by the block and strikes keys.
+func (p *progressiveStrategy) KeyFor(r *Request) []string {
+	return append(keysFor(p.inner, r), progressiveBlockKey(r), progressiveStrikesKey(r))
+}
+
+// Refund gives back the request on the inner strategy. Strikes the client got are kept.
+func (p *progressiveStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, p.inner, r)
+}
+
+// Commit settles the request on the inner strategy.
+func (p *progressiveStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, p.inner, r, actualCost)
+}
+
+func (p *progressiveStrategy) unwrap() Strategy {
+	return p.inner
+}
+
+func progressiveBlockKey(r *Request) string {
+	return r.redisKey() + ":blocked"
+}
+
+func progressiveStrikesKey(r *Request) string {
+	return r.redisKey() + ":strikes"
+}
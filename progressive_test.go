@@ -0,0 +1,70 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestProgressiveStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	strategy := NewProgressiveStrategy(NewCounterStrategy(client, clock), client, clock, time.Minute, 4*time.Minute, 2)
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		state   State
+		reason  Reason
+		block   time.Duration
+	}{
+		{name: "allows under the limit", state: Allow, reason: ReasonUnderLimit, block: 10 * time.Second},
+		{name: "blocks on the first strike", state: Deny, reason: ReasonGuardRejected, block: time.Minute},
+		{name: "denies while blocked", state: Deny, reason: ReasonBlocked, block: time.Minute},
+		{name: "allows once the block is over", advance: time.Minute, state: Allow, reason: ReasonUnderLimit, block: 10 * time.Second},
+		{name: "doubles the block on the second strike", state: Deny, reason: ReasonGuardRejected, block: 2 * time.Minute},
+		{name: "allows once the second block is over", advance: 2 * time.Minute, state: Allow, reason: ReasonUnderLimit, block: 10 * time.Second},
+		{name: "doubles the block on the third strike", state: Deny, reason: ReasonGuardRejected, block: 4 * time.Minute},
+		{name: "allows once the third block is over", advance: 4 * time.Minute, state: Allow, reason: ReasonUnderLimit, block: 10 * time.Second},
+		{name: "caps the block at the max", state: Deny, reason: ReasonGuardRejected, block: 4 * time.Minute},
+		{name: "forgets strikes after the max without denials", advance: 8 * time.Minute, state: Allow, reason: ReasonUnderLimit, block: 10 * time.Second},
+		{name: "starts from the base block again", state: Deny, reason: ReasonGuardRejected, block: time.Minute},
+	}
+
+	for _, step := range steps {
+		server.FastForward(step.advance)
+
+		result, err := strategy.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    1,
+			Duration: 10 * time.Second,
+		})
+		require.NoError(t, err, step.name)
+
+		assert.Equal(t, step.state, result.State, step.name)
+		assert.Equal(t, step.reason, result.Reason, step.name)
+		assert.Equal(t, now.Add(step.block), result.ExpiresAt, step.name)
+	}
+}
+
+func TestProgressiveStrategy_KeyFor(t *testing.T) {
+	strategy := NewProgressiveStrategy(NewSortedSetCounterStrategy(nil, time.Now), nil, time.Now, time.Minute, time.Hour, 2)
+
+	assert.Equal(t, []string{"some-user", "some-user:blocked", "some-user:strikes"}, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+}
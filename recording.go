@@ -0,0 +1,142 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"sync"
+)
+
+var (
+	_ Strategy  = &RecordingStrategy{}
+	_ KeyNamer  = &RecordingStrategy{}
+	_ Refunder  = &RecordingStrategy{}
+	_ Committer = &RecordingStrategy{}
+	_ Pipelined = &RecordingStrategy{}
+)
+
+// NewRecordingStrategy creates a strategy meant for tests that records every request it gets and the result it
+// returned, so tests can check their handlers pass the expected keys and limits to the limiter. Decisions are
+// delegated to `inner`, when it is nil every request is allowed and nothing touches Redis.
+func NewRecordingStrategy(inner Strategy) *RecordingStrategy {
+	return &RecordingStrategy{
+		inner: inner,
+	}
+}
+
+// RecordedCall is a single call made to a RecordingStrategy.
+type RecordedCall struct {
+	Request Request
+	Result  *Result
+	Err     error
+}
+
+// RecordingStrategy is the strategy created by NewRecordingStrategy.
+type RecordingStrategy struct {
+	inner Strategy
+	mutex sync.Mutex
+	calls []RecordedCall
+}
+
+// Run delegates the request to the inner strategy (or allows it if there is none) and records the call.
+func (s *RecordingStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	if s.inner == nil {
+		return s.record(r, allowedByRecording(), nil)
+	}
+
+	result, err := s.inner.Run(ctx, r)
+
+	return s.record(r, result, err)
+}
+
+// RunPipelined is the same as Run, the call is recorded once the result is interpreted.
+func (s *RecordingStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	if s.inner == nil {
+		return func() (*Result, error) {
+			return s.record(r, allowedByRecording(), nil)
+		}
+	}
+
+	interpret := runPipelined(ctx, s.inner, p, r)
+
+	return func() (*Result, error) {
+		result, err := interpret()
+		return s.record(r, result, err)
+	}
+}
+
+// Refund gives back the request on the inner strategy, without one there is nothing to give back. Refunds are not
+// recorded.
+func (s *RecordingStrategy) Refund(ctx context.Context, r *Request) error {
+	if s.inner == nil {
+		return nil
+	}
+
+	return refund(ctx, s.inner, r)
+}
+
+// Commit settles the request on the inner strategy, without one there is nothing to settle. Commits are not
+// recorded.
+func (s *RecordingStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	if s.inner == nil {
+		return nil
+	}
+
+	return commit(ctx, s.inner, r, actualCost)
+}
+
+func (s *RecordingStrategy) record(r *Request, result *Result, err error) (*Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the request is copied so changes made by the caller after the call don't show up in the recording
+	s.calls = append(s.calls, RecordedCall{
+		Request: *r,
+		Result:  result,
+		Err:     err,
+	})
+
+	return result, err
+}
+
+// KeyFor returns the keys of the inner strategy, without one no keys are used.
+func (s *RecordingStrategy) KeyFor(r *Request) []string {
+	if s.inner == nil {
+		return nil
+	}
+
+	return keysFor(s.inner, r)
+}
+
+func (s *RecordingStrategy) unwrap() Strategy {
+	return s.inner
+}
+
+func (s *RecordingStrategy) pipeline() redis.Pipeliner {
+	return pipelineFor(s.inner)
+}
+
+// Calls returns a copy of all calls recorded so far, in the order they were made.
+func (s *RecordingStrategy) Calls() []RecordedCall {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	calls := make([]RecordedCall, len(s.calls))
+	copy(calls, s.calls)
+
+	return calls
+}
+
+// Reset clears all recorded calls.
+func (s *RecordingStrategy) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.calls = nil
+}
+
+func allowedByRecording() *Result {
+	return &Result{
+		State:  Allow,
+		Reason: ReasonUnderLimit,
+	}
+}
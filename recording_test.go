@@ -0,0 +1,69 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecordingStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name   string
+		inner  Strategy
+		status int
+		result *Result
+	}{
+		{
+			name:   "allows every request without an inner strategy",
+			status: http.StatusOK,
+			result: &Result{State: Allow, Reason: ReasonUnderLimit},
+		},
+		{
+			name:   "returns the results of the inner strategy",
+			inner:  &denyAllStrategy{},
+			status: http.StatusTooManyRequests,
+			result: &Result{State: Deny, Reason: ReasonOverLimit},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			strategy := NewRecordingStrategy(ts.inner)
+
+			wrapper := NewHTTPRateLimiterHandler(&handleFuncWrapper{handleFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}}, &RateLimiterConfig{
+				Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+				Strategy:    strategy,
+				Expiration:  time.Minute,
+				MaxRequests: 10,
+			})
+
+			for _, ip := range []string{"10.10.10.10", "10.10.10.11"} {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+				req.Header.Set(forwardedFor, ip)
+
+				w := httptest.NewRecorder()
+				wrapper.ServeHTTP(w, req)
+				assert.Equal(t, ts.status, w.Result().StatusCode)
+			}
+
+			calls := strategy.Calls()
+			require.Len(t, calls, 2)
+
+			for x, ip := range []string{"10.10.10.10", "10.10.10.11"} {
+				assert.Equal(t, ip, calls[x].Request.Key)
+				assert.Equal(t, uint64(10), calls[x].Request.Limit)
+				assert.Equal(t, time.Minute, calls[x].Request.Duration)
+				assert.Equal(t, ts.result, calls[x].Result)
+				assert.NoError(t, calls[x].Err)
+			}
+
+			strategy.Reset()
+			assert.Empty(t, strategy.Calls())
+		})
+	}
+}
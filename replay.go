@@ -0,0 +1,95 @@
+package redis_rate_limiter
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+// ReplayEvent is a request that already happened, made by `Key` at `At`. `Cost` works like it does on Request,
+// zero counts as one.
+type ReplayEvent struct {
+	Key  string
+	At   time.Time
+	Cost uint64
+}
+
+// replayedRequest is a request counted in a key's window, in milliseconds like the sorted set scores.
+type replayedRequest struct {
+	at   int64
+	cost uint64
+}
+
+// Replay runs past events through the same rolling window the sorted set strategy enforces, `limit` requests every
+// `duration`, in memory and without Redis, so request logs can be checked after the fact for clients that went over
+// a limit. It returns a result for every event, in the order they were given, with the decision the sorted set
+// strategy would have made at the time, so the denied events are the ones the strategy would have rejected.
+//
+// Like the strategy the window excludes its start and works in milliseconds, requests that don't fit (including the
+// ones that cost more than the limit) are denied with ReasonGuardRejected and denied requests are not counted. The
+// events of a key must be in the order they happened, as they would have reached the strategy, and it fails if they
+// aren't. It keeps the requests in the window of every key in memory, so it's meant for batches of logs and not for an
+// endless stream.
+func Replay(events []ReplayEvent, limit uint64, duration time.Duration) ([]*Result, error) {
+	if duration < time.Millisecond {
+		return nil, errors.Errorf("the replay duration %v must be at least 1ms", duration)
+	}
+
+	windows := map[string][]replayedRequest{}
+	last := map[string]int64{}
+	results := make([]*Result, 0, len(events))
+
+	for x, event := range events {
+		cost := (&Request{Cost: event.Cost}).cost()
+
+		score, err := sortedSetScore(event.Key, event.At)
+		if err != nil {
+			return nil, err
+		}
+
+		if previous, ok := last[event.Key]; ok && previous > score {
+			return nil, errors.Errorf("event %v for key %v at %v happened before the events that came before it", x, event.Key, event.At)
+		}
+		last[event.Key] = score
+
+		window := windows[event.Key]
+
+		// the requests made at or before the start of the window have rolled off
+		minimum := event.At.Add(-duration)
+		for len(window) > 0 && window[0].at <= minimum.UnixMilli() {
+			window = window[1:]
+		}
+
+		var total uint64
+		for _, request := range window {
+			total += request.cost
+		}
+
+		result := &Result{
+			State:         Allow,
+			TotalRequests: total + cost,
+			ExpiresAt:     event.At.Add(duration),
+			Reason:        ReasonUnderLimit,
+			WindowStart:   minimum,
+			WindowEnd:     event.At,
+		}
+
+		// the strategy guard also denies the requests that cost more than the limit, so this covers both
+		if total+cost > limit {
+			result.State = Deny
+			result.TotalRequests = total
+			result.Reason = ReasonGuardRejected
+
+			// when the oldest request in the window rolls off, like the strategy tells clients over the limit
+			if len(window) > 0 {
+				result.ExpiresAt = time.UnixMilli(window[0].at).In(event.At.Location()).Add(duration)
+			}
+		} else {
+			window = append(window, replayedRequest{at: score, cost: cost})
+		}
+
+		windows[event.Key] = window
+		results = append(results, result)
+	}
+
+	return results, nil
+}
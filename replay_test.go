@@ -0,0 +1,117 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	events := []ReplayEvent{
+		{Key: "some-user", At: start},
+		{Key: "other-user", At: start},
+		{Key: "some-user", At: start.Add(10 * time.Second)},
+		{Key: "some-user", At: start.Add(20 * time.Second)},
+		{Key: "some-user", At: start.Add(30 * time.Second), Cost: 4},
+		{Key: "some-user", At: start.Add(time.Minute)},
+		{Key: "some-user", At: start.Add(time.Minute + 5*time.Second), Cost: 2},
+		{Key: "other-user", At: start.Add(time.Minute)},
+	}
+
+	results, err := Replay(events, 2, time.Minute)
+	require.NoError(t, err)
+
+	states := make([]State, 0, len(results))
+	reasons := make([]Reason, 0, len(results))
+	for _, result := range results {
+		states = append(states, result.State)
+		reasons = append(reasons, result.Reason)
+	}
+
+	assert.Equal(t, []State{Allow, Allow, Allow, Deny, Deny, Allow, Deny, Allow}, states)
+	assert.Equal(t, []Reason{
+		ReasonUnderLimit,
+		ReasonUnderLimit,
+		ReasonUnderLimit,
+		ReasonGuardRejected,
+		ReasonGuardRejected,
+		// the request made exactly a minute ago has rolled off
+		ReasonUnderLimit,
+		ReasonGuardRejected,
+		ReasonUnderLimit,
+	}, reasons)
+
+	assert.Equal(t, &Result{
+		State:         Deny,
+		TotalRequests: 2,
+		ExpiresAt:     start.Add(time.Minute),
+		Reason:        ReasonGuardRejected,
+		WindowStart:   start.Add(-40 * time.Second),
+		WindowEnd:     start.Add(20 * time.Second),
+	}, results[3])
+
+	// the replay makes the same decisions the sorted set strategy makes
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	strategy := NewSortedSetCounterStrategy(client, time.Now)
+
+	for x, event := range events {
+		result, err := strategy.Run(context.Background(), &Request{
+			Key:      event.Key,
+			Limit:    2,
+			Duration: time.Minute,
+			Cost:     event.Cost,
+			At:       event.At,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, result, results[x], "event %v", x)
+	}
+}
+
+func TestReplay_Errors(t *testing.T) {
+	start := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	tt := []struct {
+		name     string
+		events   []ReplayEvent
+		duration time.Duration
+		err      string
+	}{
+		{
+			name: "fails for events out of order",
+			events: []ReplayEvent{
+				{Key: "some-user", At: start},
+				{Key: "other-user", At: start.Add(-time.Second)},
+				{Key: "some-user", At: start.Add(-time.Second)},
+			},
+			duration: time.Minute,
+			err:      "event 2 for key some-user at 2020-03-25 10:15:29 +0000 UTC happened before the events that came before it",
+		},
+		{
+			name:     "fails for durations shorter than a millisecond",
+			events:   []ReplayEvent{{Key: "some-user", At: start}},
+			duration: time.Microsecond,
+			err:      "the replay duration 1µs must be at least 1ms",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			_, err := Replay(ts.events, 2, ts.duration)
+			assert.EqualError(t, err, ts.err)
+		})
+	}
+}
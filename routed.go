@@ -0,0 +1,91 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+var (
+	_ Strategy  = &routedStrategy{}
+	_ KeyNamer  = &routedStrategy{}
+	_ Refunder  = &routedStrategy{}
+	_ Committer = &routedStrategy{}
+	_ Pipelined = &routedStrategy{}
+)
+
+// NewRoutedStrategy creates a strategy that picks which strategy to use based on the key of every request. This
+// allows different kinds of keys to be limited with different algorithms in the same handler, like IP keys on the
+// sorted set rolling window and user keys on the cheaper counter. The router must return a strategy for every key.
+// Refunds, commits and pipelined runs go to the strategy the key is routed to and fail if it doesn't support them.
+// The strategies might use different clients, so RunMany runs requests one after the other.
+func NewRoutedStrategy(router func(key string) Strategy) Strategy {
+	return &routedStrategy{
+		router: router,
+	}
+}
+
+type routedStrategy struct {
+	router func(key string) Strategy
+}
+
+// Run delegates the request to the strategy returned by the router for the request key.
+func (s *routedStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	strategy, err := s.route(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return strategy.Run(ctx, r)
+}
+
+// RunPipelined adds the commands of the strategy the request is routed to to the pipeline.
+func (s *routedStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	strategy, err := s.route(r)
+	if err != nil {
+		return func() (*Result, error) {
+			return nil, err
+		}
+	}
+
+	return runPipelined(ctx, strategy, p, r)
+}
+
+// Refund gives back the request on the strategy it is routed to.
+func (s *routedStrategy) Refund(ctx context.Context, r *Request) error {
+	strategy, err := s.route(r)
+	if err != nil {
+		return err
+	}
+
+	return refund(ctx, strategy, r)
+}
+
+// Commit settles the request on the strategy it is routed to.
+func (s *routedStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	strategy, err := s.route(r)
+	if err != nil {
+		return err
+	}
+
+	return commit(ctx, strategy, r, actualCost)
+}
+
+// KeyFor returns the keys of the strategy the request would be routed to.
+func (s *routedStrategy) KeyFor(r *Request) []string {
+	strategy := s.router(r.Key)
+	if strategy == nil {
+		return nil
+	}
+
+	return keysFor(strategy, r)
+}
+
+func (s *routedStrategy) route(r *Request) (Strategy, error) {
+	strategy := s.router(r.Key)
+	if strategy == nil {
+		return nil, errors.Errorf("no strategy found for key %v", r.Key)
+	}
+
+	return strategy, nil
+}
@@ -0,0 +1,78 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutedStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name    string
+		key     string
+		keyType string
+		err     string
+	}{
+		{
+			name:    "routes ip keys to the sorted set strategy",
+			key:     "ip:10.10.10.10",
+			keyType: "zset",
+		},
+		{
+			name:    "routes user keys to the counter strategy",
+			key:     "user:some-user",
+			keyType: "string",
+		},
+		{
+			name: "fails when there is no strategy for the key",
+			key:  "some-user",
+			err:  "no strategy found for key some-user",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			sortedSet := NewSortedSetCounterStrategy(client, time.Now)
+			counter := NewCounterStrategy(client, time.Now)
+
+			strategy := NewRoutedStrategy(func(key string) Strategy {
+				switch {
+				case strings.HasPrefix(key, "ip:"):
+					return sortedSet
+				case strings.HasPrefix(key, "user:"):
+					return counter
+				default:
+					return nil
+				}
+			})
+
+			_, err = strategy.Run(context.Background(), &Request{
+				Key:      ts.key,
+				Limit:    100,
+				Duration: time.Minute,
+			})
+
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, ts.keyType, server.Type(ts.key))
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"hash/fnv"
+	"math/rand"
+)
+
+var (
+	_ Strategy  = &sampledStrategy{}
+	_ KeyNamer  = &sampledStrategy{}
+	_ Refunder  = &sampledStrategy{}
+	_ Committer = &sampledStrategy{}
+	_ Pipelined = &sampledStrategy{}
+)
+
+// NewSampledStrategy creates a strategy that only runs the inner strategy for a `fraction` (from 0 to 1) of the
+// requests and allows all the others without touching Redis. This is meant for rollouts, where you want to see the
+// impact of limiting on part of the traffic before enforcing it everywhere. Every request is sampled independently,
+// so the same client will be limited on some requests and not on others, use NewKeySampledStrategy if that's a
+// problem. Requests with a `Nonce` are sampled on it, so a retry, refund or commit of a request is sampled the same
+// way it was when it ran, refunds and commits only reach the inner strategy for requests that were sampled.
+func NewSampledStrategy(inner Strategy, fraction float64) Strategy {
+	return &sampledStrategy{
+		inner:    inner,
+		fraction: fraction,
+		sample: func(r *Request) float64 {
+			if r.Nonce != "" {
+				return sampleString(r.Nonce)
+			}
+
+			return rand.Float64()
+		},
+	}
+}
+
+// NewKeySampledStrategy works like NewSampledStrategy but samples based on a hash of the key, so a client is either
+// always sampled in or always sampled out (for the same fraction).
+func NewKeySampledStrategy(inner Strategy, fraction float64) Strategy {
+	return &sampledStrategy{
+		inner:    inner,
+		fraction: fraction,
+		sample: func(r *Request) float64 {
+			return sampleString(r.Key)
+		},
+	}
+}
+
+type sampledStrategy struct {
+	inner    Strategy
+	fraction float64
+	sample   func(r *Request) float64
+}
+
+// Run runs the inner strategy if the request is sampled, otherwise returns `Allow`.
+func (s *sampledStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	if s.sampled(r) {
+		return s.inner.Run(ctx, r)
+	}
+
+	return notSampled(), nil
+}
+
+// RunPipelined is the same as Run, only sampled requests add commands to the pipeline.
+func (s *sampledStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	if s.sampled(r) {
+		return runPipelined(ctx, s.inner, p, r)
+	}
+
+	return func() (*Result, error) {
+		return notSampled(), nil
+	}
+}
+
+// Refund gives back the request on the inner strategy if it was sampled.
+func (s *sampledStrategy) Refund(ctx context.Context, r *Request) error {
+	if !s.sampled(r) {
+		return nil
+	}
+
+	return refund(ctx, s.inner, r)
+}
+
+// Commit settles the request on the inner strategy if it was sampled.
+func (s *sampledStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	if !s.sampled(r) {
+		return nil
+	}
+
+	return commit(ctx, s.inner, r, actualCost)
+}
+
+// KeyFor returns the keys of the inner strategy, they're only used if the request is sampled.
+func (s *sampledStrategy) KeyFor(r *Request) []string {
+	return keysFor(s.inner, r)
+}
+
+func (s *sampledStrategy) sampled(r *Request) bool {
+	return s.sample(r) < s.fraction
+}
+
+func (s *sampledStrategy) unwrap() Strategy {
+	return s.inner
+}
+
+func (s *sampledStrategy) pipeline() redis.Pipeliner {
+	return pipelineFor(s.inner)
+}
+
+func notSampled() *Result {
+	return &Result{
+		State:  Allow,
+		Reason: ReasonNotSampled,
+	}
+}
+
+// sampleString maps the string to a number from 0 (inclusive) to 1 (exclusive).
+func sampleString(value string) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(value))
+
+	// FNV doesn't spread similar keys (like `user-1` and `user-2`) over the high bits, so we mix it
+	// with the murmur3 finalizer before using it.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	// only the top 53 bits fit in a float64 without rounding, which could produce a 1
+	return float64(x>>11) / (1 << 53)
+}
@@ -0,0 +1,108 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type denyAllStrategy struct{}
+
+func (d *denyAllStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	return &Result{State: Deny, Reason: ReasonOverLimit}, nil
+}
+
+func TestSampledStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name     string
+		strategy Strategy
+		denied   int
+	}{
+		{
+			name:     "never runs the inner strategy with a fraction of 0",
+			strategy: NewSampledStrategy(&denyAllStrategy{}, 0),
+			denied:   0,
+		},
+		{
+			name:     "always runs the inner strategy with a fraction of 1",
+			strategy: NewSampledStrategy(&denyAllStrategy{}, 1),
+			denied:   1000,
+		},
+		{
+			name:     "runs the inner strategy for part of the keys",
+			strategy: NewKeySampledStrategy(&denyAllStrategy{}, 0.1),
+			denied:   94,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			denied := 0
+
+			for x := 0; x < 1000; x++ {
+				result, err := ts.strategy.Run(context.Background(), &Request{
+					Key:      fmt.Sprintf("user-%v", x),
+					Limit:    100,
+					Duration: time.Minute,
+				})
+				require.NoError(t, err)
+
+				if result.State == Deny {
+					denied++
+				} else {
+					assert.Equal(t, ReasonNotSampled, result.Reason)
+				}
+			}
+
+			assert.Equal(t, ts.denied, denied)
+		})
+	}
+}
+
+func TestKeySampledStrategy_RunIsStablePerKey(t *testing.T) {
+	strategy := NewKeySampledStrategy(&denyAllStrategy{}, 0.5)
+
+	for x := 0; x < 100; x++ {
+		request := &Request{Key: fmt.Sprintf("user-%v", x)}
+
+		first, err := strategy.Run(context.Background(), request)
+		require.NoError(t, err)
+
+		for y := 0; y < 10; y++ {
+			result, err := strategy.Run(context.Background(), request)
+			require.NoError(t, err)
+			assert.Equal(t, first.State, result.State)
+		}
+	}
+}
+
+func TestSampledStrategy_RefundFollowsTheSampleOfTheNonce(t *testing.T) {
+	strategy := NewSampledStrategy(&denyAllStrategy{}, 0.5)
+	sampled := 0
+
+	for x := 0; x < 100; x++ {
+		request := &Request{Key: "user-1", Nonce: fmt.Sprintf("nonce-%v", x), Limit: 10, Duration: time.Minute}
+
+		result, err := strategy.Run(context.Background(), request)
+		require.NoError(t, err)
+
+		// a retry of the same request is sampled the same way
+		again, err := strategy.Run(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, result.Reason, again.Reason)
+
+		// the inner strategy doesn't support refunds, so only sampled requests get to it and fail
+		err = strategy.(Refunder).Refund(context.Background(), request)
+		if result.Reason == ReasonNotSampled {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, "the strategy *redis_rate_limiter.denyAllStrategy does not support refunds")
+			sampled++
+		}
+	}
+
+	assert.InDelta(t, 50, sampled, 15)
+}
@@ -0,0 +1,195 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultScanBatchSize is the COUNT sent with every SCAN when no batch size is given.
+	DefaultScanBatchSize = 100
+	// DefaultScanDelay is how long the scanner waits between batches when no delay is given.
+	DefaultScanDelay = 10 * time.Millisecond
+)
+
+// ScanOption customizes a KeyScanner.
+type ScanOption func(o *scanOptions)
+
+type scanOptions struct {
+	batchSize     int64
+	delay         time.Duration
+	maxConcurrent int
+}
+
+// WithScanBatchSize sets the COUNT sent with every SCAN. Redis uses it as a hint of how much work to do on every
+// call, larger values finish faster but keep Redis busy for longer on every call.
+func WithScanBatchSize(batchSize int64) ScanOption {
+	return func(o *scanOptions) {
+		o.batchSize = batchSize
+	}
+}
+
+// WithScanDelay sets how long the scanner waits between batches, this caps how many SCAN calls per second a
+// single scan makes so other clients don't have to compete with it.
+func WithScanDelay(delay time.Duration) ScanOption {
+	return func(o *scanOptions) {
+		o.delay = delay
+	}
+}
+
+// WithScanMaxConcurrent sets how many scans can run at the same time on a scanner, calls over it wait for a running
+// scan to finish. Defaults to 1, it must be at least 1.
+func WithScanMaxConcurrent(maxConcurrent int) ScanOption {
+	return func(o *scanOptions) {
+		o.maxConcurrent = maxConcurrent
+	}
+}
+
+// NewKeyScanner creates a scanner for maintenance operations that have to go over the keyspace (cleanups, reports).
+// Going over a large keyspace in one go (or with KEYS) can block Redis for everyone else, so the scanner walks it
+// with SCAN in bounded batches, waits between batches, limits how many scans run at the same time and stops as soon
+// as the context is done. It fails if WithScanMaxConcurrent is below 1, as no scan could ever run.
+func NewKeyScanner(client redis.Cmdable, opts ...ScanOption) (*KeyScanner, error) {
+	o := &scanOptions{
+		batchSize:     DefaultScanBatchSize,
+		delay:         DefaultScanDelay,
+		maxConcurrent: 1,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.maxConcurrent < 1 {
+		return nil, errors.Errorf("the scanner must allow at least 1 concurrent scan, got %v", o.maxConcurrent)
+	}
+
+	return &KeyScanner{
+		client:  client,
+		options: o,
+		running: make(chan struct{}, o.maxConcurrent),
+	}, nil
+}
+
+// KeyScanner is the scanner created by NewKeyScanner.
+type KeyScanner struct {
+	client  redis.Cmdable
+	options *scanOptions
+	running chan struct{}
+}
+
+// Scan calls `fn` with every batch of keys matching the `match` pattern. SCAN can return the same key more than once
+// and keys created or removed while the scan is running might or might not be returned, so `fn` must be fine with
+// both. Scan stops at the first error returned by `fn` or when the context is done and returns it.
+func (s *KeyScanner) Scan(ctx context.Context, match string, fn func(ctx context.Context, keys []string) error) error {
+	select {
+	case s.running <- struct{}{}:
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "failed to start scan for %v", match)
+	}
+
+	defer func() {
+		<-s.running
+	}()
+
+	var cursor uint64
+
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, match, s.options.batchSize).Result()
+		if err != nil {
+			return errors.Wrapf(err, "failed to scan keys for %v", match)
+		}
+
+		if len(keys) > 0 {
+			if err := fn(ctx, keys); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+
+		cursor = next
+
+		if err := s.wait(ctx); err != nil {
+			return errors.Wrapf(err, "scan for %v stopped", match)
+		}
+	}
+}
+
+// ActiveKeys calls `fn` with every batch of keys that start with `prefix`, like the keys of all clients currently
+// tracked under a tenant prefix. The strategies use the request `Key` (with the `Action` appended if set) as the
+// start of all of their keys, so every client shows up, but some strategies keep more than one key per client
+// (like the fixed window, with one key per window, or refund nonces on the counter), use KeyFor to find out which
+// keys belong to a request. Glob characters in `prefix` are matched literally. Like Scan, keys can be returned more
+// than once.
+func (s *KeyScanner) ActiveKeys(ctx context.Context, prefix string, fn func(ctx context.Context, keys []string) error) error {
+	return s.Scan(ctx, escapeGlob(prefix)+"*", fn)
+}
+
+// ResetByPrefix removes every key that starts with `prefix`, like all keys of a tenant, resetting the limits of all
+// of its clients, and returns how many keys were removed. Keys are removed with UNLINK as every batch is scanned, so
+// Redis frees their memory in the background, and a scan that stops early (on an error or when the context is done)
+// keeps the keys it removed so far, which are included in the count it returns. Keys created while the reset is
+// running might or might not be removed. The prefix must end with a `:`, like the separator the strategies use in
+// their keys, so an empty prefix (that would remove every key in the database, application data included) or one
+// that is only the start of another prefix (like `tenant-1` also matching `tenant-10:`) is an error.
+func (s *KeyScanner) ResetByPrefix(ctx context.Context, prefix string) (int, error) {
+	if prefix == "" {
+		return 0, errors.New("the prefix to reset can't be empty, it would remove every key in the database")
+	}
+
+	if !strings.HasSuffix(prefix, ":") {
+		return 0, errors.Errorf("the prefix to reset %q must end with a ':' separator", prefix)
+	}
+
+	count := 0
+
+	err := s.ActiveKeys(ctx, prefix, func(ctx context.Context, keys []string) error {
+		// keys returned more than once by SCAN are only counted by the UNLINK that removed them
+		removed, err := s.client.Unlink(ctx, keys...).Result()
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove keys for prefix %v", prefix)
+		}
+
+		count += int(removed)
+		return nil
+	})
+
+	return count, err
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats as a pattern.
+func escapeGlob(value string) string {
+	var b strings.Builder
+
+	for _, c := range value {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+func (s *KeyScanner) wait(ctx context.Context) error {
+	if s.options.delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(s.options.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
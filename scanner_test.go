@@ -0,0 +1,256 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestKeyScanner_Scan(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	for _, key := range []string{"tenant-a:1", "tenant-a:2", "tenant-b:1"} {
+		require.NoError(t, server.Set(key, "1"))
+	}
+
+	scanner, err := NewKeyScanner(client, WithScanBatchSize(1), WithScanDelay(time.Millisecond))
+	require.NoError(t, err)
+
+	var found []string
+	err = scanner.Scan(context.Background(), "tenant-a:*", func(ctx context.Context, keys []string) error {
+		found = append(found, keys...)
+		return nil
+	})
+	require.NoError(t, err)
+
+	sort.Strings(found)
+	assert.Equal(t, []string{"tenant-a:1", "tenant-a:2"}, found)
+
+	failure := errors.New("failed to process keys")
+	err = scanner.Scan(context.Background(), "tenant-a:*", func(ctx context.Context, keys []string) error {
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = scanner.Scan(ctx, "tenant-a:*", func(ctx context.Context, keys []string) error {
+		return nil
+	})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestKeyScanner_ActiveKeys(t *testing.T) {
+	tt := []struct {
+		name     string
+		prefix   string
+		expected []string
+	}{
+		{
+			name:     "finds the keys with the prefix",
+			prefix:   "tenant-a:",
+			expected: []string{"tenant-a:10.10.10.10", "tenant-a:10.10.10.10:26418855", "tenant-a:10.10.10.11"},
+		},
+		{
+			name:     "matches glob characters literally",
+			prefix:   "tenant-[ab]*:",
+			expected: []string{"tenant-[ab]*:10.10.10.10"},
+		},
+		{
+			name:   "finds nothing for unknown prefixes",
+			prefix: "tenant-c:",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			for _, key := range []string{
+				"tenant-a:10.10.10.10",
+				"tenant-a:10.10.10.10:26418855",
+				"tenant-a:10.10.10.11",
+				"tenant-b:10.10.10.10",
+				"tenant-[ab]*:10.10.10.10",
+			} {
+				require.NoError(t, server.Set(key, "1"))
+			}
+
+			scanner, err := NewKeyScanner(client, WithScanBatchSize(2), WithScanDelay(0))
+			require.NoError(t, err)
+
+			var found []string
+			err = scanner.ActiveKeys(context.Background(), ts.prefix, func(ctx context.Context, keys []string) error {
+				found = append(found, keys...)
+				return nil
+			})
+			require.NoError(t, err)
+
+			sort.Strings(found)
+			assert.Equal(t, ts.expected, found)
+		})
+	}
+}
+
+func TestKeyScanner_ResetByPrefix(t *testing.T) {
+	tt := []struct {
+		name      string
+		prefix    string
+		cancel    bool
+		count     int
+		remaining []string
+		err       string
+	}{
+		{
+			name:      "removes the keys with the prefix",
+			prefix:    "tenant-a:",
+			count:     3,
+			remaining: []string{"tenant-[ab]*:10.10.10.10", "tenant-b:10.10.10.10"},
+		},
+		{
+			name:      "matches glob characters literally",
+			prefix:    "tenant-[ab]*:",
+			count:     1,
+			remaining: []string{"tenant-a:10.10.10.10", "tenant-a:10.10.10.10:26418855", "tenant-a:10.10.10.11", "tenant-b:10.10.10.10"},
+		},
+		{
+			name:      "stops when the context is done",
+			prefix:    "tenant-a:",
+			cancel:    true,
+			remaining: []string{"tenant-[ab]*:10.10.10.10", "tenant-a:10.10.10.10", "tenant-a:10.10.10.10:26418855", "tenant-a:10.10.10.11", "tenant-b:10.10.10.10"},
+			err:       "failed to start scan for tenant-a:*: context canceled",
+		},
+		{
+			name:      "fails for an empty prefix",
+			remaining: []string{"tenant-[ab]*:10.10.10.10", "tenant-a:10.10.10.10", "tenant-a:10.10.10.10:26418855", "tenant-a:10.10.10.11", "tenant-b:10.10.10.10"},
+			err:       "the prefix to reset can't be empty, it would remove every key in the database",
+		},
+		{
+			name:      "fails for a prefix without a separator",
+			prefix:    "tenant-a",
+			remaining: []string{"tenant-[ab]*:10.10.10.10", "tenant-a:10.10.10.10", "tenant-a:10.10.10.10:26418855", "tenant-a:10.10.10.11", "tenant-b:10.10.10.10"},
+			err:       "the prefix to reset \"tenant-a\" must end with a ':' separator",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			for _, key := range []string{
+				"tenant-a:10.10.10.10",
+				"tenant-a:10.10.10.10:26418855",
+				"tenant-a:10.10.10.11",
+				"tenant-b:10.10.10.10",
+				"tenant-[ab]*:10.10.10.10",
+			} {
+				require.NoError(t, server.Set(key, "1"))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			scanner, err := NewKeyScanner(client, WithScanBatchSize(2), WithScanDelay(0))
+			require.NoError(t, err)
+
+			if ts.cancel {
+				// the scanner is busy, so the reset waits for it until the context is done
+				scanner.running <- struct{}{}
+				cancel()
+			}
+
+			count, err := scanner.ResetByPrefix(ctx, ts.prefix)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, ts.count, count)
+			assert.Equal(t, ts.remaining, server.Keys())
+		})
+	}
+}
+
+func TestKeyScanner_ScanMaxConcurrent(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	require.NoError(t, server.Set("some-user", "1"))
+
+	scanner, err := NewKeyScanner(client)
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		done <- scanner.Scan(context.Background(), "*", func(ctx context.Context, keys []string) error {
+			close(started)
+			<-finish
+			return nil
+		})
+	}()
+
+	<-started
+
+	// the first scan is still running so this one has to wait until the context times out
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = scanner.Scan(ctx, "*", func(ctx context.Context, keys []string) error {
+		return nil
+	})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	close(finish)
+	require.NoError(t, <-done)
+
+	err = scanner.Scan(context.Background(), "*", func(ctx context.Context, keys []string) error {
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestNewKeyScanner_WithoutConcurrentScans(t *testing.T) {
+	for _, maxConcurrent := range []int{0, -1} {
+		_, err := NewKeyScanner(nil, WithScanMaxConcurrent(maxConcurrent))
+		assert.EqualError(t, err, fmt.Sprintf("the scanner must allow at least 1 concurrent scan, got %v", maxConcurrent))
+	}
+}
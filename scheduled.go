@@ -0,0 +1,83 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+var (
+	_ Strategy  = &scheduledStrategy{}
+	_ KeyNamer  = &scheduledStrategy{}
+	_ Refunder  = &scheduledStrategy{}
+	_ Committer = &scheduledStrategy{}
+	_ Pipelined = &scheduledStrategy{}
+)
+
+// NewScheduledStrategy creates a strategy that overrides the limit and duration of every request with the ones
+// `schedule` returns for the current time before delegating to `inner`, so limits can be raised at night for batch
+// jobs and lowered during business hours. The time is the request `At` if set or `now` otherwise. A zero limit or
+// duration from `schedule` keeps the value from the `Request`.
+func NewScheduledStrategy(inner Strategy, now func() time.Time, schedule func(t time.Time) (limit uint64, duration time.Duration)) Strategy {
+	return &scheduledStrategy{
+		inner:    inner,
+		schedule: schedule,
+		now:      now,
+	}
+}
+
+type scheduledStrategy struct {
+	inner    Strategy
+	schedule func(t time.Time) (uint64, time.Duration)
+	now      func() time.Time
+}
+
+// Run overlays the scheduled limits on a copy of the request and runs the inner strategy with it.
+func (s *scheduledStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	return s.inner.Run(ctx, s.request(r))
+}
+
+// RunPipelined is the same as Run with the commands of the inner strategy added to the pipeline.
+func (s *scheduledStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	return runPipelined(ctx, s.inner, p, s.request(r))
+}
+
+// Refund gives back the scheduled request on the inner strategy.
+func (s *scheduledStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, s.inner, s.request(r))
+}
+
+// Commit settles the scheduled request on the inner strategy.
+func (s *scheduledStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, s.inner, s.request(r), actualCost)
+}
+
+// KeyFor returns the keys of the inner strategy for the scheduled request, so strategies that name keys after the
+// duration return the keys for the current schedule.
+func (s *scheduledStrategy) KeyFor(r *Request) []string {
+	return keysFor(s.inner, s.request(r))
+}
+
+func (s *scheduledStrategy) unwrap() Strategy {
+	return s.inner
+}
+
+func (s *scheduledStrategy) pipeline() redis.Pipeliner {
+	return pipelineFor(s.inner)
+}
+
+func (s *scheduledStrategy) request(r *Request) *Request {
+	limit, duration := s.schedule(r.now(s.now))
+
+	request := *r
+
+	if limit != 0 {
+		request.Limit = limit
+	}
+
+	if duration != 0 {
+		request.Duration = duration
+	}
+
+	return &request
+}
@@ -0,0 +1,103 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func businessHours(t time.Time) (uint64, time.Duration) {
+	if t.Hour() >= 9 && t.Hour() < 18 {
+		return 100, time.Minute
+	}
+
+	return 1000, 0
+}
+
+func TestScheduledStrategy_Run(t *testing.T) {
+	tt := []struct {
+		name     string
+		now      time.Time
+		at       time.Time
+		limit    uint64
+		duration time.Duration
+	}{
+		{
+			name:     "uses the business hours limits",
+			now:      time.Date(2022, 10, 3, 10, 0, 0, 0, time.UTC),
+			limit:    100,
+			duration: time.Minute,
+		},
+		{
+			name:     "uses the night limits and keeps the request duration",
+			now:      time.Date(2022, 10, 3, 23, 0, 0, 0, time.UTC),
+			limit:    1000,
+			duration: time.Hour,
+		},
+		{
+			name:     "uses the request time when set",
+			now:      time.Date(2022, 10, 3, 10, 0, 0, 0, time.UTC),
+			at:       time.Date(2022, 10, 3, 2, 0, 0, 0, time.UTC),
+			limit:    1000,
+			duration: time.Hour,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			recorder := NewRecordingStrategy(nil)
+			strategy := NewScheduledStrategy(recorder, func() time.Time {
+				return ts.now
+			}, businessHours)
+
+			request := &Request{
+				Key:      "some-user",
+				Limit:    10,
+				Duration: time.Hour,
+				At:       ts.at,
+			}
+
+			_, err := strategy.Run(context.Background(), request)
+			require.NoError(t, err)
+
+			calls := recorder.Calls()
+			require.Len(t, calls, 1)
+			assert.Equal(t, ts.limit, calls[0].Request.Limit)
+			assert.Equal(t, ts.duration, calls[0].Request.Duration)
+			assert.Equal(t, uint64(10), request.Limit)
+		})
+	}
+}
+
+func TestScheduledStrategy_RunAcrossSchedules(t *testing.T) {
+	now := time.Date(2022, 10, 3, 17, 59, 59, 0, time.UTC)
+
+	recorder := NewRecordingStrategy(nil)
+	strategy := NewScheduledStrategy(recorder, func() time.Time {
+		return now
+	}, businessHours)
+
+	request := &Request{
+		Key:      "some-user",
+		Limit:    10,
+		Duration: time.Hour,
+	}
+
+	_, err := strategy.Run(context.Background(), request)
+	require.NoError(t, err)
+
+	// the night limits start as soon as the clock crosses into them
+	now = now.Add(time.Second)
+
+	_, err = strategy.Run(context.Background(), request)
+	require.NoError(t, err)
+
+	calls := recorder.Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, uint64(100), calls[0].Request.Limit)
+	assert.Equal(t, time.Minute, calls[0].Request.Duration)
+	assert.Equal(t, uint64(1000), calls[1].Request.Limit)
+	assert.Equal(t, time.Hour, calls[1].Request.Duration)
+}
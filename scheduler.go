@@ -0,0 +1,68 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	// reserveScript takes the next available time for the key (or now if it's in the past or there is none), moves
+	// it forward by one emission interval and returns the time taken. It has to be a script so concurrent callers
+	// can't read the same next available time and take the same slot.
+	reserveScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local slot = math.max(tonumber(redis.call('GET', KEYS[1]) or '0'), now)
+local next = slot + interval
+redis.call('SET', KEYS[1], next, 'PX', next - now)
+return slot
+`)
+)
+
+// NewScheduler creates a scheduler for calls made to a service that enforces its own rate limit, like a third party
+// API. Instead of allowing or denying calls it hands out the time each call can be made, spacing the calls evenly so
+// the downstream limit is never hit, and callers wait until their time comes.
+func NewScheduler(client *redis.Client, now func() time.Time) *Scheduler {
+	return &Scheduler{
+		client: client,
+		now:    now,
+	}
+}
+
+// Scheduler is the scheduler created by NewScheduler. Every key holds the next time a call can be made, in
+// milliseconds, and every reservation moves it forward by `duration / limit`, rounded up to the millisecond.
+type Scheduler struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+// ReserveSlot reserves the earliest slot available for a call for the key, with calls spread evenly so there are at
+// most `limit` calls every `duration`. Concurrent callers get sequential slots. The slot is taken once this returns,
+// so the caller must wait until `waitUntil` and then make the call (a slot in the past means the call can be made
+// right away). Slots can't be given back, a caller that gives up on its call still delays the callers after it.
+// As nothing is ever denied, callers that keep reserving faster than the limit get slots further and further in the
+// future, use a context deadline or check `waitUntil` before waiting if that's a problem.
+func (s *Scheduler) ReserveSlot(ctx context.Context, key string, limit uint64, duration time.Duration) (waitUntil time.Time, err error) {
+	if limit == 0 {
+		return time.Time{}, errors.Errorf("the limit for key %v must be larger than zero", key)
+	}
+
+	milliseconds := duration.Milliseconds()
+	if milliseconds < int64(limit) {
+		return time.Time{}, errors.Errorf("the interval between calls for key %v must be at least 1ms, %v calls every %v is too many", key, limit, duration)
+	}
+
+	// rounded up, so a duration the limit doesn't divide evenly never fits more than `limit` calls
+	interval := (milliseconds + int64(limit) - 1) / int64(limit)
+
+	now := s.now()
+
+	slot, err := reserveScript.Run(ctx, s.client, []string{key}, now.UnixMilli(), interval).Int64()
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to reserve slot for key %v", key)
+	}
+
+	return time.UnixMilli(slot).In(now.Location()), nil
+}
@@ -0,0 +1,105 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestScheduler_ReserveSlot(t *testing.T) {
+	tt := []struct {
+		name     string
+		limit    uint64
+		duration time.Duration
+		advance  time.Duration
+		slots    []time.Time
+		err      string
+	}{
+		{
+			name:     "spreads calls evenly over the duration",
+			limit:    4,
+			duration: time.Second,
+			slots: []time.Time{
+				time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC),
+				time.Date(2020, 3, 25, 10, 15, 30, int(250*time.Millisecond), time.UTC),
+				time.Date(2020, 3, 25, 10, 15, 30, int(500*time.Millisecond), time.UTC),
+			},
+		},
+		{
+			name:     "rounds the interval up when the limit doesn't divide the duration",
+			limit:    3,
+			duration: time.Second,
+			slots: []time.Time{
+				time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC),
+				time.Date(2020, 3, 25, 10, 15, 30, int(334*time.Millisecond), time.UTC),
+				time.Date(2020, 3, 25, 10, 15, 30, int(668*time.Millisecond), time.UTC),
+				// a fourth call doesn't fit in the first second
+				time.Date(2020, 3, 25, 10, 15, 31, int(2*time.Millisecond), time.UTC),
+			},
+		},
+		{
+			name:     "starts from now once the reserved slots are in the past",
+			limit:    4,
+			duration: time.Second,
+			advance:  time.Second,
+			slots: []time.Time{
+				time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC),
+				time.Date(2020, 3, 25, 10, 15, 31, 0, time.UTC),
+				time.Date(2020, 3, 25, 10, 15, 32, 0, time.UTC),
+			},
+		},
+		{
+			name:     "fails for a zero limit",
+			duration: time.Second,
+			err:      "the limit for key some-api must be larger than zero",
+		},
+		{
+			name:     "fails for intervals shorter than a millisecond",
+			limit:    2000,
+			duration: time.Second,
+			err:      "the interval between calls for key some-api must be at least 1ms, 2000 calls every 1s is too many",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+			scheduler := NewScheduler(client, func() time.Time {
+				return now
+			})
+
+			if ts.err != "" {
+				_, err := scheduler.ReserveSlot(context.Background(), "some-api", ts.limit, ts.duration)
+				assert.EqualError(t, err, ts.err)
+				return
+			}
+
+			slots := make([]time.Time, 0, len(ts.slots))
+
+			for range ts.slots {
+				slot, err := scheduler.ReserveSlot(context.Background(), "some-api", ts.limit, ts.duration)
+				require.NoError(t, err)
+				slots = append(slots, slot)
+
+				server.FastForward(ts.advance)
+				now = now.Add(ts.advance)
+			}
+
+			assert.Equal(t, ts.slots, slots)
+		})
+	}
+}
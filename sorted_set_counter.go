@@ -3,31 +3,87 @@ package redis_rate_limiter
 import (
 	"context"
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"io"
 	"strconv"
 	"time"
 )
 
 var (
-	_ Strategy = &sortedSetCounter{}
+	_ Strategy  = &sortedSetCounter{}
+	_ Refunder  = &sortedSetCounter{}
+	_ Decayer   = &sortedSetCounter{}
+	_ Pipelined = &sortedSetCounter{}
+	_ KeyNamer  = &sortedSetCounter{}
+	_ Committer = &sortedSetCounter{}
+	_ io.Closer = &sortedSetCounter{}
+
+	// sortedSetCommitScript removes the members past the actual cost or adds the missing ones with the same score as the
+	// request, so they roll off the window together with it. Members follow sortedSetMembers, the first one is the
+	// item itself and the others have the position appended. If the item is gone it already rolled off the window
+	// (or was refunded) and there is nothing to settle.
+	sortedSetCommitScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score then
+  return 0
+end
+local actual = tonumber(ARGV[2])
+local reserved = tonumber(ARGV[3])
+for x = actual, reserved - 1 do
+  if x == 0 then
+    redis.call('ZREM', KEYS[1], ARGV[1])
+  else
+    redis.call('ZREM', KEYS[1], ARGV[1] .. ':' .. x)
+  end
+end
+for x = reserved, actual - 1 do
+  redis.call('ZADD', KEYS[1], score, ARGV[1] .. ':' .. x)
+end
+return 1
+`)
 )
 
 const (
 	sortedSetMax = "+inf"
 	sortedSetMin = "-inf"
+	// maxSortedSetScore is the largest timestamp in milliseconds a score can hold. Redis keeps scores as float64s,
+	// which only represent integers exactly up to 2^53, past that close timestamps would share the same score.
+	// 2^53 milliseconds is around the year 287396, so only a bogus `Request.At` can get there.
+	maxSortedSetScore = 1 << 53
+)
+
+const (
+	// MaxSortedSetCost is the largest `Cost` the sorted set strategy counts, requests with a larger cost that fit
+	// in the `Limit` fail. Every unit of cost is a member of the set, so this caps the memory a single request takes
+	// (around 1MB) and how long Redis is busy adding its members. Byte costs (like ContentLengthCost or
+	// `ResponseSizeCost`) need the counter strategy, which counts any cost in a single integer.
+	MaxSortedSetCost = 10000
 )
 
-func NewSortedSetCounterStrategy(client *redis.Client, now func() time.Time) Strategy {
+// NewSortedSetCounterStrategy creates a rolling window strategy backed by a sorted set per key. `client` can be a
+// `*redis.ClusterClient`: every command and script only touches a single key, so no hash tags are needed, and
+// go-redis follows MOVED and ASK redirections for single commands and pipelines (a pipeline is sent again to the
+// node that owns the slot, so its commands still run together on the same node). While a slot is being migrated the
+// set for a key lives on a single node at a time, so counts are not split across nodes. The denied counter from
+// WithDeniedCounter is a different key that can be on another node, it's counted on its own.
+func NewSortedSetCounterStrategy(client redis.Cmdable, now func() time.Time, opts ...StrategyOption) Strategy {
+	options := newStrategyOptions(client, opts)
+
+	if c, ok := client.(*redis.Client); ok {
+		client = options.database(c)
+	}
+
 	return &sortedSetCounter{
-		client: client,
-		now:    now,
+		client:  client,
+		now:     now,
+		options: options,
 	}
 }
 
 type sortedSetCounter struct {
-	client *redis.Client
-	now    func() time.Time
+	client  redis.Cmdable
+	now     func() time.Time
+	options *strategyOptions
 }
 
 // Run this implementation uses a sorted set that holds an UUID for every request with a score that is the
@@ -38,73 +94,395 @@ type sortedSetCounter struct {
 // on the first minute have now expired but the other 4 minutes of requests are still valid.
 // A rolling window counter is usually never 0 if traffic is consistent so it is very effective at preventing
 // bursts of traffic as the counter won't ever expire.
+// Requests with a `Cost` are added as that many members, so `TotalRequests` is the sum of the costs in the window.
+// Every member takes memory until it rolls off the window (around 100 bytes with the UUID, less with
+// WithCompactMembers), so a request that costs 50 takes as much memory as 50 requests do. Requests that cost more
+// than the `Limit` are denied without being added and requests that cost more than MaxSortedSetCost fail.
+// The window excludes its start, a request made exactly `Duration` ago doesn't count anymore. Clients already at the
+// limit are denied without adding the request and their `ExpiresAt` is when the oldest request in the window rolls
+// off, which costs an extra read on that path.
 func (s *sortedSetCounter) Run(ctx context.Context, r *Request) (*Result, error) {
-	now := s.now()
+	r = s.options.request(r)
+
+	result, err := s.run(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.options.countDenied(ctx, s.client, r, result)
+}
+
+func (s *sortedSetCounter) run(ctx context.Context, r *Request) (*Result, error) {
+	key := r.redisKey()
+
+	now := r.now(s.now)
 	expiresAt := now.Add(r.Duration)
 	minimum := now.Add(-r.Duration)
 
+	if _, err := sortedSetScore(key, now); err != nil {
+		return nil, err
+	}
+
 	// first count how many requests over the period we're tracking on this rolling window so check wether
 	// we're already over the limit or not. this prevents new requests from being added if a client is already
 	// rate limited, not allowing it to add an infinite amount of requests to the system overloading redis.
 	// if the client continues to send requests it also means that the memory for this specific key will not
 	// be reclaimed (as we're not writing data here) so make sure there is an eviction policy that will
 	// clear up the memory if the redis starts to get close to its memory limit.
-	result, err := s.client.ZCount(ctx, r.Key, strconv.FormatInt(minimum.UnixMilli(), 10), sortedSetMax).Uint64()
-	if err == nil && result >= r.Limit {
+	from := windowMinimum(minimum)
+	if s.options.grandfather {
+		var err error
+		if from, err = s.grandfathered(ctx, r, now, minimum); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := s.options.reader.ZCount(ctx, key, from, sortedSetMax).Uint64()
+	if err == nil && result+r.cost() > r.Limit {
 		return &Result{
 			State:         Deny,
 			TotalRequests: result,
-			ExpiresAt:     expiresAt,
+			ExpiresAt:     s.oldestExpiresAt(ctx, key, r, from, expiresAt),
+			Reason:        ReasonGuardRejected,
+			WindowStart:   minimum,
+			WindowEnd:     now,
 		}, nil
 	}
 
-	// every request needs an UUID
-	item := uuid.New()
-
 	p := s.client.Pipeline()
+	interpret := s.enqueue(ctx, p, r, now, from)
 
-	// we then remove all requests that have already expired on this set
-	removeByScore := p.ZRemRangeByScore(ctx, r.Key, "0", strconv.FormatInt(minimum.UnixMilli(), 10))
+	// the pipeline only returns the first error, so we check every command to report which one failed
+	if _, err := p.Exec(ctx); err != nil {
+		if _, cmdErr := interpret(); cmdErr != nil {
+			return nil, cmdErr
+		}
 
-	// we add the current request
-	add := p.ZAdd(ctx, r.Key, &redis.Z{
-		Score:  float64(now.UnixMilli()),
-		Member: item.String(),
-	})
+		return nil, errors.Wrapf(err, "failed to execute sorted set pipeline for key: %v", key)
+	}
 
-	// count how many non-expired requests we have on the sorted set
-	count := p.ZCount(ctx, r.Key, sortedSetMin, sortedSetMax)
+	return interpret()
+}
 
-	if _, err := p.Exec(ctx); err != nil {
-		return nil, errors.Wrapf(err, "failed to execute sorted set pipeline for key: %v", r.Key)
+// RunPipelined adds the commands to the pipeline without the guard that runs before them on `Run`, so requests are
+// always added to the set, even if the client is already over the limit.
+func (s *sortedSetCounter) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	r = s.options.request(r)
+	interpret := s.enqueue(ctx, p, r, r.now(s.now), sortedSetMin)
+
+	return func() (*Result, error) {
+		result, err := interpret()
+		if err != nil {
+			return nil, err
+		}
+
+		// the denied counter can only be incremented once the pipeline says the request was denied
+		return s.options.countDenied(ctx, s.client, r, result)
+	}
+}
+
+// enqueue adds the request to the pipeline, `from` is the minimum score of the requests counted against the limit.
+func (s *sortedSetCounter) enqueue(
+	ctx context.Context, p redis.Pipeliner, r *Request, now time.Time, from string,
+) func() (*Result, error) {
+	key := r.redisKey()
+
+	expiresAt := now.Add(r.Duration)
+	minimum := now.Add(-r.Duration)
+
+	score, err := sortedSetScore(key, now)
+	if err != nil {
+		return func() (*Result, error) {
+			return nil, err
+		}
 	}
 
-	if err := removeByScore.Err(); err != nil {
-		return nil, errors.Wrapf(err, "failed to remove items from key %v", r.Key)
+	// a request that costs more than the limit can never be allowed, so we don't write its members at all, only
+	// count the ones already there
+	if r.cost() > r.Limit {
+		count := p.ZCount(ctx, key, from, sortedSetMax)
+
+		return func() (*Result, error) {
+			if err := commandError(key, count); err != nil {
+				return nil, err
+			}
+
+			return &Result{
+				State:         Deny,
+				TotalRequests: uint64(count.Val()),
+				ExpiresAt:     expiresAt,
+				Reason:        ReasonOverLimit,
+				WindowStart:   minimum,
+				WindowEnd:     now,
+			}, nil
+		}
 	}
 
-	if err := add.Err(); err != nil {
-		return nil, errors.Wrapf(err, "failed to add item to key %v", r.Key)
+	// every unit of cost is a member, so a client controlled cost (like a Content-Length) must not be able to make
+	// us write millions of them
+	if r.cost() > MaxSortedSetCost {
+		return func() (*Result, error) {
+			return nil, errors.Errorf("the cost %v for key %v is over the %v the sorted set strategy can count, "+
+				"use the counter strategy for larger costs", r.cost(), key, MaxSortedSetCost)
+		}
 	}
 
-	totalRequests, err := count.Result()
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to count items for key %v", r.Key)
+	// every request needs an unique member, the nonce is used when it's set so a replayed request
+	// overwrites its own member instead of adding a new one and it can be found later to be refunded.
+	item := r.Nonce
+	if item == "" {
+		item = s.options.member()
+	}
+
+	members := make([]*redis.Z, 0, r.cost())
+	for _, member := range sortedSetMembers(item, r.cost()) {
+		members = append(members, &redis.Z{
+			Score:  float64(score),
+			Member: member,
+		})
+	}
+
+	// we then remove all requests that have already expired on this set
+	removeByScore := p.ZRemRangeByScore(ctx, key, sortedSetMin, expiredMaximum(minimum))
+
+	// we add the current request
+	add := p.ZAdd(ctx, key, members...)
+
+	// count how many non-expired requests we have on the sorted set
+	count := p.ZCount(ctx, key, from, sortedSetMax)
+
+	// the limit is remembered for as long as the set has requests, so a lower one can be told apart
+	if s.options.grandfather {
+		p.HSet(ctx, grandfatherKey(r), "limit", r.Limit)
+		p.PExpire(ctx, grandfatherKey(r), r.Duration)
 	}
 
-	requests := uint64(totalRequests)
+	return func() (*Result, error) {
+		if err := commandError(key, removeByScore, add, count); err != nil {
+			return nil, err
+		}
+
+		requests := uint64(count.Val())
+
+		if requests > r.Limit {
+			return &Result{
+				State:         Deny,
+				TotalRequests: requests,
+				ExpiresAt:     expiresAt,
+				Reason:        ReasonOverLimit,
+				WindowStart:   minimum,
+				WindowEnd:     now,
+			}, nil
+		}
 
-	if requests > r.Limit {
 		return &Result{
-			State:         Deny,
+			State:         Allow,
 			TotalRequests: requests,
 			ExpiresAt:     expiresAt,
+			Reason:        ReasonUnderLimit,
+			WindowStart:   minimum,
+			WindowEnd:     now,
 		}, nil
 	}
+}
+
+// oldestExpiresAt is when the oldest request counted in the window rolls off, which is when a client that was already
+// at the limit can make a request again. Clients over the limit (or requests with a cost) might need more than one
+// request to roll off, this is the earliest they could be allowed. If the oldest request can't be read it falls back to
+// a full window from now, the latest the client could have to wait.
+func (s *sortedSetCounter) oldestExpiresAt(
+	ctx context.Context, key string, r *Request, from string, fallback time.Time,
+) time.Time {
+	oldest, err := s.options.reader.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min:   from,
+		Max:   sortedSetMax,
+		Count: 1,
+	}).Result()
+	if err != nil || len(oldest) == 0 {
+		return fallback
+	}
+
+	return time.UnixMilli(int64(oldest[0].Score)).In(fallback.Location()).Add(r.Duration)
+}
+
+// grandfathered returns the minimum score of the requests counted against the limit when limits are grandfathered.
+// It's the start of the window unless the limit was lowered within it, then it's when the limit was lowered, so the
+// requests made before that don't count against the new limit. The hash is only written here when the limit is
+// lowered, a raised limit is stored by the next allowed request and keeps counting from when it was last lowered, as
+// counting fewer requests only allows more.
+func (s *sortedSetCounter) grandfathered(ctx context.Context, r *Request, now, minimum time.Time) (string, error) {
+	key := grandfatherKey(r)
+
+	values, err := s.options.reader.HMGet(ctx, key, "limit", "lowered").Result()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the limit of key %v", r.redisKey())
+	}
+
+	previous, hasPrevious := hashInt(values[0])
+	lowered, hasLowered := hashInt(values[1])
+
+	if hasPrevious && previous > int64(r.Limit) {
+		lowered, hasLowered = now.UnixMilli(), true
+
+		p := s.client.TxPipeline()
+		p.HSet(ctx, key, "limit", r.Limit, "lowered", lowered)
+		p.PExpire(ctx, key, r.Duration)
+
+		if _, err := p.Exec(ctx); err != nil {
+			return "", errors.Wrapf(err, "failed to store the lowered limit of key %v", r.redisKey())
+		}
+	}
+
+	// requests made in the same millisecond the limit was lowered count against the new limit
+	if hasLowered && lowered > minimum.UnixMilli() {
+		return strconv.FormatInt(lowered, 10), nil
+	}
+
+	return windowMinimum(minimum), nil
+}
+
+// hashInt parses a value returned by HMGET, which is nil for missing fields.
+func hashInt(value interface{}) (int64, bool) {
+	text, ok := value.(string)
+	if !ok {
+		return 0, false
+	}
+
+	parsed, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return parsed, true
+}
+
+func grandfatherKey(r *Request) string {
+	return r.redisKey() + ":limit"
+}
+
+func (s *sortedSetCounter) pipeline() redis.Pipeliner {
+	return s.client.Pipeline()
+}
+
+// Close closes the client the strategy created for WithDB, it does nothing if the strategy runs on the client it
+// was created with.
+func (s *sortedSetCounter) Close() error {
+	return s.options.close()
+}
+
+// KeyFor returns the key of the sorted set, the denied counter key when it's enabled and the limit key when limits
+// are grandfathered.
+func (s *sortedSetCounter) KeyFor(r *Request) []string {
+	keys := append([]string{r.redisKey()}, s.options.keys(r)...)
+
+	if s.options.grandfather {
+		keys = append(keys, grandfatherKey(r))
+	}
+
+	return keys
+}
+
+// the window for a request made at `now` is (now - Duration, now], so a request made exactly `Duration` ago has
+// already rolled off. Requests made in the same millisecond share a score and are always on the same side of the
+// boundary. The guard and the removal must agree on it, otherwise the guard could deny a client based on requests
+// the pipeline would have removed.
+
+// windowMinimum is the ZCOUNT minimum for the requests in the window, exclusive of `minimum`.
+func windowMinimum(minimum time.Time) string {
+	return "(" + strconv.FormatInt(minimum.UnixMilli(), 10)
+}
+
+// expiredMaximum is the ZREMRANGEBYSCORE maximum for the requests that rolled off the window, inclusive of `minimum`.
+func expiredMaximum(minimum time.Time) string {
+	return strconv.FormatInt(minimum.UnixMilli(), 10)
+}
+
+// sortedSetMembers are the members added for a request, as sorted sets count members a request with a cost is
+// added as `cost` members. The first member is the item itself, so requests without a cost are a single member
+// like they have always been, the others have the position appended, like `item:1`.
+func sortedSetMembers(item string, cost uint64) []string {
+	members := make([]string, 0, cost)
+	members = append(members, item)
+
+	for x := uint64(1); x < cost; x++ {
+		members = append(members, item+":"+strconv.FormatUint(x, 10))
+	}
+
+	return members
+}
+
+// sortedSetScore is the score for a request made at `now`, the time in milliseconds, as long as a float64 can hold
+// it exactly.
+func sortedSetScore(key string, now time.Time) (int64, error) {
+	score := now.UnixMilli()
+	if score > maxSortedSetScore || score < -maxSortedSetScore {
+		return 0, errors.Errorf("the request time %v for key %v is out of the range a sorted set score can hold", now, key)
+	}
+
+	return score, nil
+}
+
+// Refund removes the members added for the request, it does nothing if the request was denied or has already expired.
+// The request must have the same `Cost` it had when it was run.
+func (s *sortedSetCounter) Refund(ctx context.Context, r *Request) error {
+	key := r.redisKey()
+
+	// no request adds more members than MaxSortedSetCost, so there are never more to remove
+	cost := r.cost()
+	if cost > MaxSortedSetCost {
+		cost = MaxSortedSetCost
+	}
+
+	members := make([]interface{}, 0, cost)
+	for _, member := range sortedSetMembers(r.Nonce, cost) {
+		members = append(members, member)
+	}
+
+	if err := s.client.ZRem(ctx, key, members...).Err(); err != nil {
+		return errors.Wrapf(err, "failed to refund request %v for key %v", r.Nonce, key)
+	}
+
+	return nil
+}
+
+// Commit settles a request that reserved its `Cost` by removing the members past `actualCost` or adding the missing
+// ones, the new members take as much memory as the ones added by `Run`. The script adds a member per unit of cost,
+// so `actualCost` is capped at the `Limit` (the client is denied until the request rolls off either way) and at
+// MaxSortedSetCost, a large response would otherwise keep Redis busy adding members for seconds.
+func (s *sortedSetCounter) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	r = s.options.request(r)
+	key := r.redisKey()
+
+	if r.Limit > 0 && actualCost > r.Limit {
+		actualCost = r.Limit
+	}
+
+	if actualCost > MaxSortedSetCost {
+		actualCost = MaxSortedSetCost
+	}
+
+	// no request adds more members than MaxSortedSetCost, so there are never more to remove
+	reserved := r.cost()
+	if reserved > MaxSortedSetCost {
+		reserved = MaxSortedSetCost
+	}
+
+	if err := sortedSetCommitScript.Run(ctx, s.client, []string{key}, r.Nonce, actualCost, reserved).Err(); err != nil {
+		return errors.Wrapf(err, "failed to commit request %v for key %v", r.Nonce, key)
+	}
+
+	return nil
+}
+
+// Decay removes the `by` oldest requests from the set, these would be the next ones to roll off the window anyway.
+func (s *sortedSetCounter) Decay(ctx context.Context, key string, by uint64) error {
+	if by == 0 {
+		return nil
+	}
+
+	if err := s.client.ZPopMin(ctx, key, int64(by)).Err(); err != nil {
+		return errors.Wrapf(err, "failed to decay key %v", key)
+	}
 
-	return &Result{
-		State:         Allow,
-		TotalRequests: requests,
-		ExpiresAt:     expiresAt,
-	}, nil
+	return nil
 }
@@ -2,10 +2,16 @@ package redis_rate_limiter
 
 import (
 	"context"
+	"fmt"
 	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
 	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,6 +36,9 @@ func TestSortedSetCounterStrategy_Run(t *testing.T) {
 				State:         Allow,
 				TotalRequests: 50,
 				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 14, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
 			},
 			runs: 50,
 		},
@@ -44,6 +53,9 @@ func TestSortedSetCounterStrategy_Run(t *testing.T) {
 				State:         Deny,
 				TotalRequests: 100,
 				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonGuardRejected,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 14, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
 			},
 			runs: 101,
 		},
@@ -58,6 +70,9 @@ func TestSortedSetCounterStrategy_Run(t *testing.T) {
 				State:         Allow,
 				TotalRequests: 60,
 				ExpiresAt:     time.Date(2020, time.March, 25, 10, 18, 9, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 16, 9, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 17, 9, 0, time.UTC),
 			},
 			runs:    100,
 			advance: time.Second,
@@ -101,3 +116,814 @@ func TestSortedSetCounterStrategy_Run(t *testing.T) {
 		})
 	}
 }
+
+func TestSortedSetCounterStrategy_RunCommandError(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	// a key of the wrong type makes every sorted set command fail, the first one in the pipeline is reported
+	require.NoError(t, server.Set("some-user", "not-a-sorted-set"))
+
+	counter := NewSortedSetCounterStrategy(client, time.Now)
+
+	_, err = counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    100,
+		Duration: time.Minute,
+	})
+
+	var cmdErr *CommandError
+	require.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "zremrangebyscore", cmdErr.Command)
+	assert.Equal(t, "some-user", cmdErr.Key)
+}
+
+func TestSortedSetCounterStrategy_RunAt(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	// the strategy clock is never used when the requests carry their own time
+	counter := NewSortedSetCounterStrategy(client, func() time.Time {
+		panic("the strategy clock should not be called")
+	})
+
+	start := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	var lastResult *Result
+
+	// replays 3 events per minute over 5 minutes, only the last minute is inside the window
+	for x := 0; x < 15; x++ {
+		lastResult, err = counter.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    5,
+			Duration: time.Minute,
+			At:       start.Add(time.Duration(x) * 20 * time.Second),
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, &Result{
+		State:         Allow,
+		TotalRequests: 3,
+		ExpiresAt:     time.Date(2020, time.March, 25, 10, 21, 10, 0, time.UTC),
+		Reason:        ReasonUnderLimit,
+		WindowStart:   time.Date(2020, time.March, 25, 10, 19, 10, 0, time.UTC),
+		WindowEnd:     time.Date(2020, time.March, 25, 10, 20, 10, 0, time.UTC),
+	}, lastResult)
+}
+
+func TestSortedSetCounterStrategy_RunScoreBoundaries(t *testing.T) {
+	tt := []struct {
+		name string
+		at   time.Time
+		err  string
+	}{
+		{
+			name: "counts requests one millisecond apart at the largest exact score",
+			at:   time.UnixMilli(maxSortedSetScore - 1).UTC(),
+		},
+		{
+			name: "fails for requests past the largest exact score",
+			at:   time.UnixMilli(maxSortedSetScore + 1).UTC(),
+			err:  "the request time 287396-10-12 08:59:00.993 +0000 UTC for key some-user is out of the range a sorted set score can hold",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			counter := NewSortedSetCounterStrategy(client, time.Now)
+
+			var lastResult *Result
+
+			for x := 0; x < 2; x++ {
+				lastResult, err = counter.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    5,
+					Duration: time.Minute,
+					At:       ts.at.Add(time.Duration(x) * time.Millisecond),
+				})
+
+				if ts.err != "" {
+					assert.EqualError(t, err, ts.err)
+					return
+				}
+				require.NoError(t, err)
+			}
+
+			// if the scores lost precision the oldest request would fall out of the window or share a score
+			assert.Equal(t, uint64(2), lastResult.TotalRequests)
+
+			scores, err := client.ZRangeWithScores(context.Background(), "some-user", 0, -1).Result()
+			require.NoError(t, err)
+			require.Len(t, scores, 2)
+			assert.Equal(t, float64(maxSortedSetScore-1), scores[0].Score)
+			assert.Equal(t, float64(maxSortedSetScore), scores[1].Score)
+		})
+	}
+}
+
+func TestSortedSetCounterStrategy_RunWindowEdges(t *testing.T) {
+	tt := []struct {
+		name       string
+		advance    time.Duration
+		lastResult *Result
+	}{
+		{
+			name:    "counts requests made in the same millisecond until the last millisecond of the window",
+			advance: time.Minute - time.Millisecond,
+			lastResult: &Result{
+				State:         Deny,
+				TotalRequests: 2,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+				Reason:        ReasonGuardRejected,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 29, 999000000, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 29, 999000000, time.UTC),
+			},
+		},
+		{
+			name:    "drops requests made exactly one duration ago",
+			advance: time.Minute,
+			lastResult: &Result{
+				State:         Allow,
+				TotalRequests: 1,
+				ExpiresAt:     time.Date(2020, time.March, 25, 10, 17, 30, 0, time.UTC),
+				Reason:        ReasonUnderLimit,
+				WindowStart:   time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+				WindowEnd:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			counter := NewSortedSetCounterStrategy(client, func() time.Time {
+				return now
+			})
+
+			request := &Request{
+				Key:      "some-user",
+				Limit:    2,
+				Duration: time.Minute,
+			}
+
+			// both requests share a score, they must always fall on the same side of the window start
+			for x := 0; x < 2; x++ {
+				_, err := counter.Run(context.Background(), request)
+				require.NoError(t, err)
+			}
+
+			now = now.Add(ts.advance)
+
+			result, err := counter.Run(context.Background(), request)
+			require.NoError(t, err)
+			assert.Equal(t, ts.lastResult, result)
+		})
+	}
+}
+
+func TestSortedSetCounterStrategy_RunGuardExpiresAt(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	counter := NewSortedSetCounterStrategy(client, func() time.Time {
+		return now
+	})
+
+	request := &Request{
+		Key:      "some-user",
+		Limit:    3,
+		Duration: time.Minute,
+	}
+
+	// one request that already rolled off followed by three in the window, 10 seconds apart
+	for _, advance := range []time.Duration{0, time.Minute, 10 * time.Second, 10 * time.Second, 10 * time.Second} {
+		now = now.Add(advance)
+		_, err := counter.Run(context.Background(), request)
+		require.NoError(t, err)
+	}
+
+	now = now.Add(5 * time.Second)
+
+	result, err := counter.Run(context.Background(), request)
+	require.NoError(t, err)
+
+	// the client can come back once the oldest request in the window rolls off, not a full window from now
+	assert.Equal(t, &Result{
+		State:         Deny,
+		TotalRequests: 3,
+		ExpiresAt:     time.Date(2020, time.March, 25, 10, 17, 30, 0, time.UTC),
+		Reason:        ReasonGuardRejected,
+		WindowStart:   time.Date(2020, time.March, 25, 10, 16, 5, 0, time.UTC),
+		WindowEnd:     time.Date(2020, time.March, 25, 10, 17, 5, 0, time.UTC),
+	}, result)
+}
+
+func TestSortedSetCounterStrategy_Decay(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	counter := NewSortedSetCounterStrategy(client, func() time.Time {
+		return now
+	})
+	request := &Request{
+		Key:      "some-user",
+		Limit:    5,
+		Duration: time.Minute,
+	}
+
+	for x := 0; x < 5; x++ {
+		_, err := counter.Run(context.Background(), request)
+		require.NoError(t, err)
+		now = now.Add(time.Second)
+	}
+
+	require.NoError(t, counter.(Decayer).Decay(context.Background(), request.Key, 2))
+
+	// the two oldest requests are gone
+	scores, err := client.ZRangeWithScores(context.Background(), request.Key, 0, 0).Result()
+	require.NoError(t, err)
+	assert.Equal(t, float64(time.Date(2020, 3, 25, 10, 15, 32, 0, time.UTC).UnixMilli()), scores[0].Score)
+
+	result, err := counter.Run(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, &Result{
+		State:         Allow,
+		TotalRequests: 4,
+		ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 35, 0, time.UTC),
+		Reason:        ReasonUnderLimit,
+		WindowStart:   time.Date(2020, time.March, 25, 10, 14, 35, 0, time.UTC),
+		WindowEnd:     time.Date(2020, time.March, 25, 10, 15, 35, 0, time.UTC),
+	}, result)
+}
+
+func TestSortedSetCounterStrategy_RunPipelined(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	counter := NewSortedSetCounterStrategy(client, func() time.Time {
+		return now
+	})
+
+	p := client.Pipeline()
+	other := p.Incr(context.Background(), "some-other-counter")
+	interpret := counter.(Pipelined).RunPipelined(context.Background(), p, &Request{
+		Key:      "some-user",
+		Limit:    100,
+		Duration: time.Minute,
+	})
+
+	_, err = p.Exec(context.Background())
+	require.NoError(t, err)
+
+	result, err := interpret()
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), other.Val())
+	assert.Equal(t, &Result{
+		State:         Allow,
+		TotalRequests: 1,
+		ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+		Reason:        ReasonUnderLimit,
+		WindowStart:   time.Date(2020, time.March, 25, 10, 14, 30, 0, time.UTC),
+		WindowEnd:     time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+	}, result)
+}
+
+func TestSortedSetCounterStrategy_RunWithReadClient(t *testing.T) {
+	primary, err := miniredis.Run()
+	require.NoError(t, err)
+	defer primary.Close()
+
+	replica, err := miniredis.Run()
+	require.NoError(t, err)
+	defer replica.Close()
+
+	primaryClient := redis.NewClient(&redis.Options{
+		Addr: primary.Addr(),
+	})
+	defer primaryClient.Close()
+
+	replicaClient := redis.NewClient(&redis.Options{
+		Addr: replica.Addr(),
+	})
+	defer replicaClient.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	// the replica says the client is already over the limit, so the guard denies without writing to the primary
+	_, err = replica.ZAdd("some-user", float64(now.UnixMilli()), "request-1")
+	require.NoError(t, err)
+
+	counter := NewSortedSetCounterStrategy(primaryClient, func() time.Time {
+		return now
+	}, WithReadClient(replicaClient))
+
+	result, err := counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    1,
+		Duration: time.Minute,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, ReasonGuardRejected, result.Reason)
+	assert.False(t, primary.Exists("some-user"))
+}
+
+func TestSortedSetCounterStrategy_RunWithCost(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewSortedSetCounterStrategy(client, time.Now)
+
+	type outcome struct {
+		State         State
+		TotalRequests uint64
+	}
+
+	outcomes := make([]outcome, 0, 5)
+
+	for x, cost := range []uint64{4, 4, 4, 2, 11} {
+		result, err := counter.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    10,
+			Duration: time.Minute,
+			Cost:     cost,
+			Nonce:    "request-" + strconv.Itoa(x),
+		})
+		require.NoError(t, err)
+		outcomes = append(outcomes, outcome{State: result.State, TotalRequests: result.TotalRequests})
+	}
+
+	assert.Equal(t, []outcome{
+		{State: Allow, TotalRequests: 4},
+		{State: Allow, TotalRequests: 8},
+		{State: Deny, TotalRequests: 8},
+		{State: Allow, TotalRequests: 10},
+		{State: Deny, TotalRequests: 10},
+	}, outcomes)
+
+	// refunding gives back the whole cost of the request
+	require.NoError(t, counter.(Refunder).Refund(context.Background(), &Request{
+		Key:   "some-user",
+		Cost:  4,
+		Nonce: "request-0",
+	}))
+	assert.Equal(t, int64(6), client.ZCard(context.Background(), "some-user").Val())
+}
+
+func TestSortedSetCounterStrategy_RunWithLargeCost(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	counter := NewSortedSetCounterStrategy(client, func() time.Time {
+		return now
+	})
+
+	_, err = counter.Run(context.Background(), &Request{Key: "some-user", Limit: 10, Duration: time.Minute, Cost: 3})
+	require.NoError(t, err)
+
+	// pipelined requests over the limit still tell how many requests are in the window
+	p := client.Pipeline()
+	interpret := counter.(Pipelined).RunPipelined(context.Background(), p, &Request{
+		Key:      "some-user",
+		Limit:    10,
+		Duration: time.Minute,
+		Cost:     11,
+	})
+	_, err = p.Exec(context.Background())
+	require.NoError(t, err)
+
+	result, err := interpret()
+	require.NoError(t, err)
+	assert.Equal(t, &Result{
+		State:         Deny,
+		TotalRequests: 3,
+		ExpiresAt:     time.Date(2020, time.March, 25, 10, 16, 30, 0, time.UTC),
+		Reason:        ReasonOverLimit,
+		WindowStart:   time.Date(2020, time.March, 25, 10, 14, 30, 0, time.UTC),
+		WindowEnd:     time.Date(2020, time.March, 25, 10, 15, 30, 0, time.UTC),
+	}, result)
+
+	// a cost that fits in the limit but would be too many members fails without writing them
+	_, err = counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    10 * 1024 * 1024,
+		Duration: time.Minute,
+		Cost:     MaxSortedSetCost + 1,
+	})
+	assert.EqualError(t, err, "the cost 10001 for key some-user is over the 10000 the sorted set strategy can count, use the counter strategy for larger costs")
+	assert.Equal(t, int64(3), client.ZCard(context.Background(), "some-user").Val())
+}
+
+func TestSortedSetCounterStrategy_RunWithDefaultLimit(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewSortedSetCounterStrategy(client, time.Now, WithDefaultLimit(2, time.Minute))
+
+	states := make([]State, 0, 3)
+
+	for x := 0; x < 3; x++ {
+		result, err := counter.Run(context.Background(), &Request{
+			Key: "some-user",
+		})
+		require.NoError(t, err)
+		states = append(states, result.State)
+	}
+
+	assert.Equal(t, []State{Allow, Allow, Deny}, states)
+}
+
+func TestSortedSetCounterStrategy_RunWithDB(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewSortedSetCounterStrategy(client, time.Now, WithDB(5))
+	defer counter.(io.Closer).Close()
+
+	_, err = counter.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    10,
+		Duration: time.Minute,
+	})
+	require.NoError(t, err)
+
+	assert.Empty(t, server.DB(0).Keys())
+	assert.Equal(t, []string{"some-user"}, server.DB(5).Keys())
+}
+
+func TestSortedSetCounterStrategy_RunWithDeniedCounter(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewSortedSetCounterStrategy(client, time.Now, WithDeniedCounter(time.Minute))
+
+	counts := make([]uint64, 0, 3)
+
+	for x := 0; x < 3; x++ {
+		result, err := counter.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    1,
+			Duration: time.Hour,
+		})
+		require.NoError(t, err)
+		counts = append(counts, result.DeniedCount)
+	}
+
+	assert.Equal(t, []uint64{0, 1, 2}, counts)
+	assert.Equal(t, []string{"some-user", "some-user:denied"}, counter.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+}
+
+func TestSortedSetCounterStrategy_RunWithCompactMembers(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	counter := NewSortedSetCounterStrategy(client, time.Now, WithCompactMembers())
+
+	for _, request := range []*Request{
+		{Key: "some-user", Limit: 10, Duration: time.Minute},
+		{Key: "some-user", Limit: 10, Duration: time.Minute},
+		{Key: "some-user", Limit: 10, Duration: time.Minute, Cost: 2},
+		{Key: "some-user", Limit: 10, Duration: time.Minute, Nonce: "some-request"},
+	} {
+		result, err := counter.Run(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, State(Allow), result.State)
+	}
+
+	members, err := server.ZMembers("some-user")
+	require.NoError(t, err)
+	require.Len(t, members, 5)
+
+	lengths := map[int]int{}
+	for _, member := range members {
+		lengths[len(member)]++
+	}
+
+	// the binary UUIDs, the second member of the request with a cost and the nonce as it was
+	assert.Equal(t, map[int]int{16: 3, 18: 1, len("some-request"): 1}, lengths)
+	assert.Contains(t, members, "some-request")
+}
+
+func TestSortedSetCounterStrategy_RunWithGrandfatheredLimits(t *testing.T) {
+	tt := []struct {
+		name        string
+		opts        []StrategyOption
+		states      []State
+		totals      []uint64
+		grandfather bool
+	}{
+		{
+			name:   "applies a lowered limit to the whole window by default",
+			states: []State{Allow, Allow, Allow, Deny, Deny, Deny, Allow},
+			totals: []uint64{1, 2, 3, 3, 3, 3, 1},
+		},
+		{
+			name:        "applies a lowered limit only to requests made after it was lowered",
+			opts:        []StrategyOption{WithGrandfatheredLimits()},
+			states:      []State{Allow, Allow, Allow, Allow, Deny, Allow, Allow},
+			totals:      []uint64{1, 2, 3, 1, 1, 2, 1},
+			grandfather: true,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			counter := NewSortedSetCounterStrategy(client, func() time.Time {
+				return now
+			}, ts.opts...)
+
+			steps := []struct {
+				advance time.Duration
+				limit   uint64
+			}{
+				{limit: 3},
+				{limit: 3},
+				{limit: 3},
+				// the limit is lowered while the client has 3 requests in the window
+				{advance: 10 * time.Second, limit: 1},
+				{limit: 1},
+				// the limit is raised back, the requests from before it was lowered still don't count
+				{advance: 10 * time.Second, limit: 3},
+				// the requests from before the change rolled off
+				{advance: time.Minute, limit: 1},
+			}
+
+			states := make([]State, 0, len(steps))
+			totals := make([]uint64, 0, len(steps))
+
+			for _, step := range steps {
+				now = now.Add(step.advance)
+
+				result, err := counter.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    step.limit,
+					Duration: time.Minute,
+				})
+				require.NoError(t, err)
+
+				states = append(states, result.State)
+				totals = append(totals, result.TotalRequests)
+			}
+
+			assert.Equal(t, ts.states, states)
+			assert.Equal(t, ts.totals, totals)
+
+			if ts.grandfather {
+				assert.Equal(t, "1", server.HGet("some-user:limit", "limit"))
+				assert.Equal(t, []string{"some-user", "some-user:limit"}, counter.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+			} else {
+				assert.False(t, server.Exists("some-user:limit"))
+			}
+		})
+	}
+}
+
+func TestSortedSetCounterStrategy_Commit(t *testing.T) {
+	tt := []struct {
+		name     string
+		actual   uint64
+		expire   bool
+		expected int
+	}{
+		{
+			name:     "removes the members past the actual cost",
+			actual:   2,
+			expected: 3,
+		},
+		{
+			name:     "keeps the members when the actual cost is the reserved one",
+			actual:   5,
+			expected: 6,
+		},
+		{
+			name:     "adds members when the actual cost is larger",
+			actual:   8,
+			expected: 9,
+		},
+		{
+			name:     "caps the members at the limit",
+			actual:   12,
+			expected: 11,
+		},
+		{
+			name:     "removes every member for a zero cost",
+			actual:   0,
+			expected: 1,
+		},
+		{
+			name:     "does nothing once the request is gone",
+			actual:   12,
+			expire:   true,
+			expected: 1,
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+			counter := NewSortedSetCounterStrategy(client, func() time.Time {
+				return now
+			})
+
+			reserved := &Request{
+				Key:      "some-user",
+				Limit:    10,
+				Duration: time.Minute,
+				Cost:     5,
+				Nonce:    "request-1",
+			}
+
+			for _, r := range []*Request{reserved, {Key: "some-user", Limit: 10, Duration: time.Minute, Nonce: "request-2"}} {
+				result, err := counter.Run(context.Background(), r)
+				require.NoError(t, err)
+				require.Equal(t, State(Allow), result.State)
+			}
+
+			if ts.expire {
+				// a refund removes the members just like rolling off the window does
+				require.NoError(t, counter.(Refunder).Refund(context.Background(), reserved))
+			}
+
+			require.NoError(t, counter.(Committer).Commit(context.Background(), reserved, ts.actual))
+
+			members, err := server.ZMembers("some-user")
+			require.NoError(t, err)
+			assert.Len(t, members, ts.expected)
+
+			if ts.actual > 5 && !ts.expire {
+				score, err := server.ZScore("some-user", "request-1:"+strconv.Itoa(ts.expected-2))
+				require.NoError(t, err)
+				assert.Equal(t, float64(now.UnixMilli()), score)
+			}
+		})
+	}
+}
+
+func TestSortedSetCounterStrategy_RunWithClusterRedirection(t *testing.T) {
+	target, err := miniredis.Run()
+	require.NoError(t, err)
+	defer target.Close()
+
+	// the source node says it owns every slot but answers every command with a redirection to the target, like a
+	// node that just had its slots moved away during resharding
+	source, err := server.NewServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer source.Close()
+
+	var redirected int32
+
+	require.NoError(t, source.Register("CLUSTER", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(1)
+		c.WriteLen(3)
+		c.WriteInt(0)
+		c.WriteInt(16383)
+		c.WriteLen(2)
+		c.WriteBulk(source.Addr().IP.String())
+		c.WriteInt(source.Addr().Port)
+	}))
+
+	for _, command := range []string{"ZCOUNT", "ZREMRANGEBYSCORE", "ZADD"} {
+		require.NoError(t, source.Register(command, func(c *server.Peer, cmd string, args []string) {
+			atomic.AddInt32(&redirected, 1)
+			c.WriteError(fmt.Sprintf("MOVED 1 %v", target.Addr()))
+		}))
+	}
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{source.Addr().String()},
+	})
+	defer client.Close()
+
+	counter := NewSortedSetCounterStrategy(client, time.Now)
+
+	states := make([]State, 0, 3)
+
+	for x := 0; x < 3; x++ {
+		result, err := counter.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    2,
+			Duration: time.Minute,
+		})
+		require.NoError(t, err)
+		states = append(states, result.State)
+	}
+
+	assert.Equal(t, []State{Allow, Allow, Deny}, states)
+	assert.NotZero(t, atomic.LoadInt32(&redirected))
+
+	members, err := target.ZMembers("some-user")
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+}
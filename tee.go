@@ -0,0 +1,170 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	_ Strategy  = &TeeStrategy{}
+	_ KeyNamer  = &TeeStrategy{}
+	_ Refunder  = &TeeStrategy{}
+	_ Committer = &TeeStrategy{}
+	_ Pipelined = &TeeStrategy{}
+)
+
+const (
+	// DefaultTeeBufferSize is how many calls the tee strategy holds while the sink catches up when no size is given.
+	DefaultTeeBufferSize = 1024
+)
+
+// NewTeeStrategy creates a strategy that makes decisions with `inner` and forwards every request and result to
+// `sink` in the background, like to mirror counts to a time series database. The sink never blocks or fails the
+// request, calls are buffered (up to DefaultTeeBufferSize) while the sink is busy and dropped once the buffer is
+// full. Calls that failed on the inner strategy are not forwarded. Call Close to stop forwarding.
+func NewTeeStrategy(inner Strategy, sink func(ctx context.Context, r *Request, result *Result)) *TeeStrategy {
+	return NewTeeStrategyWithBuffer(inner, sink, DefaultTeeBufferSize)
+}
+
+// NewTeeStrategyWithBuffer is the same as NewTeeStrategy but sets how many calls are buffered for the sink.
+func NewTeeStrategyWithBuffer(inner Strategy, sink func(ctx context.Context, r *Request, result *Result), size int) *TeeStrategy {
+	t := &TeeStrategy{
+		inner:  inner,
+		sink:   sink,
+		calls:  make(chan RecordedCall, size),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go t.forward()
+
+	return t
+}
+
+// TeeStrategy is the strategy created by NewTeeStrategy.
+type TeeStrategy struct {
+	inner    Strategy
+	sink     func(ctx context.Context, r *Request, result *Result)
+	calls    chan RecordedCall
+	closed   chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	mutex    sync.RWMutex
+	isClosed bool
+	dropped  uint64
+}
+
+// Run returns whatever the inner strategy returns and queues the call for the sink without waiting for it.
+func (t *TeeStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	result, err := t.inner.Run(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	t.queue(r, result)
+
+	return result, nil
+}
+
+// RunPipelined is the same as Run, the call is queued once the result is interpreted.
+func (t *TeeStrategy) RunPipelined(ctx context.Context, p redis.Pipeliner, r *Request) func() (*Result, error) {
+	interpret := runPipelined(ctx, t.inner, p, r)
+
+	return func() (*Result, error) {
+		result, err := interpret()
+		if err != nil {
+			return nil, err
+		}
+
+		t.queue(r, result)
+
+		return result, nil
+	}
+}
+
+// Refund gives back the request on the inner strategy, refunds are not forwarded to the sink.
+func (t *TeeStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, t.inner, r)
+}
+
+// Commit settles the request on the inner strategy, commits are not forwarded to the sink.
+func (t *TeeStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, t.inner, r, actualCost)
+}
+
+func (t *TeeStrategy) queue(r *Request, result *Result) {
+	// the read lock makes sure Close can't happen between checking closed and queueing the call
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.isClosed {
+		return
+	}
+
+	select {
+	// the request is copied so changes made by the caller after the call don't reach the sink
+	case t.calls <- RecordedCall{Request: *r, Result: result}:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// KeyFor returns the keys of the inner strategy.
+func (t *TeeStrategy) KeyFor(r *Request) []string {
+	return keysFor(t.inner, r)
+}
+
+// Dropped is how many calls were not forwarded to the sink because the buffer was full.
+func (t *TeeStrategy) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Close stops forwarding calls, the calls already buffered are sent to the sink before it returns. Runs made after
+// Close still return results from the inner strategy but are not forwarded.
+func (t *TeeStrategy) Close() {
+	t.once.Do(func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		t.isClosed = true
+		close(t.closed)
+	})
+
+	<-t.done
+}
+
+func (t *TeeStrategy) unwrap() Strategy {
+	return t.inner
+}
+
+func (t *TeeStrategy) pipeline() redis.Pipeliner {
+	return pipelineFor(t.inner)
+}
+
+func (t *TeeStrategy) forward() {
+	defer close(t.done)
+
+	for {
+		select {
+		case call := <-t.calls:
+			t.send(call)
+		case <-t.closed:
+			// drain whatever is left, nothing else is added once closed is closed
+			for {
+				select {
+				case call := <-t.calls:
+					t.send(call)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *TeeStrategy) send(call RecordedCall) {
+	// the request that produced the call is most likely gone by now, so the sink gets its own context
+	t.sink(context.Background(), &call.Request, call.Result)
+}
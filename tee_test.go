@@ -0,0 +1,65 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTeeStrategy_Run(t *testing.T) {
+	var mutex sync.Mutex
+	var keys []string
+
+	tee := NewTeeStrategy(NewRecordingStrategy(nil), func(ctx context.Context, r *Request, result *Result) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		keys = append(keys, r.Key)
+	})
+
+	for _, key := range []string{"user-a", "user-b"} {
+		result, err := tee.Run(context.Background(), &Request{Key: key, Limit: 10, Duration: time.Minute})
+		require.NoError(t, err)
+		assert.Equal(t, State(Allow), result.State)
+	}
+
+	tee.Close()
+
+	assert.Equal(t, []string{"user-a", "user-b"}, keys)
+	assert.Equal(t, uint64(0), tee.Dropped())
+
+	// runs after closing still work but don't get to the sink
+	_, err := tee.Run(context.Background(), &Request{Key: "user-c", Limit: 10, Duration: time.Minute})
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+}
+
+func TestTeeStrategy_RunWithSlowSink(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	tee := NewTeeStrategyWithBuffer(NewRecordingStrategy(nil), func(ctx context.Context, r *Request, result *Result) {
+		started <- struct{}{}
+		<-block
+	}, 1)
+
+	_, err := tee.Run(context.Background(), &Request{Key: "user-a", Limit: 10, Duration: time.Minute})
+	require.NoError(t, err)
+
+	// the sink is now blocked on the first call
+	<-started
+
+	for x := 0; x < 3; x++ {
+		_, err := tee.Run(context.Background(), &Request{Key: "user-a", Limit: 10, Duration: time.Minute})
+		require.NoError(t, err)
+	}
+
+	// one call fits in the buffer, the others are dropped
+	assert.Equal(t, uint64(2), tee.Dropped())
+
+	close(block)
+	tee.Close()
+}
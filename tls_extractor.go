@@ -0,0 +1,36 @@
+package redis_rate_limiter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+var (
+	_ Extractor = &tlsCertExtractor{}
+)
+
+type tlsCertExtractor struct{}
+
+// NewTLSCertExtractor creates an extractor that uses the client certificate of a mutual TLS connection as the key,
+// so clients are limited by the identity they authenticated with instead of their IP or headers. The key is the
+// SHA-256 fingerprint of the leaf certificate in lowercase hex. This only works when the server itself terminates
+// TLS and requests client certificates, behind a proxy that terminates TLS there is no certificate to read.
+func NewTLSCertExtractor() Extractor {
+	return &tlsCertExtractor{}
+}
+
+// Extract returns the fingerprint of the first peer certificate, or an error if the request has none.
+func (t *tlsCertExtractor) Extract(r *http.Request) (string, error) {
+	if r.TLS == nil {
+		return "", extractError(CodeNoClientCertificate, "the request was not made over TLS, there is no client certificate")
+	}
+
+	if len(r.TLS.PeerCertificates) == 0 {
+		return "", extractError(CodeNoClientCertificate, "the request has no client certificate")
+	}
+
+	fingerprint := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+
+	return hex.EncodeToString(fingerprint[:]), nil
+}
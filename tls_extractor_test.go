@@ -0,0 +1,55 @@
+package redis_rate_limiter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSCertExtractor_Extract(t *testing.T) {
+	tt := []struct {
+		name  string
+		state *tls.ConnectionState
+		key   string
+		err   string
+	}{
+		{
+			name: "uses the fingerprint of the client certificate",
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{
+					{Raw: []byte("client-certificate")},
+					{Raw: []byte("intermediate-certificate")},
+				},
+			},
+			key: "d00f347d816fdcde28b8fde70e945ace8d877125ca0016abdc923431bc1a22be",
+		},
+		{
+			name:  "fails when there is no client certificate",
+			state: &tls.ConnectionState{},
+			err:   "the request has no client certificate",
+		},
+		{
+			name: "fails when the request was not made over TLS",
+			err:  "the request was not made over TLS, there is no client certificate",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			req.TLS = ts.state
+
+			key, err := NewTLSCertExtractor().Extract(req)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, ts.key, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	_ Strategy = &tokenBucketStrategy{}
+	_ KeyNamer = &tokenBucketStrategy{}
+
+	// tokenBucketScript refills the bucket for the time elapsed since it was last updated, up to its capacity, and
+	// takes the cost of the request from it only if there are enough tokens. Checking and taking the tokens happen in
+	// the same script, so concurrent requests can never take more tokens than the bucket has and the balance never
+	// goes negative. Tokens are kept in thousandths, as Redis truncates numbers returned by scripts to integers. It
+	// returns whether the request was allowed and the tokens left after the decision.
+	tokenBucketScript = redis.NewScript(`
+local stored = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local now = tonumber(ARGV[1])
+local duration = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3]) * 1000
+local cost = tonumber(ARGV[4]) * 1000
+local tokens = capacity
+local updated = now
+if stored[1] then
+  local elapsed = math.max(now - tonumber(stored[2]), 0)
+  tokens = math.min(capacity, tonumber(stored[1]) + math.floor(elapsed * capacity / duration))
+  updated = math.max(now, tonumber(stored[2]))
+end
+if tokens < cost then
+  return {0, tokens}
+end
+tokens = tokens - cost
+redis.call('HSET', KEYS[1], 'tokens', string.format('%d', tokens), 'updated', string.format('%d', updated))
+redis.call('PEXPIRE', KEYS[1], math.max(math.ceil((capacity - tokens) * duration / capacity), 1))
+return {1, tokens}
+`)
+)
+
+const (
+	// tokenBucketResolution is how many parts of a token the script keeps.
+	tokenBucketResolution = 1000
+)
+
+// NewTokenBucketStrategy creates a strategy that gives every key a bucket of `Limit` tokens that refills at `Limit`
+// tokens every `Duration`, and every request takes its `Cost` in tokens from it. A full bucket allows a burst of
+// `Limit` requests and after that requests are allowed at the refill rate, so unlike the window strategies there's
+// no point where a client can make twice the limit by straddling two windows.
+//
+// Every key is a hash with the tokens left and when it was last updated, at the request key, and expires once the
+// bucket would be full again. The refill is computed from the time of the requests (from `now` or `Request.At`),
+// not the Redis clock.
+func NewTokenBucketStrategy(client redis.Cmdable, now func() time.Time) Strategy {
+	return &tokenBucketStrategy{
+		client: client,
+		now:    now,
+	}
+}
+
+type tokenBucketStrategy struct {
+	client redis.Cmdable
+	now    func() time.Time
+}
+
+// Run refills the bucket and takes the request tokens from it if there are enough, denied requests don't take any.
+// `TotalRequests` is how many tokens are missing from the bucket after the decision, rounded up. Allowed requests
+// expire when the bucket is full again and denied ones when it has refilled enough for the request.
+func (t *tokenBucketStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	key := r.redisKey()
+
+	// TTLs are set in milliseconds, anything shorter would refill the whole bucket on every request
+	if r.Duration < time.Millisecond {
+		return nil, errors.Errorf("the duration %v for key %v must be at least 1ms", r.Duration, key)
+	}
+
+	now := r.now(t.now)
+
+	// a request that costs more than the bucket holds can never be allowed, the tokens left don't matter
+	if r.cost() > r.Limit {
+		return &Result{
+			State:     Deny,
+			ExpiresAt: now.Add(r.Duration),
+			Reason:    ReasonOverLimit,
+		}, nil
+	}
+
+	reply, err := int64s(tokenBucketScript.Run(ctx, t.client, []string{key}, now.UnixMilli(), r.Duration.Milliseconds(), r.Limit, r.cost()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run token bucket script for key %v", key)
+	}
+
+	capacity := int64(r.Limit) * tokenBucketResolution
+	tokens := reply[1]
+	total := uint64((capacity - tokens + tokenBucketResolution - 1) / tokenBucketResolution)
+
+	if reply[0] == 1 {
+		return &Result{
+			State:         Allow,
+			TotalRequests: total,
+			ExpiresAt:     now.Add(tokenBucketRefill(capacity-tokens, capacity, r.Duration)),
+			Reason:        ReasonUnderLimit,
+		}, nil
+	}
+
+	return &Result{
+		State:         Deny,
+		TotalRequests: total,
+		ExpiresAt:     now.Add(tokenBucketRefill(int64(r.cost())*tokenBucketResolution-tokens, capacity, r.Duration)),
+		Reason:        ReasonGuardRejected,
+	}, nil
+}
+
+// tokenBucketRefill is how long a bucket with `capacity` takes to refill `missing` tokens, rounded up to the
+// millisecond like the times the script works with.
+func tokenBucketRefill(missing int64, capacity int64, duration time.Duration) time.Duration {
+	if missing <= 0 {
+		return 0
+	}
+
+	milliseconds := (missing*duration.Milliseconds() + capacity - 1) / capacity
+
+	return time.Duration(milliseconds) * time.Millisecond
+}
+
+// KeyFor returns the key of the hash with the tokens.
+func (t *tokenBucketStrategy) KeyFor(r *Request) []string {
+	return []string{r.redisKey()}
+}
@@ -0,0 +1,141 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	strategy := NewTokenBucketStrategy(client, func() time.Time {
+		return now
+	})
+
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		cost      uint64
+		state     State
+		total     uint64
+		expiresAt time.Duration
+		reason    Reason
+	}{
+		{name: "allows the first request", state: Allow, total: 1, expiresAt: 10 * time.Second, reason: ReasonUnderLimit},
+		{name: "allows a burst up to the capacity", state: Allow, total: 2, expiresAt: 20 * time.Second, reason: ReasonUnderLimit},
+		{name: "empties the bucket", state: Allow, total: 3, expiresAt: 30 * time.Second, reason: ReasonUnderLimit},
+		{name: "denies until a token refills", state: Deny, total: 3, expiresAt: 10 * time.Second, reason: ReasonGuardRejected},
+		{name: "denies with part of a token", advance: 5 * time.Second, state: Deny, total: 3, expiresAt: 5 * time.Second, reason: ReasonGuardRejected},
+		{name: "allows once a token refilled", advance: 5 * time.Second, state: Allow, total: 3, expiresAt: 30 * time.Second, reason: ReasonUnderLimit},
+		{name: "denies requests that cost more than the tokens left", advance: 15 * time.Second, cost: 2, state: Deny, total: 2, expiresAt: 5 * time.Second, reason: ReasonGuardRejected},
+		{name: "doesn't refill over the capacity", advance: 10 * time.Minute, state: Allow, total: 1, expiresAt: 10 * time.Second, reason: ReasonUnderLimit},
+		{name: "denies requests that cost more than the capacity", cost: 4, state: Deny, total: 0, expiresAt: 30 * time.Second, reason: ReasonOverLimit},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+
+		result, err := strategy.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    3,
+			Duration: 30 * time.Second,
+			Cost:     step.cost,
+		})
+		require.NoError(t, err, step.name)
+
+		assert.Equal(t, step.state, result.State, step.name)
+		assert.Equal(t, step.total, result.TotalRequests, step.name)
+		assert.Equal(t, now.Add(step.expiresAt), result.ExpiresAt, step.name)
+		assert.Equal(t, step.reason, result.Reason, step.name)
+	}
+
+	// the key expires once the bucket would be full again
+	assert.Equal(t, 10*time.Second, server.TTL("some-user"))
+}
+
+func TestTokenBucketStrategy_RunConcurrently(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     server.Addr(),
+		PoolSize: 20,
+	})
+	defer client.Close()
+
+	start := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	strategy := NewTokenBucketStrategy(client, time.Now)
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		allowed int64
+	}{
+		{name: "allows the capacity", allowed: 10},
+		{name: "allows what refilled", advance: 30 * time.Second, allowed: 5},
+	}
+
+	var total int64
+
+	for _, step := range steps {
+		var allowed int64
+		var wg sync.WaitGroup
+
+		for x := 0; x < 50; x++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				result, err := strategy.Run(context.Background(), &Request{
+					Key:      "some-user",
+					Limit:    10,
+					Duration: time.Minute,
+					At:       start.Add(step.advance),
+				})
+				if assert.NoError(t, err, step.name) && result.State == Allow {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, step.allowed, allowed, step.name)
+		total += allowed
+
+		tokens := server.HGet("some-user", "tokens")
+		assert.Equal(t, "0", tokens, step.name)
+	}
+
+	// the capacity plus what refilled in the 30 seconds, never more
+	assert.Equal(t, int64(15), total)
+}
+
+func TestTokenBucketStrategy_RunWithShortDuration(t *testing.T) {
+	strategy := NewTokenBucketStrategy(nil, time.Now)
+
+	_, err := strategy.Run(context.Background(), &Request{
+		Key:      "some-user",
+		Limit:    3,
+		Duration: time.Microsecond,
+	})
+	assert.EqualError(t, err, "the duration 1µs for key some-user must be at least 1ms")
+}
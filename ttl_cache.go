@@ -0,0 +1,98 @@
+package redis_rate_limiter
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a bounded in memory cache where every value is valid until a given time, it's safe to use from multiple
+// goroutines. When it's full adding a new key drops the oldest one added, which is usually the first one to expire,
+// so making room is constant time instead of scanning all keys. Expired values are kept until they're replaced,
+// removed or dropped to make room, so callers can still fall back to them.
+type ttlCache struct {
+	maxSize int
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// order has the entries from the oldest added at the front to the newest at the back
+	order *list.List
+}
+
+type ttlCacheEntry struct {
+	key   string
+	value interface{}
+	until time.Time
+}
+
+// newTTLCache creates a cache that holds at most `maxSize` keys, a cache with a `maxSize` of zero or less holds nothing.
+func newTTLCache(maxSize int) *ttlCache {
+	return &ttlCache{
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// get returns the value for the key and until when it is valid, expired values included.
+func (c *ttlCache) get(key string) (interface{}, time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	entry := element.Value.(*ttlCacheEntry)
+
+	return entry.value, entry.until, true
+}
+
+// put sets the value for the key until the given time, dropping the oldest key if the cache is full.
+func (c *ttlCache) put(key string, value interface{}, until time.Time) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*ttlCacheEntry)
+		entry.value = value
+		entry.until = until
+		c.order.MoveToBack(element)
+		return
+	}
+
+	if len(c.entries) >= c.maxSize {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*ttlCacheEntry).key)
+	}
+
+	c.entries[key] = c.order.PushBack(&ttlCacheEntry{
+		key:   key,
+		value: value,
+		until: until,
+	})
+}
+
+// remove drops the key from the cache if it's there.
+func (c *ttlCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// len returns how many keys are cached, expired ones included.
+func (c *ttlCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.entries)
+}
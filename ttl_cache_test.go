@@ -0,0 +1,57 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+
+	cache := newTTLCache(2)
+	cache.put("user-1", 1, now.Add(time.Minute))
+	cache.put("user-2", 2, now.Add(-time.Second))
+
+	// expired values are still returned, the caller decides if they're good enough
+	value, until, ok := cache.get("user-2")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, now.Add(-time.Second), until)
+
+	// replacing a key moves it to the back, so it's dropped last
+	cache.put("user-1", 10, now.Add(time.Hour))
+	cache.put("user-3", 3, now.Add(time.Minute))
+
+	_, _, ok = cache.get("user-2")
+	assert.False(t, ok)
+
+	value, until, ok = cache.get("user-1")
+	assert.True(t, ok)
+	assert.Equal(t, 10, value)
+	assert.Equal(t, now.Add(time.Hour), until)
+	assert.Equal(t, 2, cache.len())
+
+	// a full cache drops the oldest key added to make room
+	cache.put("user-4", 4, now.Add(time.Minute))
+
+	_, _, ok = cache.get("user-1")
+	assert.False(t, ok)
+	assert.Equal(t, 2, cache.len())
+
+	cache.remove("user-3")
+	cache.remove("user-5")
+
+	_, _, ok = cache.get("user-3")
+	assert.False(t, ok)
+	assert.Equal(t, 1, cache.len())
+}
+
+func TestTTLCache_WithoutSize(t *testing.T) {
+	cache := newTTLCache(0)
+	cache.put("user-1", 1, time.Now().Add(time.Minute))
+
+	_, _, ok := cache.get("user-1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.len())
+}
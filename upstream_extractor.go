@@ -0,0 +1,52 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"net/http"
+)
+
+var (
+	_ Extractor = &upstreamExtractor{}
+)
+
+type upstreamContextKey struct{}
+
+// WithUpstream returns a context with the upstream (like a host or a backend name) a proxy chose for the request,
+// for NewUpstreamExtractor to read. The proxy must pick the upstream before the rate limiter runs and send the
+// request to the limiter with it:
+//
+//	upstream := router.Pick(r)
+//	limiter.ServeHTTP(w, r.WithContext(WithUpstream(r.Context(), upstream)))
+func WithUpstream(ctx context.Context, upstream string) context.Context {
+	return context.WithValue(ctx, upstreamContextKey{}, upstream)
+}
+
+// UpstreamFromContext returns the upstream set with WithUpstream, if there is one.
+func UpstreamFromContext(ctx context.Context) (string, bool) {
+	upstream, ok := ctx.Value(upstreamContextKey{}).(string)
+	return upstream, ok
+}
+
+type upstreamExtractor struct{}
+
+// NewUpstreamExtractor creates an extractor that uses the upstream set on the request context with WithUpstream as
+// the key. On its own it limits the requests to every upstream, combined with a client extractor in a composite
+// extractor it limits every client per upstream, so a client can't use up a single backend while it still gets to
+// use the others:
+//
+//	NewCompositeExtractor(NewIPExtractor(nil), NewUpstreamExtractor())
+//
+// Requests without an upstream fail with CodeMissingUpstream.
+func NewUpstreamExtractor() Extractor {
+	return &upstreamExtractor{}
+}
+
+// Extract returns the upstream of the request or an error if it has none.
+func (u *upstreamExtractor) Extract(r *http.Request) (string, error) {
+	upstream, ok := UpstreamFromContext(r.Context())
+	if !ok || upstream == "" {
+		return "", extractError(CodeMissingUpstream, "the request has no upstream set on its context")
+	}
+
+	return upstream, nil
+}
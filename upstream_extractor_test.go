@@ -0,0 +1,64 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamExtractor_Extract(t *testing.T) {
+	tt := []struct {
+		name      string
+		upstream  string
+		missing   bool
+		extractor Extractor
+		key       string
+		err       string
+	}{
+		{
+			name:      "returns the upstream",
+			upstream:  "orders-backend",
+			extractor: NewUpstreamExtractor(),
+			key:       "orders-backend",
+		},
+		{
+			name:      "limits every client per upstream",
+			upstream:  "orders-backend",
+			extractor: NewCompositeExtractor(NewIPExtractor(nil), NewUpstreamExtractor()),
+			key:       "192.0.2.1/32|orders-backend",
+		},
+		{
+			name:      "fails without an upstream",
+			missing:   true,
+			extractor: NewUpstreamExtractor(),
+			err:       "the request has no upstream set on its context",
+		},
+		{
+			name:      "fails with an empty upstream",
+			upstream:  "",
+			extractor: NewUpstreamExtractor(),
+			err:       "the request has no upstream set on its context",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/orders", nil)
+			if !ts.missing {
+				req = req.WithContext(WithUpstream(req.Context(), ts.upstream))
+			}
+
+			key, err := ts.extractor.Extract(req)
+			if ts.err != "" {
+				assert.EqualError(t, err, ts.err)
+				assert.Equal(t, CodeMissingUpstream, errorCode(err))
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, ts.key, key)
+		})
+	}
+}
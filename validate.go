@@ -0,0 +1,190 @@
+package redis_rate_limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ConfigError is returned by RateLimiterConfig.Validate with every problem found in the config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid rate limiter config: %v", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks the config for mistakes that would otherwise only show up once requests come in (or never, like
+// a header name that proxies drop), so they can be caught at startup. It doesn't talk to Redis, see Verifier for
+// checking the strategy can run its commands. It returns a ConfigError with all problems found or nil if there are
+// none.
+func (c *RateLimiterConfig) Validate() error {
+	var problems []string
+
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Strategy == nil && c.ConcurrencyLimiter == nil {
+		add("the strategy is not set")
+	}
+
+	validateLimit := func(limit string, extractor Extractor, expiration time.Duration, maxRequests uint64) {
+		if extractor == nil {
+			add("the extractor of %v is not set", limit)
+		}
+		if expiration <= 0 {
+			add("the expiration of %v must be positive but is %v", limit, expiration)
+		}
+		if maxRequests == 0 {
+			add("the max requests of %v must be positive", limit)
+		}
+	}
+
+	validateLimit("the main limit", c.Extractor, c.Expiration, c.MaxRequests)
+
+	names := make(map[string]struct{}, len(c.Limits))
+
+	for x, limit := range c.Limits {
+		name := fmt.Sprintf("limit %v", x)
+
+		switch _, seen := names[limit.Name]; {
+		case limit.Name == "":
+			add("the name of %v is not set", name)
+		case seen:
+			add("the name %q of %v is used by another limit", limit.Name, name)
+		case !validToken(limit.Name):
+			add("the name %q of %v can't be used in a header name", limit.Name, name)
+		}
+
+		names[limit.Name] = struct{}{}
+		validateLimit(name, limit.Extractor, limit.Expiration, limit.MaxRequests)
+	}
+
+	if c.Headers != nil {
+		for _, header := range [][2]string{
+			{"total requests", c.Headers.TotalRequests},
+			{"state", c.Headers.State},
+			{"expires at", c.Headers.ExpiresAt},
+			{"reset seconds", c.Headers.ResetSeconds},
+			{"reset date", c.Headers.ResetDate},
+		} {
+			// an empty name disables the header
+			if header[1] != "" && !validToken(header[1]) {
+				add("the %v header name %q is not a valid header name", header[0], header[1])
+			}
+		}
+	}
+
+	if c.StateValues != nil {
+		for _, value := range []string{c.StateValues.Allow, c.StateValues.Deny} {
+			if value == "" || strings.ContainsAny(value, "\r\n\x00") {
+				add("the state value %q is not a valid header value", value)
+			}
+		}
+	}
+
+	if c.CountStatus != nil || c.RefundOnStatus != nil {
+		// decorators are Refunders whatever they wrap, so the strategy they wrap is the one that has to support it
+		if _, ok := c.Strategy.(Refunder); c.Strategy != nil && (!ok || !supportsRefunds(c.Strategy)) {
+			add("count status and refund on status require a strategy that supports refunds")
+		}
+	}
+
+	if c.ResponseSizeCost {
+		if _, ok := c.Strategy.(Committer); c.Strategy != nil && (!ok || !supportsCommits(c.Strategy)) {
+			add("response size cost requires a strategy that supports commits")
+		}
+
+		// it keeps a member per unit of cost, a byte each
+		if _, ok := innermost(c.Strategy).(*sortedSetCounter); ok {
+			add("response size cost can't be used with the sorted set strategy, use the counter strategy")
+		}
+	}
+
+	if c.EmptyKey == EmptyKeyFallback && c.FallbackKey == "" {
+		add("the empty key fallback requires a fallback key")
+	}
+
+	if c.DenyBodyFormat < DenyBodyText || c.DenyBodyFormat > DenyBodyProblemJSON {
+		add("unknown deny body format %v", c.DenyBodyFormat)
+	}
+
+	if c.ExpiresAtFormat < ExpiresAtRFC3339 || c.ExpiresAtFormat > ExpiresAtDeltaSeconds {
+		add("unknown expires at format %v", c.ExpiresAtFormat)
+	}
+
+	if c.EmptyKey < EmptyKeyError || c.EmptyKey > EmptyKeyFallback {
+		add("unknown empty key behavior %v", c.EmptyKey)
+	}
+
+	if c.FailureMode < FailClosed || c.FailureMode > FailUnavailable {
+		add("unknown failure mode %v", c.FailureMode)
+	}
+
+	if c.RetryAfterJitter < 0 {
+		add("the retry after jitter can't be negative but is %v", c.RetryAfterJitter)
+	}
+
+	if c.ConcurrencyStatus != 0 && (c.ConcurrencyStatus < 400 || c.ConcurrencyStatus > 599) {
+		add("the concurrency status must be an error status but is %v", c.ConcurrencyStatus)
+	}
+
+	if c.MaxRetryAfter < 0 {
+		add("the max retry after can't be negative but is %v", c.MaxRetryAfter)
+	}
+
+	if c.UnavailableRetryAfter < 0 {
+		add("the unavailable retry after can't be negative but is %v", c.UnavailableRetryAfter)
+	}
+
+	if c.HeaderBudget != nil && (c.HeaderBudget.MaxLimits < 0 || c.HeaderBudget.MaxBytes < 0) {
+		add("the header budget can't be negative")
+	}
+
+	if c.TrustedUpstream != nil {
+		for _, header := range []string{c.TrustedUpstream.SecretHeader, c.TrustedUpstream.RemainingHeader} {
+			if header != "" && !validToken(header) {
+				add("the trusted upstream header name %q is not a valid header name", header)
+			}
+		}
+	}
+
+	if c.Debug && c.Logger == nil {
+		add("debug requires a logger")
+	}
+
+	denylist := keySet(c.Denylist)
+	for _, key := range c.Allowlist {
+		if _, ok := denylist[key]; ok {
+			add("the key %q is on both the allowlist and the denylist", key)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+
+	return nil
+}
+
+// validToken checks the value is an HTTP token (RFC 7230), which is what header names are made of.
+func validToken(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for x := 0; x < len(value); x++ {
+		c := value[x]
+
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,200 @@
+package redis_rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterConfig_Validate(t *testing.T) {
+	valid := func() *RateLimiterConfig {
+		return &RateLimiterConfig{
+			Extractor:   NewHTTPHeadersExtractor(forwardedFor),
+			Strategy:    NewCounterStrategy(nil, time.Now),
+			Expiration:  time.Minute,
+			MaxRequests: 100,
+		}
+	}
+
+	tt := []struct {
+		name     string
+		config   func() *RateLimiterConfig
+		problems []string
+	}{
+		{
+			name:   "accepts a valid config",
+			config: valid,
+		},
+		{
+			name: "accepts a config with every option set correctly",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.Limits = []LimitConfig{{Name: "user", Extractor: NewHTTPHeadersExtractor("X-User-ID"), Expiration: time.Hour, MaxRequests: 1000}}
+				c.Headers = &HeaderNames{State: "X-RateLimit-State"}
+				c.StateValues = &StateValues{Allow: "allowed", Deny: "blocked"}
+				c.CountStatus = func(status int) bool { return status < http.StatusInternalServerError }
+				c.ResponseSizeCost = true
+				c.EmptyKey = EmptyKeyFallback
+				c.FallbackKey = "anonymous"
+				c.Allowlist = []string{"10.10.10.10"}
+				c.Denylist = []string{"10.10.10.11"}
+				c.Debug = true
+				c.Logger = &recordingLogger{}
+				return c
+			},
+		},
+		{
+			name: "reports every missing field",
+			config: func() *RateLimiterConfig {
+				return &RateLimiterConfig{}
+			},
+			problems: []string{
+				"the strategy is not set",
+				"the extractor of the main limit is not set",
+				"the expiration of the main limit must be positive but is 0s",
+				"the max requests of the main limit must be positive",
+			},
+		},
+		{
+			name: "reports invalid limits",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.Limits = []LimitConfig{
+					{Name: "user", Extractor: NewHTTPHeadersExtractor("X-User-ID"), Expiration: time.Hour, MaxRequests: 1000},
+					{Name: "user", Extractor: NewHTTPHeadersExtractor("X-User-ID"), Expiration: time.Hour, MaxRequests: 1000},
+					{Expiration: -time.Second, MaxRequests: 1},
+					{Name: "per user", Extractor: NewHTTPHeadersExtractor("X-User-ID"), Expiration: time.Hour, MaxRequests: 1000},
+				}
+				return c
+			},
+			problems: []string{
+				`the name "user" of limit 1 is used by another limit`,
+				"the name of limit 2 is not set",
+				"the extractor of limit 2 is not set",
+				"the expiration of limit 2 must be positive but is -1s",
+				`the name "per user" of limit 3 can't be used in a header name`,
+			},
+		},
+		{
+			name: "reports invalid header names and values",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.Headers = &HeaderNames{TotalRequests: "Total Requests", State: "State:", ExpiresAt: ""}
+				c.StateValues = &StateValues{Allow: "ok\r\nX-Injected: true"}
+				c.TrustedUpstream = &TrustedUpstreamConfig{Secret: "secret", SecretHeader: "X-Secret\n"}
+				return c
+			},
+			problems: []string{
+				`the total requests header name "Total Requests" is not a valid header name`,
+				`the state header name "State:" is not a valid header name`,
+				`the state value "ok\r\nX-Injected: true" is not a valid header value`,
+				`the state value "" is not a valid header value`,
+				`the trusted upstream header name "X-Secret\n" is not a valid header name`,
+			},
+		},
+		{
+			name: "reports options the strategy doesn't support",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.Strategy = NewFixedWindowBucketStrategy(nil, time.Now)
+				c.RefundOnStatus = func(status int) bool { return status >= http.StatusInternalServerError }
+				c.ResponseSizeCost = true
+				return c
+			},
+			problems: []string{
+				"count status and refund on status require a strategy that supports refunds",
+				"response size cost requires a strategy that supports commits",
+			},
+		},
+		{
+			name: "accepts refunds and commits on a wrapped strategy that supports them",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.Strategy = NewSampledStrategy(NewCounterStrategy(nil, time.Now), 0.5)
+				c.RefundOnStatus = func(status int) bool { return status >= http.StatusInternalServerError }
+				c.ResponseSizeCost = true
+				return c
+			},
+		},
+		{
+			name: "reports options the wrapped strategy doesn't support",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.Strategy = NewNegativeCacheStrategy(NewFixedWindowBucketStrategy(nil, time.Now), time.Now, 0.5, 10)
+				c.RefundOnStatus = func(status int) bool { return status >= http.StatusInternalServerError }
+				c.ResponseSizeCost = true
+				return c
+			},
+			problems: []string{
+				"count status and refund on status require a strategy that supports refunds",
+				"response size cost requires a strategy that supports commits",
+			},
+		},
+		{
+			name: "reports response size cost on the sorted set strategy",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.Strategy = NewSortedSetCounterStrategy(nil, time.Now)
+				c.ResponseSizeCost = true
+				return c
+			},
+			problems: []string{
+				"response size cost can't be used with the sorted set strategy, use the counter strategy",
+			},
+		},
+		{
+			name: "reports conflicting and out of range options",
+			config: func() *RateLimiterConfig {
+				c := valid()
+				c.EmptyKey = EmptyKeyFallback
+				c.DenyBodyFormat = DenyBodyFormat(10)
+				c.ExpiresAtFormat = ExpiresAtFormat(-1)
+				c.FailureMode = FailureMode(3)
+				c.RetryAfterJitter = -time.Second
+				c.UnavailableRetryAfter = -time.Second
+				c.MaxRetryAfter = -time.Minute
+				c.ConcurrencyStatus = http.StatusOK
+				c.HeaderBudget = &HeaderBudget{MaxLimits: -1}
+				c.Allowlist = []string{"10.10.10.10", "10.10.10.11"}
+				c.Denylist = []string{"10.10.10.11"}
+				c.Debug = true
+				return c
+			},
+			problems: []string{
+				"the empty key fallback requires a fallback key",
+				"unknown deny body format 10",
+				"unknown expires at format -1",
+				"unknown failure mode 3",
+				"the retry after jitter can't be negative but is -1s",
+				"the concurrency status must be an error status but is 200",
+				"the max retry after can't be negative but is -1m0s",
+				"the unavailable retry after can't be negative but is -1s",
+				"the header budget can't be negative",
+				"debug requires a logger",
+				`the key "10.10.10.11" is on both the allowlist and the denylist`,
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			err := ts.config().Validate()
+			if len(ts.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var configErr *ConfigError
+			if assert.ErrorAs(t, err, &configErr) {
+				assert.Equal(t, ts.problems, configErr.Problems)
+			}
+		})
+	}
+}
+
+func TestConfigError_Error(t *testing.T) {
+	err := &ConfigError{Problems: []string{"the strategy is not set", "the max requests of the main limit must be positive"}}
+
+	assert.EqualError(t, err, "invalid rate limiter config: the strategy is not set; the max requests of the main limit must be positive")
+}
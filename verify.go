@@ -0,0 +1,98 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	_ Verifier = &counterStrategy{}
+	_ Verifier = &sortedSetCounter{}
+	_ Verifier = &fixedWindowBucketStrategy{}
+	_ Verifier = &debounceStrategy{}
+)
+
+const (
+	// VerifyKeyPrefix is prepended to the throwaway keys the strategies write to when verifying, so an ACL that
+	// restricts keys to the `rl:` prefix allows them.
+	VerifyKeyPrefix = "rl:verify:"
+	// verifyDuration is the window used when verifying, the throwaway keys expire once it's over.
+	verifyDuration = time.Second
+)
+
+// Verify runs two requests (so the second one is denied), commits, refunds and decays a throwaway key, which runs
+// every command the strategy uses.
+func (c *counterStrategy) Verify(ctx context.Context) error {
+	return verifyRefundable(ctx, c)
+}
+
+// Verify runs two requests (so the second one is denied), commits, refunds and decays a throwaway key, which runs
+// every command the strategy uses.
+func (s *sortedSetCounter) Verify(ctx context.Context) error {
+	return verifyRefundable(ctx, s)
+}
+
+// Verify runs a request for a throwaway key, which runs every command the strategy uses.
+func (f *fixedWindowBucketStrategy) Verify(ctx context.Context) error {
+	_, err := f.Run(ctx, verifyRequest())
+	return verifyError(err)
+}
+
+// Verify runs a request for a throwaway key, which runs every command the strategy uses.
+func (d *debounceStrategy) Verify(ctx context.Context) error {
+	_, err := d.Run(ctx, verifyRequest())
+	return verifyError(err)
+}
+
+type refundableStrategy interface {
+	Strategy
+	Refunder
+	Committer
+	Decayer
+}
+
+func verifyRefundable(ctx context.Context, s refundableStrategy) error {
+	r := verifyRequest()
+
+	if _, err := s.Run(ctx, r); err != nil {
+		return verifyError(err)
+	}
+
+	// the second request goes over the limit, which runs the read only guard and the denied counter
+	denied := *r
+	denied.Nonce = uuid.New().String()
+
+	if _, err := s.Run(ctx, &denied); err != nil {
+		return verifyError(err)
+	}
+
+	if err := s.Commit(ctx, r, 1); err != nil {
+		return verifyError(err)
+	}
+
+	if err := s.Refund(ctx, r); err != nil {
+		return verifyError(err)
+	}
+
+	return verifyError(s.Decay(ctx, r.redisKey(), 1))
+}
+
+// verifyRequest builds a request for a new throwaway key.
+func verifyRequest() *Request {
+	return &Request{
+		Key:      VerifyKeyPrefix + uuid.New().String(),
+		Limit:    1,
+		Duration: verifyDuration,
+		Nonce:    uuid.New().String(),
+	}
+}
+
+func verifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return errors.Wrap(err, "failed to verify the strategy can run its redis commands")
+}
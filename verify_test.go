@@ -0,0 +1,72 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	tt := []struct {
+		name     string
+		strategy func(client *redis.Client) Strategy
+	}{
+		{
+			name: "counter",
+			strategy: func(client *redis.Client) Strategy {
+				return NewCounterStrategy(client, time.Now, WithDeniedCounter(time.Minute))
+			},
+		},
+		{
+			name: "sorted set",
+			strategy: func(client *redis.Client) Strategy {
+				return NewSortedSetCounterStrategy(client, time.Now, WithDeniedCounter(time.Minute))
+			},
+		},
+		{
+			name: "fixed window",
+			strategy: func(client *redis.Client) Strategy {
+				return NewFixedWindowBucketStrategy(client, time.Now)
+			},
+		},
+		{
+			name: "debounce",
+			strategy: func(client *redis.Client) Strategy {
+				return NewDebounceStrategy(client, time.Now)
+			},
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			server, err := miniredis.Run()
+			require.NoError(t, err)
+			defer server.Close()
+
+			client := redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			})
+			defer client.Close()
+
+			verifier := ts.strategy(client).(Verifier)
+			require.NoError(t, verifier.Verify(context.Background()))
+
+			require.NotEmpty(t, server.Keys())
+			for _, key := range server.Keys() {
+				assert.Regexp(t, "^rl:verify:", key)
+			}
+
+			// the client is no longer allowed to run any commands
+			server.RequireAuth("some-password")
+
+			err = verifier.Verify(context.Background())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "failed to verify the strategy can run its redis commands")
+			assert.Contains(t, err.Error(), "NOAUTH")
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinimumRedisVersion is the oldest Redis the strategies support. Scripts, PEXPIRE and SET with PX need 2.6.12
+	// and ZADD XX (the concurrency limiter) 3.0.2. UNLINK (the scanner) and HSET with many fields (the grandfathered
+	// limits, the EWMA and the token bucket strategies) need 4.0, XADD (the audit strategy) and ZPOPMIN (decays on
+	// the sorted set strategy) need 5.0.
+	MinimumRedisVersion = "5.0.0"
+	redisVersionField   = "redis_version:"
+)
+
+var (
+	// ErrUnsupportedRedisVersion is returned by CheckRedisVersion when the server is older than MinimumRedisVersion.
+	ErrUnsupportedRedisVersion = errors.New("unsupported redis version")
+)
+
+// CheckRedisVersion reads the version of the server with `INFO server` and fails with ErrUnsupportedRedisVersion
+// if it's older than MinimumRedisVersion. The strategies don't check the version themselves (their constructors
+// don't talk to Redis), so call this on startup to fail with a clear error instead of cryptic failures when a
+// command is not supported.
+func CheckRedisVersion(ctx context.Context, client redis.Cmdable) error {
+	version, err := redisVersion(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	if compareVersions(version, MinimumRedisVersion) < 0 {
+		return errors.Wrapf(ErrUnsupportedRedisVersion, "redis %v is older than the minimum supported version %v", version, MinimumRedisVersion)
+	}
+
+	return nil
+}
+
+// redisVersion finds the `redis_version` field on the `INFO server` reply.
+func redisVersion(ctx context.Context, client redis.Cmdable) (string, error) {
+	info, err := client.Info(ctx, "server").Result()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the redis server info")
+	}
+
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, redisVersionField) {
+			return strings.TrimPrefix(line, redisVersionField), nil
+		}
+	}
+
+	return "", errors.Errorf("the redis server info has no %v field", strings.TrimSuffix(redisVersionField, ":"))
+}
+
+// compareVersions compares dotted versions number by number, returning -1, 0 or 1 like strings.Compare. Parts that
+// are not numbers (like the `rc1` of `7.0-rc1`) count as zero.
+func compareVersions(a string, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := versionPart(as, i), versionPart(bs, i)
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func versionPart(parts []string, i int) int {
+	if i >= len(parts) {
+		return 0
+	}
+
+	n, err := strconv.Atoi(parts[i])
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
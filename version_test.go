@@ -0,0 +1,88 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCheckRedisVersion(t *testing.T) {
+	tt := []struct {
+		name        string
+		info        string
+		err         string
+		unsupported bool
+	}{
+		{
+			name: "accepts newer versions",
+			info: "# Server\r\nredis_version:6.2.6\r\nredis_mode:standalone\r\n",
+		},
+		{
+			name: "accepts the minimum version",
+			info: "# Server\r\nredis_version:5.0.0\r\n",
+		},
+		{
+			name:        "rejects older versions",
+			info:        "# Server\r\nredis_version:4.0.14\r\n",
+			err:         "redis 4.0.14 is older than the minimum supported version 5.0.0: unsupported redis version",
+			unsupported: true,
+		},
+		{
+			name: "fails without a version",
+			info: "# Server\r\nredis_mode:standalone\r\n",
+			err:  "the redis server info has no redis_version field",
+		},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			s, err := miniredis.Run()
+			require.NoError(t, err)
+			defer s.Close()
+
+			// miniredis doesn't implement INFO
+			require.NoError(t, s.Server().Register("INFO", func(c *server.Peer, cmd string, args []string) {
+				c.WriteBulk(ts.info)
+			}))
+
+			client := redis.NewClient(&redis.Options{
+				Addr: s.Addr(),
+			})
+			defer client.Close()
+
+			err = CheckRedisVersion(context.Background(), client)
+			if ts.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.EqualError(t, err, ts.err)
+			assert.Equal(t, ts.unsupported, errors.Is(err, ErrUnsupportedRedisVersion))
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tt := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{a: "3.0.2", b: "3.0.2", expected: 0},
+		{a: "3.0", b: "3.0.2", expected: -1},
+		{a: "6.2.6", b: "3.0.2", expected: 1},
+		{a: "10.0.0", b: "9.9.9", expected: 1},
+		{a: "7.0-rc1", b: "7.0.0", expected: 0},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.a+" "+ts.b, func(t *testing.T) {
+			assert.Equal(t, ts.expected, compareVersions(ts.a, ts.b))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"math"
+	"time"
+)
+
+var (
+	_ Strategy  = &warmupStrategy{}
+	_ KeyNamer  = &warmupStrategy{}
+	_ Refunder  = &warmupStrategy{}
+	_ Committer = &warmupStrategy{}
+
+	// warmupScript stores when the key was first seen if it's new and returns it. The key expires once the client has
+	// been quiet for a whole window after its warmup is over, so a client that comes back after that warms up again.
+	// ARGV has the time of the request, the warmup and the duration in milliseconds.
+	warmupScript = redis.NewScript(`
+local first = tonumber(redis.call('GET', KEYS[1]) or ARGV[1])
+redis.call('SET', KEYS[1], first, 'PX', math.max(first + tonumber(ARGV[2]) - tonumber(ARGV[1]), 0) + tonumber(ARGV[3]))
+return first
+`)
+)
+
+// NewWarmupStrategy creates a strategy that relaxes the limit of keys that were just seen for the first time, for
+// clients that front load requests while they start (like retries while they set up their connections). For the
+// first `warmup` after a key is first seen the `Limit` of its requests is multiplied by `factor` before running
+// `inner`, after that `inner` enforces the `Limit` as it is. Factors below one are ignored, the warmup never makes the
+// limit stricter.
+//
+// The requests made during the warmup are counted by `inner` as usual, so a client that used the relaxed limit is
+// denied once the warmup is over until enough of them roll off its window. When the key was first seen is kept at
+// the request key with `:warmup` appended, which expires once the client has been quiet for a whole `Duration` after
+// its warmup, a client that comes back after that warms up again.
+func NewWarmupStrategy(inner Strategy, client *redis.Client, now func() time.Time, warmup time.Duration, factor float64) Strategy {
+	return &warmupStrategy{
+		inner:  inner,
+		client: client,
+		now:    now,
+		warmup: warmup,
+		factor: factor,
+	}
+}
+
+type warmupStrategy struct {
+	inner  Strategy
+	client *redis.Client
+	now    func() time.Time
+	warmup time.Duration
+	factor float64
+}
+
+// Run records when the key was first seen and runs the inner strategy with the relaxed limit while it's warming up.
+func (w *warmupStrategy) Run(ctx context.Context, r *Request) (*Result, error) {
+	now := r.now(w.now)
+
+	first, err := warmupScript.Run(ctx, w.client, []string{warmupKey(r)}, now.UnixMilli(), w.warmup.Milliseconds(), r.Duration.Milliseconds()).Int64()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check warmup for key %v", r.redisKey())
+	}
+
+	if now.UnixMilli()-first >= w.warmup.Milliseconds() || w.factor <= 1 {
+		return w.inner.Run(ctx, r)
+	}
+
+	request := *r
+	request.Limit = warmupLimit(r.Limit, w.factor)
+
+	return w.inner.Run(ctx, &request)
+}
+
+// warmupLimit is the limit multiplied by the factor, rounded down but never below the limit and capped at the
+// largest limit instead of overflowing.
+func warmupLimit(limit uint64, factor float64) uint64 {
+	relaxed := math.Floor(float64(limit) * factor)
+	if relaxed >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+
+	if uint64(relaxed) < limit {
+		return limit
+	}
+
+	return uint64(relaxed)
+}
+
+// KeyFor returns the keys of the inner strategy followed by the first seen key.
+func (w *warmupStrategy) KeyFor(r *Request) []string {
+	return append(keysFor(w.inner, r), warmupKey(r))
+}
+
+// Refund gives back the request on the inner strategy.
+func (w *warmupStrategy) Refund(ctx context.Context, r *Request) error {
+	return refund(ctx, w.inner, r)
+}
+
+// Commit settles the request on the inner strategy.
+func (w *warmupStrategy) Commit(ctx context.Context, r *Request, actualCost uint64) error {
+	return commit(ctx, w.inner, r, actualCost)
+}
+
+func (w *warmupStrategy) unwrap() Strategy {
+	return w.inner
+}
+
+func warmupKey(r *Request) string {
+	return r.redisKey() + ":warmup"
+}
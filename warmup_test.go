@@ -0,0 +1,91 @@
+package redis_rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWarmupStrategy_Run(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+
+	now := time.Date(2020, 3, 25, 10, 15, 30, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	strategy := NewWarmupStrategy(NewSortedSetCounterStrategy(client, clock), client, clock, 10*time.Second, 2)
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		state   State
+		total   uint64
+	}{
+		{name: "allows the first request", state: Allow, total: 1},
+		{name: "allows up to the limit", state: Allow, total: 2},
+		{name: "allows a burst over the limit while warming up", state: Allow, total: 3},
+		{name: "allows up to the relaxed limit", state: Allow, total: 4},
+		{name: "denies over the relaxed limit", state: Deny, total: 4},
+		{name: "enforces the limit once the warmup is over", advance: 10 * time.Second, state: Deny, total: 4},
+		{name: "allows once the warmup requests rolled off", advance: 50 * time.Second, state: Allow, total: 1},
+		{name: "allows up to the limit after the warmup", state: Allow, total: 2},
+		{name: "doesn't warm up again while the client is active", state: Deny, total: 2},
+		{name: "warms up again after a quiet window", advance: 2 * time.Minute, state: Allow, total: 1},
+		{name: "allows up to the limit again", state: Allow, total: 2},
+		{name: "allows a burst over the limit again", state: Allow, total: 3},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		server.FastForward(step.advance)
+
+		result, err := strategy.Run(context.Background(), &Request{
+			Key:      "some-user",
+			Limit:    2,
+			Duration: time.Minute,
+		})
+		require.NoError(t, err, step.name)
+
+		assert.Equal(t, step.state, result.State, step.name)
+		assert.Equal(t, step.total, result.TotalRequests, step.name)
+	}
+
+	first, err := server.Get("some-user:warmup")
+	require.NoError(t, err)
+	assert.Equal(t, "1585131510000", first)
+	assert.Equal(t, 70*time.Second, server.TTL("some-user:warmup"))
+	assert.Equal(t, []string{"some-user", "some-user:warmup"}, strategy.(KeyNamer).KeyFor(&Request{Key: "some-user"}))
+}
+
+func TestWarmupLimit(t *testing.T) {
+	tt := []struct {
+		name     string
+		limit    uint64
+		factor   float64
+		expected uint64
+	}{
+		{name: "multiplies the limit", limit: 2, factor: 2, expected: 4},
+		{name: "rounds down", limit: 3, factor: 1.5, expected: 4},
+		{name: "never lowers the limit", limit: 2, factor: 0.5, expected: 2},
+		{name: "caps the limit instead of overflowing", limit: math.MaxUint64 / 2, factor: 3, expected: math.MaxUint64},
+	}
+
+	for _, ts := range tt {
+		t.Run(ts.name, func(t *testing.T) {
+			assert.Equal(t, ts.expected, warmupLimit(ts.limit, ts.factor))
+		})
+	}
+}